@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -33,16 +35,19 @@ func main() {
 	walletCmd := flag.NewFlagSet("wallet", flag.ExitOnError)
 	balanceCmd := flag.NewFlagSet("balance", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
 
 	// Run/Mine Flags
 	nodeAddr := runCmd.String("addr", ":9000", "P2P listen address")
 	seedNode := runCmd.String("seed", "", "Seed node address to connect to")
 	rpcPort := runCmd.String("rpc", ":8080", "RPC server port")
+	banTime := runCmd.Duration("bantime", p2p.DefaultBanDuration, "How long misbehaving peers are banned")
 
 	minerNodeAddr := mineCmd.String("addr", ":9001", "P2P listen address")
 	minerSeedNode := mineCmd.String("seed", "", "Seed node address to connect to")
 	minerRewardAddr := mineCmd.String("miner-addr", "", "Address to receive mining rewards (hex)")
 	minerRpcPort := mineCmd.String("rpc", ":8081", "RPC server port")
+	minerBanTime := mineCmd.Duration("bantime", p2p.DefaultBanDuration, "How long misbehaving peers are banned")
 
 	// Wallet Flags
 	walletAction := walletCmd.String("action", "new", "Action: new")
@@ -59,6 +64,9 @@ func main() {
 	sendKeyFile := sendCmd.String("key", "wallet.dat", "Private key file")
 	sendRpc := sendCmd.String("rpc", "http://localhost:8080", "RPC server URL")
 
+	// Reindex Flags
+	reindexDB := reindexCmd.String("db", "data", "Database directory to reindex")
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -67,7 +75,7 @@ func main() {
 	switch os.Args[1] {
 	case "run":
 		runCmd.Parse(os.Args[2:])
-		startNode(*nodeAddr, *seedNode, *rpcPort, false, types.Hash{})
+		startNode(*nodeAddr, *seedNode, *rpcPort, *banTime, false, types.Hash{})
 	case "mine":
 		mineCmd.Parse(os.Args[2:])
 		if *minerRewardAddr == "" {
@@ -78,7 +86,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("Invalid miner address: %v", err)
 		}
-		startNode(*minerNodeAddr, *minerSeedNode, *minerRpcPort, true, addrHash)
+		startNode(*minerNodeAddr, *minerSeedNode, *minerRpcPort, *minerBanTime, true, addrHash)
 	case "wallet":
 		walletCmd.Parse(os.Args[2:])
 		handleWallet(*walletAction, *walletFile)
@@ -96,6 +104,9 @@ func main() {
 			os.Exit(1)
 		}
 		handleSend(*sendRpc, *sendKeyFile, *sendTo, *sendAmount, *sendFee)
+	case "reindex":
+		reindexCmd.Parse(os.Args[2:])
+		handleReindex(*reindexDB)
 	default:
 		printUsage()
 		os.Exit(1)
@@ -109,9 +120,10 @@ func printUsage() {
 	fmt.Println("  chrd wallet --action new --file <wallet.dat>")
 	fmt.Println("  chrd balance --addr <hex>")
 	fmt.Println("  chrd send --to <hex> --amount <uint64> --key <wallet.dat>")
+	fmt.Println("  chrd reindex --db <data>")
 }
 
-func startNode(listenAddr, seedAddr, rpcPort string, isMiner bool, minerAddr types.Hash) {
+func startNode(listenAddr, seedAddr, rpcPort string, banTime time.Duration, isMiner bool, minerAddr types.Hash) {
 	log.Printf("Starting Chronodrachma Node (Testnet)...")
 
 	// Initialize Hasher (SHA256 or RandomX based on build tags)
@@ -138,6 +150,7 @@ func startNode(listenAddr, seedAddr, rpcPort string, isMiner bool, minerAddr typ
 	if err != nil {
 		log.Fatalf("Failed to load chain: %v", err)
 	}
+	chain.SetMaxReorgDepth(config.TestnetConfig.MaxReorgDepth)
 
 	mp := mempool.NewMempool(chain)
 
@@ -152,18 +165,25 @@ func startNode(listenAddr, seedAddr, rpcPort string, isMiner bool, minerAddr typ
 	if seedAddr != "" {
 		seeds = append(seeds, seedAddr)
 	}
+	nodeKey, err := p2p.LoadOrCreateNodeKey(filepath.Join(dbPath, p2p.NodeKeyFile))
+	if err != nil {
+		log.Fatalf("Failed to load node key: %v", err)
+	}
 	p2pConfig := p2p.ServerConfig{
-		ListenAddr: listenAddr,
-		SeedNodes:  seeds,
+		ListenAddr:  listenAddr,
+		SeedNodes:   seeds,
+		Network:     config.TestnetConfig,
+		DB:          s.DB(),
+		BanDuration: banTime,
+		NodeKey:     nodeKey,
 	}
 	server := p2p.NewServer(p2pConfig, chain, mp)
-	// Start P2P in goroutine or non-blocking? Server.Start is blocking?
-	// Server.Start loops listener. So we need goroutine.
-	go func() {
-		if err := server.Start(); err != nil {
-			log.Fatalf("Failed to start P2P server: %v", err)
-		}
-	}()
+	// Start returns once listening; the RPC server below relies on the
+	// ban list and address book it loads.
+	if err := server.Start(); err != nil {
+		log.Fatalf("Failed to start P2P server: %v", err)
+	}
+	log.Printf("Node ID %s", server.NodeID())
 
 	// RPC
 	rpcServer := rpc.NewServer(chain, mp, server)
@@ -184,6 +204,43 @@ func startNode(listenAddr, seedAddr, rpcPort string, isMiner bool, minerAddr typ
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	log.Println("Shutting down...")
+	rpcServer.Close()
+
+	// Stop the network before the deferred store close: peers write to
+	// the address book and ban list until they are gone.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		log.Printf("P2P server did not stop cleanly: %v", err)
+	}
+}
+
+func handleReindex(dbPath string) {
+	hasher, err := consensus.NewHasher(make([]byte, 32), false)
+	if err != nil {
+		log.Fatalf("Failed to initialize hasher: %v", err)
+	}
+	defer hasher.Close()
+
+	s, err := blockchain.NewBadgerStore(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	chain, err := blockchain.NewChain(s, hasher)
+	if err != nil {
+		log.Fatalf("Failed to load chain: %v", err)
+	}
+	if chain.Tip() == nil {
+		log.Fatalf("No chain found in %s", dbPath)
+	}
+
+	log.Printf("Rebuilding account state up to height %d...", chain.Height())
+	if err := chain.RebuildState(); err != nil {
+		log.Fatalf("Reindex failed: %v", err)
+	}
+	log.Println("Account state rebuilt.")
 }
 
 func handleWallet(action, filename string) {
@@ -236,8 +293,8 @@ func handleSend(rpcUrl, keyFile, toHex string, amount, fee uint64) {
 	defer resp.Body.Close()
 
 	var balanceResp struct {
-		Balance types.Amount `json:"balance"`
-		Nonce   uint64       `json:"nonce"`
+		Balance rpc.Amount `json:"balance"`
+		Nonce   uint64     `json:"nonce"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&balanceResp); err != nil {
 		log.Fatalf("Failed to decode balance response: %v", err)
@@ -8,18 +8,22 @@ import (
 
 // NetworkConfig holds the network-wide parameters.
 type NetworkConfig struct {
-	Name             string
-	GenesisTimestamp time.Time
-	InitialDifficulty uint64
-	SeedNodes        []string
+	Name              string
+	Magic             [4]byte // Prefix of every P2P frame; peers with another magic are on another network.
+	GenesisTimestamp  time.Time
+	InitialDifficulty uint64 // Converted to a PoW target: Target = 2^256 / Difficulty.
+	MaxReorgDepth     uint64 // Blocks buried deeper than this under the tip are final.
+	SeedNodes         []string
 }
 
 // TestnetConfig defines the parameters for the Phase II testnet.
 var TestnetConfig = NetworkConfig{
-	Name:             "chrd-testnet-v1",
-	GenesisTimestamp: time.Now(), // Will be overridden at runtime or fixed for shared genesis
-	InitialDifficulty: 1000,      // Low difficulty for CPU mining test
-	SeedNodes:        []string{}, // To be populated via CLI or discovery
+	Name:              "chrd-testnet-v1",
+	Magic:             [4]byte{'C', 'H', 'R', 'T'},
+	GenesisTimestamp:  time.Now(), // Will be overridden at runtime or fixed for shared genesis
+	InitialDifficulty: 1000,       // Target = 2^256/1000: ~1000 hashes per block, low for CPU mining test
+	MaxReorgDepth:     24,         // 24-hour finality at 60-minute blocks
+	SeedNodes:         []string{}, // To be populated via CLI or discovery
 }
 
 // GenesisMinerAddress is a hardcoded address for the genesis coinbase.
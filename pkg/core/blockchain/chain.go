@@ -1,8 +1,12 @@
 package blockchain
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"log"
+	"math/big"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,8 +18,16 @@ var (
 	ErrChainAlreadyInitialized = errors.New("chain is already initialized with genesis")
 	ErrBlockNotFound           = errors.New("block not found")
 	ErrParentNotFound          = errors.New("parent block not found")
+	ErrOrphanBlock             = errors.New("block stored as orphan until its parent arrives")
+	ErrFinalizedFork           = errors.New("block forks the chain below the finalized height")
+	ErrKnownInvalid            = errors.New("block is or builds on a block known to be invalid")
 )
 
+// DefaultMaxReorgDepth is the deepest reorganization the chain accepts: with
+// 60-minute blocks, 24 blocks is the 24-hour finality rule. Blocks buried
+// deeper than this under the tip are final.
+const DefaultMaxReorgDepth = 24
+
 // TxPool defines the interface for Mempool interaction.
 type TxPool interface {
 	AddTransaction(tx *types.Transaction) error
@@ -30,10 +42,25 @@ type Chain struct {
 	hasher      consensus.Hasher
 	genesisTime time.Time
 	pool        TxPool
+	orphans     *OrphanPool
+
+	// maxReorgDepth bounds how many blocks a reorganization may disconnect.
+	// 0 disables the limit.
+	maxReorgDepth uint64
+
+	// Header index for headers-first sync: validated headers whose blocks
+	// are not stored yet, the one with the most work, and the headers whose
+	// blocks turned out to be invalid. Guarded by mu.
+	headers    map[types.Hash]*headerNode
+	bestHeader *headerNode
+	invalid    map[types.Hash]struct{}
 
 	// Subscription for tip updates (e.g. for miner)
 	subscribers []chan *types.Block
 	subMu       sync.Mutex
+
+	// Subscriptions for main chain updates, guarded by subMu.
+	updateSubs []chan *ChainUpdate
 }
 
 // NewChain creates a new chain instance.
@@ -41,7 +68,12 @@ func NewChain(store BlockStore, hasher consensus.Hasher) (*Chain, error) {
 	chain := &Chain{
 		store:       store,
 		hasher:      hasher,
+		orphans:     NewOrphanPool(),
+		headers:     make(map[types.Hash]*headerNode),
+		invalid:     make(map[types.Hash]struct{}),
 		subscribers: make([]chan *types.Block, 0),
+
+		maxReorgDepth: DefaultMaxReorgDepth,
 	}
 
 	// Try to load tip from store
@@ -58,6 +90,10 @@ func NewChain(store BlockStore, hasher consensus.Hasher) (*Chain, error) {
 		if err == nil {
 			chain.genesisTime = genesis.Header.Timestamp
 		}
+
+		if err := chain.checkConsistency(); err != nil {
+			return nil, fmt.Errorf("chain consistency check failed: %w", err)
+		}
 	}
 
 	return chain, nil
@@ -90,6 +126,48 @@ func (c *Chain) notifySubscribers(newTip *types.Block) {
 	}
 }
 
+// UpdateBufferSize is the capacity of the channels returned by
+// SubscribeUpdates.
+const UpdateBufferSize = 64
+
+// SubscribeUpdates returns a channel that receives every change of the main
+// chain in order, and a function that ends the subscription and closes the
+// channel. Updates are dropped while the channel is full, so the consumer
+// must keep up.
+func (c *Chain) SubscribeUpdates() (<-chan *ChainUpdate, func()) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	ch := make(chan *ChainUpdate, UpdateBufferSize)
+	c.updateSubs = append(c.updateSubs, ch)
+	cancel := func() {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		for i, sub := range c.updateSubs {
+			if sub == ch {
+				c.updateSubs = append(c.updateSubs[:i], c.updateSubs[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}
+	return ch, cancel
+}
+
+// notifyUpdate sends a main chain update to all update subscribers.
+func (c *Chain) notifyUpdate(update *ChainUpdate) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	for _, ch := range c.updateSubs {
+		select {
+		case ch <- update:
+		default:
+			log.Printf("Chain update subscriber is full, dropping an update")
+		}
+	}
+}
+
 // SetMempool sets the transaction pool for the chain.
 func (c *Chain) SetMempool(pool TxPool) {
 	c.mu.Lock()
@@ -97,7 +175,58 @@ func (c *Chain) SetMempool(pool TxPool) {
 	c.pool = pool
 }
 
-// InitGenesis creates, validates, and adds the genesis block to the chain.
+// SetMaxReorgDepth sets how many blocks a reorganization may disconnect
+// before the blocks under the tip are treated as final. 0 disables the limit.
+func (c *Chain) SetMaxReorgDepth(depth uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxReorgDepth = depth
+}
+
+// FinalizedHeight returns the height of the last final block: the canonical
+// chain up to and including it can no longer be reorganized.
+func (c *Chain) FinalizedHeight() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.finalizedHeight()
+}
+
+// finalizedHeight assumes c.mu is held.
+func (c *Chain) finalizedHeight() uint64 {
+	if c.tip == nil || c.maxReorgDepth == 0 || c.tip.Header.Height < c.maxReorgDepth {
+		return 0
+	}
+	return c.tip.Header.Height - c.maxReorgDepth
+}
+
+// checkFinality rejects a block whose parent does not descend from the
+// canonical block at the finalized height, i.e. a fork that would rewrite
+// finalized history. It assumes c.mu is held.
+func (c *Chain) checkFinality(parent *types.Block) error {
+	finalized := c.finalizedHeight()
+	if parent.Hash == c.tip.Hash || finalized == 0 {
+		return nil
+	}
+	if parent.Header.Height < finalized {
+		return fmt.Errorf("%w: parent height %d, finalized height %d", ErrFinalizedFork, parent.Header.Height, finalized)
+	}
+
+	ancestor, err := c.GetAncestorAtHeight(parent, finalized)
+	if err != nil {
+		return err
+	}
+	final, err := c.store.GetBlockByHeight(finalized)
+	if err != nil {
+		return err
+	}
+	if ancestor.Hash != final.Hash {
+		return fmt.Errorf("%w: fork below finalized height %d", ErrFinalizedFork, finalized)
+	}
+	return nil
+}
+
+// InitGenesis creates, mines, validates, and adds the genesis block to the chain.
+// difficulty is converted to a target (Target = 2^256 / difficulty); 0 is treated as 1.
 func (c *Chain) InitGenesis(minerAddress types.Hash, difficulty uint64, timestamp time.Time) (*types.Block, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -128,7 +257,7 @@ func (c *Chain) InitGenesis(minerAddress types.Hash, difficulty uint64, timestam
 		Timestamp:     timestamp,
 		PrevBlockHash: types.ZeroHash,
 		MerkleRoot:    types.ComputeMerkleRoot(txs),
-		Difficulty:    difficulty,
+		Bits:          consensus.DifficultyToCompact(difficulty),
 		Nonce:         0,
 	}
 
@@ -137,36 +266,36 @@ func (c *Chain) InitGenesis(minerAddress types.Hash, difficulty uint64, timestam
 		Transactions: txs,
 	}
 
+	// Search for a nonce that meets the target.
+	for {
+		powHash, err := c.hasher.Hash(block.Header.Serialize())
+		if err != nil {
+			return nil, err
+		}
+		if consensus.MeetsTarget(powHash, block.Header.Bits) {
+			block.PowHash = powHash
+			break
+		}
+		block.Header.Nonce++
+	}
+
 	// Compute block identity hash.
 	block.Hash = block.ComputeHash()
 
-	// Compute PoW hash.
-	headerBytes := header.Serialize()
-	powHash, err := c.hasher.Hash(headerBytes)
-	if err != nil {
-		return nil, err
-	}
-	block.PowHash = powHash
-
 	// Validate the genesis block.
 	if err := ValidateGenesis(block, c.hasher); err != nil {
 		return nil, err
 	}
 
-	// 1. Save Block Data
-	if err := c.store.SaveBlock(block); err != nil {
+	// 1. Save Cumulative Work, then Block Data
+	if err := c.store.SaveCumulativeWork(block.Hash, consensus.CalcWork(block.Header.Bits)); err != nil {
 		return nil, err
 	}
-	// 2. Set as Canonical (Genesis is always canonical initially)
-	if err := c.store.SetCanonical(0, block.Hash); err != nil {
-		return nil, err
-	}
-	// 3. Save Cumulative Difficulty
-	if err := c.store.SaveCumulativeDifficulty(block.Hash, difficulty); err != nil {
+	if err := c.store.SaveBlock(block); err != nil {
 		return nil, err
 	}
-	// 4. Save Head
-	if err := c.store.SaveHead(block.Hash); err != nil {
+	// 2. Make it canonical, apply its coinbase and save the head in one go
+	if err := c.store.CommitChainUpdate(&ChainUpdate{Connect: []*types.Block{block}}); err != nil {
 		return nil, err
 	}
 
@@ -190,33 +319,106 @@ func (c *Chain) AddBlock(block *types.Block) error {
 		return nil // Already processed
 	}
 
+	// 1b. Check it is not known to be invalid
+	if c.isInvalid(block.ComputeHash()) || c.isInvalid(block.Header.PrevBlockHash) {
+		return ErrKnownInvalid
+	}
+
 	// 2. Find Parent
 	parent, err := c.store.GetBlockByHash(block.Header.PrevBlockHash)
 	if err != nil {
-		// If we support orphans, we would stash it here.
-		// For now, we reject if parent is missing.
+		// ProcessBlock keeps such blocks in the orphan pool.
 		return ErrParentNotFound
 	}
 
+	// 3-5. Validate against the parent
+	if err := c.checkBlock(block, parent); err != nil {
+		switch {
+		case condemnsHeader(block, err):
+			c.invalidateHeader(block.ComputeHash())
+		case errors.Is(err, ErrFinalizedFork):
+			// Not invalid, but a branch we will never follow.
+			c.dropBranch(block.ComputeHash())
+		}
+		return err
+	}
+
+	// 6. Calculate Cumulative Work
+	parentWork, err := c.store.GetCumulativeWork(parent.Hash)
+	if err != nil {
+		// Genesis must have cumulative work.
+		return fmt.Errorf("failed to get parent work: %v", err)
+	}
+
+	// Accumulate the expected work of this block's target.
+	newWork := new(big.Int).Add(parentWork, consensus.CalcWork(block.Header.Bits))
+
+	// 7. Save Cumulative Work and Block. The block goes last: once it is
+	// stored it counts as processed (step 1), so its work must already exist.
+	if err := c.store.SaveCumulativeWork(block.Hash, newWork); err != nil {
+		return err
+	}
+	if err := c.store.SaveBlock(block); err != nil {
+		return err
+	}
+	c.forgetHeader(block.Hash)
+
+	// 8. Fork Choice Rule: the chain with the most cumulative work wins.
+	tipWork, err := c.store.GetCumulativeWork(c.tip.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to get tip work: %v", err)
+	}
+
+	cmp := newWork.Cmp(tipWork)
+	if cmp > 0 || (cmp == 0 && block.Header.PrevBlockHash == c.tip.Hash) {
+		// New Heaviest Chain!
+		fmt.Printf("Reorganizing chain: New Tip %d (%x) beats Old Tip %d (%x)\n",
+			block.Header.Height, block.Hash[:8], c.tip.Header.Height, c.tip.Hash[:8])
+
+		return c.reorganize(block)
+	}
+
+	// Else: It's a side-chain or stale block. We just saved it.
+	// Just log it.
+	// fmt.Printf("Added side-chain block height=%d hash=%x (work: %s vs Tip: %s)\n",
+	// 	block.Header.Height, block.Hash[:8], newWork, tipWork)
+
+	return nil
+}
+
+// checkBlock validates a block against its stored parent: height,
+// finality, difficulty, the block itself and its transactions. It assumes
+// c.mu is held.
+func (c *Chain) checkBlock(block, parent *types.Block) error {
 	// 3. Validate Height
 	if block.Header.Height != parent.Header.Height+1 {
-		return fmt.Errorf("invalid block height: expected %d, got %d", parent.Header.Height+1, block.Header.Height)
+		return fmt.Errorf("%w: expected %d, got %d", ErrInvalidHeight, parent.Header.Height+1, block.Header.Height)
+	}
+
+	// 3b. Refuse to rewrite finalized history.
+	if err := c.checkFinality(parent); err != nil {
+		log.Printf("Rejected block %d (%x): %v", block.Header.Height, block.Hash[:8], err)
+		return err
 	}
 
 	// 4. Verify Difficulty Adjustment
 	// We need to look at the chain *leading up to* this block, effectively walking backwards from parent.
-	getBlockForDiff := func(h uint64) (*types.Block, error) {
+	getHeaderForDiff := func(h uint64) (*types.BlockHeader, error) {
 		// We need to find the ancestor of 'parent' at height 'h'.
-		return c.GetAncestorAtHeight(parent, h)
+		ancestor, err := c.GetAncestorAtHeight(parent, h)
+		if err != nil {
+			return nil, err
+		}
+		return &ancestor.Header, nil
 	}
 
-	requiredDiff, err := consensus.CalcNextRequiredDifficulty(parent, getBlockForDiff)
+	requiredBits, err := consensus.CalcNextRequiredBits(&parent.Header, getHeaderForDiff)
 	if err != nil {
 		return err
 	}
 
-	if block.Header.Difficulty != requiredDiff {
-		return fmt.Errorf("block difficulty %d does not match required %d", block.Header.Difficulty, requiredDiff)
+	if block.Header.Bits != requiredBits {
+		return fmt.Errorf("%w: got bits %08x, required %08x", ErrInvalidBits, block.Header.Bits, requiredBits)
 	}
 
 	// 5. Validate Block Context
@@ -224,47 +426,86 @@ func (c *Chain) AddBlock(block *types.Block) error {
 		return err
 	}
 
-	// 6. Calculate Cumulative Difficulty (CDF)
-	parentCDF, err := c.store.GetCumulativeDifficulty(parent.Hash)
+	// 5b. Replay transactions against the parent's account state.
+	parentState, err := c.stateAt(parent)
 	if err != nil {
-		// Should verify consistency, assume 0 or error?
-		// Genesis must have CDF.
-		return fmt.Errorf("failed to get parent cdf: %v", err)
+		return fmt.Errorf("failed to load parent state: %w", err)
 	}
+	return ValidateBlockTransactions(block, NewStateView(parentState))
+}
 
-	// Use big.Int to prevent overflow?
-	// Prototype uses uint64, but let's be safe if we were using it.
-	// We'll stick to uint64 for storage as per interface.
-	newCDF := parentCDF + block.Header.Difficulty
+// ProcessBlock adds a block received from 'source' (a peer identifier).
+// A block whose parent is unknown is kept in the orphan pool and ErrOrphanBlock
+// is returned; the caller should fetch OrphanRoot(block.Hash) from the source.
+// Once a block is connected, orphans waiting on it are connected recursively.
+// Orphans must carry their own hash and proof of work, so that a peer cannot
+// park junk under the hash of a block we are yet to receive.
+func (c *Chain) ProcessBlock(block *types.Block, source string) error {
+	if c.orphans.Has(block.ComputeHash()) {
+		return ErrOrphanBlock
+	}
 
-	// 7. Save Block and CDF
-	if err := c.store.SaveBlock(block); err != nil {
-		return err
+	err := c.AddBlock(block)
+	if errors.Is(err, ErrParentNotFound) {
+		if err := validateBlockPoW(block, c.hasher); err != nil {
+			return err
+		}
+		c.orphans.Add(block, source)
+
+		// The parent may have been connected since AddBlock looked for it,
+		// too early for its connectOrphans to see this block.
+		if parent, _ := c.store.GetBlockByHash(block.Header.PrevBlockHash); parent == nil {
+			return ErrOrphanBlock
+		}
+		c.connectOrphans(block.Header.PrevBlockHash)
+		if b, _ := c.store.GetBlockByHash(block.Hash); b == nil {
+			return ErrOrphanBlock
+		}
+		return nil
 	}
-	if err := c.store.SaveCumulativeDifficulty(block.Hash, newCDF); err != nil {
+	if err != nil {
 		return err
 	}
 
-	// 8. Fork Choice Rule: Check against current Tip
-	tipCDF, err := c.store.GetCumulativeDifficulty(c.tip.Hash)
-	if err != nil {
-		return fmt.Errorf("failed to get tip cdf: %v", err)
-	}
+	c.connectOrphans(block.Hash)
+	return nil
+}
 
-	if newCDF > tipCDF || (newCDF == tipCDF && block.Header.PrevBlockHash == c.tip.Hash) {
-		// New Heaviest Chain!
-		fmt.Printf("Reorganizing chain: New Tip %d (%x) beats Old Tip %d (%x)\n",
-			block.Header.Height, block.Hash[:8], c.tip.Header.Height, c.tip.Hash[:8])
+// connectOrphans adds every orphan descending from parentHash, breadth first.
+func (c *Chain) connectOrphans(parentHash types.Hash) {
+	queue := []types.Hash{parentHash}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
 
-		return c.reorganize(block)
+		for _, child := range c.orphans.TakeChildren(parent) {
+			if err := c.AddBlock(child); err != nil {
+				log.Printf("Orphan block %x rejected: %v", child.Hash[:8], err)
+				continue
+			}
+			queue = append(queue, child.Hash)
+		}
 	}
+}
 
-	// Else: It's a side-chain or stale block. We just saved it.
-	// Just log it.
-	// fmt.Printf("Added side-chain block height=%d hash=%x (CDF: %d vs Tip: %d)\n",
-	// 	block.Header.Height, block.Hash[:8], newCDF, tipCDF)
+// OrphanRoot returns the hash of the missing ancestor of an orphan block.
+func (c *Chain) OrphanRoot(hash types.Hash) types.Hash {
+	return c.orphans.Root(hash)
+}
 
-	return nil
+// HaveBlock reports whether the block is stored or waiting in the orphan pool,
+// so that it need not be downloaded again.
+func (c *Chain) HaveBlock(hash types.Hash) bool {
+	if c.orphans.Has(hash) {
+		return true
+	}
+	b, _ := c.store.GetBlockByHash(hash)
+	return b != nil
+}
+
+// OrphanCount returns the number of blocks waiting in the orphan pool.
+func (c *Chain) OrphanCount() int {
+	return c.orphans.Len()
 }
 
 // reorganize switches the active chain to the newTip.
@@ -276,25 +517,29 @@ func (c *Chain) reorganize(newTip *types.Block) error {
 		return err
 	}
 
-	_ = ancestor // We mostly used it to build paths
+	// Blocks are checked against the finalized height as they arrive, but the
+	// tip may have moved since a side chain was stored.
+	if finalized := c.finalizedHeight(); ancestor.Header.Height < finalized {
+		return fmt.Errorf("%w: fork point %d, finalized height %d", ErrFinalizedFork, ancestor.Header.Height, finalized)
+	}
 
 	// 2. Validate New Chain segments fully?
 	// We validated each block as we added it (AddBlock logic).
 	// We assume they are valid.
 
-	// 3. Update Canonical Index
-	// Set new path as canonical
-	for _, b := range newChain {
-		if err := c.store.SetCanonical(b.Header.Height, b.Hash); err != nil {
-			return err
-		}
+	// 3. Commit the switch atomically: roll the account state back to the
+	// ancestor and forward to newTip, rewrite the canonical index (dropping
+	// entries above a shorter new chain) and save the head.
+	disconnect := make([]*types.Block, len(oldChain))
+	copy(disconnect, oldChain)
+	reverseBlocks(disconnect)
+	update := &ChainUpdate{Disconnect: disconnect, Connect: newChain}
+	if err := c.store.CommitChainUpdate(update); err != nil {
+		return fmt.Errorf("failed to commit reorganization: %w", err)
 	}
 
 	// 4. Update Tip
 	c.tip = newTip
-	if err := c.store.SaveHead(newTip.Hash); err != nil {
-		return err
-	}
 
 	// 5. Update Mempool
 	if c.pool != nil {
@@ -343,6 +588,7 @@ func (c *Chain) reorganize(newTip *types.Block) error {
 
 	// 6. Notify Subscribers
 	c.notifySubscribers(newTip)
+	c.notifyUpdate(update)
 
 	return nil
 }
@@ -452,6 +698,11 @@ func (c *Chain) GetBlockByHash(hash types.Hash) (*types.Block, error) {
 	return c.store.GetBlockByHash(hash)
 }
 
+// CumulativeWork returns the total work of the chain ending at the given block.
+func (c *Chain) CumulativeWork(hash types.Hash) (*big.Int, error) {
+	return c.store.GetCumulativeWork(hash)
+}
+
 // Tip returns the current chain tip.
 func (c *Chain) Tip() *types.Block {
 	c.mu.RLock()
@@ -501,56 +752,205 @@ func (c *Chain) TotalSupply() types.Amount {
 	return TotalSupplyAtHeight(c.tip.Header.Height)
 }
 
-// GetAccountState calculates the balance and nonce for a given address
-// by scanning the entire CANONICAL blockchain history.
+// GetAccountState returns the spendable balance and next nonce of addr
+// as of the current CANONICAL tip.
 func (c *Chain) GetAccountState(addr types.Hash) (types.Amount, uint64, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	var balance types.Amount
-	var nonce uint64
-	currentHeight := uint64(0)
-	if c.tip != nil {
-		currentHeight = c.tip.Header.Height
+	if c.tip == nil {
+		return 0, 0, nil
 	}
 
-	// Iterate from genesis to tip
-	for h := uint64(0); h <= currentHeight; h++ {
-		// Note: GetBlockByHeight here uses the Store's GetBlockByHeight,
-		// which uses the canonical index map.
-		// Since we hold the lock, and store calls are safe, we just need to avoid recursive locking
-		// if `c.GetBlockByHeight` was called. But we can call `c.store.GetBlockByHeight`.
+	acc, err := c.store.GetAccount(addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return acc.SpendableAt(c.tip.Header.Height), acc.Nonce, nil
+}
+
+// SelectTransactions picks, from candidate transactions such as the
+// mempool's, up to max that can follow each other in a block on top of
+// parent. They are ordered by sender and nonce and replayed against the
+// state after parent; a transaction that does not apply is left out, and
+// with it the sender's later ones. It also returns the fees of the
+// selected transactions, which the block's coinbase collects.
+func (c *Chain) SelectTransactions(parent *types.Block, txs []*types.Transaction, max int) ([]*types.Transaction, types.Amount, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
+	view, err := c.stateAt(parent)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	txs = append([]*types.Transaction(nil), txs...)
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].From != txs[j].From {
+			return bytes.Compare(txs[i].From[:], txs[j].From[:]) < 0
+		}
+		return txs[i].Nonce < txs[j].Nonce
+	})
+
+	height := parent.Header.Height + 1
+	reward := BlockReward(height)
+	seen := make(map[types.Hash]struct{}, len(txs))
+	var selected []*types.Transaction
+	var fees types.Amount
+	for _, tx := range txs {
+		if len(selected) >= max {
+			break
+		}
+		if tx.Type != types.TxTypeTransfer {
+			continue
+		}
+		// The coinbase must be able to collect the fee.
+		if reward+fees+tx.Fee < reward+fees {
+			continue
+		}
+		if err := validateTransaction(tx, height, view, seen); err != nil {
+			continue
+		}
+		if err := view.applyTransaction(tx, height); err != nil {
+			return nil, 0, err
+		}
+		selected = append(selected, tx)
+		fees += tx.Fee
+	}
+	return selected, fees, nil
+}
+
+// RebuildState discards the account state index and rebuilds it by replaying
+// every block of the canonical chain from genesis.
+func (c *Chain) RebuildState() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.store.ResetState(); err != nil {
+		return err
+	}
+
+	headHash, err := c.store.GetHead()
+	if err != nil {
+		return err
+	}
+	head, err := c.store.GetBlockByHash(headHash)
+	if err != nil {
+		return err
+	}
+
+	for h := uint64(0); h <= head.Header.Height; h++ {
 		block, err := c.store.GetBlockByHeight(h)
 		if err != nil {
-			if err == ErrBlockNotFoundInStore {
-				break
-			}
-			return 0, 0, err
-		}
-
-		for _, tx := range block.Transactions {
-			// 1. Credits
-			if tx.To == addr {
-				if tx.Type == types.TxTypeCoinbase {
-					// Check Maturity
-					if IsMature(block.Header.Height, currentHeight) {
-						balance += tx.Amount
-					}
-				} else {
-					// Standard transfer
-					balance += tx.Amount
-				}
-			}
+			return fmt.Errorf("failed to get block at height %d: %w", h, err)
+		}
+		view := NewStateView(c.store)
+		if err := view.applyBlock(block); err != nil {
+			return fmt.Errorf("failed to apply block at height %d: %w", h, err)
+		}
+		if err := c.store.ConnectState(block.Hash, view.accounts); err != nil {
+			return fmt.Errorf("failed to apply block at height %d: %w", h, err)
+		}
+	}
+	return nil
+}
 
-			// 2. Debits (Sent transactions)
-			if tx.From == addr {
-				totalDebit := tx.Amount + tx.Fee
-				balance -= totalDebit
-				nonce++
+// checkConsistency detects and repairs a store left half-updated by a crash
+// in the middle of a chain update (as could happen before chain updates were
+// committed atomically): canonical entries that are not ancestors of the
+// head, entries above the head, and an account state that does not belong
+// to the head. It runs from NewChain, before the chain is shared.
+func (c *Chain) checkConsistency() error {
+	// 1. The canonical index must follow the head's ancestry.
+	repaired := 0
+	for curr := c.tip; ; {
+		height := curr.Header.Height
+		canon, err := c.store.GetBlockByHeight(height)
+		if err != nil && !errors.Is(err, ErrBlockNotFoundInStore) {
+			return err
+		}
+		if canon == nil || canon.Hash != curr.Hash {
+			if err := c.store.SetCanonical(height, curr.Hash); err != nil {
+				return err
 			}
+			repaired++
+		}
+		if height == 0 {
+			break
+		}
+		if curr, err = c.store.GetBlockByHash(curr.Header.PrevBlockHash); err != nil {
+			return fmt.Errorf("failed to load ancestor at height %d: %w", height-1, err)
+		}
+	}
+	trimmed, err := c.store.TrimCanonical(c.tip.Header.Height)
+	if err != nil {
+		return err
+	}
+	if repaired > 0 || trimmed > 0 {
+		log.Printf("Repaired canonical index: %d entries rewritten, %d stale entries removed", repaired, trimmed)
+	}
+
+	// 2. The account state must belong to the head. If it belongs to another
+	// known block, move it along the fork paths using undo data.
+	stateTip, err := c.store.GetStateTip()
+	if err == nil && stateTip == c.tip.Hash {
+		return nil
+	}
+	if err == nil {
+		if err = c.moveState(stateTip); err == nil {
+			log.Printf("Moved account state from %x to head %x", stateTip[:8], c.tip.Hash[:8])
+			return nil
 		}
+		log.Printf("Failed to move account state to head: %v; rebuilding", err)
 	}
 
-	return balance, nonce, nil
+	// Databases created before the account index existed (or whose index
+	// was reset) have no state for the current head: rebuild it.
+	if err := c.RebuildState(); err != nil {
+		return fmt.Errorf("failed to rebuild account state: %w", err)
+	}
+	return nil
+}
+
+// moveState moves the stored account state from block 'from' to the tip.
+func (c *Chain) moveState(from types.Hash) error {
+	fromBlock, err := c.store.GetBlockByHash(from)
+	if err != nil {
+		return err
+	}
+	_, toTip, fromChain, err := c.findForkPaths(fromBlock, c.tip)
+	if err != nil {
+		return err
+	}
+	reverseBlocks(fromChain)
+	return c.store.CommitChainUpdate(&ChainUpdate{Disconnect: fromChain, Connect: toTip})
+}
+
+// stateAt returns a view of the account state after 'block'. The stored state
+// reflects the canonical tip; for side-chain blocks the view rolls back to the
+// fork point using undo data and replays the side chain in memory.
+// It assumes c.mu is held.
+func (c *Chain) stateAt(block *types.Block) (*StateView, error) {
+	view := NewStateView(c.store)
+	if block.Hash == c.tip.Hash {
+		return view, nil
+	}
+
+	_, sideChain, canonChain, err := c.findForkPaths(c.tip, block)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(canonChain) - 1; i >= 0; i-- {
+		undo, err := c.store.GetStateUndo(canonChain[i].Hash)
+		if err != nil {
+			return nil, err
+		}
+		view.restore(undo)
+	}
+	for _, b := range sideChain {
+		if err := view.applyBlock(b); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
 }
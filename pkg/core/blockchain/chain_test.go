@@ -1,11 +1,20 @@
 package blockchain
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/chronodrachma/chrd/pkg/core/consensus"
 	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/dgraph-io/badger/v4"
 )
 
 func mustNewTestChain(t *testing.T, hasher consensus.Hasher) (*Chain, BlockStore) {
@@ -223,8 +232,8 @@ func TestValidateBlock_InvalidHeight(t *testing.T) {
 
 	err = chain.AddBlock(block)
 	// AddBlock validates height early
-	if err == nil || err.Error() != "invalid block height: expected 1, got 5" {
-		t.Errorf("expected 'invalid block height', got: %v", err)
+	if !errors.Is(err, ErrInvalidHeight) || err.Error() != ErrInvalidHeight.Error()+": expected 1, got 5" {
+		t.Errorf("expected ErrInvalidHeight (expected 1, got 5), got: %v", err)
 	}
 }
 
@@ -301,7 +310,7 @@ func TestValidateBlock_InvalidCoinbaseAmount(t *testing.T) {
 		block.Hash = block.ComputeHash()
 		pow, _ := hasher.Hash(block.Header.Serialize())
 		block.PowHash = pow
-		if consensus.MeetsDifficulty(pow, block.Header.Difficulty) {
+		if consensus.MeetsTarget(pow, block.Header.Bits) {
 			break
 		}
 		block.Header.Nonce++
@@ -329,15 +338,13 @@ func TestForkChoice(t *testing.T) {
 	}
 
 	// 1. Mine Chain A: Genesis -> A1 -> A2
-	// CDF: 1 -> 2 -> 3
+	// Work: 1 -> 2 -> 3
 	a1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
-	a1.Header.Difficulty = 1
 	if err := chain.AddBlock(a1); err != nil {
 		t.Fatalf("failed to add A1: %v", err)
 	}
 
 	a2 := buildTestBlock(t, hasher, a1, miner, a1.Hash, 0)
-	a2.Header.Difficulty = 1
 	if err := chain.AddBlock(a2); err != nil {
 		t.Fatalf("failed to add A2: %v", err)
 	}
@@ -347,13 +354,12 @@ func TestForkChoice(t *testing.T) {
 	}
 
 	// 2. Mine Chain B: Genesis -> B1 -> B2 -> B3
-	// CDF: 1 -> 2 -> 3 -> 4
+	// Work: 1 -> 2 -> 3 -> 4
 	// B1 is sibling of A1
 	b1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 100)
-	b1.Header.Difficulty = 1
 	// buildTestBlock handles mining, so b1 is valid PoW with seed 100.
 
-	// Add B1. It has CDF 2 (same as A1, less than Tip A2 (3)).
+	// Add B1. It has work 2 (same as A1, less than Tip A2 (3)).
 	// Should NOT reorg.
 	if err := chain.AddBlock(b1); err != nil {
 		t.Fatalf("failed to add B1: %v", err)
@@ -363,9 +369,8 @@ func TestForkChoice(t *testing.T) {
 	}
 
 	b2 := buildTestBlock(t, hasher, b1, miner, b1.Hash, 101)
-	b2.Header.Difficulty = 1
 
-	// Add B2. CDF 3. Equal to Tip A2 (3).
+	// Add B2. Work 3. Equal to Tip A2 (3).
 	// Strictly greater check means NO reorg yet.
 	if err := chain.AddBlock(b2); err != nil {
 		t.Fatalf("failed to add B2: %v", err)
@@ -375,9 +380,8 @@ func TestForkChoice(t *testing.T) {
 	}
 
 	b3 := buildTestBlock(t, hasher, b2, miner, b2.Hash, 102)
-	b3.Header.Difficulty = 1
 
-	// Add B3. CDF 4. Greater than Tip A2 (3).
+	// Add B3. Work 4. Greater than Tip A2 (3).
 	// REORG EXPECTED.
 	if err := chain.AddBlock(b3); err != nil {
 		t.Fatalf("failed to add B3: %v", err)
@@ -433,15 +437,11 @@ func buildTestBlock(t *testing.T, hasher consensus.Hasher, parent *types.Block,
 			Timestamp:     parent.Header.Timestamp.Add(1 * time.Hour),
 			PrevBlockHash: prevHash,
 			MerkleRoot:    types.ComputeMerkleRoot(txs),
-			Difficulty:    parent.Header.Difficulty, // Inherit difficulty by default
+			Bits:          parent.Header.Bits, // Inherit target by default
 			Nonce:         nonceSeed,
 		},
 		Transactions: txs,
 	}
-	// Fallback if parent diff is 0 (test genesis)
-	if block.Header.Difficulty == 0 {
-		block.Header.Difficulty = 1
-	}
 
 	// Mine until difficulty is met
 	for {
@@ -452,7 +452,7 @@ func buildTestBlock(t *testing.T, hasher consensus.Hasher, parent *types.Block,
 		}
 		block.PowHash = powHash
 
-		if consensus.MeetsDifficulty(powHash, block.Header.Difficulty) {
+		if consensus.MeetsTarget(powHash, block.Header.Bits) {
 			break
 		}
 		block.Header.Nonce++
@@ -486,60 +486,45 @@ func TestReorgMempool(t *testing.T) {
 	pool := &mockTxPool{}
 	chain.SetMempool(pool)
 
+	sender, senderKey := newTestKey(t)
 	miner := types.Hash{0x01}
-	// Start in past
-	genesis, _ := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	// Start in past; the genesis coinbase pays the sender.
+	genesis, _ := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+
+	// Let the genesis coinbase mature: Gen -> ... -> P23
+	p23 := extendTestChain(t, chain, hasher, genesis, miner, 23)
 
-	// Chain A: Gen -> A1 (contains TX1)
-	// Chain B: Gen -> B1 -> B2 (no TX1)
+	// Chain A: P23 -> A24 (contains TX1)
+	// Chain B: P23 -> B24 -> B25 (no TX1)
 
 	// Create TX1
-	tx1 := &types.Transaction{
-		Type:      types.TxTypeTransfer,
-		From:      types.Hash{0xA},
-		To:        types.Hash{0xB},
-		Amount:    10,
-		Nonce:     1,
-		Timestamp: time.Now(),
-	}
-	tx1.ID = tx1.ComputeID()
+	tx1 := newSignedTransfer(t, senderKey, sender, types.Hash{0xB}, 10, 0, 0)
 
-	// Mine A1 with TX1
-	a1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
-	a1.Transactions = append(a1.Transactions, tx1)
-	a1.Header.MerkleRoot = types.ComputeMerkleRoot(a1.Transactions)
-	// Remine because merkle root changed
-	a1.Header.Nonce = 0
-	for {
-		a1.Hash = a1.ComputeHash()
-		pow, _ := hasher.Hash(a1.Header.Serialize())
-		a1.PowHash = pow
-		if consensus.MeetsDifficulty(pow, a1.Header.Difficulty) {
-			break
-		}
-		a1.Header.Nonce++
-	}
+	// Mine A24 with TX1
+	a24 := buildTestBlock(t, hasher, p23, miner, p23.Hash, 0)
+	a24.Transactions = append(a24.Transactions, tx1)
+	remineTestBlock(t, hasher, a24)
 
-	if err := chain.AddBlock(a1); err != nil {
-		t.Fatalf("failed to add A1: %v", err)
+	if err := chain.AddBlock(a24); err != nil {
+		t.Fatalf("failed to add A24: %v", err)
 	}
 
-	// Mine B1 (side chain)
-	b1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 100)
-	if err := chain.AddBlock(b1); err != nil {
-		t.Fatalf("failed to add B1: %v", err)
+	// Mine B24 (side chain)
+	b24 := buildTestBlock(t, hasher, p23, miner, p23.Hash, 100)
+	if err := chain.AddBlock(b24); err != nil {
+		t.Fatalf("failed to add B24: %v", err)
 	}
 
-	// Mine B2 (extends B1, triggers reorg)
-	b2 := buildTestBlock(t, hasher, b1, miner, b1.Hash, 200)
+	// Mine B25 (extends B24, triggers reorg)
+	b25 := buildTestBlock(t, hasher, b24, miner, b24.Hash, 200)
 
 	// Trigger Reorg to B chain
-	if err := chain.AddBlock(b2); err != nil {
-		t.Fatalf("failed to add B2: %v", err)
+	if err := chain.AddBlock(b25); err != nil {
+		t.Fatalf("failed to add B25: %v", err)
 	}
 
 	// Expectation:
-	// A1 was reorganized out. TX1 was in A1.
+	// A24 was reorganized out. TX1 was in A24.
 	// TX1 is NOT in B chain.
 	// TX1 should be added back to mempool.
 
@@ -555,3 +540,1195 @@ func TestReorgMempool(t *testing.T) {
 		t.Error("TX1 was not added back to mempool after reorg")
 	}
 }
+
+func TestValidateBlockTransactions_ValidTransfer(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	sender, senderKey := newTestKey(t)
+	recipient := types.Hash{0xB}
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	p23 := extendTestChain(t, chain, hasher, genesis, miner, 23)
+
+	amount := types.Amount(types.ChronosPerCHRD / 2)
+	fee := types.Amount(100)
+	block := buildTestBlock(t, hasher, p23, miner, p23.Hash, 0)
+	block.Transactions = append(block.Transactions,
+		newSignedTransfer(t, senderKey, sender, recipient, amount, fee, 0),
+		// A second transfer in the same block must use the next nonce.
+		newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 1),
+	)
+	remineTestBlock(t, hasher, block)
+
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+
+	balance, nonce, err := chain.GetAccountState(sender)
+	if err != nil {
+		t.Fatalf("GetAccountState failed: %v", err)
+	}
+	if want := types.BlockReward - amount - fee - 1; balance != want {
+		t.Errorf("sender balance = %d, want %d", balance, want)
+	}
+	if nonce != 2 {
+		t.Errorf("sender nonce = %d, want 2", nonce)
+	}
+
+	balance, _, err = chain.GetAccountState(recipient)
+	if err != nil {
+		t.Fatalf("GetAccountState failed: %v", err)
+	}
+	if balance != amount+1 {
+		t.Errorf("recipient balance = %d, want %d", balance, amount+1)
+	}
+
+	// The fee went to the miner, so no coins were burned.
+	minerAcc, err := store.GetAccount(miner)
+	if err != nil {
+		t.Fatalf("GetAccount failed: %v", err)
+	}
+	last := minerAcc.Immature[len(minerAcc.Immature)-1]
+	if last.Amount != types.BlockReward+fee {
+		t.Errorf("coinbase output = %d, want reward + fee %d", last.Amount, types.BlockReward+fee)
+	}
+	var total types.Amount
+	for _, addr := range []types.Hash{sender, recipient, miner} {
+		acc, err := store.GetAccount(addr)
+		if err != nil {
+			t.Fatalf("GetAccount failed: %v", err)
+		}
+		total += acc.Balance
+		for _, u := range acc.Immature {
+			total += u.Amount
+		}
+	}
+	if want := TotalSupplyAtHeight(block.Header.Height); total != want {
+		t.Errorf("sum of balances = %d, want total supply %d", total, want)
+	}
+}
+
+func TestSelectTransactions(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	sender, senderKey := newTestKey(t)
+	other, otherKey := newTestKey(t)
+	recipient := types.Hash{0xB}
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	p23 := extendTestChain(t, chain, hasher, genesis, miner, 23)
+
+	first := newSignedTransfer(t, senderKey, sender, recipient, 1, 10, 0)
+	second := newSignedTransfer(t, senderKey, sender, recipient, 1, 10, 1)
+	candidates := []*types.Transaction{
+		second,
+		newSignedTransfer(t, senderKey, sender, recipient, types.BlockReward, 10, 1), // Overspends.
+		first,
+		newSignedTransfer(t, senderKey, sender, recipient, 1, 10, 3), // After a gap.
+		newSignedTransfer(t, otherKey, other, recipient, 1, 10, 0),   // No funds.
+	}
+
+	selected, fees, err := chain.SelectTransactions(p23, candidates, 10)
+	if err != nil {
+		t.Fatalf("SelectTransactions failed: %v", err)
+	}
+	if len(selected) != 2 || selected[0] != first || selected[1] != second {
+		t.Fatalf("selected %d transactions, want the sender's nonces 0 and 1 in order", len(selected))
+	}
+	if fees != 20 {
+		t.Errorf("fees = %d, want those of the selected transactions, 20", fees)
+	}
+	if limited, fees, _ := chain.SelectTransactions(p23, candidates, 1); len(limited) != 1 || limited[0] != first || fees != 10 {
+		t.Errorf("limit of 1: selected %d transactions with fees %d, want nonce 0", len(limited), fees)
+	}
+
+	// The selection makes a valid block.
+	block := buildTestBlock(t, hasher, p23, miner, p23.Hash, 0)
+	block.Transactions = append(block.Transactions, selected...)
+	block.Transactions[0].Amount += fees
+	block.Transactions[0].ID = block.Transactions[0].ComputeID()
+	remineTestBlock(t, hasher, block)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+
+	// Once mined, the transactions no longer apply.
+	if selected, _, _ := chain.SelectTransactions(block, candidates, 10); len(selected) != 0 {
+		t.Errorf("selected %d mined transactions, want none", len(selected))
+	}
+}
+
+func TestCoinbaseMustCollectFees(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	sender, senderKey := newTestKey(t)
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	p23 := extendTestChain(t, chain, hasher, genesis, miner, 23)
+
+	tx := newSignedTransfer(t, senderKey, sender, types.Hash{0xB}, 10, 500, 0)
+	for _, coinbaseAmount := range []types.Amount{types.BlockReward, types.BlockReward + 501} {
+		block := buildTestBlock(t, hasher, p23, miner, p23.Hash, 0)
+		block.Transactions = append(block.Transactions, tx)
+		remineTestBlock(t, hasher, block)
+
+		// Override the amount set by remineTestBlock and mine again.
+		block.Transactions[0].Amount = coinbaseAmount
+		block.Transactions[0].ID = block.Transactions[0].ComputeID()
+		block.Header.MerkleRoot = types.ComputeMerkleRoot(block.Transactions)
+		for {
+			block.Hash = block.ComputeHash()
+			pow, _ := hasher.Hash(block.Header.Serialize())
+			block.PowHash = pow
+			if consensus.MeetsTarget(pow, block.Header.Bits) {
+				break
+			}
+			block.Header.Nonce++
+		}
+
+		if err := chain.AddBlock(block); err != ErrInvalidCoinbaseAmt {
+			t.Errorf("coinbase of %d: expected ErrInvalidCoinbaseAmt, got %v", coinbaseAmount, err)
+		}
+	}
+}
+
+func TestValidateBlockTransactions_Rejects(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	sender, senderKey := newTestKey(t)
+	_, otherKey := newTestKey(t)
+	recipient := types.Hash{0xB}
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	// At height 23 the genesis coinbase is still immature.
+	p22 := extendTestChain(t, chain, hasher, genesis, miner, 22)
+	immature := buildTestBlock(t, hasher, p22, miner, p22.Hash, 0)
+	immature.Transactions = append(immature.Transactions, newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 0))
+	remineTestBlock(t, hasher, immature)
+	if err := chain.AddBlock(immature); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("spending immature coinbase: got %v, want ErrInsufficientFunds", err)
+	}
+
+	p23 := extendTestChain(t, chain, hasher, p22, miner, 1)
+
+	transfer := newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 0)
+	badSig := newSignedTransfer(t, otherKey, sender, recipient, 1, 0, 0)
+	badID := newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 0)
+	badID.ID = types.Hash{0xEE}
+	badType := newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 0)
+	badType.Type = 7
+	badType.ID = badType.ComputeID()
+	secondCoinbase := newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 0)
+	secondCoinbase.Type = types.TxTypeCoinbase
+
+	tests := []struct {
+		name string
+		txs  []*types.Transaction
+		want error
+	}{
+		{"bad signature", []*types.Transaction{badSig}, ErrInvalidTxSignature},
+		{"bad id", []*types.Transaction{badID}, ErrInvalidTxID},
+		{"unknown type", []*types.Transaction{badType}, ErrInvalidTxType},
+		{"nonce gap", []*types.Transaction{newSignedTransfer(t, senderKey, sender, recipient, 1, 0, 1)}, ErrInvalidTxNonce},
+		{"replayed nonce", []*types.Transaction{transfer, newSignedTransfer(t, senderKey, sender, recipient, 2, 0, 0)}, ErrInvalidTxNonce},
+		{"duplicate", []*types.Transaction{transfer, transfer}, ErrDuplicateTx},
+		{"overspend", []*types.Transaction{newSignedTransfer(t, senderKey, sender, recipient, types.BlockReward, 1, 0)}, ErrInsufficientFunds},
+		{"fee overflow", []*types.Transaction{newSignedTransfer(t, senderKey, sender, recipient, 1, ^types.Amount(0), 0)}, ErrAmountOverflow},
+		{"unsigned from unfunded", []*types.Transaction{{Type: types.TxTypeTransfer, From: types.Hash{0xA}, To: recipient, Amount: 1}}, ErrInvalidTxID},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := buildTestBlock(t, hasher, p23, miner, p23.Hash, uint64(i)*1000)
+			block.Transactions = append(block.Transactions, tt.txs...)
+			remineTestBlock(t, hasher, block)
+
+			err := chain.AddBlock(block)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("AddBlock error = %v, want %v", err, tt.want)
+			}
+			var txErr *TxError
+			if !errors.As(err, &txErr) {
+				t.Fatalf("AddBlock error %v is not a *TxError", err)
+			}
+		})
+	}
+
+	// The only coinbase must be at position 0; a second one is rejected structurally.
+	block := buildTestBlock(t, hasher, p23, miner, p23.Hash, 99_000)
+	block.Transactions = append(block.Transactions, secondCoinbase)
+	remineTestBlock(t, hasher, block)
+	if err := chain.AddBlock(block); err != ErrInvalidCoinbasePos {
+		t.Errorf("second coinbase: got %v, want ErrInvalidCoinbasePos", err)
+	}
+}
+
+// newTestKey returns an Ed25519 key whose public key doubles as an address.
+func newTestKey(t *testing.T) (types.Hash, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var addr types.Hash
+	copy(addr[:], pub)
+	return addr, priv
+}
+
+// newSignedTransfer builds a transfer signed with key.
+func newSignedTransfer(t *testing.T, key ed25519.PrivateKey, from, to types.Hash, amount, fee types.Amount, nonce uint64) *types.Transaction {
+	t.Helper()
+	tx := &types.Transaction{
+		Type:      types.TxTypeTransfer,
+		Timestamp: time.Now(),
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		Fee:       fee,
+		Nonce:     nonce,
+	}
+	tx.Signature = ed25519.Sign(key, tx.Serialize())
+	tx.ID = tx.ComputeID()
+	return tx
+}
+
+// extendTestChain adds n empty blocks on top of parent and returns the last one.
+func extendTestChain(t *testing.T, chain *Chain, hasher consensus.Hasher, parent *types.Block, miner types.Hash, n int) *types.Block {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		block := buildTestBlock(t, hasher, parent, miner, parent.Hash, 0)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("failed to add block %d: %v", block.Header.Height, err)
+		}
+		parent = block
+	}
+	return parent
+}
+
+// remineTestBlock recomputes the merkle root and PoW after the block body changed.
+func remineTestBlock(t *testing.T, hasher consensus.Hasher, block *types.Block) {
+	t.Helper()
+	// The coinbase collects the fees of the transfers added to the block.
+	fees, err := TotalFees(block.Transactions)
+	if err != nil {
+		t.Fatalf("TotalFees failed: %v", err)
+	}
+	coinbase := block.Transactions[0]
+	coinbase.Amount = BlockReward(block.Header.Height) + fees
+	coinbase.ID = coinbase.ComputeID()
+
+	block.Header.MerkleRoot = types.ComputeMerkleRoot(block.Transactions)
+	for {
+		block.Hash = block.ComputeHash()
+		pow, err := hasher.Hash(block.Header.Serialize())
+		if err != nil {
+			t.Fatalf("hasher error: %v", err)
+		}
+		block.PowHash = pow
+		if consensus.MeetsTarget(pow, block.Header.Bits) {
+			return
+		}
+		block.Header.Nonce++
+	}
+}
+
+func TestAccountStateFollowsReorg(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	sender, senderKey := newTestKey(t)
+	recipientA := types.Hash{0xA}
+	recipientB := types.Hash{0xB}
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(sender, 1, time.Now().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	p23 := extendTestChain(t, chain, hasher, genesis, miner, 23)
+
+	assertState := func(addr types.Hash, wantBalance types.Amount, wantNonce uint64) {
+		t.Helper()
+		balance, nonce, err := chain.GetAccountState(addr)
+		if err != nil {
+			t.Fatalf("GetAccountState failed: %v", err)
+		}
+		if balance != wantBalance || nonce != wantNonce {
+			t.Errorf("state of %x = (%d, %d), want (%d, %d)", addr[:1], balance, nonce, wantBalance, wantNonce)
+		}
+	}
+
+	// Chain A spends the genesis coinbase to recipientA.
+	a24 := buildTestBlock(t, hasher, p23, miner, p23.Hash, 0)
+	a24.Transactions = append(a24.Transactions, newSignedTransfer(t, senderKey, sender, recipientA, 10, 0, 0))
+	remineTestBlock(t, hasher, a24)
+	if err := chain.AddBlock(a24); err != nil {
+		t.Fatalf("failed to add A24: %v", err)
+	}
+	assertState(sender, types.BlockReward-10, 1)
+	assertState(recipientA, 10, 0)
+
+	// Chain B reuses nonce 0 for a different transfer. It is only valid
+	// against the side chain's own state, not the canonical one.
+	b24 := buildTestBlock(t, hasher, p23, miner, p23.Hash, 100)
+	b24.Transactions = append(b24.Transactions, newSignedTransfer(t, senderKey, sender, recipientB, 20, 0, 0))
+	remineTestBlock(t, hasher, b24)
+	if err := chain.AddBlock(b24); err != nil {
+		t.Fatalf("failed to add B24: %v", err)
+	}
+	assertState(sender, types.BlockReward-10, 1)
+
+	b25 := buildTestBlock(t, hasher, b24, miner, b24.Hash, 200)
+	if err := chain.AddBlock(b25); err != nil {
+		t.Fatalf("failed to add B25: %v", err)
+	}
+	if chain.Tip().Hash != b25.Hash {
+		t.Fatal("Tip should be B25 after reorg")
+	}
+	assertState(sender, types.BlockReward-20, 1)
+	assertState(recipientA, 0, 0)
+	assertState(recipientB, 20, 0)
+	// Only the coinbase of height 1 has matured at height 25.
+	assertState(miner, types.BlockReward, 0)
+
+	// Rebuilding from blocks must give the same state.
+	if err := chain.RebuildState(); err != nil {
+		t.Fatalf("RebuildState failed: %v", err)
+	}
+	assertState(sender, types.BlockReward-20, 1)
+	assertState(recipientA, 0, 0)
+	assertState(recipientB, 20, 0)
+	assertState(miner, types.BlockReward, 0)
+}
+
+// newForkedTestChain builds genesis + C1..C4 (canonical) and a side block S1
+// off genesis.
+func newForkedTestChain(t *testing.T, hasher consensus.Hasher) (*Chain, BlockStore, []*types.Block, *types.Block) {
+	t.Helper()
+	chain, store := mustNewTestChain(t, hasher)
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	canon := []*types.Block{genesis}
+	for i := 0; i < 4; i++ {
+		canon = append(canon, extendTestChain(t, chain, hasher, canon[i], miner, 1))
+	}
+
+	side := buildTestBlock(t, hasher, genesis, types.Hash{0x02}, genesis.Hash, 100)
+	if err := chain.AddBlock(side); err != nil {
+		t.Fatalf("failed to add side block: %v", err)
+	}
+	if chain.Tip().Hash != canon[4].Hash {
+		t.Fatal("side block should not become the tip")
+	}
+	return chain, store, canon, side
+}
+
+func assertImmatureCount(t *testing.T, store BlockStore, addr types.Hash, want int) {
+	t.Helper()
+	acc, err := store.GetAccount(addr)
+	if err != nil {
+		t.Fatalf("GetAccount failed: %v", err)
+	}
+	if len(acc.Immature) != want {
+		t.Errorf("immature outputs of %x = %d, want %d", addr[:1], len(acc.Immature), want)
+	}
+}
+
+func TestCommitChainUpdateIsAtomic(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	_, store, canon, side := newForkedTestChain(t, hasher)
+	defer store.Close()
+	tip := canon[4]
+
+	// S1 was never connected, so it has no undo data and the update must
+	// fail after C4 has already been rolled back inside the transaction.
+	err := store.CommitChainUpdate(&ChainUpdate{Disconnect: []*types.Block{tip, side}})
+	if !errors.Is(err, ErrUndoNotFound) {
+		t.Fatalf("CommitChainUpdate error = %v, want ErrUndoNotFound", err)
+	}
+
+	head, err := store.GetHead()
+	if err != nil || head != tip.Hash {
+		t.Errorf("head = %x (%v), want C4", head[:4], err)
+	}
+	stateTip, err := store.GetStateTip()
+	if err != nil || stateTip != tip.Hash {
+		t.Errorf("state tip = %x (%v), want C4", stateTip[:4], err)
+	}
+	if b, err := store.GetBlockByHeight(4); err != nil || b.Hash != tip.Hash {
+		t.Errorf("canonical block at height 4 should still be C4 (err: %v)", err)
+	}
+	assertImmatureCount(t, store, types.Hash{0x01}, 5)
+}
+
+func TestRepairHalfAppliedReorg(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	_, store, canon, side := newForkedTestChain(t, hasher)
+	defer store.Close()
+	tip := canon[4]
+
+	// Simulate a crash in the middle of a non-atomic chain update: the head
+	// points at C4 but the account state was rolled back to C2, two canonical
+	// entries are gone, one points at the side chain and one is left above
+	// the head.
+	if err := store.CommitChainUpdate(&ChainUpdate{Disconnect: []*types.Block{canon[4], canon[3]}}); err != nil {
+		t.Fatalf("CommitChainUpdate failed: %v", err)
+	}
+	if err := store.SaveHead(tip.Hash); err != nil {
+		t.Fatalf("SaveHead failed: %v", err)
+	}
+	if err := store.SetCanonical(1, side.Hash); err != nil {
+		t.Fatalf("SetCanonical failed: %v", err)
+	}
+	if err := store.SetCanonical(7, side.Hash); err != nil {
+		t.Fatalf("SetCanonical failed: %v", err)
+	}
+	assertImmatureCount(t, store, types.Hash{0x01}, 3)
+
+	chain, err := NewChain(store, hasher)
+	if err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	if chain.Tip().Hash != tip.Hash {
+		t.Fatalf("tip = height %d, want C4", chain.Height())
+	}
+	for h, want := range canon {
+		b, err := store.GetBlockByHeight(uint64(h))
+		if err != nil || b.Hash != want.Hash {
+			t.Errorf("canonical block at height %d not repaired (err: %v)", h, err)
+		}
+	}
+	if _, err := store.GetBlockByHeight(7); !errors.Is(err, ErrBlockNotFoundInStore) {
+		t.Errorf("stale canonical entry above the head should be removed, got err %v", err)
+	}
+	stateTip, err := store.GetStateTip()
+	if err != nil || stateTip != tip.Hash {
+		t.Errorf("state tip = %x (%v), want C4", stateTip[:4], err)
+	}
+	assertImmatureCount(t, store, types.Hash{0x01}, 5)
+	assertImmatureCount(t, store, types.Hash{0x02}, 0)
+}
+
+func TestReorgDepthLimit(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+	chain.SetMaxReorgDepth(3)
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	canon := []*types.Block{genesis}
+	for i := 0; i < 6; i++ {
+		canon = append(canon, extendTestChain(t, chain, hasher, canon[i], miner, 1))
+	}
+	if got := chain.FinalizedHeight(); got != 3 {
+		t.Fatalf("FinalizedHeight = %d, want 3", got)
+	}
+
+	// Forking off block 2 would rewrite the final block 3.
+	deep := buildTestBlock(t, hasher, canon[2], miner, canon[2].Hash, 100)
+	if err := chain.AddBlock(deep); !errors.Is(err, ErrFinalizedFork) {
+		t.Fatalf("AddBlock(fork at 2) = %v, want ErrFinalizedFork", err)
+	}
+	if b, _ := store.GetBlockByHash(deep.Hash); b != nil {
+		t.Error("rejected fork block should not be stored")
+	}
+
+	// Forking off the finalized block itself is allowed.
+	s4 := buildTestBlock(t, hasher, canon[3], miner, canon[3].Hash, 100)
+	if err := chain.AddBlock(s4); err != nil {
+		t.Fatalf("AddBlock(fork at 3) failed: %v", err)
+	}
+
+	// Once the tip moves on, block 4 is final and S4's branch is dead.
+	canon = append(canon, extendTestChain(t, chain, hasher, canon[6], miner, 1))
+	if got := chain.FinalizedHeight(); got != 4 {
+		t.Fatalf("FinalizedHeight = %d, want 4", got)
+	}
+	s5 := buildTestBlock(t, hasher, s4, miner, s4.Hash, 100)
+	if err := chain.AddBlock(s5); !errors.Is(err, ErrFinalizedFork) {
+		t.Fatalf("AddBlock(S5) = %v, want ErrFinalizedFork", err)
+	}
+	if chain.Tip().Hash != canon[7].Hash {
+		t.Error("tip should be unchanged")
+	}
+
+	// 0 disables the limit.
+	chain.SetMaxReorgDepth(0)
+	if got := chain.FinalizedHeight(); got != 0 {
+		t.Errorf("FinalizedHeight with no limit = %d, want 0", got)
+	}
+	if err := chain.AddBlock(s5); err != nil {
+		t.Errorf("AddBlock(S5) without limit failed: %v", err)
+	}
+}
+
+func TestCumulativeWorkBeyondUint64(t *testing.T) {
+	store, err := NewBadgerStore("")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	hash := types.Hash{0x42}
+	work := new(big.Int).Lsh(big.NewInt(3), 200)
+	if err := store.SaveCumulativeWork(hash, work); err != nil {
+		t.Fatalf("SaveCumulativeWork failed: %v", err)
+	}
+	got, err := store.GetCumulativeWork(hash)
+	if err != nil {
+		t.Fatalf("GetCumulativeWork failed: %v", err)
+	}
+	if got.Cmp(work) != 0 {
+		t.Errorf("cumulative work = %s, want %s", got, work)
+	}
+}
+
+// newGobBlock returns a block in the gob layout of v0 and v1 stores, with
+// a coinbase and a correct hash.
+func newGobBlock(parent *gobBlock, bits uint32) *gobBlock {
+	ts := time.Unix(1_700_000_000, 0)
+	coinbase := types.NewCoinbaseTx(types.Hash{0x01}, 0)
+	coinbase.Timestamp = ts
+	header := types.BlockHeader{Version: 1, Timestamp: ts, Bits: bits}
+	if parent != nil {
+		header.Height = parent.Header.Height + 1
+		header.PrevBlockHash = parent.Hash
+		coinbase.Nonce = header.Height
+	}
+	coinbase.ID = coinbase.ComputeID()
+	header.MerkleRoot = types.ComputeMerkleRoot([]*types.Transaction{coinbase})
+
+	return &gobBlock{
+		Header: gobHeader{
+			Version:       header.Version,
+			Height:        header.Height,
+			Timestamp:     header.Timestamp,
+			PrevBlockHash: header.PrevBlockHash,
+			MerkleRoot:    header.MerkleRoot,
+			Bits:          header.Bits,
+		},
+		Transactions: []*gobTransaction{{
+			ID:        coinbase.ID,
+			Type:      uint8(coinbase.Type),
+			Timestamp: coinbase.Timestamp,
+			To:        coinbase.To,
+			Amount:    uint64(coinbase.Amount),
+			Nonce:     coinbase.Nonce,
+		}},
+		Hash: header.ComputeHash(),
+	}
+}
+
+// writeGobStore creates a store at dir holding the given gob-encoded
+// blocks, at the given schema version. A v0 store also gets the legacy
+// summed-difficulty entry of each block.
+func writeGobStore(t *testing.T, dir string, version byte, blocks ...*gobBlock) {
+	t.Helper()
+	store, err := NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	err = store.db.Update(func(txn *badger.Txn) error {
+		for _, b := range blocks {
+			if err := putGob(txn, []byte(fmt.Sprintf("block:hash:%x", b.Hash)), b); err != nil {
+				return err
+			}
+			if version == 0 {
+				buf := make([]byte, 8)
+				binary.LittleEndian.PutUint64(buf, 12345)
+				if err := txn.Set([]byte(fmt.Sprintf("block:cdf:%x", b.Hash)), buf); err != nil {
+					return err
+				}
+			}
+		}
+		if version == 0 {
+			return txn.Delete([]byte("meta:version"))
+		}
+		return txn.Set([]byte("meta:version"), []byte{0, 0, 0, version})
+	})
+	if err != nil {
+		t.Fatalf("failed to write legacy data: %v", err)
+	}
+}
+
+func TestNewStoreSkipsMigrations(t *testing.T) {
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = nil
+	for range saved {
+		migrations = append(migrations, func(*badger.DB) error {
+			t.Error("migration ran on a new store")
+			return nil
+		})
+	}
+
+	store, err := NewBadgerStore("")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	if version, err := store.getSchemaVersion(); err != nil || version != schemaVersion {
+		t.Errorf("schema version = %d, %v; want %d", version, err, schemaVersion)
+	}
+}
+
+func TestMigrateCumulativeWork(t *testing.T) {
+	dir := t.TempDir()
+	easy, hard := consensus.PowLimitBits, consensus.TargetToCompact(new(big.Int).Rsh(consensus.CompactToTarget(consensus.PowLimitBits), 4))
+
+	// Genesis, two blocks on top and a harder side block off genesis.
+	genesis := newGobBlock(nil, easy)
+	b1 := newGobBlock(genesis, easy)
+	b2 := newGobBlock(b1, easy)
+	side := newGobBlock(genesis, hard)
+	writeGobStore(t, dir, 0, b2, side, genesis, b1)
+
+	// Reopening recomputes the work from the blocks' targets.
+	store, err := NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	unit := consensus.CalcWork(easy)
+	want := []struct {
+		name  string
+		block *gobBlock
+		work  *big.Int
+	}{
+		{"genesis", genesis, unit},
+		{"b1", b1, new(big.Int).Mul(unit, big.NewInt(2))},
+		{"b2", b2, new(big.Int).Mul(unit, big.NewInt(3))},
+		{"side", side, new(big.Int).Add(unit, consensus.CalcWork(hard))},
+	}
+	for _, w := range want {
+		got, err := store.GetCumulativeWork(w.block.Hash)
+		if err != nil {
+			t.Fatalf("GetCumulativeWork(%s) failed: %v", w.name, err)
+		}
+		if got.Cmp(w.work) != 0 {
+			t.Errorf("work of %s = %s, want %s", w.name, got, w.work)
+		}
+	}
+
+	err = store.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(fmt.Sprintf("block:cdf:%x", b2.Hash)))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("legacy key still present (err=%v)", err)
+	}
+	if v, _ := store.getSchemaVersion(); v != schemaVersion {
+		t.Errorf("schema version = %d, want %d", v, schemaVersion)
+	}
+}
+
+func TestMigrateBlockEncoding(t *testing.T) {
+	dir := t.TempDir()
+	genesis := newGobBlock(nil, consensus.PowLimitBits)
+	block := newGobBlock(genesis, consensus.PowLimitBits)
+	writeGobStore(t, dir, 1, genesis, block)
+
+	store, err := NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	got, err := store.GetBlockByHash(block.Hash)
+	if err != nil {
+		t.Fatalf("GetBlockByHash failed: %v", err)
+	}
+	if got.Hash != block.Hash || got.ComputeHash() != block.Hash || got.Header.Bits != consensus.PowLimitBits ||
+		len(got.Transactions) != 1 || got.Transactions[0].ID != block.Transactions[0].ID ||
+		got.Transactions[0].ComputeID() != block.Transactions[0].ID {
+		t.Errorf("migrated block does not match: %+v", got)
+	}
+}
+
+func TestMigrateBlockEncodingResumes(t *testing.T) {
+	dir := t.TempDir()
+	genesis := newGobBlock(nil, consensus.PowLimitBits)
+	block := newGobBlock(genesis, consensus.PowLimitBits)
+	writeGobStore(t, dir, 1, genesis, block)
+
+	// A run cut short converted the genesis entry but not the version.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(genesis); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := decodeGobBlock(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decodeGobBlock failed: %v", err)
+	}
+	val, err := converted.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("block:hash:%x", genesis.Hash)), val)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen a partly migrated store: %v", err)
+	}
+	defer reopened.Close()
+	for _, hash := range []types.Hash{genesis.Hash, block.Hash} {
+		if got, err := reopened.GetBlockByHash(hash); err != nil || got.ComputeHash() != hash {
+			t.Errorf("block %x after resuming: %v", hash[:4], err)
+		}
+	}
+}
+
+func TestMigrateRefusesUnconvertibleBlocks(t *testing.T) {
+	// Blocks from before compact targets carry a difficulty instead.
+	legacy := newGobBlock(nil, 0)
+	legacy.Header.Difficulty = 12
+	dir := t.TempDir()
+	writeGobStore(t, dir, 1, legacy)
+	if store, err := NewBadgerStore(dir); !errors.Is(err, ErrStoreTooOld) {
+		if store != nil {
+			store.Close()
+		}
+		t.Fatalf("opening a store with pre-target blocks: %v, want ErrStoreTooOld", err)
+	}
+
+	// A block that no longer hashes to its key is not written back.
+	corrupt := newGobBlock(nil, consensus.PowLimitBits)
+	corrupt.Header.Nonce++
+	dir = t.TempDir()
+	writeGobStore(t, dir, 1, corrupt)
+	if store, err := NewBadgerStore(dir); err == nil {
+		store.Close()
+		t.Fatal("opened a store whose block does not match its hash")
+	}
+}
+
+func TestProcessBlockConnectsOrphans(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	b1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
+	b2 := buildTestBlock(t, hasher, b1, miner, b1.Hash, 0)
+	b3 := buildTestBlock(t, hasher, b2, miner, b2.Hash, 0)
+
+	// Deliver in reverse order.
+	for _, b := range []*types.Block{b3, b2} {
+		if err := chain.ProcessBlock(b, "peer"); err != ErrOrphanBlock {
+			t.Fatalf("ProcessBlock(%d) = %v, want ErrOrphanBlock", b.Header.Height, err)
+		}
+	}
+	if chain.OrphanCount() != 2 {
+		t.Fatalf("orphan count = %d, want 2", chain.OrphanCount())
+	}
+	if root := chain.OrphanRoot(b3.Hash); root != b1.Hash {
+		t.Errorf("orphan root = %x, want B1 %x", root[:4], b1.Hash[:4])
+	}
+
+	if err := chain.ProcessBlock(b1, "peer"); err != nil {
+		t.Fatalf("ProcessBlock(B1) failed: %v", err)
+	}
+	if chain.Tip().Hash != b3.Hash {
+		t.Errorf("tip = height %d, want B3", chain.Height())
+	}
+	if chain.OrphanCount() != 0 {
+		t.Errorf("orphan count = %d, want 0", chain.OrphanCount())
+	}
+}
+
+func TestProcessBlockRejectsForgedOrphans(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	b1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
+	b2 := buildTestBlock(t, hasher, b1, miner, b1.Hash, 0)
+
+	// Junk claiming the hash of B2 is not pooled, so B2 is not mistaken
+	// for a block we already have.
+	junk := &types.Block{
+		Header: types.BlockHeader{Height: 2, PrevBlockHash: types.Hash{0xEE}, Bits: b2.Header.Bits},
+		Hash:   b2.Hash,
+	}
+	if err := chain.ProcessBlock(junk, "attacker"); !errors.Is(err, ErrInvalidBlockHash) {
+		t.Fatalf("ProcessBlock(junk) = %v, want ErrInvalidBlockHash", err)
+	}
+
+	// Nor is a block with its own hash but no proof of work.
+	junk.Hash = junk.ComputeHash()
+	if err := chain.ProcessBlock(junk, "attacker"); !errors.Is(err, ErrPowHashMismatch) {
+		t.Fatalf("ProcessBlock(unworked junk) = %v, want ErrPowHashMismatch", err)
+	}
+	if chain.OrphanCount() != 0 || chain.HaveBlock(b2.Hash) {
+		t.Fatalf("forged orphans were pooled: count %d", chain.OrphanCount())
+	}
+
+	if err := chain.ProcessBlock(b2, "peer"); err != ErrOrphanBlock {
+		t.Fatalf("ProcessBlock(B2) = %v, want ErrOrphanBlock", err)
+	}
+	if err := chain.ProcessBlock(b1, "peer"); err != nil {
+		t.Fatalf("ProcessBlock(B1) failed: %v", err)
+	}
+	if chain.Tip().Hash != b2.Hash {
+		t.Errorf("tip = height %d, want B2", chain.Height())
+	}
+}
+
+func TestProcessBlockConcurrentParentAndChild(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	blocks := []*types.Block{genesis}
+	for i := 0; i < 8; i++ {
+		parent := blocks[len(blocks)-1]
+		blocks = append(blocks, buildTestBlock(t, hasher, parent, miner, parent.Hash, 0))
+	}
+
+	// Deliver each parent and child at the same time: whichever way they
+	// interleave, the child must not be left behind in the orphan pool.
+	for i := 1; i < len(blocks); i += 2 {
+		var wg sync.WaitGroup
+		for _, b := range blocks[i : i+2] {
+			wg.Add(1)
+			go func(b *types.Block) {
+				defer wg.Done()
+				chain.ProcessBlock(b, "peer")
+			}(b)
+		}
+		wg.Wait()
+
+		if tip := chain.Tip(); tip.Hash != blocks[i+1].Hash {
+			t.Fatalf("tip = height %d, want %d", tip.Header.Height, i+1)
+		}
+	}
+	if chain.OrphanCount() != 0 {
+		t.Errorf("orphan count = %d, want 0", chain.OrphanCount())
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	pool := NewOrphanPool()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	orphan := func(i int) *types.Block {
+		return &types.Block{
+			Hash:   types.Hash{byte(i), byte(i >> 8), 0xAA},
+			Header: types.BlockHeader{PrevBlockHash: types.Hash{byte(i), byte(i >> 8), 0xBB}},
+		}
+	}
+
+	// A single source cannot exceed its quota; its oldest orphans are evicted.
+	for i := 0; i < MaxOrphansPerSource+10; i++ {
+		pool.Add(orphan(i), "greedy")
+		now = now.Add(time.Second)
+	}
+	if pool.Len() != MaxOrphansPerSource {
+		t.Fatalf("pool size = %d, want %d", pool.Len(), MaxOrphansPerSource)
+	}
+	if pool.Has(orphan(0).Hash) {
+		t.Error("oldest orphan of the source should have been evicted")
+	}
+
+	// The pool as a whole is bounded.
+	for i := 1000; i < 1000+2*MaxOrphanBlocks; i++ {
+		pool.Add(orphan(i), fmt.Sprintf("peer-%d", i))
+	}
+	if pool.Len() != MaxOrphanBlocks {
+		t.Fatalf("pool size = %d, want %d", pool.Len(), MaxOrphanBlocks)
+	}
+
+	// Everything expires.
+	now = now.Add(OrphanExpiry + time.Minute)
+	pool.Add(orphan(5000), "late")
+	if pool.Len() != 1 {
+		t.Errorf("pool size after expiry = %d, want 1", pool.Len())
+	}
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	miner := types.Hash{0x01}
+	genesisTime := time.Now().Add(-20 * time.Hour).Truncate(time.Second)
+
+	source, sourceStore := mustNewTestChain(t, hasher)
+	defer sourceStore.Close()
+	genesis, err := source.InitGenesis(miner, 1, genesisTime)
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	tip := extendTestChain(t, source, hasher, genesis, miner, 15)
+
+	locator, err := source.BlockLocator(tip.Hash)
+	if err != nil {
+		t.Fatalf("BlockLocator failed: %v", err)
+	}
+	// Heights 15..6 one by one, then 4 and genesis.
+	if len(locator) != 12 || locator[0] != tip.Hash || locator[11] != genesis.Hash {
+		t.Errorf("unexpected locator of %d hashes", len(locator))
+	}
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+	if _, err := chain.InitGenesis(miner, 1, genesisTime); err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	ourLocator, _ := chain.BlockLocator(chain.Tip().Hash)
+	headers := source.LocateHeaders(ourLocator, types.Hash{}, 2000)
+	if len(headers) != 15 || headers[0].Height != 1 {
+		t.Fatalf("LocateHeaders returned %d headers", len(headers))
+	}
+
+	// Broken header runs are rejected.
+	badBits := append([]types.BlockHeader(nil), headers...)
+	badBits[3].Bits++
+	if _, err := chain.ProcessHeaders(badBits); !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("ProcessHeaders with wrong bits = %v, want ErrInvalidBits", err)
+	}
+	if _, err := chain.ProcessHeaders(headers[5:]); !errors.Is(err, ErrParentNotFound) {
+		t.Errorf("ProcessHeaders without parent = %v, want ErrParentNotFound", err)
+	}
+	gap := append(append([]types.BlockHeader(nil), headers[:2]...), headers[3:]...)
+	if _, err := chain.ProcessHeaders(gap); !errors.Is(err, ErrHeadersNotContiguous) {
+		t.Errorf("ProcessHeaders with a gap = %v, want ErrHeadersNotContiguous", err)
+	}
+
+	// The headers before the bad one were kept; the rest are new.
+	added, err := chain.ProcessHeaders(headers)
+	if err != nil {
+		t.Fatalf("ProcessHeaders failed: %v", err)
+	}
+	if added != 12 {
+		t.Errorf("ProcessHeaders added %d headers, want 12", added)
+	}
+	bestHash, bestHeight, _, err := chain.BestHeader()
+	if err != nil || bestHash != tip.Hash || bestHeight != 15 {
+		t.Fatalf("BestHeader = %x at %d (%v), want source tip", bestHash[:4], bestHeight, err)
+	}
+	if chain.Tip().Header.Height != 0 {
+		t.Fatal("headers must not move the tip")
+	}
+
+	// Download the bodies in order.
+	for {
+		missing := chain.MissingBlocks(4)
+		if len(missing) == 0 {
+			break
+		}
+		for _, hash := range missing {
+			block, err := source.GetBlockByHash(hash)
+			if err != nil {
+				t.Fatalf("source lacks block %x: %v", hash[:4], err)
+			}
+			if err := chain.AddBlock(block); err != nil {
+				t.Fatalf("AddBlock %d failed: %v", block.Header.Height, err)
+			}
+		}
+	}
+	if chain.Tip().Hash != tip.Hash {
+		t.Errorf("tip = %x, want source tip", chain.Tip().Hash[:4])
+	}
+	if n := len(chain.headers); n != 0 {
+		t.Errorf("%d headers left in the index after their blocks arrived", n)
+	}
+}
+
+func TestInvalidBodyDropsHeader(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	// B2 pays its miner too much, with a header that commits to it; B3
+	// builds on it. B2' is a valid, lighter fork.
+	b1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
+	b2 := buildTestBlock(t, hasher, b1, miner, b1.Hash, 0)
+	b2.Transactions[0].Amount++
+	b2.Transactions[0].ID = b2.Transactions[0].ComputeID()
+	b2.Header.MerkleRoot = types.ComputeMerkleRoot(b2.Transactions)
+	for {
+		b2.Hash = b2.ComputeHash()
+		if b2.PowHash, err = hasher.Hash(b2.Header.Serialize()); err != nil {
+			t.Fatalf("hasher error: %v", err)
+		}
+		if consensus.MeetsTarget(b2.PowHash, b2.Header.Bits) {
+			break
+		}
+		b2.Header.Nonce++
+	}
+	b3 := buildTestBlock(t, hasher, b2, miner, b2.Hash, 0)
+	alt := buildTestBlock(t, hasher, b1, miner, b1.Hash, 100)
+
+	if _, err := chain.ProcessHeaders([]types.BlockHeader{b1.Header, b2.Header, b3.Header}); err != nil {
+		t.Fatalf("ProcessHeaders failed: %v", err)
+	}
+	if _, err := chain.ProcessHeaders([]types.BlockHeader{b1.Header, alt.Header}); err != nil {
+		t.Fatalf("ProcessHeaders(fork) failed: %v", err)
+	}
+	if best, _, _, _ := chain.BestHeader(); best != b3.Hash {
+		t.Fatalf("best header = %x, want B3", best[:4])
+	}
+
+	if err := chain.AddBlock(b1); err != nil {
+		t.Fatalf("AddBlock(B1) failed: %v", err)
+	}
+	if err := chain.AddBlock(b2); !errors.Is(err, ErrInvalidCoinbaseAmt) {
+		t.Fatalf("AddBlock(B2) = %v, want ErrInvalidCoinbaseAmt", err)
+	}
+
+	// B2 and B3 are gone and B2' is now the block to fetch.
+	if best, _, _, _ := chain.BestHeader(); best != alt.Hash {
+		t.Errorf("best header = %x, want B2'", best[:4])
+	}
+	if missing := chain.MissingBlocks(10); len(missing) != 1 || missing[0] != alt.Hash {
+		t.Errorf("MissingBlocks = %d hashes, want B2'", len(missing))
+	}
+	if _, err := chain.ProcessHeaders([]types.BlockHeader{b3.Header}); !errors.Is(err, ErrKnownInvalid) {
+		t.Errorf("ProcessHeaders(B3) = %v, want ErrKnownInvalid", err)
+	}
+	if err := chain.AddBlock(b3); !errors.Is(err, ErrKnownInvalid) {
+		t.Errorf("AddBlock(B3) = %v, want ErrKnownInvalid", err)
+	}
+
+	// A tampered copy of a valid block does not condemn its header.
+	tampered := *alt
+	coinbase := *alt.Transactions[0]
+	coinbase.Amount++
+	tampered.Transactions = []*types.Transaction{&coinbase}
+	if err := chain.AddBlock(&tampered); !errors.Is(err, ErrInvalidTxID) {
+		t.Fatalf("AddBlock(tampered B2') = %v, want ErrInvalidTxID", err)
+	}
+	if err := chain.AddBlock(alt); err != nil {
+		t.Fatalf("AddBlock(B2') failed: %v", err)
+	}
+	if chain.Tip().Hash != alt.Hash {
+		t.Errorf("tip = height %d, want B2'", chain.Height())
+	}
+}
+
+func TestSideHeadersPruned(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	miner := types.Hash{0x01}
+	genesis, err := chain.InitGenesis(miner, 1, time.Now().Add(-10*time.Hour))
+	if err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+	a1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 0)
+	a2 := buildTestBlock(t, hasher, a1, miner, a1.Hash, 0)
+	s1 := buildTestBlock(t, hasher, genesis, miner, genesis.Hash, 100)
+	if _, err := chain.ProcessHeaders([]types.BlockHeader{a1.Header, a2.Header}); err != nil {
+		t.Fatalf("ProcessHeaders failed: %v", err)
+	}
+	if _, err := chain.ProcessHeaders([]types.BlockHeader{s1.Header}); err != nil {
+		t.Fatalf("ProcessHeaders(side) failed: %v", err)
+	}
+	if len(chain.headers) != 3 {
+		t.Fatalf("index holds %d headers, want 3", len(chain.headers))
+	}
+
+	// Side branches expire; the best header chain stays.
+	chain.mu.Lock()
+	chain.pruneHeaders(time.Now().Add(SideHeaderExpiry + time.Minute))
+	_, haveSide := chain.headers[s1.Hash]
+	n := len(chain.headers)
+	chain.mu.Unlock()
+	if haveSide || n != 2 {
+		t.Errorf("index holds %d headers (side branch kept: %v), want the 2 best", n, haveSide)
+	}
+}
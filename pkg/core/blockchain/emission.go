@@ -8,8 +8,27 @@ func BlockReward(height uint64) types.Amount {
 	return types.BlockReward
 }
 
+// TotalFees returns the sum of the fees of the transfers in txs, which the
+// block's coinbase collects on top of BlockReward. Coinbase transactions are
+// skipped. It returns ErrAmountOverflow if the sum does not fit in an Amount.
+func TotalFees(txs []*types.Transaction) (types.Amount, error) {
+	var total types.Amount
+	for _, tx := range txs {
+		if tx.Type == types.TxTypeCoinbase {
+			continue
+		}
+		if total+tx.Fee < total {
+			return 0, ErrAmountOverflow
+		}
+		total += tx.Fee
+	}
+	return total, nil
+}
+
 // TotalSupplyAtHeight returns the total CHRD emitted after the given block height.
 // Each block emits 1 CHRD, so: TotalSupply = (height + 1) * 1 CHRD.
+// Fees do not change the supply: the coinbase pays them to the miner out of
+// coins debited from the senders in the same block.
 func TotalSupplyAtHeight(height uint64) types.Amount {
 	return types.Amount((height + 1) * uint64(types.BlockReward))
 }
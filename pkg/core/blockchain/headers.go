@@ -0,0 +1,508 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/consensus"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// ErrHeadersNotContiguous is returned by ProcessHeaders when a header does not
+// build on the one before it.
+var ErrHeadersNotContiguous = errors.New("headers are not a contiguous chain")
+
+const (
+	// MaxSideHeaders bounds the indexed headers that are not on the best
+	// header chain. Beyond it the oldest side branches are dropped.
+	MaxSideHeaders = 2000
+
+	// SideHeaderExpiry is how long a header off the best header chain is
+	// kept waiting for its branch to overtake.
+	SideHeaderExpiry = 24 * time.Hour
+
+	// MaxInvalidHeaders bounds the remembered invalid block hashes.
+	MaxInvalidHeaders = 1000
+)
+
+// headerNode is a validated header whose block we don't have yet.
+type headerNode struct {
+	header types.BlockHeader
+	work   *big.Int  // Cumulative work of the chain ending at this header.
+	added  time.Time // When the header was indexed.
+}
+
+// ProcessHeaders validates a contiguous run of headers and adds them to the
+// header index, ahead of their blocks. Each header is checked against its
+// parent like a block would be: height, timestamp, difficulty retarget,
+// proof of work and finality. The first header's parent must be a stored
+// block or an indexed header, or ErrParentNotFound is returned.
+//
+// It returns the number of headers that were new. Headers before an invalid
+// one are kept. Side branches beyond MaxSideHeaders or older than
+// SideHeaderExpiry are dropped.
+func (c *Chain) ProcessHeaders(headers []types.BlockHeader) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.pruneHeaders(time.Now())
+
+	if c.tip == nil {
+		return 0, errors.New("chain not initialized: no genesis block")
+	}
+
+	added := 0
+	var prevHash types.Hash
+	for i := range headers {
+		h := &headers[i]
+		hash := h.ComputeHash()
+		if i > 0 && h.PrevBlockHash != prevHash {
+			return added, ErrHeadersNotContiguous
+		}
+		prevHash = hash
+
+		if c.isInvalid(hash) || c.isInvalid(h.PrevBlockHash) {
+			return added, fmt.Errorf("header %d (%x): %w", h.Height, hash[:8], ErrKnownInvalid)
+		}
+		if c.haveHeader(hash) {
+			continue
+		}
+
+		parent, err := c.headerByHash(h.PrevBlockHash)
+		if err != nil {
+			return added, ErrParentNotFound
+		}
+		if err := c.validateHeader(h, parent, h.PrevBlockHash); err != nil {
+			return added, fmt.Errorf("header %d (%x): %w", h.Height, hash[:8], err)
+		}
+
+		parentWork, err := c.headerWork(h.PrevBlockHash)
+		if err != nil {
+			return added, err
+		}
+		node := &headerNode{
+			header: *h,
+			work:   new(big.Int).Add(parentWork, consensus.CalcWork(h.Bits)),
+			added:  time.Now(),
+		}
+		c.headers[hash] = node
+		if c.bestHeader == nil || node.work.Cmp(c.bestHeader.work) > 0 {
+			c.bestHeader = node
+		}
+		added++
+	}
+	return added, nil
+}
+
+// validateHeader checks a header against its parent. It assumes c.mu is held.
+func (c *Chain) validateHeader(h, parent *types.BlockHeader, parentHash types.Hash) error {
+	if h.Height != parent.Height+1 {
+		return ErrInvalidHeight
+	}
+	if h.Timestamp.Unix() <= parent.Timestamp.Unix() {
+		return ErrTimestampTooOld
+	}
+	if h.Timestamp.After(time.Now().Add(MaxFutureBlockTime)) {
+		return ErrTimestampTooFar
+	}
+	if err := c.checkHeaderFinality(parent, parentHash); err != nil {
+		return err
+	}
+
+	requiredBits, err := consensus.CalcNextRequiredBits(parent, func(height uint64) (*types.BlockHeader, error) {
+		_, ancestor, err := c.ancestorHeader(parentHash, parent, height)
+		return ancestor, err
+	})
+	if err != nil {
+		return err
+	}
+	if h.Bits != requiredBits {
+		return fmt.Errorf("%w: got bits %08x, required %08x", ErrInvalidBits, h.Bits, requiredBits)
+	}
+
+	powHash, err := c.hasher.Hash(h.Serialize())
+	if err != nil {
+		return err
+	}
+	if !consensus.MeetsTarget(powHash, h.Bits) {
+		return ErrInvalidPoW
+	}
+	return nil
+}
+
+// checkHeaderFinality is checkFinality for a header's parent. It assumes
+// c.mu is held.
+func (c *Chain) checkHeaderFinality(parent *types.BlockHeader, parentHash types.Hash) error {
+	finalized := c.finalizedHeight()
+	if parentHash == c.tip.Hash || finalized == 0 {
+		return nil
+	}
+	if parent.Height < finalized {
+		return fmt.Errorf("%w: parent height %d, finalized height %d", ErrFinalizedFork, parent.Height, finalized)
+	}
+	ancestorHash, _, err := c.ancestorHeader(parentHash, parent, finalized)
+	if err != nil {
+		return err
+	}
+	final, err := c.store.GetBlockByHeight(finalized)
+	if err != nil {
+		return err
+	}
+	if ancestorHash != final.Hash {
+		return fmt.Errorf("%w: fork below finalized height %d", ErrFinalizedFork, finalized)
+	}
+	return nil
+}
+
+// haveHeader reports whether hash is an indexed header or a stored block.
+// It assumes c.mu is held.
+func (c *Chain) haveHeader(hash types.Hash) bool {
+	_, err := c.headerByHash(hash)
+	return err == nil
+}
+
+// headerByHash returns the header of an indexed header or a stored block.
+// It assumes c.mu is held.
+func (c *Chain) headerByHash(hash types.Hash) (*types.BlockHeader, error) {
+	if node, ok := c.headers[hash]; ok {
+		return &node.header, nil
+	}
+	block, err := c.store.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block.Header, nil
+}
+
+// headerWork returns the cumulative work of an indexed header or a stored
+// block. It assumes c.mu is held.
+func (c *Chain) headerWork(hash types.Hash) (*big.Int, error) {
+	if node, ok := c.headers[hash]; ok {
+		return node.work, nil
+	}
+	return c.store.GetCumulativeWork(hash)
+}
+
+// isCanonical reports whether hash is the canonical block at height.
+// It assumes c.mu is held.
+func (c *Chain) isCanonical(hash types.Hash, height uint64) bool {
+	if height > c.tip.Header.Height {
+		return false
+	}
+	block, err := c.store.GetBlockByHeight(height)
+	return err == nil && block.Hash == hash
+}
+
+// ancestorHeader returns the ancestor at height of the header h (whose hash
+// is hash), walking back through indexed headers and stored blocks until it
+// reaches the canonical chain, whose height index is used for the rest.
+// It assumes c.mu is held.
+func (c *Chain) ancestorHeader(hash types.Hash, h *types.BlockHeader, height uint64) (types.Hash, *types.BlockHeader, error) {
+	if height > h.Height {
+		return types.Hash{}, nil, errors.New("target height is higher than start header")
+	}
+	for h.Height > height {
+		if c.isCanonical(hash, h.Height) {
+			block, err := c.store.GetBlockByHeight(height)
+			if err != nil {
+				return types.Hash{}, nil, err
+			}
+			return block.Hash, &block.Header, nil
+		}
+		parent, err := c.headerByHash(h.PrevBlockHash)
+		if err != nil {
+			return types.Hash{}, nil, err
+		}
+		hash, h = h.PrevBlockHash, parent
+	}
+	return hash, h, nil
+}
+
+// forgetHeader drops a header from the index once its block is stored.
+// It assumes c.mu is held.
+func (c *Chain) forgetHeader(hash types.Hash) {
+	delete(c.headers, hash)
+}
+
+// isInvalid reports whether hash is a block known to be invalid. It assumes
+// c.mu is held.
+func (c *Chain) isInvalid(hash types.Hash) bool {
+	_, ok := c.invalid[hash]
+	return ok
+}
+
+// condemnsHeader reports whether err, returned by checkBlock for block,
+// shows that no block with block's header can be valid. Errors that a peer
+// can cause by tampering with a valid block's body don't: the header's
+// commitment to the transactions only covers their IDs, and the IDs don't
+// cover the signatures. Neither do errors that depend on our clock, our
+// finality rule or our storage.
+func condemnsHeader(block *types.Block, err error) bool {
+	var txErr *TxError
+	switch {
+	case errors.Is(err, ErrInvalidHeight),
+		errors.Is(err, ErrInvalidPrevHash),
+		errors.Is(err, ErrTimestampTooOld),
+		errors.Is(err, ErrInvalidBits),
+		errors.Is(err, ErrInvalidPoW):
+		return true
+	case errors.Is(err, ErrInvalidTxSignature), errors.Is(err, ErrInvalidTxID):
+		return false
+	case errors.As(err, &txErr),
+		errors.Is(err, ErrNoCoinbaseTx),
+		errors.Is(err, ErrInvalidCoinbasePos),
+		errors.Is(err, ErrInvalidCoinbaseAmt),
+		errors.Is(err, ErrAmountOverflow):
+		// Only if these are the transactions the header commits to.
+		if types.ComputeMerkleRoot(block.Transactions) != block.Header.MerkleRoot {
+			return false
+		}
+		for _, tx := range block.Transactions {
+			if tx.ID != tx.ComputeID() {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidateHeader records that the block with header hash hash and its
+// descendants are invalid, and drops them from the header index. It assumes
+// c.mu is held.
+func (c *Chain) invalidateHeader(hash types.Hash) {
+	for _, h := range c.dropBranch(hash) {
+		if len(c.invalid) >= MaxInvalidHeaders {
+			for old := range c.invalid {
+				delete(c.invalid, old)
+				break
+			}
+		}
+		c.invalid[h] = struct{}{}
+	}
+}
+
+// dropBranch drops hash and its descendants from the header index, picks
+// the best header again, and returns the dropped hashes. It assumes c.mu is
+// held.
+func (c *Chain) dropBranch(hash types.Hash) []types.Hash {
+	dropped := c.dropHeaders(hash)
+	if c.bestHeader != nil {
+		if _, ok := c.headers[c.bestHeader.header.ComputeHash()]; ok {
+			return dropped
+		}
+	}
+	c.bestHeader = nil
+	for _, node := range c.headers {
+		if c.bestHeader == nil || node.work.Cmp(c.bestHeader.work) > 0 {
+			c.bestHeader = node
+		}
+	}
+	return dropped
+}
+
+// dropHeaders removes hash and every indexed header descending from it
+// from the index, and returns their hashes, hash first. It assumes c.mu is
+// held.
+func (c *Chain) dropHeaders(hash types.Hash) []types.Hash {
+	children := make(map[types.Hash][]types.Hash)
+	for h, node := range c.headers {
+		children[node.header.PrevBlockHash] = append(children[node.header.PrevBlockHash], h)
+	}
+	dropped := []types.Hash{hash}
+	for i := 0; i < len(dropped); i++ {
+		delete(c.headers, dropped[i])
+		dropped = append(dropped, children[dropped[i]]...)
+	}
+	return dropped
+}
+
+// pruneHeaders drops the branches of the header index that are not on the
+// best header chain once they are older than SideHeaderExpiry, and the
+// oldest of them while there are more than MaxSideHeaders. It assumes c.mu
+// is held.
+func (c *Chain) pruneHeaders(now time.Time) {
+	onBest := make(map[types.Hash]bool)
+	if c.bestHeader != nil {
+		hash := c.bestHeader.header.ComputeHash()
+		for {
+			node, ok := c.headers[hash]
+			if !ok {
+				break
+			}
+			onBest[hash] = true
+			hash = node.header.PrevBlockHash
+		}
+	}
+	if len(c.headers) == len(onBest) {
+		return
+	}
+
+	// A header off the best chain only has descendants off it too, so
+	// dropping a branch never touches the best chain.
+	var side []types.Hash
+	for h := range c.headers {
+		if !onBest[h] {
+			side = append(side, h)
+		}
+	}
+	sort.Slice(side, func(i, j int) bool {
+		return c.headers[side[i]].added.Before(c.headers[side[j]].added)
+	})
+	remaining := len(side)
+	for _, h := range side {
+		node, ok := c.headers[h]
+		if !ok {
+			continue // Dropped with an older ancestor.
+		}
+		if remaining <= MaxSideHeaders && now.Sub(node.added) < SideHeaderExpiry {
+			break
+		}
+		remaining -= len(c.dropHeaders(h))
+	}
+}
+
+// BestHeader returns the hash, height and cumulative work of the header with
+// the most work, whether or not its block is available yet.
+func (c *Chain) BestHeader() (types.Hash, uint64, *big.Int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.tip == nil {
+		return types.Hash{}, 0, nil, errors.New("chain not initialized: no genesis block")
+	}
+	tipWork, err := c.store.GetCumulativeWork(c.tip.Hash)
+	if err != nil {
+		return types.Hash{}, 0, nil, err
+	}
+	if c.bestHeader != nil && c.bestHeader.work.Cmp(tipWork) > 0 {
+		return c.bestHeader.header.ComputeHash(), c.bestHeader.header.Height, c.bestHeader.work, nil
+	}
+	return c.tip.Hash, c.tip.Header.Height, tipWork, nil
+}
+
+// MissingBlocks returns up to max hashes of blocks on the best header chain
+// that are neither stored nor in the orphan pool, lowest first.
+func (c *Chain) MissingBlocks(max int) []types.Hash {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.bestHeader == nil {
+		return nil
+	}
+	tipWork, err := c.store.GetCumulativeWork(c.tip.Hash)
+	if err != nil || c.bestHeader.work.Cmp(tipWork) <= 0 {
+		return nil
+	}
+
+	// Walk back from the best header to the first block we have.
+	var missing []types.Hash
+	hash := c.bestHeader.header.ComputeHash()
+	for {
+		node, ok := c.headers[hash]
+		if !ok {
+			break
+		}
+		if !c.orphans.Has(hash) {
+			missing = append(missing, hash)
+		}
+		hash = node.header.PrevBlockHash
+	}
+
+	// Reverse into ascending order and keep the lowest max.
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	if len(missing) > max {
+		missing = missing[:max]
+	}
+	return missing
+}
+
+// BlockLocator returns hashes describing the chain ending at hash, for a
+// peer to find where its chain forks from ours: the 10 most recent blocks,
+// then exponentially sparser ones back to genesis, which is always last.
+// hash must be an indexed header or a stored block.
+func (c *Chain) BlockLocator(hash types.Hash) ([]types.Hash, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	h, err := c.headerByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var locator []types.Hash
+	step := uint64(1)
+	for {
+		locator = append(locator, hash)
+		if h.Height == 0 {
+			return locator, nil
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		target := uint64(0)
+		if h.Height > step {
+			target = h.Height - step
+		}
+		hash, h, err = c.ancestorHeader(hash, h, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// LocateHeaders returns the canonical headers following the first locator
+// hash on our canonical chain (or genesis if none is), up to and including
+// stop, at most max of them.
+func (c *Chain) LocateHeaders(locator []types.Hash, stop types.Hash, max int) []types.BlockHeader {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.tip == nil {
+		return nil
+	}
+	start := uint64(0)
+	for _, hash := range locator {
+		block, err := c.store.GetBlockByHash(hash)
+		if err != nil {
+			continue
+		}
+		if c.isCanonical(hash, block.Header.Height) {
+			start = block.Header.Height
+			break
+		}
+	}
+
+	var headers []types.BlockHeader
+	for height := start + 1; height <= c.tip.Header.Height && len(headers) < max; height++ {
+		block, err := c.store.GetBlockByHeight(height)
+		if err != nil {
+			break
+		}
+		headers = append(headers, block.Header)
+		if block.Hash == stop {
+			break
+		}
+	}
+	return headers
+}
+
+// HaveHeader reports whether hash is a validated header or a stored block.
+func (c *Chain) HaveHeader(hash types.Hash) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.haveHeader(hash)
+}
+
+// HeaderWork returns the cumulative work of the chain ending at hash, which
+// must be a validated header or a stored block.
+func (c *Chain) HeaderWork(hash types.Hash) (*big.Int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headerWork(hash)
+}
@@ -0,0 +1,320 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/consensus"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// schemaVersion is the current on-disk layout version of BadgerStore.
+// Stores without a "meta:version" key are version 0.
+const schemaVersion uint32 = 2
+
+// migrations[i] upgrades a store from version i to version i+1.
+var migrations = []func(db *badger.DB) error{
+	migrateCumulativeWork,
+	migrateBlockEncoding,
+}
+
+// migrate brings the store up to schemaVersion, one step at a time.
+func (s *BadgerStore) migrate() error {
+	version, err := s.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("store schema version %d is newer than supported version %d", version, schemaVersion)
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	// A new store has nothing to migrate.
+	empty, err := s.hasNoBlocks()
+	if err != nil {
+		return err
+	}
+	if empty {
+		return s.setSchemaVersion(schemaVersion)
+	}
+
+	for ; version < schemaVersion; version++ {
+		log.Printf("Migrating block store from schema v%d to v%d...", version, version+1)
+		if err := migrations[version](s.db); err != nil {
+			return fmt.Errorf("migration to v%d: %w", version+1, err)
+		}
+		if err := s.setSchemaVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasNoBlocks reports whether the store holds no blocks.
+func (s *BadgerStore) hasNoBlocks() (bool, error) {
+	empty := true
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte("block:hash:")
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: false})
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+func (s *BadgerStore) getSchemaVersion() (uint32, error) {
+	var version uint32
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("meta:version"))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 4 {
+				return errors.New("invalid schema version length")
+			}
+			version = binary.BigEndian.Uint32(val)
+			return nil
+		})
+	})
+	return version, err
+}
+
+func (s *BadgerStore) setSchemaVersion(version uint32) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, version)
+		return txn.Set([]byte("meta:version"), buf)
+	})
+}
+
+// ErrStoreTooOld is returned when opening a store whose blocks predate
+// compact difficulty targets. Their hashes commit to the old header layout,
+// so they cannot be converted; the node has to sync from scratch.
+var ErrStoreTooOld = errors.New("block store predates compact difficulty targets and must be resynced")
+
+// gobBlock, gobHeader and gobTransaction freeze the layout of the blocks
+// that schema v0 and v1 stores gob-encode under "block:hash:". Blocks
+// written before compact targets carry Difficulty and no Bits; gob matches
+// fields by name, so both kinds decode.
+type gobBlock struct {
+	Header       gobHeader
+	Transactions []*gobTransaction
+	Hash         types.Hash
+	PowHash      types.Hash
+}
+
+type gobHeader struct {
+	Version       uint32
+	Height        uint64
+	Timestamp     time.Time
+	PrevBlockHash types.Hash
+	MerkleRoot    types.Hash
+	Difficulty    uint64 // Before compact targets only.
+	Bits          uint32
+	Nonce         uint64
+}
+
+type gobTransaction struct {
+	ID        types.Hash
+	Type      uint8
+	Timestamp time.Time
+	From      types.Hash
+	To        types.Hash
+	Amount    uint64
+	Fee       uint64
+	Nonce     uint64
+	Signature []byte
+}
+
+// decodeGobBlock decodes a gob-encoded block stored by a v0 or v1 store.
+func decodeGobBlock(val []byte) (*types.Block, error) {
+	var g gobBlock
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&g); err != nil {
+		return nil, err
+	}
+	if g.Header.Bits == 0 {
+		return nil, fmt.Errorf("%w: block %x has difficulty %d and no target", ErrStoreTooOld, g.Hash[:8], g.Header.Difficulty)
+	}
+
+	b := &types.Block{
+		Header: types.BlockHeader{
+			Version:       g.Header.Version,
+			Height:        g.Header.Height,
+			Timestamp:     g.Header.Timestamp,
+			PrevBlockHash: g.Header.PrevBlockHash,
+			MerkleRoot:    g.Header.MerkleRoot,
+			Bits:          g.Header.Bits,
+			Nonce:         g.Header.Nonce,
+		},
+		Hash:    g.Hash,
+		PowHash: g.PowHash,
+	}
+	if b.ComputeHash() != g.Hash {
+		return nil, fmt.Errorf("block %x does not match its header after conversion", g.Hash[:8])
+	}
+	for _, tx := range g.Transactions {
+		b.Transactions = append(b.Transactions, &types.Transaction{
+			ID:        tx.ID,
+			Type:      types.TxType(tx.Type),
+			Timestamp: tx.Timestamp,
+			From:      tx.From,
+			To:        tx.To,
+			Amount:    types.Amount(tx.Amount),
+			Fee:       types.Amount(tx.Fee),
+			Nonce:     tx.Nonce,
+			Signature: tx.Signature,
+		})
+	}
+	return b, nil
+}
+
+// migrateCumulativeWork (v0 -> v1) replaces the little-endian uint64
+// "block:cdf:<hash>" entries, which summed difficulties, with big-integer
+// "block:work:<hash>" entries recomputed from the stored headers: the sum
+// of consensus.CalcWork(Bits) from genesis, as the chain computes it.
+func migrateCumulativeWork(db *badger.DB) error {
+	headers := make(map[types.Hash]*types.BlockHeader)
+	var legacyKeys [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte("block:hash:")
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var block *types.Block
+			err := it.Item().Value(func(val []byte) error {
+				var err error
+				block, err = decodeGobBlock(val)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("decode gob block %s: %w", it.Item().Key()[len(prefix):], err)
+			}
+			headers[block.Hash] = &block.Header
+		}
+
+		cdf := txn.NewIterator(badger.IteratorOptions{Prefix: []byte("block:cdf:"), PrefetchValues: false})
+		defer cdf.Close()
+		for cdf.Rewind(); cdf.Valid(); cdf.Next() {
+			legacyKeys = append(legacyKeys, cdf.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sum the work along each block's ancestry, reusing what is known.
+	work := make(map[types.Hash]*big.Int, len(headers))
+	for hash := range headers {
+		var path []types.Hash
+		base := new(big.Int)
+		for h := hash; ; {
+			if w, ok := work[h]; ok {
+				base = w
+				break
+			}
+			header, ok := headers[h]
+			if !ok {
+				return fmt.Errorf("block %x: ancestor %x not in store", hash[:8], h[:8])
+			}
+			path = append(path, h)
+			if header.PrevBlockHash.IsZero() {
+				break
+			}
+			h = header.PrevBlockHash
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			base = new(big.Int).Add(base, consensus.CalcWork(headers[path[i]].Bits))
+			work[path[i]] = base
+		}
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for hash, w := range work {
+		if err := wb.Set(workKey(hash), w.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, key := range legacyKeys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// migrateBlockEncoding (v1 -> v2) re-encodes the gob "block:hash:<hash>"
+// entries with the canonical binary encoding. The write batch may be cut
+// short by a crash before the version is bumped, so entries already in the
+// binary encoding are left as they are when the step runs again.
+func migrateBlockEncoding(db *badger.DB) error {
+	prefix := []byte("block:hash:")
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+
+			var block *types.Block
+			err := item.Value(func(val []byte) error {
+				if isBinaryBlock(key, val) {
+					return nil
+				}
+				var err error
+				block, err = decodeGobBlock(val)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("decode gob block %s: %w", key[len(prefix):], err)
+			}
+			if block == nil {
+				continue // Converted by an earlier, interrupted run.
+			}
+
+			val, err := block.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := wb.Set(key, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// isBinaryBlock reports whether val, stored under key, is the binary
+// encoding of the block the key names.
+func isBinaryBlock(key, val []byte) bool {
+	var b types.Block
+	if err := b.UnmarshalBinary(val); err != nil {
+		return false
+	}
+	hash := b.ComputeHash()
+	return b.Hash == hash && string(key) == fmt.Sprintf("block:hash:%x", hash)
+}
@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+const (
+	// MaxOrphanBlocks bounds the total number of orphan blocks held in memory.
+	MaxOrphanBlocks = 200
+
+	// MaxOrphansPerSource bounds how many orphans a single peer can park in the pool.
+	MaxOrphansPerSource = 50
+
+	// OrphanExpiry is how long an orphan waits for its parent before being dropped.
+	OrphanExpiry = 20 * time.Minute
+)
+
+// orphanBlock is a block whose parent was not yet known when it arrived.
+type orphanBlock struct {
+	block   *types.Block
+	source  string // Peer that sent the block.
+	expires time.Time
+}
+
+// OrphanPool holds blocks whose parent is unknown, keyed by PrevBlockHash,
+// until the parent arrives. It is bounded both globally and per source.
+type OrphanPool struct {
+	mu       sync.Mutex
+	orphans  map[types.Hash]*orphanBlock   // By block hash.
+	byParent map[types.Hash][]*orphanBlock // By PrevBlockHash.
+	bySource map[string][]*orphanBlock     // Oldest first.
+	now      func() time.Time
+}
+
+// NewOrphanPool creates an empty orphan pool.
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans:  make(map[types.Hash]*orphanBlock),
+		byParent: make(map[types.Hash][]*orphanBlock),
+		bySource: make(map[string][]*orphanBlock),
+		now:      time.Now,
+	}
+}
+
+// Add stores an orphan block received from source. If the source is at its
+// limit its oldest orphan is evicted; if the pool is full the oldest orphan
+// overall is evicted.
+func (op *OrphanPool) Add(block *types.Block, source string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if _, ok := op.orphans[block.Hash]; ok {
+		return
+	}
+
+	now := op.now()
+	op.expireLocked(now)
+
+	if len(op.bySource[source]) >= MaxOrphansPerSource {
+		op.removeLocked(op.bySource[source][0])
+	}
+	if len(op.orphans) >= MaxOrphanBlocks {
+		op.removeLocked(op.oldestLocked())
+	}
+
+	o := &orphanBlock{
+		block:   block,
+		source:  source,
+		expires: now.Add(OrphanExpiry),
+	}
+	op.orphans[block.Hash] = o
+	op.byParent[block.Header.PrevBlockHash] = append(op.byParent[block.Header.PrevBlockHash], o)
+	op.bySource[source] = append(op.bySource[source], o)
+}
+
+// Has reports whether the block is held in the pool.
+func (op *OrphanPool) Has(hash types.Hash) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	_, ok := op.orphans[hash]
+	return ok
+}
+
+// Len returns the number of orphans in the pool.
+func (op *OrphanPool) Len() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return len(op.orphans)
+}
+
+// Root follows the PrevBlockHash links of orphans starting at hash and
+// returns the first ancestor hash that is not itself an orphan: the block
+// that must be fetched to connect the orphan chain.
+func (op *OrphanPool) Root(hash types.Hash) types.Hash {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	for {
+		o, ok := op.orphans[hash]
+		if !ok {
+			return hash
+		}
+		hash = o.block.Header.PrevBlockHash
+	}
+}
+
+// TakeChildren removes and returns the orphans whose parent is parentHash.
+func (op *OrphanPool) TakeChildren(parentHash types.Hash) []*types.Block {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	children := op.byParent[parentHash]
+	blocks := make([]*types.Block, 0, len(children))
+	for _, o := range append([]*orphanBlock(nil), children...) {
+		blocks = append(blocks, o.block)
+		op.removeLocked(o)
+	}
+	return blocks
+}
+
+// expireLocked drops every orphan past its expiry. Assumes op.mu is held.
+func (op *OrphanPool) expireLocked(now time.Time) {
+	for _, o := range op.orphans {
+		if now.After(o.expires) {
+			op.removeLocked(o)
+		}
+	}
+}
+
+// oldestLocked returns the orphan closest to expiry. Assumes op.mu is held
+// and the pool is not empty.
+func (op *OrphanPool) oldestLocked() *orphanBlock {
+	var oldest *orphanBlock
+	for _, o := range op.orphans {
+		if oldest == nil || o.expires.Before(oldest.expires) {
+			oldest = o
+		}
+	}
+	return oldest
+}
+
+// removeLocked deletes an orphan from every index. Assumes op.mu is held.
+func (op *OrphanPool) removeLocked(o *orphanBlock) {
+	delete(op.orphans, o.block.Hash)
+
+	parent := o.block.Header.PrevBlockHash
+	op.byParent[parent] = removeOrphan(op.byParent[parent], o)
+	if len(op.byParent[parent]) == 0 {
+		delete(op.byParent, parent)
+	}
+
+	op.bySource[o.source] = removeOrphan(op.bySource[o.source], o)
+	if len(op.bySource[o.source]) == 0 {
+		delete(op.bySource, o.source)
+	}
+}
+
+func removeOrphan(list []*orphanBlock, o *orphanBlock) []*orphanBlock {
+	for i, x := range list {
+		if x == o {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
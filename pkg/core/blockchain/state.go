@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// Account is the state of a single address.
+type Account struct {
+	Balance  types.Amount // Spendable balance: transfers and matured coinbase, minus debits.
+	Nonce    uint64       // Number of transfers sent; the next transfer must use this nonce.
+	Immature []UTXO       // Coinbase outputs that had not matured when the account was last touched.
+}
+
+// SpendableAt returns the balance that can be spent in a block at the given height.
+func (a *Account) SpendableAt(height uint64) types.Amount {
+	return a.Balance + SpendableBalance(a.Immature, height)
+}
+
+// mature moves every immature coinbase output spendable at height into Balance.
+func (a *Account) mature(height uint64) {
+	remaining := a.Immature[:0]
+	for _, u := range a.Immature {
+		if IsMature(u.BlockHeight, height) {
+			a.Balance += u.Amount
+		} else {
+			remaining = append(remaining, u)
+		}
+	}
+	a.Immature = remaining
+}
+
+// clone returns a deep copy of the account.
+func (a *Account) clone() *Account {
+	c := *a
+	if a.Immature != nil {
+		c.Immature = append([]UTXO(nil), a.Immature...)
+	}
+	return &c
+}
+
+// AccountReader provides read access to account state.
+// Unknown addresses return an empty account, not an error.
+type AccountReader interface {
+	GetAccount(addr types.Hash) (*Account, error)
+}
+
+// AccountUndo records the state of an account before a block touched it,
+// so that disconnecting the block can restore it.
+type AccountUndo struct {
+	Addr    types.Hash
+	Account *Account // nil if the account did not exist before the block.
+}
+
+// emptyState is the account state before the genesis block.
+type emptyState struct{}
+
+func (emptyState) GetAccount(types.Hash) (*Account, error) {
+	return &Account{}, nil
+}
+
+// StateView is an in-memory overlay of account changes on top of an AccountReader.
+// The base is never modified.
+type StateView struct {
+	base     AccountReader
+	accounts map[types.Hash]*Account
+}
+
+// NewStateView creates an empty overlay on top of base.
+func NewStateView(base AccountReader) *StateView {
+	return &StateView{
+		base:     base,
+		accounts: make(map[types.Hash]*Account),
+	}
+}
+
+// GetAccount returns the account as seen through the overlay.
+// The returned account is owned by the view and must not be modified by callers.
+func (v *StateView) GetAccount(addr types.Hash) (*Account, error) {
+	return v.account(addr)
+}
+
+// account loads addr into the overlay (copying it from the base) and returns it.
+func (v *StateView) account(addr types.Hash) (*Account, error) {
+	if acc, ok := v.accounts[addr]; ok {
+		return acc, nil
+	}
+	acc, err := v.base.GetAccount(addr)
+	if err != nil {
+		return nil, err
+	}
+	acc = acc.clone()
+	v.accounts[addr] = acc
+	return acc, nil
+}
+
+// restore overwrites accounts in the view with their pre-block state.
+func (v *StateView) restore(undo []AccountUndo) {
+	for _, u := range undo {
+		if u.Account == nil {
+			v.accounts[u.Addr] = &Account{}
+			continue
+		}
+		v.accounts[u.Addr] = u.Account.clone()
+	}
+}
+
+// applyBlock applies every transaction in block without validating it.
+// Only use this for blocks that have already passed ValidateBlockTransactions.
+func (v *StateView) applyBlock(block *types.Block) error {
+	for _, tx := range block.Transactions {
+		if err := v.applyTransaction(tx, block.Header.Height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTransaction applies a single transaction included at the given height.
+// Coinbase outputs are credited as immature; transfers debit the sender
+// (amount + fee), bump its nonce and credit the recipient.
+func (v *StateView) applyTransaction(tx *types.Transaction, height uint64) error {
+	if tx.Type == types.TxTypeCoinbase {
+		to, err := v.account(tx.To)
+		if err != nil {
+			return err
+		}
+		to.Immature = append(to.Immature, UTXO{
+			TxID:          tx.ID,
+			BlockHeight:   height,
+			Amount:        tx.Amount,
+			RecipientAddr: tx.To,
+		})
+		return nil
+	}
+
+	from, err := v.account(tx.From)
+	if err != nil {
+		return err
+	}
+	from.mature(height)
+	from.Balance -= tx.Amount + tx.Fee
+	from.Nonce++
+
+	to, err := v.account(tx.To)
+	if err != nil {
+		return err
+	}
+	to.Balance += tx.Amount
+	return nil
+}
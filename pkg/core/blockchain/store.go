@@ -2,10 +2,11 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/big"
+	"strconv"
 	"sync"
 
 	"github.com/chronodrachma/chrd/pkg/core/types"
@@ -14,6 +15,7 @@ import (
 
 var (
 	ErrBlockNotFoundInStore = errors.New("block not found in store")
+	ErrUndoNotFound         = errors.New("state undo data not found")
 )
 
 // BlockStore defines the interface for persistent block storage.
@@ -25,18 +27,65 @@ type BlockStore interface {
 	GetBlockByHeight(height uint64) (*types.Block, error)
 
 	// SetCanonical maps a height to a block hash, defining the canonical chain.
+	// Normal chain updates go through CommitChainUpdate; this is for repairs.
 	SetCanonical(height uint64, hash types.Hash) error
 
+	// TrimCanonical deletes the canonical height entries above 'height' (and any
+	// malformed ones) and returns how many were removed.
+	TrimCanonical(height uint64) (int, error)
+
 	SaveHead(hash types.Hash) error
 	GetHead() (types.Hash, error)
 
-	// Cumulative Difficulty (CDF) storage
-	SaveCumulativeDifficulty(hash types.Hash, cd uint64) error
-	GetCumulativeDifficulty(hash types.Hash) (uint64, error)
+	// CommitChainUpdate moves the canonical chain in a single transaction:
+	// it disconnects and connects the account state of the given blocks,
+	// rewrites their canonical height entries and saves the new head.
+	// Either all of it is persisted or none of it is.
+	CommitChainUpdate(update *ChainUpdate) error
+
+	// Cumulative chain work storage: the total expected work from genesis
+	// up to and including the block, as an arbitrary-precision integer.
+	SaveCumulativeWork(hash types.Hash, work *big.Int) error
+	GetCumulativeWork(hash types.Hash) (*big.Int, error)
+
+	// Account state index. GetAccount returns an empty account for unknown addresses.
+	GetAccount(addr types.Hash) (*Account, error)
+
+	// ConnectState atomically writes the accounts changed by block 'hash',
+	// records their previous values as undo data and moves the state tip to 'hash'.
+	// It does not touch the canonical index or the head (see CommitChainUpdate).
+	ConnectState(hash types.Hash, accounts map[types.Hash]*Account) error
+
+	// GetStateUndo returns the undo data recorded when block 'hash' was connected.
+	GetStateUndo(hash types.Hash) ([]AccountUndo, error)
+
+	// GetStateTip returns the hash of the last block applied to the account state.
+	GetStateTip() (types.Hash, error)
+
+	// ResetState deletes the whole account state index and its undo data.
+	ResetState() error
 
 	Close() error
 }
 
+// ChainUpdate describes a switch of the canonical chain between two tips
+// that share a common ancestor.
+type ChainUpdate struct {
+	Disconnect []*types.Block // Blocks leaving the canonical chain, highest first.
+	Connect    []*types.Block // Blocks joining the canonical chain, lowest first.
+}
+
+// newHead returns the hash of the head after the update.
+func (u *ChainUpdate) newHead() (types.Hash, error) {
+	if len(u.Connect) > 0 {
+		return u.Connect[len(u.Connect)-1].Hash, nil
+	}
+	if len(u.Disconnect) > 0 {
+		return u.Disconnect[len(u.Disconnect)-1].Header.PrevBlockHash, nil
+	}
+	return types.Hash{}, errors.New("empty chain update")
+}
+
 // BadgerStore implements BlockStore using BadgerDB.
 type BadgerStore struct {
 	db *badger.DB
@@ -58,20 +107,36 @@ func NewBadgerStore(path string) (*BadgerStore, error) {
 		return nil, err
 	}
 
-	return &BadgerStore{
+	s := &BadgerStore{
 		db: db,
-	}, nil
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store migration failed: %w", err)
+	}
+	return s, nil
 }
 
 func (s *BadgerStore) Close() error {
 	return s.db.Close()
 }
 
+// DB returns the underlying database, for components that keep their own
+// keys next to the chain (such as the P2P address book under "p2p:").
+func (s *BadgerStore) DB() *badger.DB {
+	return s.db
+}
+
 // Keys:
-// Block by Hash:   "block:hash:<hash>" -> serialized block
+// Block by Hash:   "block:hash:<hash>" -> block binary encoding (types.Block.MarshalBinary)
 // Block by Height: "block:height:<height>" -> hash
 // Head:            "chain:head" -> hash
-// CDF:             "block:cdf:<hash>" -> uint64
+// Chain work:      "block:work:<hash>" -> big-endian big.Int bytes
+// Schema version:  "meta:version" -> uint32 (see migrations.go)
+// Account:         "account:<addr>" -> serialized Account
+// State undo:      "state:undo:<hash>" -> serialized []AccountUndo
+// State tip:       "state:tip" -> hash
+// Peer addresses:  "p2p:addr:<host:port>" -> owned by p2p.AddrManager
 
 func (s *BadgerStore) SaveBlock(block *types.Block) error {
 	s.mu.Lock()
@@ -79,12 +144,10 @@ func (s *BadgerStore) SaveBlock(block *types.Block) error {
 
 	return s.db.Update(func(txn *badger.Txn) error {
 		// 1. Serialize block
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		if err := enc.Encode(block); err != nil {
+		serializedBlock, err := block.MarshalBinary()
+		if err != nil {
 			return err
 		}
-		serializedBlock := buf.Bytes()
 
 		// 2. Save by Hash
 		hashKey := fmt.Sprintf("block:hash:%x", block.Hash)
@@ -103,9 +166,38 @@ func (s *BadgerStore) SetCanonical(height uint64, hash types.Hash) error {
 	defer s.mu.Unlock()
 
 	return s.db.Update(func(txn *badger.Txn) error {
-		heightKey := fmt.Sprintf("block:height:%d", height)
-		return txn.Set([]byte(heightKey), hash[:])
+		return txn.Set(heightKey(height), hash[:])
+	})
+}
+
+func (s *BadgerStore) TrimCanonical(height uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := []byte("block:height:")
+	trimmed := 0
+	err := s.db.Update(func(txn *badger.Txn) error {
+		// Entries above the head need not be contiguous, so scan them all.
+		var stale [][]byte
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			h, err := strconv.ParseUint(string(key[len(prefix):]), 10, 64)
+			if err != nil || h > height {
+				stale = append(stale, key)
+			}
+		}
+		it.Close()
+
+		for _, key := range stale {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		trimmed = len(stale)
+		return nil
 	})
+	return trimmed, err
 }
 
 func (s *BadgerStore) GetBlockByHash(hash types.Hash) (*types.Block, error) {
@@ -124,8 +216,7 @@ func (s *BadgerStore) GetBlockByHash(hash types.Hash) (*types.Block, error) {
 		}
 
 		return item.Value(func(val []byte) error {
-			dec := gob.NewDecoder(bytes.NewReader(val))
-			return dec.Decode(&block)
+			return block.UnmarshalBinary(val)
 		})
 	})
 
@@ -146,8 +237,7 @@ func (s *BadgerStore) GetBlockByHeight(height uint64) (*types.Block, error) {
 	s.mu.RLock()
 	var hash types.Hash
 	err := s.db.View(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("block:height:%d", height)
-		item, err := txn.Get([]byte(key))
+		item, err := txn.Get(heightKey(height))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
 				return ErrBlockNotFoundInStore
@@ -190,36 +280,260 @@ func (s *BadgerStore) GetHead() (types.Hash, error) {
 	return hash, err
 }
 
-func (s *BadgerStore) SaveCumulativeDifficulty(hash types.Hash, cd uint64) error {
+func (s *BadgerStore) SaveCumulativeWork(hash types.Hash, work *big.Int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	return s.db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("block:cdf:%x", hash)
-		buf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, cd)
-		return txn.Set([]byte(key), buf)
+		return txn.Set(workKey(hash), work.Bytes())
 	})
 }
 
-func (s *BadgerStore) GetCumulativeDifficulty(hash types.Hash) (uint64, error) {
+func (s *BadgerStore) GetCumulativeWork(hash types.Hash) (*big.Int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var cd uint64
+	work := new(big.Int)
 	err := s.db.View(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("block:cdf:%x", hash)
-		item, err := txn.Get([]byte(key))
+		item, err := txn.Get(workKey(hash))
 		if err != nil {
 			return err
 		}
 		return item.Value(func(val []byte) error {
-			if len(val) < 8 {
-				return errors.New("invalid cdf value length")
+			work.SetBytes(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return work, nil
+}
+
+func (s *BadgerStore) GetAccount(addr types.Hash) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var acc *Account
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		acc, err = getAccountTxn(txn, addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		return &Account{}, nil
+	}
+	return acc, nil
+}
+
+func (s *BadgerStore) ConnectState(hash types.Hash, accounts map[types.Hash]*Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return connectStateTxn(txn, hash, accounts)
+	})
+}
+
+func (s *BadgerStore) CommitChainUpdate(update *ChainUpdate) error {
+	head, err := update.newHead()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		// 1. Roll the old branch back. Heights above the new tip are left
+		// without a canonical entry.
+		for _, b := range update.Disconnect {
+			if err := disconnectStateTxn(txn, b.Hash); err != nil {
+				return fmt.Errorf("disconnect block %x: %w", b.Hash[:8], err)
+			}
+			if err := txn.Delete(heightKey(b.Header.Height)); err != nil {
+				return err
+			}
+		}
+
+		// 2. Apply the new branch on top of the state written so far.
+		for _, b := range update.Connect {
+			view := NewStateView(txnAccountReader{txn})
+			if err := view.applyBlock(b); err != nil {
+				return fmt.Errorf("connect block %x: %w", b.Hash[:8], err)
+			}
+			if err := connectStateTxn(txn, b.Hash, view.accounts); err != nil {
+				return fmt.Errorf("connect block %x: %w", b.Hash[:8], err)
 			}
-			cd = binary.LittleEndian.Uint64(val)
+			if err := txn.Set(heightKey(b.Header.Height), b.Hash[:]); err != nil {
+				return err
+			}
+		}
+
+		// 3. Move the head together with the state tip.
+		if err := txn.Set([]byte("state:tip"), head[:]); err != nil {
+			return err
+		}
+		return txn.Set([]byte("chain:head"), head[:])
+	})
+}
+
+func (s *BadgerStore) GetStateUndo(hash types.Hash) ([]AccountUndo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var undo []AccountUndo
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		undo, err = getStateUndoTxn(txn, hash)
+		return err
+	})
+	return undo, err
+}
+
+func (s *BadgerStore) GetStateTip() (types.Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hash types.Hash
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("state:tip"))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			copy(hash[:], val)
 			return nil
 		})
 	})
-	return cd, err
+	return hash, err
+}
+
+func (s *BadgerStore) ResetState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.DropPrefix([]byte("account:"), []byte("state:"))
+}
+
+func heightKey(height uint64) []byte {
+	return []byte(fmt.Sprintf("block:height:%d", height))
+}
+
+func workKey(hash types.Hash) []byte {
+	return []byte(fmt.Sprintf("block:work:%x", hash))
+}
+
+func accountKey(addr types.Hash) []byte {
+	return []byte(fmt.Sprintf("account:%x", addr))
+}
+
+func stateUndoKey(hash types.Hash) []byte {
+	return []byte(fmt.Sprintf("state:undo:%x", hash))
+}
+
+// txnAccountReader reads accounts through a transaction, including its own
+// uncommitted writes.
+type txnAccountReader struct {
+	txn *badger.Txn
+}
+
+func (r txnAccountReader) GetAccount(addr types.Hash) (*Account, error) {
+	acc, err := getAccountTxn(r.txn, addr)
+	if err != nil || acc != nil {
+		return acc, err
+	}
+	return &Account{}, nil
+}
+
+// connectStateTxn writes the accounts changed by block 'hash' together with
+// their previous values as undo data, and moves the state tip to 'hash'.
+func connectStateTxn(txn *badger.Txn, hash types.Hash, accounts map[types.Hash]*Account) error {
+	undo := make([]AccountUndo, 0, len(accounts))
+	for addr, acc := range accounts {
+		prev, err := getAccountTxn(txn, addr)
+		if err != nil {
+			return err
+		}
+		undo = append(undo, AccountUndo{Addr: addr, Account: prev})
+
+		if err := putGob(txn, accountKey(addr), acc); err != nil {
+			return err
+		}
+	}
+
+	if err := putGob(txn, stateUndoKey(hash), undo); err != nil {
+		return err
+	}
+	return txn.Set([]byte("state:tip"), hash[:])
+}
+
+// disconnectStateTxn restores the accounts changed by block 'hash' from its
+// undo data and deletes the undo data. The caller moves the state tip.
+func disconnectStateTxn(txn *badger.Txn, hash types.Hash) error {
+	undo, err := getStateUndoTxn(txn, hash)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range undo {
+		if u.Account == nil {
+			if err := txn.Delete(accountKey(u.Addr)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := putGob(txn, accountKey(u.Addr), u.Account); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(stateUndoKey(hash))
+}
+
+// getAccountTxn reads an account inside txn. It returns nil if the account does not exist.
+func getAccountTxn(txn *badger.Txn, addr types.Hash) (*Account, error) {
+	item, err := txn.Get(accountKey(addr))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var acc Account
+	err = item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&acc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func getStateUndoTxn(txn *badger.Txn, hash types.Hash) ([]AccountUndo, error) {
+	item, err := txn.Get(stateUndoKey(hash))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrUndoNotFound
+		}
+		return nil, err
+	}
+
+	var undo []AccountUndo
+	err = item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&undo)
+	})
+	return undo, err
+}
+
+// putGob gob-encodes v and stores it under key.
+func putGob(txn *badger.Txn, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return txn.Set(key, buf.Bytes())
 }
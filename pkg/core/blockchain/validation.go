@@ -1,7 +1,9 @@
 package blockchain
 
 import (
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/chronodrachma/chrd/pkg/core/consensus"
@@ -11,18 +13,40 @@ import (
 var (
 	ErrInvalidPrevHash    = errors.New("block previous hash does not match parent")
 	ErrInvalidHeight      = errors.New("block height is not parent height + 1")
-	ErrInvalidTimestamp    = errors.New("block timestamp is invalid")
+	ErrInvalidTimestamp   = errors.New("block timestamp is invalid")
 	ErrTimestampTooOld    = errors.New("block timestamp is before parent timestamp")
 	ErrTimestampTooFar    = errors.New("block timestamp is too far in the future")
 	ErrInvalidPoW         = errors.New("block PoW hash does not meet difficulty target")
 	ErrInvalidBlockHash   = errors.New("block hash does not match header")
 	ErrInvalidMerkleRoot  = errors.New("merkle root does not match transactions")
 	ErrNoCoinbaseTx       = errors.New("block must contain exactly one coinbase transaction")
-	ErrInvalidCoinbaseAmt = errors.New("coinbase amount does not match block reward")
+	ErrInvalidCoinbaseAmt = errors.New("coinbase amount does not match block reward plus fees")
 	ErrInvalidCoinbasePos = errors.New("coinbase transaction must be first in block")
 	ErrPowHashMismatch    = errors.New("block PoW hash does not match re-execution")
+	ErrInvalidBits        = errors.New("block target does not match the required difficulty")
+
+	ErrInvalidTxType      = errors.New("transaction has an unknown type")
+	ErrInvalidTxID        = errors.New("transaction ID does not match its contents")
+	ErrInvalidTxSignature = errors.New("transaction signature is invalid")
+	ErrInvalidTxNonce     = errors.New("transaction nonce is not the sender's next nonce")
+	ErrInsufficientFunds  = errors.New("transaction spends more than the sender's spendable balance")
+	ErrDuplicateTx        = errors.New("block contains a duplicate transaction")
+	ErrAmountOverflow     = errors.New("transaction amount plus fee overflows")
 )
 
+// TxError reports which transaction in a block failed validation.
+type TxError struct {
+	Index int
+	TxID  types.Hash
+	Err   error
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("tx %d (%x): %v", e.Index, e.TxID[:8], e.Err)
+}
+
+func (e *TxError) Unwrap() error { return e.Err }
+
 // MaxFutureBlockTime is how far ahead of local time a block's timestamp can be.
 const MaxFutureBlockTime = 2 * time.Hour
 
@@ -38,8 +62,9 @@ func ValidateBlock(block *types.Block, parent *types.Block, hasher consensus.Has
 		return ErrInvalidPrevHash
 	}
 
-	// 3. Timestamp must be after parent.
-	if !block.Header.Timestamp.After(parent.Header.Timestamp) {
+	// 3. Timestamp must be after parent. Only whole seconds are part of the
+	// header encoding, so compare those.
+	if block.Header.Timestamp.Unix() <= parent.Header.Timestamp.Unix() {
 		return ErrTimestampTooOld
 	}
 
@@ -59,10 +84,13 @@ func ValidateGenesis(genesis *types.Block, hasher consensus.Hasher) error {
 	if genesis.Header.PrevBlockHash != types.ZeroHash {
 		return ErrInvalidPrevHash
 	}
-	return validateBlockInternal(genesis, hasher)
+	if err := validateBlockInternal(genesis, hasher); err != nil {
+		return err
+	}
+	return validateCoinbaseAmount(genesis)
 }
 
-// validateBlockInternal checks merkle root, block hash, PoW, and coinbase.
+// validateBlockInternal checks merkle root, block hash, PoW, and coinbase position.
 func validateBlockInternal(block *types.Block, hasher consensus.Hasher) error {
 	// 5. Merkle root.
 	expectedMerkle := types.ComputeMerkleRoot(block.Transactions)
@@ -70,6 +98,34 @@ func validateBlockInternal(block *types.Block, hasher consensus.Hasher) error {
 		return ErrInvalidMerkleRoot
 	}
 
+	// 6-8. Block hash and PoW.
+	if err := validateBlockPoW(block, hasher); err != nil {
+		return err
+	}
+
+	// 9. Coinbase validation: exactly one coinbase TX at position 0.
+	coinbaseCount := 0
+	for i, tx := range block.Transactions {
+		if tx.Type == types.TxTypeCoinbase {
+			if i != 0 {
+				return ErrInvalidCoinbasePos
+			}
+			coinbaseCount++
+		}
+	}
+	if coinbaseCount != 1 {
+		return ErrNoCoinbaseTx
+	}
+
+	// The coinbase amount depends on the fees of the transfers, so it is
+	// checked once they are validated (see validateCoinbaseAmount).
+	return nil
+}
+
+// validateBlockPoW checks the block hash and proof of work. It needs no
+// parent, so it is also how blocks are vetted before the orphan pool takes
+// them.
+func validateBlockPoW(block *types.Block, hasher consensus.Hasher) error {
 	// 6. Block hash (SHA-256 of header).
 	expectedHash := block.ComputeHash()
 	if block.Hash != expectedHash {
@@ -86,32 +142,105 @@ func validateBlockInternal(block *types.Block, hasher consensus.Hasher) error {
 		return ErrPowHashMismatch
 	}
 
-	// 8. PoW meets difficulty.
-	// Note: We check if the hash meets the claimed difficulty. 
-	// The check for whether the claimed difficulty is *correct* relative to the chain
+	// 8. PoW meets target.
+	// Note: We check if the hash meets the claimed target.
+	// The check for whether the claimed target is *correct* relative to the chain
 	// must be done by the caller (Contextual Validation).
-	if !consensus.MeetsDifficulty(block.PowHash, block.Header.Difficulty) {
+	if !consensus.MeetsTarget(block.PowHash, block.Header.Bits) {
 		return ErrInvalidPoW
 	}
+	return nil
+}
+
+// validateCoinbaseAmount checks that the coinbase pays exactly the block
+// reward plus the fees of the block's transfers.
+func validateCoinbaseAmount(block *types.Block) error {
+	fees, err := TotalFees(block.Transactions)
+	if err != nil {
+		return err
+	}
+	reward := BlockReward(block.Header.Height)
+	if reward+fees < reward {
+		return ErrAmountOverflow
+	}
+	if block.Transactions[0].Amount != reward+fees {
+		return ErrInvalidCoinbaseAmt
+	}
+	return nil
+}
+
+// ValidateBlockTransactions replays every transaction of block on top of view,
+// which must hold the account state as of the block's parent. Each transfer must
+// carry a valid ID and Ed25519 signature from its sender, use the sender's next
+// nonce and spend no more than the sender's balance (only matured coinbase
+// outputs count). Failures are returned as a *TxError wrapping the cause.
+// Finally the coinbase must collect exactly the block reward plus all fees.
+//
+// On success view contains the state after the block.
+func ValidateBlockTransactions(block *types.Block, view *StateView) error {
+	height := block.Header.Height
+	seen := make(map[types.Hash]struct{}, len(block.Transactions))
 
-	// 9. Coinbase validation: exactly one coinbase TX at position 0.
-	coinbaseCount := 0
 	for i, tx := range block.Transactions {
-		if tx.Type == types.TxTypeCoinbase {
-			if i != 0 {
-				return ErrInvalidCoinbasePos
-			}
-			coinbaseCount++
+		if err := validateTransaction(tx, height, view, seen); err != nil {
+			return &TxError{Index: i, TxID: tx.ID, Err: err}
+		}
+		if err := view.applyTransaction(tx, height); err != nil {
+			return err
 		}
 	}
-	if coinbaseCount != 1 {
-		return ErrNoCoinbaseTx
+	return validateCoinbaseAmount(block)
+}
+
+// validateTransaction checks a single transaction against the current view.
+func validateTransaction(tx *types.Transaction, height uint64, view *StateView, seen map[types.Hash]struct{}) error {
+	if tx.ID != tx.ComputeID() {
+		return ErrInvalidTxID
+	}
+	if _, dup := seen[tx.ID]; dup {
+		return ErrDuplicateTx
+	}
+	seen[tx.ID] = struct{}{}
+
+	switch tx.Type {
+	case types.TxTypeCoinbase:
+		// Position is checked by validateBlockInternal, amount by validateCoinbaseAmount.
+		return nil
+	case types.TxTypeTransfer:
+	default:
+		return ErrInvalidTxType
 	}
 
-	// 10. Coinbase amount must equal block reward.
-	if block.Transactions[0].Amount != BlockReward(block.Header.Height) {
-		return ErrInvalidCoinbaseAmt
+	if err := VerifyTxSignature(tx); err != nil {
+		return err
+	}
+
+	sender, err := view.GetAccount(tx.From)
+	if err != nil {
+		return err
 	}
+	if tx.Nonce != sender.Nonce {
+		return ErrInvalidTxNonce
+	}
+
+	debit := tx.Amount + tx.Fee
+	if debit < tx.Amount {
+		return ErrAmountOverflow
+	}
+	if sender.SpendableAt(height) < debit {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
 
+// VerifyTxSignature checks the Ed25519 signature of a transfer.
+// The From address is the sender's Ed25519 public key.
+func VerifyTxSignature(tx *types.Transaction) error {
+	if len(tx.Signature) != ed25519.SignatureSize {
+		return ErrInvalidTxSignature
+	}
+	if !ed25519.Verify(tx.From[:], tx.Serialize(), tx.Signature) {
+		return ErrInvalidTxSignature
+	}
 	return nil
 }
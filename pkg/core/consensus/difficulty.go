@@ -12,81 +12,83 @@ const (
 
 	// DifficultyAdjustmentWindow is the number of blocks to look back for calculating average time.
 	DifficultyAdjustmentWindow = 24
+
+	// MaxAdjustmentFactor bounds how far a single retarget can move the target
+	// (in either direction), so a handful of bad timestamps cannot swing it wildly.
+	MaxAdjustmentFactor = 4
 )
 
-// CalcNextRequiredDifficulty calculates the required difficulty for the next block
-// based on the moving average of the past blocks.
+// CalcNextRequiredBits calculates the compact target for the block following prev,
+// based on the moving average of the past DifficultyAdjustmentWindow blocks.
 //
-// The difficulty is the inverse of the target hash (Conceptually).
-// Here we use a simplified model where 'Difficulty' is a uint64 representing the specific
-// requirements (e.g., number of leading zeros or a target value).
+// Targets are 256-bit integers (Target = 2^256 / Difficulty); a lower target is
+// harder to meet. The next target is the average target of the window scaled by
+// how long the window actually took:
 //
-// For this prototype, we'll use a standard target-based difficulty where:
-// Target = 2^256 / Difficulty
-// Higher Difficulty = Lower Target = Harder to find hash < Target.
+//	NewTarget = AvgTarget * ActualTimespan / ExpectedTimespan
 //
-// To adjust: NewDifficulty = OldDifficulty * (ActualTime / TargetTime)
-// Wait, if ActualTime > TargetTime (too slow), we want easier difficulty.
-// NewDifficulty = OldDifficulty * (TargetTime / ActualTime)
+// If blocks came too fast, ActualTimespan < ExpectedTimespan and the target drops
+// (difficulty rises). The actual timespan is clamped to a factor of
+// MaxAdjustmentFactor and the result is capped at PowLimit.
 //
-// note: types.BlockHeader.Difficulty is uint64.
-func CalcNextRequiredDifficulty(
-	prevBlock *types.Block,
-	getBlockByHeight func(uint64) (*types.Block, error),
-) (uint64, error) {
+// getHeaderByHeight must return the ancestor of prev at the given height (which
+// matters on forks, where the canonical chain may differ).
+func CalcNextRequiredBits(
+	prev *types.BlockHeader,
+	getHeaderByHeight func(uint64) (*types.BlockHeader, error),
+) (uint32, error) {
 
 	// 1. Genesis and early blocks have constant difficulty.
-	if prevBlock == nil || prevBlock.Header.Height < DifficultyAdjustmentWindow {
-		if prevBlock != nil {
-			return prevBlock.Header.Difficulty, nil
-		}
+	if prev == nil {
 		// Fallback for genesis creation (caller should handle this usually)
-		return 1, nil
+		return PowLimitBits, nil
 	}
-
-	// 2. Get the block at the start of the window.
-	firstHeight := prevBlock.Header.Height - DifficultyAdjustmentWindow + 1
-	firstBlock, err := getBlockByHeight(firstHeight)
-	if err != nil {
-		return 0, err
+	if prev.Height < DifficultyAdjustmentWindow {
+		return prev.Bits, nil
 	}
 
-	// 3. Calculate actual time taken for the window.
-	// Note: We use timestamps.
-	actualTime := prevBlock.Header.Timestamp.Unix() - firstBlock.Header.Timestamp.Unix()
-	
-	// Avoid division by zero or negative time (sanity check).
-	if actualTime <= 0 {
-		actualTime = 1
+	// 2. Sum the targets of the window (prev.Height-Window+1 ..= prev.Height)
+	// and find the timestamp of the block just before it.
+	sum := new(big.Int)
+	var first *types.BlockHeader
+	for h := prev.Height - DifficultyAdjustmentWindow; h <= prev.Height; h++ {
+		header := prev
+		if h != prev.Height {
+			var err error
+			header, err = getHeaderByHeight(h)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if h == prev.Height-DifficultyAdjustmentWindow {
+			first = header
+			continue
+		}
+		sum.Add(sum, CompactToTarget(header.Bits))
 	}
+	avgTarget := sum.Div(sum, big.NewInt(DifficultyAdjustmentWindow))
 
-	// 4. Calculate target time for the window.
-	targetTime := int64(TargetBlockTime * DifficultyAdjustmentWindow)
+	// 3. Calculate actual time taken for the window, clamped.
+	expected := int64(TargetBlockTime * DifficultyAdjustmentWindow)
+	actual := prev.Timestamp.Unix() - first.Timestamp.Unix()
+	if actual < expected/MaxAdjustmentFactor {
+		actual = expected / MaxAdjustmentFactor
+	}
+	if actual > expected*MaxAdjustmentFactor {
+		actual = expected * MaxAdjustmentFactor
+	}
 
-	// 5. Adjust difficulty.
-	// We use big.Int to avoid overflow during calculation.
-	oldDiff := new(big.Int).SetUint64(prevBlock.Header.Difficulty)
-	
-	// NewDiff = OldDiff * (TargetTime / ActualTime)
-	// If ActualTime < TargetTime (too fast), factor > 1 -> Difficulty increases.
-	// If ActualTime > TargetTime (too slow), factor < 1 -> Difficulty decreases.
-	
-	newDiff := new(big.Int).Mul(oldDiff, big.NewInt(targetTime))
-	newDiff.Div(newDiff, big.NewInt(actualTime))
+	// 4. Scale the target.
+	newTarget := avgTarget.Mul(avgTarget, big.NewInt(actual))
+	newTarget.Div(newTarget, big.NewInt(expected))
 
-	// 6. Clamp difficulty.
-	// Min difficulty = 1.
-	if newDiff.Cmp(big.NewInt(1)) < 0 {
-		return 1, nil
+	// 5. Clamp to the allowed range.
+	if newTarget.Cmp(PowLimit) > 0 {
+		return PowLimitBits, nil
 	}
-	
-	// Cap max adjustment factor to prevent wild swings? (Optional for prototype)
-	// Let's stick to simple retargeting for now.
-
-	if !newDiff.IsUint64() {
-		// Overflowed uint64, cap at max uint64 (extremely unlikely)
-		return ^uint64(0), nil
+	if newTarget.Sign() == 0 {
+		newTarget.SetInt64(1)
 	}
 
-	return newDiff.Uint64(), nil
+	return TargetToCompact(newTarget), nil
 }
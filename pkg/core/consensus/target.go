@@ -0,0 +1,135 @@
+package consensus
+
+import (
+	"math/big"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// PowLimitBits is the compact encoding of the easiest allowed target
+// (difficulty 1). It decodes to 0xffff * 2^240.
+const PowLimitBits uint32 = 0x2100ffff
+
+var (
+	// oneLsh256 is 2^256, the size of the hash space.
+	oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+	// PowLimit is the highest (easiest) target a block may use.
+	PowLimit = CompactToTarget(PowLimitBits)
+)
+
+// CompactToTarget decodes a compact ("bits") target into a 256-bit integer.
+//
+// The compact format is the one used by Bitcoin: the high byte is a base-256
+// exponent and the low 23 bits are the mantissa, so that
+// Target = Mantissa * 256^(Exponent-3). Bit 0x00800000 is a sign bit; negative
+// targets are never valid.
+func CompactToTarget(bits uint32) *big.Int {
+	mantissa := bits & 0x007fffff
+	negative := bits&0x00800000 != 0
+	exponent := uint(bits >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if negative {
+		target.Neg(target)
+	}
+	return target
+}
+
+// TargetToCompact encodes a 256-bit target into compact form. The encoding
+// keeps only the 23 most significant mantissa bits, so the round trip
+// CompactToTarget(TargetToCompact(t)) may round t down.
+func TargetToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(target).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Abs(target)
+		shifted.Rsh(shifted, 8*(exponent-3))
+		mantissa = uint32(shifted.Uint64())
+	}
+
+	// The mantissa must not set the sign bit; move one byte into the exponent.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// DifficultyToTarget converts a difficulty into a target: Target = 2^256 / Difficulty,
+// capped at PowLimit. A difficulty of 0 is treated as 1.
+func DifficultyToTarget(difficulty uint64) *big.Int {
+	if difficulty == 0 {
+		difficulty = 1
+	}
+	target := new(big.Int).Div(oneLsh256, new(big.Int).SetUint64(difficulty))
+	if target.Cmp(PowLimit) > 0 {
+		return new(big.Int).Set(PowLimit)
+	}
+	return target
+}
+
+// DifficultyToCompact converts a difficulty directly into compact form.
+func DifficultyToCompact(difficulty uint64) uint32 {
+	return TargetToCompact(DifficultyToTarget(difficulty))
+}
+
+// TargetToDifficulty converts a target back into a difficulty: 2^256 / Target.
+// It is meant for display; it saturates at the maximum uint64.
+func TargetToDifficulty(target *big.Int) uint64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d := new(big.Int).Div(oneLsh256, target)
+	if !d.IsUint64() {
+		return ^uint64(0)
+	}
+	return d.Uint64()
+}
+
+// CalcWork returns the expected number of hashes needed to find a block with
+// the given compact target: 2^256 / (Target + 1). Invalid targets have no work.
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToTarget(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return denominator.Div(oneLsh256, denominator)
+}
+
+// HashToBig interprets a hash as a big-endian 256-bit integer.
+func HashToBig(h types.Hash) *big.Int {
+	return new(big.Int).SetBytes(h[:])
+}
+
+// MeetsTarget checks whether a PoW hash satisfies the compact target:
+// the hash, read as a big-endian integer, must not exceed the target.
+// Targets that are zero, negative or above PowLimit are rejected.
+func MeetsTarget(powHash types.Hash, bits uint32) bool {
+	target := CompactToTarget(bits)
+	if target.Sign() <= 0 || target.Cmp(PowLimit) > 0 {
+		return false
+	}
+	return HashToBig(powHash).Cmp(target) <= 0
+}
@@ -0,0 +1,227 @@
+package consensus
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+func mustBigHex(t *testing.T, s string) *big.Int {
+	t.Helper()
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex %q", s)
+	}
+	return n
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		bits   uint32
+		target string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x1b0404cb, "404cb000000000000000000000000000000000000000000000000"},
+		{PowLimitBits, "ffff000000000000000000000000000000000000000000000000000000000000"},
+		{0x02008000, "80"},
+		{0x05009234, "92340000"},
+		{0x04123456, "12345600"},
+	}
+	for _, tt := range tests {
+		want := mustBigHex(t, tt.target)
+		got := CompactToTarget(tt.bits)
+		if got.Cmp(want) != 0 {
+			t.Errorf("CompactToTarget(%08x) = %x, want %x", tt.bits, got, want)
+		}
+		if back := TargetToCompact(want); back != tt.bits {
+			t.Errorf("TargetToCompact(%x) = %08x, want %08x", want, back, tt.bits)
+		}
+	}
+
+	// Mantissa bits below the exponent are dropped.
+	if got := CompactToTarget(0x01003456); got.Sign() != 0 {
+		t.Errorf("CompactToTarget(01003456) = %x, want 0", got)
+	}
+	// The sign bit yields a negative target.
+	if got := CompactToTarget(0x04923456); got.Sign() >= 0 {
+		t.Errorf("CompactToTarget(04923456) = %x, want negative", got)
+	}
+}
+
+func TestDifficultyConversions(t *testing.T) {
+	if DifficultyToTarget(0).Cmp(PowLimit) != 0 || DifficultyToTarget(1).Cmp(PowLimit) != 0 {
+		t.Error("difficulty 0 and 1 should map to PowLimit")
+	}
+	if DifficultyToCompact(1) != PowLimitBits {
+		t.Errorf("DifficultyToCompact(1) = %08x, want %08x", DifficultyToCompact(1), PowLimitBits)
+	}
+
+	// 2^256 / 2^32 = 2^224.
+	want := new(big.Int).Lsh(big.NewInt(1), 224)
+	if got := DifficultyToTarget(1 << 32); got.Cmp(want) != 0 {
+		t.Errorf("DifficultyToTarget(2^32) = %x, want %x", got, want)
+	}
+
+	// Compact encoding rounds the target down, so difficulty can only round up.
+	for _, d := range []uint64{2, 1000, 123_456_789, 1 << 40} {
+		back := TargetToDifficulty(CompactToTarget(DifficultyToCompact(d)))
+		if back < d || back > d+d/10000+1 {
+			t.Errorf("difficulty %d round-tripped to %d", d, back)
+		}
+	}
+}
+
+func TestCalcWork(t *testing.T) {
+	if got := CalcWork(PowLimitBits); got.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("CalcWork(PowLimitBits) = %s, want 1", got)
+	}
+	// 2^256 / (2^224 + 1) rounds down to 2^32 - 1.
+	if got := CalcWork(DifficultyToCompact(1 << 32)); got.Cmp(big.NewInt(1<<32-1)) != 0 {
+		t.Errorf("CalcWork(2^32) = %s, want %d", got, uint64(1<<32-1))
+	}
+	if got := CalcWork(0); got.Sign() != 0 {
+		t.Errorf("CalcWork(0) = %s, want 0", got)
+	}
+
+	// Harder targets always mean more work.
+	easy := CalcWork(DifficultyToCompact(1000))
+	hard := CalcWork(DifficultyToCompact(2000))
+	if hard.Cmp(easy) <= 0 {
+		t.Errorf("work(2000)=%s should exceed work(1000)=%s", hard, easy)
+	}
+}
+
+func hashFromBig(t *testing.T, n *big.Int) types.Hash {
+	t.Helper()
+	var h types.Hash
+	n.FillBytes(h[:])
+	return h
+}
+
+func TestMeetsTarget(t *testing.T) {
+	bits := uint32(0x1d00ffff)
+	target := CompactToTarget(bits)
+
+	if !MeetsTarget(hashFromBig(t, target), bits) {
+		t.Error("hash equal to target should pass")
+	}
+	if MeetsTarget(hashFromBig(t, new(big.Int).Add(target, big.NewInt(1))), bits) {
+		t.Error("hash above target should fail")
+	}
+	if !MeetsTarget(types.Hash{}, bits) {
+		t.Error("zero hash should pass any valid target")
+	}
+
+	allOnes := types.Hash{}
+	for i := range allOnes {
+		allOnes[i] = 0xFF
+	}
+	if MeetsTarget(allOnes, PowLimitBits) {
+		t.Error("all-0xFF hash should fail even the easiest target")
+	}
+
+	invalid := []uint32{0, 0x04923456, 0x2200ffff}
+	for _, b := range invalid {
+		if MeetsTarget(types.Hash{}, b) {
+			t.Errorf("bits %08x should be rejected", b)
+		}
+	}
+}
+
+// headerChain builds headers at heights 0..n-1, spaced 'spacing' apart, with the given bits.
+func headerChain(n int, spacing time.Duration, bits uint32) []*types.BlockHeader {
+	start := time.Unix(1_700_000_000, 0)
+	headers := make([]*types.BlockHeader, n)
+	for i := range headers {
+		headers[i] = &types.BlockHeader{
+			Height:    uint64(i),
+			Timestamp: start.Add(time.Duration(i) * spacing),
+			Bits:      bits,
+		}
+	}
+	return headers
+}
+
+func nextBits(t *testing.T, headers []*types.BlockHeader) uint32 {
+	t.Helper()
+	prev := headers[len(headers)-1]
+	bits, err := CalcNextRequiredBits(prev, func(h uint64) (*types.BlockHeader, error) {
+		return headers[h], nil
+	})
+	if err != nil {
+		t.Fatalf("CalcNextRequiredBits failed: %v", err)
+	}
+	return bits
+}
+
+func TestCalcNextRequiredBits(t *testing.T) {
+	base := uint32(0x1d00ffff)
+	baseTarget := CompactToTarget(base)
+	blockTime := TargetBlockTime * time.Second
+
+	tests := []struct {
+		name    string
+		spacing time.Duration
+		bits    uint32
+		want    *big.Int
+	}{
+		{"on schedule", blockTime, base, baseTarget},
+		{"twice as fast", blockTime / 2, base, new(big.Int).Rsh(baseTarget, 1)},
+		{"twice as slow", blockTime * 2, base, new(big.Int).Lsh(baseTarget, 1)},
+		{"ten times as fast is clamped", blockTime / 10, base, new(big.Int).Rsh(baseTarget, 2)},
+		{"ten times as slow is clamped", blockTime * 10, base, new(big.Int).Lsh(baseTarget, 2)},
+		{"never easier than PowLimit", blockTime * 2, PowLimitBits, PowLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := headerChain(DifficultyAdjustmentWindow+5, tt.spacing, tt.bits)
+			got := nextBits(t, headers)
+			if got != TargetToCompact(tt.want) {
+				t.Errorf("next bits = %08x (target %x), want %08x (target %x)",
+					got, CompactToTarget(got), TargetToCompact(tt.want), tt.want)
+			}
+		})
+	}
+
+	// Before the first full window the target does not move.
+	early := headerChain(DifficultyAdjustmentWindow, blockTime/2, base)
+	if got := nextBits(t, early); got != base {
+		t.Errorf("early next bits = %08x, want %08x", got, base)
+	}
+}
+
+// TestRetargetAgreesWithValidation checks that after a retarget, a hash that
+// met the old target but not the new one is rejected, and the new target's
+// boundary is accepted.
+func TestRetargetAgreesWithValidation(t *testing.T) {
+	base := uint32(0x1d00ffff)
+	headers := headerChain(DifficultyAdjustmentWindow+1, TargetBlockTime*time.Second/2, base)
+	next := nextBits(t, headers)
+
+	newTarget := CompactToTarget(next)
+	oldTarget := CompactToTarget(base)
+	if newTarget.Cmp(oldTarget) >= 0 {
+		t.Fatalf("fast blocks should lower the target: old %x, new %x", oldTarget, newTarget)
+	}
+
+	boundary := hashFromBig(t, newTarget)
+	justAbove := hashFromBig(t, new(big.Int).Add(newTarget, big.NewInt(1)))
+
+	if !MeetsTarget(boundary, next) {
+		t.Error("hash at the new target should pass the new bits")
+	}
+	if MeetsTarget(justAbove, next) {
+		t.Error("hash just above the new target should fail the new bits")
+	}
+	if !MeetsTarget(justAbove, base) {
+		t.Error("hash just above the new target should still pass the old bits")
+	}
+
+	// The retargeted block is worth more work than the old ones.
+	if CalcWork(next).Cmp(CalcWork(base)) <= 0 {
+		t.Error("retargeted block should carry more work")
+	}
+}
@@ -1,7 +1,6 @@
 package mempool
 
 import (
-	"crypto/ed25519"
 	"errors"
 	"sort"
 	"sync"
@@ -18,11 +17,19 @@ var (
 	ErrTxTooOld           = errors.New("transaction timestamp too old")
 )
 
+// TxBufferSize is the capacity of the channels returned by
+// SubscribeTransactions.
+const TxBufferSize = 256
+
 // Mempool manages pending transactions.
 type Mempool struct {
 	mu    sync.RWMutex
 	txs   map[types.Hash]*types.Transaction
 	chain *blockchain.Chain
+
+	// Subscriptions for accepted transactions.
+	subMu       sync.Mutex
+	subscribers []chan *types.Transaction
 }
 
 // NewMempool creates a new transaction pool.
@@ -40,6 +47,64 @@ func (mp *Mempool) Size() int {
 	return len(mp.txs)
 }
 
+// Get returns the pending transaction with the given ID.
+func (mp *Mempool) Get(id types.Hash) (*types.Transaction, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	tx, ok := mp.txs[id]
+	return tx, ok
+}
+
+// Transactions returns every pending transaction, in no particular order.
+func (mp *Mempool) Transactions() []*types.Transaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	txs := make([]*types.Transaction, 0, len(mp.txs))
+	for _, tx := range mp.txs {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// SubscribeTransactions returns a channel that receives every transaction
+// accepted into the pool, and a function that ends the subscription and
+// closes the channel. Transactions are dropped while the channel is full,
+// so the consumer must keep up.
+func (mp *Mempool) SubscribeTransactions() (<-chan *types.Transaction, func()) {
+	mp.subMu.Lock()
+	defer mp.subMu.Unlock()
+
+	ch := make(chan *types.Transaction, TxBufferSize)
+	mp.subscribers = append(mp.subscribers, ch)
+	cancel := func() {
+		mp.subMu.Lock()
+		defer mp.subMu.Unlock()
+		for i, sub := range mp.subscribers {
+			if sub == ch {
+				mp.subscribers = append(mp.subscribers[:i], mp.subscribers[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}
+	return ch, cancel
+}
+
+// notifySubscribers sends an accepted transaction to all subscribers.
+func (mp *Mempool) notifySubscribers(tx *types.Transaction) {
+	mp.subMu.Lock()
+	defer mp.subMu.Unlock()
+
+	for _, ch := range mp.subscribers {
+		select {
+		case ch <- tx:
+		default:
+			// The subscriber is too slow; it misses this one.
+		}
+	}
+}
+
 // AddTransaction validates and adds a transaction to the pool.
 func (mp *Mempool) AddTransaction(tx *types.Transaction) error {
 	mp.mu.Lock()
@@ -54,13 +119,8 @@ func (mp *Mempool) AddTransaction(tx *types.Transaction) error {
 	// (Check basic structure, non-zero amount, etc - omitted for prototype)
 
 	// 3. Verify Signature
-	// We assume From address is the Ed25519 public key (or hash of it).
-	// For this prototype, let's assume From IS the public key (32 bytes).
-	// Address == PubKey.
-	// If Address is hash of PubKey, we need PubKey in Tx logic. 
-	// The `types.Hash` is 32 bytes. Ed25519 PubKey is 32 bytes.
-	// So we treat `tx.From` as the PubKey.
-	if !ed25519.Verify(tx.From[:], tx.Serialize(), tx.Signature) {
+	// The From address is the sender's Ed25519 public key.
+	if err := blockchain.VerifyTxSignature(tx); err != nil {
 		return ErrInvalidSignature
 	}
 
@@ -99,6 +159,7 @@ func (mp *Mempool) AddTransaction(tx *types.Transaction) error {
 	}
 
 	mp.txs[tx.ID] = tx
+	mp.notifySubscribers(tx)
 	return nil
 }
 
@@ -109,7 +170,7 @@ func (mp *Mempool) GetPendingTransactions(maxCount int) []*types.Transaction {
 	defer mp.mu.RUnlock()
 
 	result := make([]*types.Transaction, 0, maxCount)
-	
+
 	// Convert map to slice for sorting
 	allTxs := make([]*types.Transaction, 0, len(mp.txs))
 	for _, tx := range mp.txs {
@@ -1,5 +1,11 @@
 package types
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // ChronosPerCHRD defines the number of smallest units ("chronos") in 1 CHRD.
 // 1 CHRD = 10^8 chronos (analogous to Bitcoin's satoshis).
 const ChronosPerCHRD uint64 = 100_000_000
@@ -17,5 +23,34 @@ func (a Amount) ToCHRD() float64 {
 	return float64(a) / float64(ChronosPerCHRD)
 }
 
+// String formats the amount in CHRD with all eight decimal places, such as
+// "1.50000000". Unlike ToCHRD it is exact.
+func (a Amount) String() string {
+	return fmt.Sprintf("%d.%08d", uint64(a)/ChronosPerCHRD, uint64(a)%ChronosPerCHRD)
+}
+
+// ParseAmount parses a decimal CHRD amount, such as "1.5" or "0.00000001",
+// into chronos. It accepts at most eight decimal places.
+func ParseAmount(s string) (Amount, error) {
+	whole, frac, dot := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 8 || (dot && frac == "") {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	w, err := strconv.ParseUint(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", s, err)
+	}
+	var f uint64
+	if frac != "" {
+		if f, err = strconv.ParseUint(frac+strings.Repeat("0", 8-len(frac)), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid amount %q: %w", s, err)
+		}
+	}
+	if w > (^uint64(0)-f)/ChronosPerCHRD {
+		return 0, fmt.Errorf("invalid amount %q: out of range", s)
+	}
+	return Amount(w*ChronosPerCHRD + f), nil
+}
+
 // BlockReward is the fixed reward per block: exactly 1 CHRD.
 const BlockReward Amount = Amount(ChronosPerCHRD)
@@ -0,0 +1,33 @@
+package types
+
+import "testing"
+
+func TestAmountStringAndParse(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		str    string
+	}{
+		{0, "0.00000000"},
+		{1, "0.00000001"},
+		{BlockReward, "1.00000000"},
+		{150_000_000, "1.50000000"},
+		{Amount(^uint64(0)), "184467440737.09551615"},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.String(); got != tt.str {
+			t.Errorf("Amount(%d).String() = %q, want %q", uint64(tt.amount), got, tt.str)
+		}
+		if got, err := ParseAmount(tt.str); err != nil || got != tt.amount {
+			t.Errorf("ParseAmount(%q) = %d, %v; want %d", tt.str, uint64(got), err, uint64(tt.amount))
+		}
+	}
+
+	if got, err := ParseAmount("2.5"); err != nil || got != 250_000_000 {
+		t.Errorf("ParseAmount(2.5) = %d, %v", uint64(got), err)
+	}
+	for _, s := range []string{"", ".5", "1.", "-1", "+1", "1.123456789", "1e8", "184467440737.09551616"} {
+		if _, err := ParseAmount(s); err == nil {
+			t.Errorf("ParseAmount(%q) succeeded", s)
+		}
+	}
+}
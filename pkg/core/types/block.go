@@ -12,26 +12,35 @@ type BlockHeader struct {
 	Timestamp     time.Time
 	PrevBlockHash Hash
 	MerkleRoot    Hash
-	Difficulty    uint64
+	Bits          uint32 // Compact encoding of the PoW target (see consensus.CompactToTarget).
 	Nonce         uint64
 }
 
-// Serialize returns a deterministic 100-byte encoding of the header.
+// HeaderSize is the length of a serialized block header.
+const HeaderSize = 96
+
+// Serialize returns a deterministic 96-byte encoding of the header.
 // Field order: Version(4) || Height(8) || Timestamp(8) || PrevBlockHash(32) ||
 //
-//	MerkleRoot(32) || Difficulty(8) || Nonce(8)
+//	MerkleRoot(32) || Bits(4) || Nonce(8)
 func (h *BlockHeader) Serialize() []byte {
-	buf := make([]byte, 100)
+	buf := make([]byte, HeaderSize)
 	binary.BigEndian.PutUint32(buf[0:4], h.Version)
 	binary.BigEndian.PutUint64(buf[4:12], h.Height)
 	binary.BigEndian.PutUint64(buf[12:20], uint64(h.Timestamp.Unix()))
 	copy(buf[20:52], h.PrevBlockHash[:])
 	copy(buf[52:84], h.MerkleRoot[:])
-	binary.BigEndian.PutUint64(buf[84:92], h.Difficulty)
-	binary.BigEndian.PutUint64(buf[92:100], h.Nonce)
+	binary.BigEndian.PutUint32(buf[84:88], h.Bits)
+	binary.BigEndian.PutUint64(buf[88:96], h.Nonce)
 	return buf
 }
 
+// ComputeHash computes the SHA-256 of the serialized header, which is the
+// hash of the block it belongs to.
+func (h *BlockHeader) ComputeHash() Hash {
+	return ComputeSHA256(h.Serialize())
+}
+
 // Block is a complete block: header + body (transactions).
 type Block struct {
 	Header       BlockHeader
@@ -42,7 +51,7 @@ type Block struct {
 
 // ComputeHash computes the SHA-256 of the serialized header.
 func (b *Block) ComputeHash() Hash {
-	return ComputeSHA256(b.Header.Serialize())
+	return b.Header.ComputeHash()
 }
 
 // ComputeMerkleRoot computes the SHA-256 Merkle tree root of the transaction IDs.
@@ -0,0 +1,176 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EncodingVersion is the version byte that starts the binary encoding of
+// blocks and transactions. Decoders reject versions they do not know.
+const EncodingVersion byte = 1
+
+const (
+	// txFieldsSize is the length of Transaction.Serialize.
+	txFieldsSize = 97
+
+	// minTxEncodingSize is the length of an encoded transaction without signature:
+	// Version(1) || Fields(97) || ID(32) || SigLen(4).
+	minTxEncodingSize = 1 + txFieldsSize + 32 + 4
+
+	// blockPrefixSize is the length of an encoded block before its transactions:
+	// Version(1) || Header(96) || Hash(32) || PowHash(32) || TxCount(4).
+	blockPrefixSize = 1 + HeaderSize + 32 + 32 + 4
+
+	// MaxSignatureSize bounds the signature length accepted by the decoder.
+	MaxSignatureSize = 1024
+
+	// MaxTxSize is the length of the largest transaction encoding.
+	MaxTxSize = minTxEncodingSize + MaxSignatureSize
+)
+
+// ErrInvalidEncoding is returned when binary data cannot be decoded.
+var ErrInvalidEncoding = errors.New("invalid binary encoding")
+
+// MarshalBinary returns the header encoding, identical to Serialize.
+func (h *BlockHeader) MarshalBinary() ([]byte, error) {
+	return h.Serialize(), nil
+}
+
+// UnmarshalBinary decodes a header produced by Serialize.
+// Timestamps have one-second precision.
+func (h *BlockHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != HeaderSize {
+		return fmt.Errorf("%w: header is %d bytes, want %d", ErrInvalidEncoding, len(data), HeaderSize)
+	}
+	h.Version = binary.BigEndian.Uint32(data[0:4])
+	h.Height = binary.BigEndian.Uint64(data[4:12])
+	h.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(data[12:20])), 0)
+	copy(h.PrevBlockHash[:], data[20:52])
+	copy(h.MerkleRoot[:], data[52:84])
+	h.Bits = binary.BigEndian.Uint32(data[84:88])
+	h.Nonce = binary.BigEndian.Uint64(data[88:96])
+	return nil
+}
+
+// MarshalBinary returns the canonical encoding of the transaction:
+//
+//	Version(1) || Serialize()(97) || ID(32) || SigLen(4) || Signature(SigLen)
+func (tx *Transaction) MarshalBinary() ([]byte, error) {
+	if len(tx.Signature) > MaxSignatureSize {
+		return nil, fmt.Errorf("%w: signature is %d bytes", ErrInvalidEncoding, len(tx.Signature))
+	}
+	buf := make([]byte, 0, minTxEncodingSize+len(tx.Signature))
+	buf = append(buf, EncodingVersion)
+	buf = append(buf, tx.Serialize()...)
+	buf = append(buf, tx.ID[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(tx.Signature)))
+	buf = append(buf, tx.Signature...)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a transaction produced by MarshalBinary.
+// Timestamps have one-second precision.
+func (tx *Transaction) UnmarshalBinary(data []byte) error {
+	if len(data) < minTxEncodingSize {
+		return fmt.Errorf("%w: transaction is %d bytes", ErrInvalidEncoding, len(data))
+	}
+	if data[0] != EncodingVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidEncoding, data[0])
+	}
+
+	f := data[1 : 1+txFieldsSize]
+	tx.Type = TxType(f[0])
+	tx.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(f[1:9])), 0)
+	copy(tx.From[:], f[9:41])
+	copy(tx.To[:], f[41:73])
+	tx.Amount = Amount(binary.BigEndian.Uint64(f[73:81]))
+	tx.Fee = Amount(binary.BigEndian.Uint64(f[81:89]))
+	tx.Nonce = binary.BigEndian.Uint64(f[89:97])
+
+	rest := data[1+txFieldsSize:]
+	copy(tx.ID[:], rest[:32])
+	sigLen := binary.BigEndian.Uint32(rest[32:36])
+	if sigLen > MaxSignatureSize || uint64(sigLen) != uint64(len(rest)-36) {
+		return fmt.Errorf("%w: bad signature length %d", ErrInvalidEncoding, sigLen)
+	}
+	tx.Signature = nil
+	if sigLen > 0 {
+		tx.Signature = append([]byte(nil), rest[36:]...)
+	}
+	return nil
+}
+
+// MarshalBinary returns the canonical encoding of the block:
+//
+//	Version(1) || Header(96) || Hash(32) || PowHash(32) || TxCount(4) ||
+//	TxCount * (TxLen(4) || Transaction(TxLen))
+func (b *Block) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, blockPrefixSize+len(b.Transactions)*(4+minTxEncodingSize+64))
+	buf = append(buf, EncodingVersion)
+	buf = append(buf, b.Header.Serialize()...)
+	buf = append(buf, b.Hash[:]...)
+	buf = append(buf, b.PowHash[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		txBytes, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(txBytes)))
+		buf = append(buf, txBytes...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a block produced by MarshalBinary.
+func (b *Block) UnmarshalBinary(data []byte) error {
+	if len(data) < blockPrefixSize {
+		return fmt.Errorf("%w: block is %d bytes", ErrInvalidEncoding, len(data))
+	}
+	if data[0] != EncodingVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidEncoding, data[0])
+	}
+
+	off := 1
+	if err := b.Header.UnmarshalBinary(data[off : off+HeaderSize]); err != nil {
+		return err
+	}
+	off += HeaderSize
+	copy(b.Hash[:], data[off:off+32])
+	off += 32
+	copy(b.PowHash[:], data[off:off+32])
+	off += 32
+	count := binary.BigEndian.Uint32(data[off : off+4])
+	off += 4
+
+	// Every transaction takes at least 4+minTxEncodingSize bytes; checking the
+	// count first keeps a forged count from causing a huge allocation.
+	if uint64(count)*(4+minTxEncodingSize) > uint64(len(data)-off) {
+		return fmt.Errorf("%w: %d transactions do not fit in %d bytes", ErrInvalidEncoding, count, len(data)-off)
+	}
+
+	b.Transactions = make([]*Transaction, count)
+	for i := range b.Transactions {
+		if len(data)-off < 4 {
+			return fmt.Errorf("%w: truncated transaction %d", ErrInvalidEncoding, i)
+		}
+		txLen := binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+		if uint64(txLen) > uint64(len(data)-off) {
+			return fmt.Errorf("%w: truncated transaction %d", ErrInvalidEncoding, i)
+		}
+		tx := &Transaction{}
+		if err := tx.UnmarshalBinary(data[off : off+int(txLen)]); err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		off += int(txLen)
+		b.Transactions[i] = tx
+	}
+
+	if off != len(data) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, len(data)-off)
+	}
+	return nil
+}
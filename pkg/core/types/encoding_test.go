@@ -0,0 +1,102 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBlock() *Block {
+	ts := time.Unix(1_700_000_000, 0)
+	coinbase := &Transaction{
+		Type:      TxTypeCoinbase,
+		Timestamp: ts,
+		To:        Hash{0x01},
+		Amount:    BlockReward,
+		Nonce:     7,
+	}
+	coinbase.ID = coinbase.ComputeID()
+	transfer := &Transaction{
+		Type:      TxTypeTransfer,
+		Timestamp: ts,
+		From:      Hash{0x02},
+		To:        Hash{0x03},
+		Amount:    42,
+		Fee:       3,
+		Nonce:     1,
+		Signature: bytes.Repeat([]byte{0xAB}, 64),
+	}
+	transfer.ID = transfer.ComputeID()
+
+	txs := []*Transaction{coinbase, transfer}
+	b := &Block{
+		Header: BlockHeader{
+			Version:       1,
+			Height:        7,
+			Timestamp:     ts,
+			PrevBlockHash: Hash{0xAA},
+			MerkleRoot:    ComputeMerkleRoot(txs),
+			Bits:          0x2100ffff,
+			Nonce:         99,
+		},
+		Transactions: txs,
+		PowHash:      Hash{0xBB},
+	}
+	b.Hash = b.ComputeHash()
+	return b
+}
+
+func TestBlockBinaryRoundTrip(t *testing.T) {
+	b := testBlock()
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	var got Block
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if !reflect.DeepEqual(&got, b) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, *b)
+	}
+
+	// The encoding is deterministic.
+	again, _ := got.MarshalBinary()
+	if !bytes.Equal(again, data) {
+		t.Error("re-encoding a decoded block changed its bytes")
+	}
+}
+
+func TestBlockUnmarshalRejectsMalformed(t *testing.T) {
+	data, err := testBlock().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	badVersion := append([]byte(nil), data...)
+	badVersion[0] = 0xFF
+	hugeCount := append([]byte(nil), data...)
+	copy(hugeCount[blockPrefixSize-4:], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", data[:len(data)-1]},
+		{"trailing bytes", append(append([]byte(nil), data...), 0)},
+		{"unknown version", badVersion},
+		{"huge tx count", hugeCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Block
+			if err := b.UnmarshalBinary(tt.data); !errors.Is(err, ErrInvalidEncoding) {
+				t.Errorf("UnmarshalBinary error = %v, want ErrInvalidEncoding", err)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -49,6 +50,32 @@ func (h Hash) String() string {
 	return h.Hex()
 }
 
+// MarshalJSON encodes the hash as a lowercase hex string.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 2*HashSize+2)
+	buf = append(buf, '"')
+	buf = hex.AppendEncode(buf, h[:])
+	return append(buf, '"'), nil
+}
+
+// UnmarshalJSON decodes a hex string as produced by MarshalJSON. Like the
+// standard decoders, it leaves the hash unchanged for null.
+func (h *Hash) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("hash must be a hex string: %w", err)
+	}
+	parsed, err := HashFromHex(s)
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
 // IsZero returns true if every byte is 0x00.
 func (h Hash) IsZero() bool {
 	return h == ZeroHash
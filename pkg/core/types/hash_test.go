@@ -0,0 +1,26 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHashJSON(t *testing.T) {
+	h := Hash{0xAB, 0xCD}
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"` + h.Hex() + `"`; string(data) != want {
+		t.Fatalf("Marshal = %s, want %s", data, want)
+	}
+	var got Hash
+	if err := json.Unmarshal(data, &got); err != nil || got != h {
+		t.Fatalf("Unmarshal = %x, %v", got, err)
+	}
+	for _, bad := range []string{`"abcd"`, `"zz"`, `[171,205]`} {
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", bad)
+		}
+	}
+}
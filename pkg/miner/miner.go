@@ -15,6 +15,9 @@ import (
 	"github.com/chronodrachma/chrd/pkg/p2p"
 )
 
+// MaxBlockTransactions bounds the transfers the miner puts in a block.
+const MaxBlockTransactions = 1000
+
 type Miner struct {
 	chain     *blockchain.Chain
 	hasher    consensus.Hasher // Must be initialized for mining (e.g. RandomX dataset)
@@ -82,13 +85,17 @@ func (m *Miner) miningLoop() {
 		foundBlockCh := make(chan *types.Block, 1)
 
 		go func(parentBlock *types.Block, miningCtx context.Context) {
-			// Calculate difficulty
-			getBlockInternal := func(h uint64) (*types.Block, error) {
-				return m.chain.GetBlockByHeight(h)
+			// Calculate target
+			getHeaderInternal := func(h uint64) (*types.BlockHeader, error) {
+				b, err := m.chain.GetBlockByHeight(h)
+				if err != nil {
+					return nil, err
+				}
+				return &b.Header, nil
 			}
-			difficulty, err := consensus.CalcNextRequiredDifficulty(parentBlock, getBlockInternal)
+			bits, err := consensus.CalcNextRequiredBits(&parentBlock.Header, getHeaderInternal)
 			if err != nil {
-				log.Printf("Miner: failed to calc difficulty: %v", err)
+				log.Printf("Miner: failed to calc target: %v", err)
 				// Retry after sleep? Or just wait for next tip?
 				// For now, small sleep and exit this attempt
 				time.Sleep(time.Second)
@@ -96,7 +103,7 @@ func (m *Miner) miningLoop() {
 			}
 
 			// Construct template
-			template := m.createBlockTemplate(parentBlock, difficulty)
+			template := m.createBlockTemplate(parentBlock, bits)
 
 			// Mine with N workers
 			if m.solveBlock(miningCtx, template) {
@@ -110,6 +117,7 @@ func (m *Miner) miningLoop() {
 		// 4. Wait for events
 		select {
 		case <-m.quit:
+			cancel()
 			return
 
 		case newTip := <-tipCh:
@@ -137,29 +145,35 @@ func (m *Miner) miningLoop() {
 	}
 }
 
-func (m *Miner) createBlockTemplate(parent *types.Block, difficulty uint64) *types.Block {
-	timestamp := time.Now()
+func (m *Miner) createBlockTemplate(parent *types.Block, bits uint32) *types.Block {
+	// Headers carry whole seconds; truncate so the template matches its encoding.
+	timestamp := time.Now().Truncate(time.Second)
 	// Ensure timestamp is greater than parent
-	if !timestamp.After(parent.Header.Timestamp) {
-		timestamp = parent.Header.Timestamp.Add(time.Second)
+	if timestamp.Unix() <= parent.Header.Timestamp.Unix() {
+		timestamp = time.Unix(parent.Header.Timestamp.Unix()+1, 0)
 	}
 
-	// Create coinbase
+	// Include the mempool transactions that apply on top of parent.
+	// Only their fees go to the coinbase.
+	pending, fees, err := m.chain.SelectTransactions(parent, m.mempool.Transactions(), MaxBlockTransactions)
+	if err != nil {
+		log.Printf("Miner: failed to select transactions: %v", err)
+		pending, fees = nil, 0
+	}
+
+	// Create coinbase collecting the block reward and the fees.
 	coinbase := &types.Transaction{
 		Type:      types.TxTypeCoinbase,
 		Timestamp: timestamp,
 		From:      types.ZeroHash,
 		To:        m.address,
-		Amount:    blockchain.BlockReward(parent.Header.Height + 1),
+		Amount:    blockchain.BlockReward(parent.Header.Height+1) + fees,
 		Fee:       0,
 		Nonce:     0,
 	}
 	coinbase.ID = coinbase.ComputeID()
 
 	txs := []*types.Transaction{coinbase}
-
-	// Include transactions from mempool
-	pending := m.mempool.GetPendingTransactions(1000)
 	txs = append(txs, pending...)
 
 	header := types.BlockHeader{
@@ -168,7 +182,7 @@ func (m *Miner) createBlockTemplate(parent *types.Block, difficulty uint64) *typ
 		Timestamp:     timestamp,
 		PrevBlockHash: parent.Hash,
 		MerkleRoot:    types.ComputeMerkleRoot(txs),
-		Difficulty:    difficulty,
+		Bits:          bits,
 		Nonce:         rand.Uint64(), // Start with random nonce
 	}
 
@@ -220,7 +234,7 @@ func (m *Miner) solveBlock(ctx context.Context, block *types.Block) bool {
 						return
 					}
 
-					if consensus.MeetsDifficulty(hash, header.Difficulty) {
+					if consensus.MeetsTarget(hash, header.Bits) {
 						// Found it!
 						// Update the shared block with the solution (Thread safe? only one writer wins)
 						// We need to signal we won.
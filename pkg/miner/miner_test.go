@@ -1,6 +1,7 @@
 package miner
 
 import (
+	"crypto/ed25519"
 	"testing"
 	"time"
 
@@ -149,7 +150,7 @@ func TestMiner_TipUpdate(t *testing.T) {
 
 	// Construct b2 on top of tip1.
 	fastHasher := consensus.NewSHA256Hasher()
-	b2 := buildManualBlock(t, fastHasher, tip1, minerAddr)
+	b2 := buildManualBlock(t, chain, fastHasher, tip1, minerAddr)
 
 	// Add b2 to chain.
 	if err := chain.AddBlock(b2); err != nil {
@@ -193,32 +194,119 @@ Loop:
 	}
 }
 
-func buildManualBlock(t *testing.T, hasher consensus.Hasher, parent *types.Block, miner types.Hash) *types.Block {
+func TestBlockTemplateSkipsInapplicableTransactions(t *testing.T) {
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	chain, store := mustNewTestChain(t, hasher)
+	defer store.Close()
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sender types.Hash
+	copy(sender[:], pub)
+	recipient := types.Hash{0x02}
+	tip, err := chain.InitGenesis(sender, 0, time.Now().Add(-1*time.Hour))
+	if err != nil {
+		t.Fatalf("genesis init failed: %v", err)
+	}
+	for i := uint64(0); i < blockchain.CoinbaseMaturity; i++ {
+		tip = buildManualBlock(t, chain, hasher, tip, types.Hash{0x01})
+		if err := chain.AddBlock(tip); err != nil {
+			t.Fatalf("AddBlock failed: %v", err)
+		}
+	}
+
+	transfer := func(amount types.Amount, nonce uint64) *types.Transaction {
+		tx := &types.Transaction{Type: types.TxTypeTransfer, Timestamp: time.Now(), From: sender, To: recipient, Amount: amount, Fee: 10, Nonce: nonce}
+		tx.Signature = ed25519.Sign(key, tx.Serialize())
+		tx.ID = tx.ComputeID()
+		return tx
+	}
+	mp := mempool.NewMempool(chain)
+	stale, next := transfer(1, 0), transfer(1, 1)
+	for _, tx := range []*types.Transaction{stale, next} {
+		if err := mp.AddTransaction(tx); err != nil {
+			t.Fatalf("AddTransaction failed: %v", err)
+		}
+	}
+
+	// A competing block spends the sender's nonce 0, so the first pending
+	// transaction no longer applies; the second now does.
+	tip = buildManualBlock(t, chain, hasher, tip, types.Hash{0x01}, transfer(2, 0))
+	if err := chain.AddBlock(tip); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+
+	m := NewMiner(chain, hasher, nil, mp, types.Hash{0x03})
+	template := m.createBlockTemplate(tip, nextBits(t, chain, tip))
+	if n := len(template.Transactions); n != 2 || template.Transactions[1] != next {
+		t.Fatalf("template has %d transactions, want the coinbase and the applicable transfer", n)
+	}
+	if got, want := template.Transactions[0].Amount, blockchain.BlockReward(tip.Header.Height+1)+next.Fee; got != want {
+		t.Errorf("coinbase amount = %d, want reward plus the included fee %d", got, want)
+	}
+	mineBlock(hasher, template)
+	if err := chain.AddBlock(template); err != nil {
+		t.Errorf("mined template rejected: %v", err)
+	}
+}
+
+// buildManualBlock builds and mines a block holding txs on parent, the
+// chain's tip.
+func buildManualBlock(t *testing.T, chain *blockchain.Chain, hasher consensus.Hasher, parent *types.Block, miner types.Hash, txs ...*types.Transaction) *types.Block {
 	t.Helper()
 	height := parent.Header.Height + 1
+	bits := nextBits(t, chain, parent)
+	fees, err := blockchain.TotalFees(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
 	coinbase := &types.Transaction{
-		Type: types.TxTypeCoinbase, Timestamp: time.Now(), From: types.ZeroHash, To: miner, Amount: blockchain.BlockReward(height), Nonce: height,
+		Type: types.TxTypeCoinbase, Timestamp: time.Now(), From: types.ZeroHash, To: miner, Amount: blockchain.BlockReward(height) + fees, Nonce: height,
 	}
 	coinbase.ID = coinbase.ComputeID()
+	txs = append([]*types.Transaction{coinbase}, txs...)
 
 	block := &types.Block{
 		Header: types.BlockHeader{
-			Version: 1, Height: height, Timestamp: time.Now(), PrevBlockHash: parent.Hash,
-			MerkleRoot: types.ComputeMerkleRoot([]*types.Transaction{coinbase}),
-			Difficulty: 0, Nonce: 0, // Diff 0 for easy mining
+			Version: 1, Height: height, Timestamp: parent.Header.Timestamp.Add(time.Second), PrevBlockHash: parent.Hash,
+			MerkleRoot: types.ComputeMerkleRoot(txs),
+			Bits:       bits,
 		},
-		Transactions: []*types.Transaction{coinbase},
+		Transactions: txs,
 	}
+	mineBlock(hasher, block)
+	return block
+}
 
-	// Mine it
+// nextBits returns the target of the block after parent, the chain's tip.
+func nextBits(t *testing.T, chain *blockchain.Chain, parent *types.Block) uint32 {
+	t.Helper()
+	bits, err := consensus.CalcNextRequiredBits(&parent.Header, func(h uint64) (*types.BlockHeader, error) {
+		b, err := chain.GetBlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		return &b.Header, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bits
+}
+
+// mineBlock searches for a nonce that meets the block's target.
+func mineBlock(hasher consensus.Hasher, block *types.Block) {
 	for {
 		block.Hash = block.ComputeHash()
 		pow, _ := hasher.Hash(block.Header.Serialize())
 		block.PowHash = pow
-		if consensus.MeetsDifficulty(pow, 0) {
+		if consensus.MeetsTarget(pow, block.Header.Bits) {
 			break
 		}
 		block.Header.Nonce++
 	}
-	return block
 }
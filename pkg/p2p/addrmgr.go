@@ -0,0 +1,447 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	// MaxKnownAddresses bounds the address book. When it is full the
+	// least recently seen address makes room for a new one.
+	MaxKnownAddresses = 2000
+
+	// MaxAddrFailures is the number of consecutive failed connection
+	// attempts after which an address is forgotten.
+	MaxAddrFailures = 10
+
+	// RetryBaseDelay and MaxRetryDelay bound the exponential backoff
+	// between connection attempts to the same address.
+	RetryBaseDelay = 30 * time.Second
+	MaxRetryDelay  = time.Hour
+
+	// MaxAddrsPerSource bounds the entries learned from the peers of one
+	// network group, and MaxAddrsPerGroup the entries in one network group,
+	// so that no single source can fill the book with its own addresses.
+	MaxAddrsPerSource = MaxKnownAddresses / 8
+	MaxAddrsPerGroup  = MaxKnownAddresses / 16
+
+	// AddrGossipPenalty ages the LastSeen of addresses learned from peers,
+	// so that gossip can never look fresher than a node we saw ourselves.
+	AddrGossipPenalty = 2 * time.Hour
+)
+
+// addrKeyPrefix prefixes the address book entries in the database.
+const addrKeyPrefix = "p2p:addr:"
+
+// KnownAddress is an address book entry.
+type KnownAddress struct {
+	Addr        string    // host:port
+	LastSeen    time.Time // Last time the node was known to be up.
+	LastAttempt time.Time // Last time we tried to connect.
+	LastSuccess time.Time // Last time a connection succeeded.
+	Attempts    int       // Consecutive failed attempts.
+
+	// source is the network group of the peer that told us about the
+	// address; empty if we learned it ourselves or loaded it from disk.
+	source string
+}
+
+// retryAt returns when the address may be tried again.
+func (ka *KnownAddress) retryAt() time.Time {
+	if ka.Attempts == 0 {
+		return ka.LastAttempt
+	}
+	delay := MaxRetryDelay
+	if ka.Attempts < 32 {
+		delay = min(RetryBaseDelay<<(ka.Attempts-1), MaxRetryDelay)
+	}
+	return ka.LastAttempt.Add(delay)
+}
+
+// AddrManager is the address book of known peers. Entries are persisted in
+// the database, if one is given, so they survive restarts.
+type AddrManager struct {
+	db    *badger.DB // nil keeps the book in memory only.
+	mu    sync.Mutex
+	addrs map[string]*KnownAddress
+
+	bySource map[string]int // Entries per source group.
+	byGroup  map[string]int // Entries per network group.
+}
+
+// NewAddrManager loads the address book from db. A nil db gives an empty,
+// in-memory book.
+func NewAddrManager(db *badger.DB) (*AddrManager, error) {
+	a := &AddrManager{
+		db:       db,
+		addrs:    make(map[string]*KnownAddress),
+		bySource: make(map[string]int),
+		byGroup:  make(map[string]int),
+	}
+	if db == nil {
+		return a, nil
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(addrKeyPrefix)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			addr := string(item.Key()[len(prefix):])
+			err := item.Value(func(val []byte) error {
+				ka, err := decodeKnownAddress(addr, val)
+				if err != nil {
+					return err
+				}
+				a.insert(ka)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load address book: %w", err)
+	}
+	return a, nil
+}
+
+// validAddr reports whether addr is a dialable host:port.
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || len(addr) > 255 {
+		return false
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return false
+	}
+	return true
+}
+
+// addrGroup returns the network group of addr: its /16 for IPv4, its /32
+// for IPv6, and the host itself for names.
+func addrGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
+
+// Add records that addr was up at lastSeen. Invalid addresses are ignored.
+func (a *AddrManager) Add(addr string, lastSeen time.Time) {
+	a.addAll([]NetAddress{{Addr: addr, LastSeen: lastSeen}}, "")
+}
+
+// AddGossiped records the addresses a peer at source sent us. Their LastSeen
+// is aged by AddrGossipPenalty, and the peer's network group may contribute
+// at most MaxAddrsPerSource entries, at most MaxAddrsPerGroup of them in any
+// one network group.
+func (a *AddrManager) AddGossiped(addrs []NetAddress, source string) {
+	cutoff := time.Now().Add(-AddrGossipPenalty)
+	aged := make([]NetAddress, len(addrs))
+	for i, na := range addrs {
+		if na.LastSeen.After(cutoff) {
+			na.LastSeen = cutoff
+		}
+		aged[i] = na
+	}
+	a.addAll(aged, addrGroup(source))
+}
+
+// addAll records addrs, learned from source, and writes the changes to the
+// database in one transaction.
+func (a *AddrManager) addAll(addrs []NetAddress, source string) {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var saved, evicted []string
+	for _, na := range addrs {
+		if !validAddr(na.Addr) {
+			continue
+		}
+		// Don't believe timestamps from the future.
+		lastSeen := na.LastSeen
+		if lastSeen.After(now) {
+			lastSeen = now
+		}
+
+		if ka, ok := a.addrs[na.Addr]; ok {
+			if !lastSeen.After(ka.LastSeen) {
+				continue
+			}
+			ka.LastSeen = lastSeen
+		} else {
+			if source != "" && (a.bySource[source] >= MaxAddrsPerSource ||
+				a.byGroup[addrGroup(na.Addr)] >= MaxAddrsPerGroup) {
+				continue
+			}
+			if len(a.addrs) >= MaxKnownAddresses {
+				evicted = append(evicted, a.evict())
+			}
+			a.insert(&KnownAddress{Addr: na.Addr, LastSeen: lastSeen, source: source})
+		}
+		saved = append(saved, na.Addr)
+	}
+	a.write(saved, evicted)
+}
+
+// evict drops the least recently seen address we never connected to, or
+// the least recently seen address if we connected to all of them, and
+// returns it. a.mu must be held and the book must not be empty.
+func (a *AddrManager) evict() string {
+	var oldest *KnownAddress
+	for _, ka := range a.addrs {
+		switch {
+		case oldest == nil:
+			oldest = ka
+		case ka.LastSuccess.IsZero() != oldest.LastSuccess.IsZero():
+			if ka.LastSuccess.IsZero() {
+				oldest = ka
+			}
+		case ka.LastSeen.Before(oldest.LastSeen):
+			oldest = ka
+		}
+	}
+	a.drop(oldest.Addr)
+	return oldest.Addr
+}
+
+// Attempt records a connection attempt to addr. After MaxAddrFailures
+// attempts without a success the address is forgotten.
+func (a *AddrManager) Attempt(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = time.Now()
+	ka.Attempts++
+	if ka.Attempts > MaxAddrFailures {
+		a.remove(addr)
+		return
+	}
+	a.save(ka)
+}
+
+// Good records a successful connection to addr.
+func (a *AddrManager) Good(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Attempts = 0
+	a.save(ka)
+}
+
+// Remove forgets addr.
+func (a *AddrManager) Remove(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remove(addr)
+}
+
+// Select picks a random address for an outbound connection among those
+// whose retry backoff has elapsed and for which skip returns false.
+func (a *AddrManager) Select(skip func(addr string) bool) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var candidates []string
+	for addr, ka := range a.addrs {
+		if ka.retryAt().After(now) || skip(addr) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[rand.IntN(len(candidates))], true
+}
+
+// Addresses returns up to n addresses to share with peers, most recently
+// seen first. Addresses that are currently failing are left out.
+func (a *AddrManager) Addresses(n int) []NetAddress {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]NetAddress, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		if ka.Attempts > 0 {
+			continue
+		}
+		list = append(list, NetAddress{Addr: ka.Addr, LastSeen: ka.LastSeen})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Get returns a copy of the entry for addr.
+func (a *AddrManager) Get(addr string) (KnownAddress, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *ka, true
+}
+
+// Len returns the number of known addresses.
+func (a *AddrManager) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.addrs)
+}
+
+// insert adds ka to the book in memory. a.mu must be held.
+func (a *AddrManager) insert(ka *KnownAddress) {
+	a.addrs[ka.Addr] = ka
+	a.byGroup[addrGroup(ka.Addr)]++
+	if ka.source != "" {
+		a.bySource[ka.source]++
+	}
+}
+
+// drop deletes addr from the book in memory. a.mu must be held.
+func (a *AddrManager) drop(addr string) {
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return
+	}
+	delete(a.addrs, addr)
+	decrement(a.byGroup, addrGroup(addr))
+	if ka.source != "" {
+		decrement(a.bySource, ka.source)
+	}
+}
+
+func decrement(counts map[string]int, key string) {
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// remove deletes addr from memory and the database. a.mu must be held.
+func (a *AddrManager) remove(addr string) {
+	a.drop(addr)
+	a.write(nil, []string{addr})
+}
+
+// save writes ka to the database. a.mu must be held.
+func (a *AddrManager) save(ka *KnownAddress) {
+	a.write([]string{ka.Addr}, nil)
+}
+
+// write stores the saved entries that are still in the book and deletes
+// the removed ones that are not, in one transaction. a.mu must be held.
+func (a *AddrManager) write(saved, removed []string) {
+	if a.db == nil || len(saved)+len(removed) == 0 {
+		return
+	}
+	err := a.db.Update(func(txn *badger.Txn) error {
+		for _, addr := range removed {
+			if _, ok := a.addrs[addr]; ok {
+				continue
+			}
+			if err := txn.Delete([]byte(addrKeyPrefix + addr)); err != nil {
+				return err
+			}
+		}
+		for _, addr := range saved {
+			ka, ok := a.addrs[addr]
+			if !ok {
+				continue
+			}
+			if err := txn.Set([]byte(addrKeyPrefix+addr), encodeKnownAddress(ka)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to update address book: %v", err)
+	}
+}
+
+// knownAddressSize is the length of a stored entry:
+// LastSeen(8) || LastAttempt(8) || LastSuccess(8) || Attempts(4).
+const knownAddressSize = 28
+
+func encodeKnownAddress(ka *KnownAddress) []byte {
+	buf := make([]byte, 0, knownAddressSize)
+	buf = binary.BigEndian.AppendUint64(buf, unixOrZero(ka.LastSeen))
+	buf = binary.BigEndian.AppendUint64(buf, unixOrZero(ka.LastAttempt))
+	buf = binary.BigEndian.AppendUint64(buf, unixOrZero(ka.LastSuccess))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(ka.Attempts))
+	return buf
+}
+
+func decodeKnownAddress(addr string, val []byte) (*KnownAddress, error) {
+	if len(val) != knownAddressSize {
+		return nil, errors.New("invalid address entry length for " + addr)
+	}
+	return &KnownAddress{
+		Addr:        addr,
+		LastSeen:    timeOrZero(binary.BigEndian.Uint64(val[0:8])),
+		LastAttempt: timeOrZero(binary.BigEndian.Uint64(val[8:16])),
+		LastSuccess: timeOrZero(binary.BigEndian.Uint64(val[16:24])),
+		Attempts:    int(binary.BigEndian.Uint32(val[24:28])),
+	}, nil
+}
+
+// unixOrZero stores the zero time as 0 rather than its (negative) Unix value.
+func unixOrZero(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+func timeOrZero(sec uint64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(sec), 0)
+}
@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestAddrManagerPersists(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAddrManager(db)
+	if err != nil {
+		t.Fatalf("NewAddrManager failed: %v", err)
+	}
+	seen := time.Unix(1_700_000_000, 0)
+	a.Add("10.0.0.1:3000", seen)
+	a.Add("10.0.0.2:3000", seen)
+	a.Attempt("10.0.0.2:3000")
+	a.Remove("10.0.0.1:3000")
+
+	// Invalid addresses are ignored.
+	for _, addr := range []string{"10.0.0.3", "10.0.0.3:0", "0.0.0.0:3000", ":3000"} {
+		a.Add(addr, seen)
+	}
+
+	reloaded, err := NewAddrManager(db)
+	if err != nil {
+		t.Fatalf("reloading address book failed: %v", err)
+	}
+	if reloaded.Len() != 1 {
+		t.Fatalf("reloaded %d addresses, want 1", reloaded.Len())
+	}
+	ka, ok := reloaded.Get("10.0.0.2:3000")
+	if !ok {
+		t.Fatal("10.0.0.2:3000 was not persisted")
+	}
+	if !ka.LastSeen.Equal(seen) || ka.Attempts != 1 || ka.LastAttempt.IsZero() {
+		t.Errorf("unexpected reloaded entry: %+v", ka)
+	}
+}
+
+func TestAddrManagerBackoff(t *testing.T) {
+	a, _ := NewAddrManager(nil)
+	const addr = "10.0.0.1:3000"
+	a.Add(addr, time.Now())
+	none := func(string) bool { return false }
+
+	if got, ok := a.Select(none); !ok || got != addr {
+		t.Fatalf("Select = %q, %v; want %q", got, ok, addr)
+	}
+	if _, ok := a.Select(func(string) bool { return true }); ok {
+		t.Error("Select returned a skipped address")
+	}
+
+	// A failed attempt puts the address on hold.
+	a.Attempt(addr)
+	if _, ok := a.Select(none); ok {
+		t.Error("address selected again before its retry delay")
+	}
+	if len(a.Addresses(10)) != 0 {
+		t.Error("failing address shared with peers")
+	}
+
+	// Once the delay has passed it is tried again.
+	a.mu.Lock()
+	a.addrs[addr].LastAttempt = time.Now().Add(-RetryBaseDelay - time.Second)
+	a.mu.Unlock()
+	if _, ok := a.Select(none); !ok {
+		t.Error("address not retried after its delay")
+	}
+
+	// Success clears the failures.
+	a.Good(addr)
+	if _, ok := a.Select(none); !ok {
+		t.Error("good address not selectable")
+	}
+	if len(a.Addresses(10)) != 1 {
+		t.Error("good address not shared")
+	}
+
+	// Too many failures in a row and it is forgotten.
+	for i := 0; i <= MaxAddrFailures; i++ {
+		a.Attempt(addr)
+	}
+	if a.Len() != 0 {
+		t.Error("address kept after MaxAddrFailures failures")
+	}
+}
+
+func TestAddrManagerGossipLimits(t *testing.T) {
+	a, _ := NewAddrManager(nil)
+	now := time.Now()
+
+	// A node we connected to.
+	const good = "192.168.1.1:3000"
+	a.Add(good, now)
+	a.Good(good)
+
+	// Gossip can't claim to be fresher than AddrGossipPenalty ago.
+	a.AddGossiped([]NetAddress{{Addr: "172.16.0.1:3000", LastSeen: now}}, "203.0.113.9:3000")
+	cutoff := time.Now().Add(-AddrGossipPenalty)
+	if ka, _ := a.Get("172.16.0.1:3000"); ka.LastSeen.After(cutoff) {
+		t.Errorf("gossiped LastSeen = %v, want at most %v", ka.LastSeen, cutoff)
+	}
+
+	// One network group takes at most MaxAddrsPerGroup entries.
+	var list []NetAddress
+	for i := 0; i < MaxAddrPerMsg; i++ {
+		list = append(list, NetAddress{Addr: fmt.Sprintf("10.1.%d.%d:3000", i/250, i%250+1), LastSeen: now})
+	}
+	a.AddGossiped(list, "198.51.100.1:3000")
+	if n := a.Len(); n != 2+MaxAddrsPerGroup {
+		t.Fatalf("book has %d addresses after gossip from one group, want %d", n, 2+MaxAddrsPerGroup)
+	}
+
+	// Peers in one network group contribute at most MaxAddrsPerSource
+	// entries, however many messages they send.
+	for round := 0; round < 4; round++ {
+		list = list[:0]
+		for i := 0; i < MaxAddrPerMsg; i++ {
+			list = append(list, NetAddress{Addr: fmt.Sprintf("10.%d.%d.1:3000", 10+round*4+i/250, i%250), LastSeen: now})
+		}
+		a.AddGossiped(list, fmt.Sprintf("198.51.%d.1:3000", round))
+	}
+	if n := a.Len(); n != 2+MaxAddrsPerSource {
+		t.Fatalf("book has %d addresses after gossip from one source group, want %d", n, 2+MaxAddrsPerSource)
+	}
+
+	// Filling the book from many sources evicts gossip, not the node we
+	// connected to.
+	for src := 0; src < 2*MaxKnownAddresses/MaxAddrsPerGroup; src++ {
+		list = list[:0]
+		for i := 0; i < MaxAddrsPerGroup; i++ {
+			list = append(list, NetAddress{Addr: fmt.Sprintf("%d.%d.%d.1:3000", 20+src, i, src), LastSeen: now})
+		}
+		a.AddGossiped(list, fmt.Sprintf("%d.0.0.1:3000", 100+src))
+	}
+	if a.Len() != MaxKnownAddresses {
+		t.Errorf("book has %d addresses, want %d", a.Len(), MaxKnownAddresses)
+	}
+	if _, ok := a.Get(good); !ok {
+		t.Error("gossip evicted an address we connected to")
+	}
+}
+
+func TestAddrManagerAddGossipedWritesOnce(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAddrManager(db)
+	if err != nil {
+		t.Fatalf("NewAddrManager failed: %v", err)
+	}
+	var list []NetAddress
+	for i := 0; i < 10; i++ {
+		list = append(list, NetAddress{Addr: fmt.Sprintf("10.%d.0.1:3000", i), LastSeen: time.Now()})
+	}
+	before := db.MaxVersion()
+	a.AddGossiped(list, "198.51.100.1:3000")
+	if commits := db.MaxVersion() - before; commits != 1 {
+		t.Errorf("AddGossiped made %d commits, want 1", commits)
+	}
+
+	reloaded, err := NewAddrManager(db)
+	if err != nil {
+		t.Fatalf("reloading address book failed: %v", err)
+	}
+	if reloaded.Len() != len(list) {
+		t.Errorf("reloaded %d addresses, want %d", reloaded.Len(), len(list))
+	}
+}
@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// banKeyPrefix prefixes the ban entries in the database.
+const banKeyPrefix = "p2p:ban:"
+
+// BanEntry is a banned host and when its ban expires.
+type BanEntry struct {
+	Host  string
+	Until time.Time
+}
+
+// BanList holds the banned hosts. Entries are persisted in the database, if
+// one is given, so bans survive restarts.
+type BanList struct {
+	db   *badger.DB // nil keeps the list in memory only.
+	mu   sync.Mutex
+	bans map[string]time.Time
+}
+
+// NewBanList loads the unexpired bans from db. A nil db gives an empty,
+// in-memory list.
+func NewBanList(db *badger.DB) (*BanList, error) {
+	b := &BanList{
+		db:   db,
+		bans: make(map[string]time.Time),
+	}
+	if db == nil {
+		return b, nil
+	}
+
+	now := time.Now()
+	var expired []string
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(banKeyPrefix)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			host := string(item.Key()[len(prefix):])
+			err := item.Value(func(val []byte) error {
+				if len(val) != 8 {
+					return fmt.Errorf("invalid ban entry length for %s", host)
+				}
+				until := time.Unix(int64(binary.BigEndian.Uint64(val)), 0)
+				if until.Before(now) {
+					expired = append(expired, host)
+					return nil
+				}
+				b.bans[host] = until
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load ban list: %w", err)
+	}
+
+	for _, host := range expired {
+		b.delete(host)
+	}
+	return b, nil
+}
+
+// Ban bans host until the given time, replacing any existing ban.
+func (b *BanList) Ban(host string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans[host] = until
+	if b.db == nil {
+		return
+	}
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(banKeyPrefix+host), binary.BigEndian.AppendUint64(nil, uint64(until.Unix())))
+	})
+	if err != nil {
+		log.Printf("Failed to save ban of %s: %v", host, err)
+	}
+}
+
+// Unban lifts the ban on host. It reports whether host was banned.
+func (b *BanList) Unban(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.bans[host]
+	b.delete(host)
+	return ok
+}
+
+// IsBanned reports whether host is currently banned.
+func (b *BanList) IsBanned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.bans[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		b.delete(host)
+		return false
+	}
+	return true
+}
+
+// List returns the current bans, ordered by host.
+func (b *BanList) List() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	list := make([]BanEntry, 0, len(b.bans))
+	for host, until := range b.bans {
+		if now.After(until) {
+			continue
+		}
+		list = append(list, BanEntry{Host: host, Until: until})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+// delete removes host from memory and the database. b.mu must be held,
+// except during NewBanList.
+func (b *BanList) delete(host string) {
+	delete(b.bans, host)
+	if b.db == nil {
+		return
+	}
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(banKeyPrefix + host))
+	})
+	if err != nil {
+		log.Printf("Failed to delete ban of %s: %v", host, err)
+	}
+}
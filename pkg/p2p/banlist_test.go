@@ -0,0 +1,44 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestBanListPersists(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	b, err := NewBanList(db)
+	if err != nil {
+		t.Fatalf("NewBanList failed: %v", err)
+	}
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	b.Ban("10.0.0.1", until)
+	b.Ban("10.0.0.2", until)
+	b.Ban("10.0.0.3", time.Now().Add(-time.Second)) // Already expired.
+	if !b.Unban("10.0.0.2") {
+		t.Error("Unban of a banned host returned false")
+	}
+	if b.Unban("10.0.0.9") {
+		t.Error("Unban of an unknown host returned true")
+	}
+
+	reloaded, err := NewBanList(db)
+	if err != nil {
+		t.Fatalf("reloading ban list failed: %v", err)
+	}
+	want := []BanEntry{{Host: "10.0.0.1", Until: until}}
+	got := reloaded.List()
+	if len(got) != 1 || got[0].Host != want[0].Host || !got[0].Until.Equal(until) {
+		t.Errorf("reloaded bans = %+v, want %+v", got, want)
+	}
+	if !reloaded.IsBanned("10.0.0.1") || reloaded.IsBanned("10.0.0.2") || reloaded.IsBanned("10.0.0.3") {
+		t.Error("IsBanned disagrees with the reloaded list")
+	}
+}
@@ -0,0 +1,233 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// ShortIDSize is the length of a ShortID.
+const ShortIDSize = 6
+
+// ShortID identifies a transaction within one compact block: the first
+// ShortIDSize bytes of SHA-256(BlockHash || Nonce || TxID). Salting with the
+// block hash and a per-message nonce keeps anyone from crafting transactions
+// whose short IDs collide in every block.
+type ShortID [ShortIDSize]byte
+
+// shortTxID returns the short ID of txID in the compact block of blockHash
+// sent with nonce.
+func shortTxID(blockHash types.Hash, nonce uint64, txID types.Hash) ShortID {
+	buf := make([]byte, 0, 2*types.HashSize+8)
+	buf = append(buf, blockHash[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, nonce)
+	buf = append(buf, txID[:]...)
+	sum := types.ComputeSHA256(buf)
+
+	var id ShortID
+	copy(id[:], sum[:ShortIDSize])
+	return id
+}
+
+// newCompactBlock returns the compact form of block. The coinbase is
+// prefilled, as no peer has it in its mempool. It returns nil if block has
+// too many transactions to be relayed compactly.
+func newCompactBlock(block *types.Block) *MsgCmpctBlock {
+	if len(block.Transactions) == 0 || len(block.Transactions) > MaxCompactTxs {
+		return nil
+	}
+	m := &MsgCmpctBlock{
+		Header:    block.Header,
+		PowHash:   block.PowHash,
+		Nonce:     randomNonce(),
+		ShortIDs:  make([]ShortID, 0, len(block.Transactions)-1),
+		Prefilled: []PrefilledTx{{Index: 0, Tx: block.Transactions[0]}},
+	}
+	for _, tx := range block.Transactions[1:] {
+		m.ShortIDs = append(m.ShortIDs, shortTxID(block.Hash, m.Nonce, tx.ID))
+	}
+	return m
+}
+
+// partialBlock is a block being rebuilt from a MsgCmpctBlock.
+type partialBlock struct {
+	header  types.BlockHeader
+	hash    types.Hash
+	powHash types.Hash
+	txs     []*types.Transaction // nil where the transaction is missing.
+	missing []uint16             // Indexes of the nil entries, increasing.
+}
+
+// newPartialBlock lays out the transactions of m, filling in the prefilled
+// ones and those of pool whose short IDs match. A short ID that matches
+// several transactions, or that appears twice in m, is left missing rather
+// than guessed.
+func newPartialBlock(m *MsgCmpctBlock, pool []*types.Transaction) (*partialBlock, error) {
+	n := len(m.ShortIDs) + len(m.Prefilled)
+	b := &partialBlock{
+		header:  m.Header,
+		hash:    m.Header.ComputeHash(),
+		powHash: m.PowHash,
+		txs:     make([]*types.Transaction, n),
+	}
+
+	prefilled := make([]bool, n)
+	for _, p := range m.Prefilled {
+		if int(p.Index) >= n {
+			return nil, fmt.Errorf("prefilled index %d out of range", p.Index)
+		}
+		b.txs[p.Index] = p.Tx
+		prefilled[p.Index] = true
+	}
+
+	// Map each short ID to its index in the block; -1 marks duplicates.
+	slots := make(map[ShortID]int, len(m.ShortIDs))
+	index := 0
+	for _, id := range m.ShortIDs {
+		for prefilled[index] {
+			index++
+		}
+		if _, dup := slots[id]; dup {
+			slots[id] = -1
+		} else {
+			slots[id] = index
+		}
+		index++
+	}
+
+	ambiguous := make(map[int]bool)
+	for _, tx := range pool {
+		i, ok := slots[shortTxID(b.hash, m.Nonce, tx.ID)]
+		if !ok || i < 0 {
+			continue
+		}
+		if b.txs[i] != nil && b.txs[i].ID != tx.ID {
+			ambiguous[i] = true
+		}
+		b.txs[i] = tx
+	}
+	for i := range ambiguous {
+		b.txs[i] = nil
+	}
+
+	for i, tx := range b.txs {
+		if tx == nil {
+			b.missing = append(b.missing, uint16(i))
+		}
+	}
+	return b, nil
+}
+
+// fill inserts the transactions answering a MsgGetBlockTx for b.missing.
+func (b *partialBlock) fill(txs []*types.Transaction) error {
+	if len(txs) != len(b.missing) {
+		return fmt.Errorf("got %d transactions for %d missing", len(txs), len(b.missing))
+	}
+	for i, index := range b.missing {
+		b.txs[index] = txs[i]
+	}
+	b.missing = nil
+	return nil
+}
+
+// block returns the rebuilt block once no transactions are missing, or
+// false if its transactions don't match the header's merkle root (a short
+// ID collision, or a lying peer).
+func (b *partialBlock) block() (*types.Block, bool) {
+	if len(b.missing) > 0 || types.ComputeMerkleRoot(b.txs) != b.header.MerkleRoot {
+		return nil, false
+	}
+	return &types.Block{
+		Header:       b.header,
+		Transactions: b.txs,
+		Hash:         b.hash,
+		PowHash:      b.powHash,
+	}, true
+}
+
+// supportsCompactBlocks reports whether the peer can serve MsgCmpctBlock.
+func (p *Peer) supportsCompactBlocks() bool {
+	v := p.RemoteVersion()
+	return v != nil && v.Version >= CompactBlocksVersion
+}
+
+// handleCmpctBlock rebuilds the block in m from our mempool, asking p for
+// the transactions we lack.
+func (p *Peer) handleCmpctBlock(m *MsgCmpctBlock) {
+	hash := m.Header.ComputeHash()
+	iv := InvVect{Type: InvTypeBlock, Hash: hash}
+	p.knownInv.Add(iv)
+	if p.Server.Chain.HaveBlock(hash) {
+		p.Server.requests.received(iv)
+		return
+	}
+
+	b, err := newPartialBlock(m, p.Server.Mempool.Transactions())
+	if err != nil {
+		p.Misbehaving(BanThreshold, fmt.Sprintf("invalid compact block %x: %v", hash[:8], err))
+		return
+	}
+	if pending := p.compact; pending != nil && pending.hash != hash {
+		// A peer sends one compact block at a time; fetch the abandoned
+		// one in full.
+		p.Send(&MsgGetData{Inventory: []InvVect{{Type: InvTypeBlock, Hash: pending.hash}}})
+	}
+	p.compact = nil
+
+	if len(b.missing) > 0 {
+		log.Printf("Compact block %x from %s: %d of %d transactions missing", hash[:8], p.Conn.RemoteAddr(), len(b.missing), len(b.txs))
+		p.compact = b
+		p.Send(&MsgGetBlockTx{BlockHash: hash, Indexes: b.missing})
+		return
+	}
+	p.completeCompact(b)
+}
+
+// handleBlockTx completes the pending compact block with the transactions
+// p sent.
+func (p *Peer) handleBlockTx(m *MsgBlockTx) {
+	b := p.compact
+	if b == nil || b.hash != m.BlockHash {
+		p.Misbehaving(10, fmt.Sprintf("unrequested transactions for block %x", m.BlockHash[:8]))
+		return
+	}
+	p.compact = nil
+	if err := b.fill(m.Txs); err != nil {
+		p.Misbehaving(20, fmt.Sprintf("block transactions %x: %v", b.hash[:8], err))
+		p.Send(&MsgGetData{Inventory: []InvVect{{Type: InvTypeBlock, Hash: b.hash}}})
+		return
+	}
+	p.completeCompact(b)
+}
+
+// completeCompact processes a rebuilt block, falling back to fetching it in
+// full if the transactions don't match its header.
+func (p *Peer) completeCompact(b *partialBlock) {
+	block, ok := b.block()
+	if !ok {
+		log.Printf("Compact block %x from %s doesn't match its merkle root, fetching it in full", b.hash[:8], p.Conn.RemoteAddr())
+		p.Send(&MsgGetData{Inventory: []InvVect{{Type: InvTypeBlock, Hash: b.hash}}})
+		return
+	}
+	p.handleBlock(block)
+}
+
+// handleGetBlockTx sends the transactions of a block p is rebuilding.
+func (p *Peer) handleGetBlockTx(m *MsgGetBlockTx) {
+	block, err := p.Server.Chain.GetBlockByHash(m.BlockHash)
+	if err != nil {
+		p.Send(&MsgNotFound{Inventory: []InvVect{{Type: InvTypeBlock, Hash: m.BlockHash}}})
+		return
+	}
+	txs := make([]*types.Transaction, len(m.Indexes))
+	for i, index := range m.Indexes {
+		if int(index) >= len(block.Transactions) {
+			p.Misbehaving(BanThreshold, fmt.Sprintf("transaction index %d out of range for block %x", index, m.BlockHash[:8]))
+			return
+		}
+		txs[i] = block.Transactions[index]
+	}
+	p.Send(&MsgBlockTx{BlockHash: m.BlockHash, Txs: txs})
+}
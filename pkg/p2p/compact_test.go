@@ -0,0 +1,152 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// newTestTransfer returns a transfer signed with key, from the address of
+// key's public key.
+func newTestTransfer(key ed25519.PrivateKey, to types.Hash, amount types.Amount, nonce uint64) *types.Transaction {
+	tx := &types.Transaction{
+		Type:      types.TxTypeTransfer,
+		Timestamp: time.Unix(1_700_000_000, 0),
+		To:        to,
+		Amount:    amount,
+		Fee:       1,
+		Nonce:     nonce,
+	}
+	copy(tx.From[:], key.Public().(ed25519.PublicKey))
+	tx.Signature = ed25519.Sign(key, tx.Serialize())
+	tx.ID = tx.ComputeID()
+	return tx
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := &types.Transaction{Type: types.TxTypeCoinbase, To: types.Hash{0x0C}, Amount: types.BlockReward}
+	coinbase.ID = coinbase.ComputeID()
+	txs := []*types.Transaction{coinbase}
+	for i := uint64(0); i < 6; i++ {
+		txs = append(txs, newTestTransfer(key, types.Hash{0x0D}, 10, i))
+	}
+	block := &types.Block{
+		Header:       types.BlockHeader{Version: 1, Height: 7, Timestamp: time.Unix(1_700_000_000, 0)},
+		Transactions: txs,
+		PowHash:      types.Hash{0x99},
+	}
+	block.Header.MerkleRoot = types.ComputeMerkleRoot(txs)
+	block.Hash = block.ComputeHash()
+
+	cmpct := newCompactBlock(block)
+	if len(cmpct.ShortIDs) != 6 || len(cmpct.Prefilled) != 1 || cmpct.Prefilled[0].Tx != coinbase {
+		t.Fatalf("compact block has %d short IDs and %d prefilled, want 6 and the coinbase", len(cmpct.ShortIDs), len(cmpct.Prefilled))
+	}
+
+	// The mempool lacks transactions 2 and 5 and holds an unrelated one.
+	pool := []*types.Transaction{txs[4], txs[1], txs[6], txs[3], newTestTransfer(key, types.Hash{0x0E}, 3, 9)}
+	b, err := newPartialBlock(cmpct, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{2, 5}; !reflect.DeepEqual(b.missing, want) {
+		t.Fatalf("missing = %v, want %v", b.missing, want)
+	}
+	if _, ok := b.block(); ok {
+		t.Fatal("incomplete block was built")
+	}
+	if err := b.fill([]*types.Transaction{txs[2]}); err == nil {
+		t.Error("fill accepted too few transactions")
+	}
+	if err := b.fill([]*types.Transaction{txs[2], txs[5]}); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := b.block()
+	if !ok {
+		t.Fatal("rebuilt block doesn't match its merkle root")
+	}
+	if !reflect.DeepEqual(got, block) {
+		t.Errorf("rebuilt block differs from the original")
+	}
+
+	// Wrong transactions are caught by the merkle root.
+	b, _ = newPartialBlock(cmpct, nil)
+	wrong := append([]*types.Transaction(nil), txs[1:]...)
+	wrong[0], wrong[1] = wrong[1], wrong[0]
+	if err := b.fill(wrong); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.block(); ok {
+		t.Error("block with reordered transactions was accepted")
+	}
+
+	// A short ID sent twice is never guessed.
+	cmpct.ShortIDs[3] = cmpct.ShortIDs[0]
+	b, _ = newPartialBlock(cmpct, txs)
+	if want := []uint16{1, 4}; !reflect.DeepEqual(b.missing, want) {
+		t.Errorf("missing with a duplicate short ID = %v, want %v", b.missing, want)
+	}
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	s := newTestServer(t, "test", testGenesisTime)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr types.Hash
+	copy(addr[:], key.Public().(ed25519.PublicKey))
+	mineTestBlocks(t, s.Chain, addr, int(blockchain.CoinbaseMaturity)+1)
+
+	// The next block holds one transaction s has and one it doesn't.
+	known := newTestTransfer(key, types.Hash{0x0D}, 10, 0)
+	unknown := newTestTransfer(key, types.Hash{0x0D}, 20, 1)
+	if err := s.Mempool.AddTransaction(known); err != nil {
+		t.Fatal(err)
+	}
+	block := newTestBlock(t, s.Chain, addr, known, unknown)
+
+	conn := dialHandshaked(t, s)
+	blockInv := InvVect{Type: InvTypeBlock, Hash: block.Hash}
+	EncodeMessage(conn, testMagic, &MsgInv{Inventory: []InvVect{blockInv}})
+	getData := expectMessage[*MsgGetData](t, conn)
+	if want := (InvVect{Type: InvTypeCompactBlock, Hash: block.Hash}); len(getData.Inventory) != 1 || getData.Inventory[0] != want {
+		t.Fatalf("getdata = %+v, want %+v", getData.Inventory, want)
+	}
+
+	EncodeMessage(conn, testMagic, newCompactBlock(block))
+	getTx := expectMessage[*MsgGetBlockTx](t, conn)
+	if getTx.BlockHash != block.Hash || !reflect.DeepEqual(getTx.Indexes, []uint16{2}) {
+		t.Fatalf("getblocktx = %x %v, want index 2 of %x", getTx.BlockHash[:8], getTx.Indexes, block.Hash[:8])
+	}
+	EncodeMessage(conn, testMagic, &MsgBlockTx{BlockHash: block.Hash, Txs: []*types.Transaction{unknown}})
+	waitFor(t, "the compact block to be accepted", func() bool {
+		return s.Chain.Tip().Hash == block.Hash
+	})
+
+	// s serves the block compactly, and its transactions on request.
+	EncodeMessage(conn, testMagic, &MsgGetData{Inventory: []InvVect{{Type: InvTypeCompactBlock, Hash: block.Hash}}})
+	served := expectMessage[*MsgCmpctBlock](t, conn)
+	if served.Header.ComputeHash() != block.Hash || len(served.ShortIDs) != 2 || len(served.Prefilled) != 1 {
+		t.Fatalf("served compact block %x has %d short IDs and %d prefilled", served.Header.ComputeHash().Bytes()[:8], len(served.ShortIDs), len(served.Prefilled))
+	}
+	EncodeMessage(conn, testMagic, &MsgGetBlockTx{BlockHash: block.Hash, Indexes: []uint16{1, 2}})
+	txs := expectMessage[*MsgBlockTx](t, conn)
+	if len(txs.Txs) != 2 || txs.Txs[0].ID != known.ID || txs.Txs[1].ID != unknown.ID {
+		t.Errorf("blocktx = %+v, want the two transfers", txs.Txs)
+	}
+
+	// Asking for transactions the block doesn't have is a ban.
+	EncodeMessage(conn, testMagic, &MsgGetBlockTx{BlockHash: block.Hash, Indexes: []uint16{3}})
+	waitFor(t, "peer to be banned", func() bool {
+		return s.IsBanned(conn.LocalAddr())
+	})
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// EvictProtectLatency is the number of inbound peers with the lowest
+	// ping latency that are never evicted.
+	EvictProtectLatency = 8
+
+	// EvictProtectBlocks is the number of inbound peers that most recently
+	// relayed a new block that are never evicted.
+	EvictProtectBlocks = 4
+)
+
+// evictionCandidate is the state of an inbound peer that selectEviction
+// looks at.
+type evictionCandidate struct {
+	peer        *Peer
+	host        string
+	connectedAt time.Time
+	latency     time.Duration // 0 until the first pong.
+	lastBlock   time.Time     // Zero if it never relayed a new block.
+}
+
+// evictionCandidate returns the state selectEviction needs.
+func (p *Peer) evictionCandidate() evictionCandidate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return evictionCandidate{
+		peer:        p,
+		host:        hostOf(p.Conn.RemoteAddr()),
+		connectedAt: p.connectedAt,
+		latency:     p.latency,
+		lastBlock:   p.lastBlock,
+	}
+}
+
+// selectEviction picks the inbound peer to disconnect to make room for a
+// new one, or returns nil if every candidate is protected. Protected, in
+// turn, are the EvictProtectLatency peers with the lowest latency, the
+// EvictProtectBlocks peers that most recently relayed a block, and the
+// longest connected half of the rest: an attacker can't cheaply fake any of
+// these. The newest connection from the host with the most connections is
+// evicted from what remains.
+func selectEviction(candidates []evictionCandidate) *Peer {
+	rest := append([]evictionCandidate(nil), candidates...)
+
+	rest = protect(rest, EvictProtectLatency, func(c evictionCandidate) bool { return c.latency > 0 },
+		func(a, b evictionCandidate) bool { return a.latency < b.latency })
+	rest = protect(rest, EvictProtectBlocks, func(c evictionCandidate) bool { return !c.lastBlock.IsZero() },
+		func(a, b evictionCandidate) bool { return a.lastBlock.After(b.lastBlock) })
+	rest = protect(rest, len(rest)/2, func(evictionCandidate) bool { return true },
+		func(a, b evictionCandidate) bool { return a.connectedAt.Before(b.connectedAt) })
+	if len(rest) == 0 {
+		return nil
+	}
+
+	perHost := make(map[string]int)
+	for _, c := range rest {
+		perHost[c.host]++
+	}
+	var victim *evictionCandidate
+	for i := range rest {
+		c := &rest[i]
+		if victim == nil || perHost[c.host] > perHost[victim.host] ||
+			(perHost[c.host] == perHost[victim.host] && c.connectedAt.After(victim.connectedAt)) {
+			victim = c
+		}
+	}
+	return victim.peer
+}
+
+// protect removes from candidates up to n of those that qualify, best first
+// by less, and returns the others.
+func protect(candidates []evictionCandidate, n int, qualifies func(evictionCandidate) bool, less func(a, b evictionCandidate) bool) []evictionCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		qi, qj := qualifies(candidates[i]), qualifies(candidates[j])
+		if qi != qj {
+			return qi
+		}
+		return qi && less(candidates[i], candidates[j])
+	})
+	kept := 0
+	for kept < n && kept < len(candidates) && qualifies(candidates[kept]) {
+		kept++
+	}
+	return candidates[kept:]
+}
@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSelectEviction(t *testing.T) {
+	base := time.Now()
+	var candidates []evictionCandidate
+	add := func(host string, age time.Duration, latency time.Duration, lastBlock time.Time) *Peer {
+		p := &Peer{}
+		candidates = append(candidates, evictionCandidate{
+			peer:        p,
+			host:        host,
+			connectedAt: base.Add(-age),
+			latency:     latency,
+			lastBlock:   lastBlock,
+		})
+		return p
+	}
+
+	// Fast peers and block relayers are protected however new they are.
+	for i := 0; i < EvictProtectLatency; i++ {
+		add(fmt.Sprintf("10.0.0.%d", i), time.Second, time.Millisecond, time.Time{})
+	}
+	for i := 0; i < EvictProtectBlocks; i++ {
+		add(fmt.Sprintf("10.0.1.%d", i), time.Second, 0, base)
+	}
+	if p := selectEviction(candidates); p != nil {
+		t.Fatalf("evicted a protected peer")
+	}
+
+	// Of the rest, the older half is protected and the newest connection of
+	// the busiest host goes.
+	add("10.0.2.1", 4*time.Hour, 0, time.Time{})
+	add("10.0.2.1", 3*time.Hour, 0, time.Time{})
+	add("10.0.2.2", 2*time.Hour, 0, time.Time{})
+	add("10.0.2.3", time.Hour, 0, time.Time{})
+	want := add("10.0.2.3", 2*time.Minute, 0, time.Time{})
+	add("10.0.2.4", time.Minute, 0, time.Time{})
+	if p := selectEviction(candidates); p != want {
+		t.Errorf("selectEviction picked %p, want the newest peer of 10.0.2.3 (%p)", p, want)
+	}
+}
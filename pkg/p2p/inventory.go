@@ -0,0 +1,255 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// InvType identifies the kind of object an inventory vector refers to.
+type InvType byte
+
+const (
+	InvTypeTx    InvType = 0x01
+	InvTypeBlock InvType = 0x02
+
+	// InvTypeCompactBlock requests a block as a MsgCmpctBlock. It is only
+	// used in MsgGetData; blocks are announced as InvTypeBlock.
+	InvTypeCompactBlock InvType = 0x03
+)
+
+// InvVect identifies a block or transaction by hash.
+type InvVect struct {
+	Type InvType
+	Hash types.Hash
+}
+
+const (
+	// MaxInvPerMsg bounds the inventory vectors in MsgInv, MsgGetData and MsgNotFound.
+	MaxInvPerMsg = 50000
+
+	// MaxKnownInventory bounds the per-peer set of inventory the peer is
+	// known to have. The oldest entries are forgotten first.
+	MaxKnownInventory = 5000
+
+	// RequestTimeout is how long a peer has to deliver requested data before
+	// the request is moved to another peer that announced it.
+	RequestTimeout = time.Minute
+
+	// requestCheckInterval is how often timed out requests are looked for.
+	requestCheckInterval = 5 * time.Second
+)
+
+// invFor returns the inventory vector announcing msg, if msg carries a block
+// or a transaction.
+func invFor(msg Message) (InvVect, bool) {
+	switch m := msg.(type) {
+	case *MsgBlock:
+		return InvVect{Type: InvTypeBlock, Hash: m.Block.Hash}, true
+	case *MsgTx:
+		return InvVect{Type: InvTypeTx, Hash: m.Tx.ID}, true
+	default:
+		return InvVect{}, false
+	}
+}
+
+// knownInventory is a bounded set of inventory vectors. When full, the
+// oldest entry is evicted.
+type knownInventory struct {
+	mu    sync.Mutex
+	set   map[InvVect]struct{}
+	order []InvVect // Ring buffer of the entries in insertion order.
+	next  int
+}
+
+func newKnownInventory(size int) *knownInventory {
+	return &knownInventory{
+		set:   make(map[InvVect]struct{}, size),
+		order: make([]InvVect, 0, size),
+	}
+}
+
+// Add records iv, evicting the oldest entry if the set is full.
+func (k *knownInventory) Add(iv InvVect) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.set[iv]; ok {
+		return
+	}
+	if len(k.order) < cap(k.order) {
+		k.order = append(k.order, iv)
+	} else {
+		delete(k.set, k.order[k.next])
+		k.order[k.next] = iv
+		k.next = (k.next + 1) % len(k.order)
+	}
+	k.set[iv] = struct{}{}
+}
+
+// Has reports whether iv is in the set.
+func (k *knownInventory) Has(iv InvVect) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, ok := k.set[iv]
+	return ok
+}
+
+// invRequest is an outstanding getdata request.
+type invRequest struct {
+	peer *Peer
+	sent time.Time
+
+	// announcers are other peers that announced the item, to ask next if
+	// the current request fails.
+	announcers []*Peer
+}
+
+// requestTracker makes sure each announced item is requested from one peer
+// at a time, and moves requests to other announcers when a peer answers
+// with MsgNotFound, disconnects or times out.
+type requestTracker struct {
+	mu       sync.Mutex
+	inflight map[InvVect]*invRequest
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{inflight: make(map[InvVect]*invRequest)}
+}
+
+// announced records that p announced iv. It returns true if iv should be
+// requested from p now, and false if it is already being requested from
+// another peer (p is then kept as a fallback).
+func (t *requestTracker) announced(p *Peer, iv InvVect, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.inflight[iv]
+	if !ok {
+		t.inflight[iv] = &invRequest{peer: p, sent: now}
+		return true
+	}
+	if req.peer == p {
+		return false
+	}
+	for _, a := range req.announcers {
+		if a == p {
+			return false
+		}
+	}
+	req.announcers = append(req.announcers, p)
+	return false
+}
+
+// received clears the request for iv once the data has arrived.
+func (t *requestTracker) received(iv InvVect) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight, iv)
+}
+
+// notFound handles p's MsgNotFound for iv. It returns the peer to ask next,
+// or nil if no other peer announced it.
+func (t *requestTracker) notFound(p *Peer, iv InvVect, now time.Time) *Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.inflight[iv]
+	if !ok || req.peer != p {
+		return nil
+	}
+	return t.reassign(iv, req, now)
+}
+
+// peerGone moves the requests outstanding with p to other announcers and
+// forgets p as an announcer. It returns the items to request, by peer.
+func (t *requestTracker) peerGone(p *Peer, now time.Time) map[*Peer][]InvVect {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	retry := make(map[*Peer][]InvVect)
+	for iv, req := range t.inflight {
+		for i, a := range req.announcers {
+			if a == p {
+				req.announcers = append(req.announcers[:i], req.announcers[i+1:]...)
+				break
+			}
+		}
+		if req.peer != p {
+			continue
+		}
+		if next := t.reassign(iv, req, now); next != nil {
+			retry[next] = append(retry[next], iv)
+		}
+	}
+	return retry
+}
+
+// expire moves requests older than RequestTimeout to other announcers.
+// It returns the items to request, by peer.
+func (t *requestTracker) expire(now time.Time) map[*Peer][]InvVect {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	retry := make(map[*Peer][]InvVect)
+	for iv, req := range t.inflight {
+		if now.Sub(req.sent) < RequestTimeout {
+			continue
+		}
+		if next := t.reassign(iv, req, now); next != nil {
+			retry[next] = append(retry[next], iv)
+		}
+	}
+	return retry
+}
+
+// reassign hands req to its next connected announcer, or drops it if there
+// is none. t.mu must be held.
+func (t *requestTracker) reassign(iv InvVect, req *invRequest, now time.Time) *Peer {
+	for len(req.announcers) > 0 {
+		next := req.announcers[0]
+		req.announcers = req.announcers[1:]
+		if next.stopped() {
+			continue
+		}
+		req.peer = next
+		req.sent = now
+		return next
+	}
+	delete(t.inflight, iv)
+	return nil
+}
+
+// holder returns the peer iv is requested from and when it was asked.
+func (t *requestTracker) holder(iv InvVect) (*Peer, time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.inflight[iv]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return req.peer, req.sent, true
+}
+
+// inflightFrom returns the number of requests outstanding with p.
+func (t *requestTracker) inflightFrom(p *Peer) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, req := range t.inflight {
+		if req.peer == p {
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of outstanding requests.
+func (t *requestTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inflight)
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+func TestKnownInventoryEvictsOldest(t *testing.T) {
+	k := newKnownInventory(3)
+	iv := func(b byte) InvVect { return InvVect{Type: InvTypeTx, Hash: types.Hash{b}} }
+
+	for b := byte(1); b <= 4; b++ {
+		k.Add(iv(b))
+	}
+	if k.Has(iv(1)) {
+		t.Error("oldest entry was not evicted")
+	}
+	for b := byte(2); b <= 4; b++ {
+		if !k.Has(iv(b)) {
+			t.Errorf("entry %d missing", b)
+		}
+	}
+	if k.Has(InvVect{Type: InvTypeBlock, Hash: types.Hash{2}}) {
+		t.Error("inventory type is not part of the key")
+	}
+}
+
+func TestRequestTrackerReassigns(t *testing.T) {
+	a, _ := newPipePeer(t)
+	b, _ := newPipePeer(t)
+	c, _ := newPipePeer(t)
+	tr := newRequestTracker()
+	iv := InvVect{Type: InvTypeBlock, Hash: types.Hash{0x01}}
+	now := time.Now()
+
+	if !tr.announced(a, iv, now) {
+		t.Fatal("first announcement should be requested")
+	}
+	if tr.announced(b, iv, now) || tr.announced(c, iv, now) || tr.announced(b, iv, now) {
+		t.Fatal("item requested twice")
+	}
+
+	// Only the peer we asked can say it's not found.
+	if next := tr.notFound(b, iv, now); next != nil {
+		t.Fatalf("notfound from an unasked peer moved the request to %v", next)
+	}
+	if next := tr.notFound(a, iv, now); next != b {
+		t.Fatalf("after notfound, next peer = %v, want b", next)
+	}
+
+	// b times out; c is disconnected, so nobody is left.
+	c.Stop()
+	if retry := tr.expire(now.Add(RequestTimeout / 2)); len(retry) != 0 {
+		t.Fatalf("request expired early: %v", retry)
+	}
+	if retry := tr.expire(now.Add(RequestTimeout)); len(retry) != 0 {
+		t.Fatalf("request moved to a stopped peer: %v", retry)
+	}
+	if tr.Len() != 0 {
+		t.Fatal("request without announcers was kept")
+	}
+
+	// Once received, the item may be announced again without a request.
+	tr.announced(a, iv, now)
+	tr.announced(b, iv, now)
+	if retry := tr.peerGone(a, now); len(retry[b]) != 1 {
+		t.Fatalf("request not moved to b when a left: %v", retry)
+	}
+	tr.received(iv)
+	if tr.Len() != 0 {
+		t.Error("received item still tracked")
+	}
+}
@@ -1,9 +1,14 @@
 package p2p
 
 import (
-	"encoding/gob"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"time"
 
 	"github.com/chronodrachma/chrd/pkg/core/types"
 )
@@ -12,23 +17,53 @@ import (
 type MessageType byte
 
 const (
-	MsgTypeVersion   MessageType = 0x01
-	MsgTypeBlock     MessageType = 0x02
-	MsgTypeTx        MessageType = 0x03
-	MsgTypeGetBlocks MessageType = 0x04
-	MsgTypeBlocks    MessageType = 0x05
+	MsgTypeVersion MessageType = 0x01
+	MsgTypeBlock   MessageType = 0x02
+	MsgTypeTx      MessageType = 0x03
+	// 0x04 and 0x05 were MsgGetBlocks and MsgBlocks, height-based sync
+	// replaced by headers-first sync in protocol version 3.
+	MsgTypeGetBlock   MessageType = 0x06
+	MsgTypeVerAck     MessageType = 0x07
+	MsgTypePing       MessageType = 0x08
+	MsgTypePong       MessageType = 0x09
+	MsgTypeGetAddr    MessageType = 0x0A
+	MsgTypeAddr       MessageType = 0x0B
+	MsgTypeInv        MessageType = 0x0C
+	MsgTypeGetData    MessageType = 0x0D
+	MsgTypeNotFound   MessageType = 0x0E
+	MsgTypeGetHeaders MessageType = 0x0F
+	MsgTypeHeaders    MessageType = 0x10
+	MsgTypeCmpctBlock MessageType = 0x11
+	MsgTypeGetBlockTx MessageType = 0x12
+	MsgTypeBlockTx    MessageType = 0x13
 )
 
 // Message is the generic interface for all P2P messages.
+// Payloads use the binary encodings of package types for blocks and transactions.
 type Message interface {
 	Type() MessageType
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
 }
 
-// MsgVersion is the initial handshake message.
+// MsgVersion is the initial handshake message. Each side sends it on connect
+// and answers the other's with MsgVerAck.
 type MsgVersion struct {
-	Version     uint32
-	BlockHeight uint64
-	From        string
+	Version        uint32     // Protocol version.
+	Network        string     // config.NetworkConfig.Name.
+	GenesisHash    types.Hash // Peers on another chain are disconnected.
+	BestHash       types.Hash
+	BestHeight     uint64
+	CumulativeWork *big.Int // Total work of the chain ending at BestHash.
+	Services       uint64   // Service bits (ServiceFullNode, ...).
+	Nonce          uint64   // Random per server; detects connections to ourselves.
+	From           string   // Sender's listen address.
+
+	// NodeKey is the sender's ed25519 identity, and Signature its
+	// signature over SessionKey and Nonce (see signVersion).
+	NodeKey    [32]byte
+	SessionKey [32]byte // X25519 key for an encrypted session; zero if not offered.
+	Signature  [64]byte
 }
 
 func (m *MsgVersion) Type() MessageType { return MsgTypeVersion }
@@ -47,74 +82,796 @@ type MsgTx struct {
 
 func (m *MsgTx) Type() MessageType { return MsgTypeTx }
 
-// MsgGetBlocks requests blocks starting from a specific height.
-type MsgGetBlocks struct {
-	FromHeight uint64
+// MsgGetBlock requests a single block by hash (e.g. the missing parent of an orphan).
+type MsgGetBlock struct {
+	Hash types.Hash
 }
 
-func (m *MsgGetBlocks) Type() MessageType { return MsgTypeGetBlocks }
+func (m *MsgGetBlock) Type() MessageType { return MsgTypeGetBlock }
+
+// MsgVerAck acknowledges a MsgVersion. It has no payload.
+type MsgVerAck struct{}
 
-// MsgBlocks sends a batch of blocks.
-type MsgBlocks struct {
-	Blocks []*types.Block
+func (m *MsgVerAck) Type() MessageType { return MsgTypeVerAck }
+
+// MsgPing checks that the peer is alive; it must answer with a MsgPong
+// carrying the same nonce.
+type MsgPing struct {
+	Nonce uint64
 }
 
-func (m *MsgBlocks) Type() MessageType { return MsgTypeBlocks }
+func (m *MsgPing) Type() MessageType { return MsgTypePing }
 
-// EncodeMessage writes a message to the writer using Gob encoding.
-// Format: [Type(1)][Payload(Gob)]
-func EncodeMessage(w io.Writer, msg Message) error {
-	// Write Type
-	if _, err := w.Write([]byte{byte(msg.Type())}); err != nil {
-		return err
-	}
+// MsgPong answers a MsgPing.
+type MsgPong struct {
+	Nonce uint64
+}
+
+func (m *MsgPong) Type() MessageType { return MsgTypePong }
 
-	// Write Payload
-	enc := gob.NewEncoder(w)
-	return enc.Encode(msg)
+// MsgGetAddr asks the peer for addresses of other nodes. It has no payload.
+type MsgGetAddr struct{}
+
+func (m *MsgGetAddr) Type() MessageType { return MsgTypeGetAddr }
+
+// NetAddress is a node's listen address and when it was last known to be up.
+type NetAddress struct {
+	Addr     string // host:port
+	LastSeen time.Time
 }
 
-// DecodeMessage reads a message from the reader.
-func DecodeMessage(r io.Reader) (Message, error) {
-	// Read Type
-	typeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(r, typeBuf); err != nil {
-		return nil, err
-	}
+// MsgAddr answers MsgGetAddr with at most MaxAddrPerMsg addresses.
+type MsgAddr struct {
+	Addresses []NetAddress
+}
+
+func (m *MsgAddr) Type() MessageType { return MsgTypeAddr }
+
+// MsgInv announces blocks and transactions the sender has. The receiver
+// requests the ones it lacks with MsgGetData.
+type MsgInv struct {
+	Inventory []InvVect
+}
+
+func (m *MsgInv) Type() MessageType { return MsgTypeInv }
+
+// MsgGetData requests announced blocks and transactions. Each is answered
+// with a MsgBlock, MsgCmpctBlock or MsgTx, and those the sender no longer
+// has are listed in a MsgNotFound.
+type MsgGetData struct {
+	Inventory []InvVect
+}
+
+func (m *MsgGetData) Type() MessageType { return MsgTypeGetData }
+
+// MsgNotFound lists requested items the sender does not have.
+type MsgNotFound struct {
+	Inventory []InvVect
+}
+
+func (m *MsgNotFound) Type() MessageType { return MsgTypeNotFound }
+
+// MsgGetHeaders requests the headers following the first locator hash that
+// is on the receiver's canonical chain, up to HashStop (zero for as many as
+// fit in one MsgHeaders).
+type MsgGetHeaders struct {
+	Locator  []types.Hash // See blockchain.Chain.BlockLocator.
+	HashStop types.Hash
+}
+
+func (m *MsgGetHeaders) Type() MessageType { return MsgTypeGetHeaders }
+
+// MsgHeaders answers MsgGetHeaders with at most MaxHeadersPerMsg consecutive
+// headers. Fewer than MaxHeadersPerMsg means the sender has no more.
+type MsgHeaders struct {
+	Headers []types.BlockHeader
+}
+
+func (m *MsgHeaders) Type() MessageType { return MsgTypeHeaders }
+
+// MsgCmpctBlock relays a block as its header and the short IDs of its
+// transactions, answering a MsgGetData for InvTypeCompactBlock. The receiver
+// rebuilds the block from its mempool and fetches the transactions it lacks
+// with MsgGetBlockTx. Transactions the receiver can't have, such as the
+// coinbase, are sent in full as Prefilled.
+type MsgCmpctBlock struct {
+	Header    types.BlockHeader
+	PowHash   types.Hash
+	Nonce     uint64    // Salts the short IDs; see shortTxID.
+	ShortIDs  []ShortID // The transactions not prefilled, in block order.
+	Prefilled []PrefilledTx
+}
+
+func (m *MsgCmpctBlock) Type() MessageType { return MsgTypeCmpctBlock }
+
+// PrefilledTx is a transaction sent in full in a MsgCmpctBlock, at Index in
+// the block.
+type PrefilledTx struct {
+	Index uint16
+	Tx    *types.Transaction
+}
+
+// MsgGetBlockTx requests the transactions at Indexes (in increasing order)
+// of a block announced with MsgCmpctBlock.
+type MsgGetBlockTx struct {
+	BlockHash types.Hash
+	Indexes   []uint16
+}
+
+func (m *MsgGetBlockTx) Type() MessageType { return MsgTypeGetBlockTx }
+
+// MsgBlockTx answers MsgGetBlockTx with the requested transactions, in the
+// order requested.
+type MsgBlockTx struct {
+	BlockHash types.Hash
+	Txs       []*types.Transaction
+}
+
+func (m *MsgBlockTx) Type() MessageType { return MsgTypeBlockTx }
 
-	var msg Message
-	switch MessageType(typeBuf[0]) {
+// Frame layout:
+//
+//	Magic(4) || Command(1) || Length(4) || Checksum(4) || Payload(Length)
+//
+// Magic identifies the network, Command is the MessageType, Length is the
+// big-endian payload length and Checksum is the first 4 bytes of the
+// SHA-256 of the payload. The payload is the message's MarshalBinary encoding.
+const frameHeaderSize = 13
+
+const (
+	// MaxBlockPayload bounds the payload of a single-block message.
+	MaxBlockPayload = 4 << 20
+
+	// MaxMessageSize bounds the payload of any message: the largest that
+	// newMessage accepts for any message type.
+	MaxMessageSize = MaxBlockPayload
+
+	// MaxAddrPerMsg bounds the number of addresses in a MsgAddr.
+	MaxAddrPerMsg = 1000
+
+	// maxAddrPayload is the largest MsgAddr payload: Count(2) plus
+	// MaxAddrPerMsg entries of LastSeen(8) || Len(1) || Addr(255).
+	maxAddrPayload = 2 + MaxAddrPerMsg*(8+1+255)
+
+	// MaxLocatorHashes bounds the locator of a MsgGetHeaders.
+	MaxLocatorHashes = 64
+
+	// MaxHeadersPerMsg bounds the headers in a MsgHeaders.
+	MaxHeadersPerMsg = 2000
+
+	// MaxCompactTxs bounds the transactions of a block relayed with
+	// MsgCmpctBlock, whose indexes are 16 bits. Larger blocks are relayed
+	// with MsgBlock.
+	MaxCompactTxs = 0xffff
+
+	// maxInvPayload is the largest inventory payload: Count(4) plus
+	// MaxInvPerMsg entries of Type(1) || Hash(32).
+	maxInvPayload = 4 + MaxInvPerMsg*invVectSize
+)
+
+const invVectSize = 1 + types.HashSize
+
+var (
+	ErrBadMagic         = errors.New("message has wrong network magic")
+	ErrUnknownMessage   = errors.New("unknown message type")
+	ErrMessageTooLarge  = errors.New("message exceeds maximum size")
+	ErrBadChecksum      = errors.New("message checksum mismatch")
+	ErrMalformedMessage = errors.New("malformed message payload")
+)
+
+// newMessage returns an empty message of type t and the maximum payload
+// size accepted for it.
+func newMessage(t MessageType) (Message, uint32, error) {
+	switch t {
 	case MsgTypeVersion:
-		msg = &MsgVersion{}
+		return &MsgVersion{}, 1024, nil
 	case MsgTypeBlock:
-		msg = &MsgBlock{}
+		return &MsgBlock{}, MaxBlockPayload, nil
 	case MsgTypeTx:
-		msg = &MsgTx{}
-	case MsgTypeGetBlocks:
-		msg = &MsgGetBlocks{}
-	case MsgTypeBlocks:
-		msg = &MsgBlocks{}
+		return &MsgTx{}, types.MaxTxSize, nil
+	case MsgTypeGetBlock:
+		return &MsgGetBlock{}, types.HashSize, nil
+	case MsgTypeVerAck:
+		return &MsgVerAck{}, 0, nil
+	case MsgTypePing:
+		return &MsgPing{}, 8, nil
+	case MsgTypePong:
+		return &MsgPong{}, 8, nil
+	case MsgTypeGetAddr:
+		return &MsgGetAddr{}, 0, nil
+	case MsgTypeAddr:
+		return &MsgAddr{}, maxAddrPayload, nil
+	case MsgTypeInv:
+		return &MsgInv{}, maxInvPayload, nil
+	case MsgTypeGetData:
+		return &MsgGetData{}, maxInvPayload, nil
+	case MsgTypeNotFound:
+		return &MsgNotFound{}, maxInvPayload, nil
+	case MsgTypeGetHeaders:
+		return &MsgGetHeaders{}, 1 + MaxLocatorHashes*types.HashSize + types.HashSize, nil
+	case MsgTypeHeaders:
+		return &MsgHeaders{}, 2 + MaxHeadersPerMsg*types.HeaderSize, nil
+	case MsgTypeCmpctBlock:
+		return &MsgCmpctBlock{}, MaxBlockPayload, nil
+	case MsgTypeGetBlockTx:
+		return &MsgGetBlockTx{}, types.HashSize + 2 + MaxCompactTxs*2, nil
+	case MsgTypeBlockTx:
+		return &MsgBlockTx{}, MaxBlockPayload, nil
 	default:
-		return nil, fmt.Errorf("unknown message type: 0x%x", typeBuf[0])
+		return nil, 0, fmt.Errorf("%w: 0x%x", ErrUnknownMessage, byte(t))
+	}
+}
+
+// checksum returns the first 4 bytes of the SHA-256 of payload.
+func checksum(payload []byte) []byte {
+	sum := types.ComputeSHA256(payload)
+	return sum[:4]
+}
+
+// EncodeMessage writes a framed message for the network identified by magic.
+func EncodeMessage(w io.Writer, magic [4]byte, msg Message) error {
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, limit, err := newMessage(msg.Type())
+	if err != nil {
+		return err
+	}
+	if uint64(len(payload)) > uint64(limit) {
+		return fmt.Errorf("%w: %d bytes for type 0x%x", ErrMessageTooLarge, len(payload), byte(msg.Type()))
+	}
+
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	copy(buf[0:4], magic[:])
+	buf[4] = byte(msg.Type())
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	copy(buf[9:13], checksum(payload))
+	buf = append(buf, payload...)
+	_, err = w.Write(buf)
+	return err
+}
+
+// DecodeMessage reads one framed message for the network identified by magic.
+// It reads exactly one frame from r and never more, and validates the frame
+// header before allocating the payload. Errors other than I/O errors wrap
+// one of ErrBadMagic, ErrUnknownMessage, ErrMessageTooLarge, ErrBadChecksum
+// or ErrMalformedMessage.
+func DecodeMessage(r io.Reader, magic [4]byte) (Message, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
 	}
 
-	// Read Payload
-	dec := gob.NewDecoder(r)
-	if err := dec.Decode(msg); err != nil {
+	if !bytes.Equal(header[0:4], magic[:]) {
+		return nil, fmt.Errorf("%w: %x", ErrBadMagic, header[0:4])
+	}
+	msg, limit, err := newMessage(MessageType(header[4]))
+	if err != nil {
 		return nil, err
 	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > limit {
+		return nil, fmt.Errorf("%w: %d bytes for type 0x%x", ErrMessageTooLarge, length, header[4])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(checksum(payload), header[9:13]) {
+		return nil, ErrBadChecksum
+	}
+	if err := msg.UnmarshalBinary(payload); err != nil {
+		return nil, fmt.Errorf("%w: type 0x%x: %v", ErrMalformedMessage, header[4], err)
+	}
 
 	return msg, nil
 }
 
-func init() {
-	// Register types for Gob
-	gob.Register(&MsgVersion{})
-	gob.Register(&MsgBlock{})
-	gob.Register(&MsgTx{})
-	gob.Register(&MsgGetBlocks{})
-	gob.Register(&MsgBlocks{})
-	gob.Register(types.Block{})
-	gob.Register(types.Transaction{})
-	gob.Register(types.BlockHeader{})
+// errInvalidPayload is returned when a message payload cannot be decoded.
+var errInvalidPayload = errors.New("invalid message payload")
+
+// MarshalBinary encodes the version as
+//
+//	Version(4) || Services(8) || Nonce(8) || BestHeight(8) || GenesisHash(32) ||
+//	BestHash(32) || WorkLen(1) || Work || NetworkLen(1) || Network || FromLen(2) || From
+func (m *MsgVersion) MarshalBinary() ([]byte, error) {
+	var work []byte
+	if m.CumulativeWork != nil {
+		if m.CumulativeWork.Sign() < 0 {
+			return nil, fmt.Errorf("%w: negative work", errInvalidPayload)
+		}
+		work = m.CumulativeWork.Bytes()
+	}
+	if len(work) > 0xff || len(m.Network) > 0xff || len(m.From) > 0xffff {
+		return nil, fmt.Errorf("%w: field too long", errInvalidPayload)
+	}
+
+	buf := make([]byte, 0, versionFixedSize+len(work)+len(m.Network)+len(m.From))
+	buf = binary.BigEndian.AppendUint32(buf, m.Version)
+	buf = binary.BigEndian.AppendUint64(buf, m.Services)
+	buf = binary.BigEndian.AppendUint64(buf, m.Nonce)
+	buf = binary.BigEndian.AppendUint64(buf, m.BestHeight)
+	buf = append(buf, m.GenesisHash[:]...)
+	buf = append(buf, m.BestHash[:]...)
+	buf = append(buf, byte(len(work)))
+	buf = append(buf, work...)
+	buf = append(buf, byte(len(m.Network)))
+	buf = append(buf, m.Network...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.From)))
+	buf = append(buf, m.From...)
+	buf = append(buf, m.NodeKey[:]...)
+	buf = append(buf, m.SessionKey[:]...)
+	return append(buf, m.Signature[:]...), nil
+}
+
+// versionFixedSize is the length of a MsgVersion with empty variable fields.
+const versionFixedSize = 4 + 8 + 8 + 8 + 32 + 32 + 1 + 1 + 2 + versionAuthSize
+
+// versionAuthSize is the length of the trailing
+// NodeKey(32) || SessionKey(32) || Signature(64).
+const versionAuthSize = 32 + 32 + 64
+
+func (m *MsgVersion) UnmarshalBinary(data []byte) error {
+	if len(data) < versionFixedSize {
+		return errInvalidPayload
+	}
+	m.Version = binary.BigEndian.Uint32(data[0:4])
+	m.Services = binary.BigEndian.Uint64(data[4:12])
+	m.Nonce = binary.BigEndian.Uint64(data[12:20])
+	m.BestHeight = binary.BigEndian.Uint64(data[20:28])
+	copy(m.GenesisHash[:], data[28:60])
+	copy(m.BestHash[:], data[60:92])
+	data = data[92:]
+
+	n := int(data[0])
+	if len(data) < 1+n+1 {
+		return errInvalidPayload
+	}
+	// Work is encoded minimally (no leading zeros) so that it re-encodes identically.
+	if n > 0 && data[1] == 0 {
+		return errInvalidPayload
+	}
+	m.CumulativeWork = new(big.Int).SetBytes(data[1 : 1+n])
+	data = data[1+n:]
+
+	n = int(data[0])
+	if len(data) < 1+n+2 {
+		return errInvalidPayload
+	}
+	m.Network = string(data[1 : 1+n])
+	data = data[1+n:]
+
+	n = int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) != 2+n+versionAuthSize {
+		return errInvalidPayload
+	}
+	m.From = string(data[2 : 2+n])
+	data = data[2+n:]
+
+	copy(m.NodeKey[:], data[0:32])
+	copy(m.SessionKey[:], data[32:64])
+	copy(m.Signature[:], data[64:128])
+	return nil
+}
+
+func (m *MsgBlock) MarshalBinary() ([]byte, error) {
+	return m.Block.MarshalBinary()
+}
+
+func (m *MsgBlock) UnmarshalBinary(data []byte) error {
+	m.Block = &types.Block{}
+	return m.Block.UnmarshalBinary(data)
+}
+
+func (m *MsgTx) MarshalBinary() ([]byte, error) {
+	return m.Tx.MarshalBinary()
+}
+
+func (m *MsgTx) UnmarshalBinary(data []byte) error {
+	m.Tx = &types.Transaction{}
+	return m.Tx.UnmarshalBinary(data)
+}
+
+func (m *MsgGetBlock) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), m.Hash[:]...), nil
+}
+
+func (m *MsgVerAck) MarshalBinary() ([]byte, error) { return nil, nil }
+
+func (m *MsgVerAck) UnmarshalBinary(data []byte) error {
+	if len(data) != 0 {
+		return errInvalidPayload
+	}
+	return nil
+}
+
+func (m *MsgPing) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, m.Nonce), nil
+}
+
+func (m *MsgPing) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errInvalidPayload
+	}
+	m.Nonce = binary.BigEndian.Uint64(data)
+	return nil
+}
+
+func (m *MsgPong) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, m.Nonce), nil
+}
+
+func (m *MsgPong) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errInvalidPayload
+	}
+	m.Nonce = binary.BigEndian.Uint64(data)
+	return nil
+}
+
+func (m *MsgGetAddr) MarshalBinary() ([]byte, error) { return nil, nil }
+
+func (m *MsgGetAddr) UnmarshalBinary(data []byte) error {
+	if len(data) != 0 {
+		return errInvalidPayload
+	}
+	return nil
+}
+
+// MarshalBinary encodes the addresses as
+// Count(2) || Count * (LastSeen(8) || Len(1) || Addr(Len)).
+func (m *MsgAddr) MarshalBinary() ([]byte, error) {
+	if len(m.Addresses) > MaxAddrPerMsg {
+		return nil, fmt.Errorf("%d addresses exceed limit of %d", len(m.Addresses), MaxAddrPerMsg)
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(m.Addresses)))
+	for _, a := range m.Addresses {
+		if len(a.Addr) > 255 {
+			return nil, fmt.Errorf("address %q too long", a.Addr)
+		}
+		buf = binary.BigEndian.AppendUint64(buf, uint64(a.LastSeen.Unix()))
+		buf = append(buf, byte(len(a.Addr)))
+		buf = append(buf, a.Addr...)
+	}
+	return buf, nil
+}
+
+func (m *MsgAddr) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errInvalidPayload
+	}
+	count := int(binary.BigEndian.Uint16(data[0:2]))
+	data = data[2:]
+	if count > MaxAddrPerMsg || count*9 > len(data) {
+		return errInvalidPayload
+	}
+
+	m.Addresses = make([]NetAddress, count)
+	for i := range m.Addresses {
+		if len(data) < 9 {
+			return errInvalidPayload
+		}
+		lastSeen := time.Unix(int64(binary.BigEndian.Uint64(data[0:8])), 0)
+		n := int(data[8])
+		data = data[9:]
+		if len(data) < n {
+			return errInvalidPayload
+		}
+		m.Addresses[i] = NetAddress{Addr: string(data[:n]), LastSeen: lastSeen}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return errInvalidPayload
+	}
+	return nil
+}
+
+// encodeInventory encodes inventory vectors as
+// Count(4) || Count * (Type(1) || Hash(32)).
+func encodeInventory(inv []InvVect) ([]byte, error) {
+	if len(inv) > MaxInvPerMsg {
+		return nil, fmt.Errorf("%d inventory vectors exceed limit of %d", len(inv), MaxInvPerMsg)
+	}
+	buf := make([]byte, 0, 4+len(inv)*invVectSize)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(inv)))
+	for _, iv := range inv {
+		buf = append(buf, byte(iv.Type))
+		buf = append(buf, iv.Hash[:]...)
+	}
+	return buf, nil
+}
+
+func decodeInventory(data []byte) ([]InvVect, error) {
+	if len(data) < 4 {
+		return nil, errInvalidPayload
+	}
+	count := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+	if count > MaxInvPerMsg || uint64(count)*invVectSize != uint64(len(data)) {
+		return nil, errInvalidPayload
+	}
+
+	inv := make([]InvVect, count)
+	for i := range inv {
+		inv[i].Type = InvType(data[0])
+		copy(inv[i].Hash[:], data[1:invVectSize])
+		data = data[invVectSize:]
+	}
+	return inv, nil
+}
+
+func (m *MsgInv) MarshalBinary() ([]byte, error) { return encodeInventory(m.Inventory) }
+
+func (m *MsgInv) UnmarshalBinary(data []byte) (err error) {
+	m.Inventory, err = decodeInventory(data)
+	return err
+}
+
+func (m *MsgGetData) MarshalBinary() ([]byte, error) { return encodeInventory(m.Inventory) }
+
+func (m *MsgGetData) UnmarshalBinary(data []byte) (err error) {
+	m.Inventory, err = decodeInventory(data)
+	return err
+}
+
+func (m *MsgNotFound) MarshalBinary() ([]byte, error) { return encodeInventory(m.Inventory) }
+
+func (m *MsgNotFound) UnmarshalBinary(data []byte) (err error) {
+	m.Inventory, err = decodeInventory(data)
+	return err
+}
+
+// MarshalBinary encodes the request as
+// Count(1) || Count * Hash(32) || HashStop(32).
+func (m *MsgGetHeaders) MarshalBinary() ([]byte, error) {
+	if len(m.Locator) > MaxLocatorHashes {
+		return nil, fmt.Errorf("%d locator hashes exceed limit of %d", len(m.Locator), MaxLocatorHashes)
+	}
+	buf := make([]byte, 0, 1+(len(m.Locator)+1)*types.HashSize)
+	buf = append(buf, byte(len(m.Locator)))
+	for _, h := range m.Locator {
+		buf = append(buf, h[:]...)
+	}
+	buf = append(buf, m.HashStop[:]...)
+	return buf, nil
+}
+
+func (m *MsgGetHeaders) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errInvalidPayload
+	}
+	count := int(data[0])
+	data = data[1:]
+	if count > MaxLocatorHashes || len(data) != (count+1)*types.HashSize {
+		return errInvalidPayload
+	}
+	m.Locator = make([]types.Hash, count)
+	for i := range m.Locator {
+		copy(m.Locator[i][:], data[:types.HashSize])
+		data = data[types.HashSize:]
+	}
+	copy(m.HashStop[:], data)
+	return nil
+}
+
+// MarshalBinary encodes the headers as Count(2) || Count * Header(96).
+func (m *MsgHeaders) MarshalBinary() ([]byte, error) {
+	if len(m.Headers) > MaxHeadersPerMsg {
+		return nil, fmt.Errorf("%d headers exceed limit of %d", len(m.Headers), MaxHeadersPerMsg)
+	}
+	buf := make([]byte, 0, 2+len(m.Headers)*types.HeaderSize)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Headers)))
+	for i := range m.Headers {
+		buf = append(buf, m.Headers[i].Serialize()...)
+	}
+	return buf, nil
+}
+
+func (m *MsgHeaders) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errInvalidPayload
+	}
+	count := int(binary.BigEndian.Uint16(data[0:2]))
+	data = data[2:]
+	if count > MaxHeadersPerMsg || len(data) != count*types.HeaderSize {
+		return errInvalidPayload
+	}
+	m.Headers = make([]types.BlockHeader, count)
+	for i := range m.Headers {
+		if err := m.Headers[i].UnmarshalBinary(data[:types.HeaderSize]); err != nil {
+			return err
+		}
+		data = data[types.HeaderSize:]
+	}
+	return nil
+}
+
+func (m *MsgGetBlock) UnmarshalBinary(data []byte) error {
+	if len(data) != len(m.Hash) {
+		return errInvalidPayload
+	}
+	copy(m.Hash[:], data)
+	return nil
+}
+
+// MarshalBinary encodes the compact block as
+//
+//	Header(96) || PowHash(32) || Nonce(8) || Count(2) || Count * ShortID(6) ||
+//	Count(2) || Count * (Index(2) || TxLen(4) || Transaction(TxLen))
+//
+// Prefilled indexes must be increasing.
+func (m *MsgCmpctBlock) MarshalBinary() ([]byte, error) {
+	if len(m.ShortIDs)+len(m.Prefilled) > MaxCompactTxs {
+		return nil, fmt.Errorf("%d transactions exceed limit of %d", len(m.ShortIDs)+len(m.Prefilled), MaxCompactTxs)
+	}
+	buf := make([]byte, 0, types.HeaderSize+types.HashSize+8+2+len(m.ShortIDs)*ShortIDSize+2)
+	buf = append(buf, m.Header.Serialize()...)
+	buf = append(buf, m.PowHash[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, m.Nonce)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.ShortIDs)))
+	for _, id := range m.ShortIDs {
+		buf = append(buf, id[:]...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Prefilled)))
+	for i, p := range m.Prefilled {
+		if i > 0 && p.Index <= m.Prefilled[i-1].Index {
+			return nil, fmt.Errorf("%w: prefilled indexes not increasing", errInvalidPayload)
+		}
+		txBytes, err := p.Tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, p.Index)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(txBytes)))
+		buf = append(buf, txBytes...)
+	}
+	return buf, nil
+}
+
+func (m *MsgCmpctBlock) UnmarshalBinary(data []byte) error {
+	const prefix = types.HeaderSize + types.HashSize + 8 + 2
+	if len(data) < prefix {
+		return errInvalidPayload
+	}
+	if err := m.Header.UnmarshalBinary(data[:types.HeaderSize]); err != nil {
+		return err
+	}
+	data = data[types.HeaderSize:]
+	copy(m.PowHash[:], data[:types.HashSize])
+	data = data[types.HashSize:]
+	m.Nonce = binary.BigEndian.Uint64(data[0:8])
+	count := int(binary.BigEndian.Uint16(data[8:10]))
+	data = data[10:]
+	if len(data) < count*ShortIDSize+2 {
+		return errInvalidPayload
+	}
+	m.ShortIDs = make([]ShortID, count)
+	for i := range m.ShortIDs {
+		copy(m.ShortIDs[i][:], data[:ShortIDSize])
+		data = data[ShortIDSize:]
+	}
+
+	count = int(binary.BigEndian.Uint16(data[0:2]))
+	data = data[2:]
+	if len(m.ShortIDs)+count > MaxCompactTxs || count*(2+4) > len(data) {
+		return errInvalidPayload
+	}
+	m.Prefilled = make([]PrefilledTx, count)
+	for i := range m.Prefilled {
+		if len(data) < 2+4 {
+			return errInvalidPayload
+		}
+		index := binary.BigEndian.Uint16(data[0:2])
+		txLen := binary.BigEndian.Uint32(data[2:6])
+		data = data[6:]
+		if i > 0 && index <= m.Prefilled[i-1].Index {
+			return errInvalidPayload
+		}
+		if int(index) >= len(m.ShortIDs)+count || uint64(txLen) > uint64(len(data)) {
+			return errInvalidPayload
+		}
+		tx := &types.Transaction{}
+		if err := tx.UnmarshalBinary(data[:txLen]); err != nil {
+			return err
+		}
+		m.Prefilled[i] = PrefilledTx{Index: index, Tx: tx}
+		data = data[txLen:]
+	}
+	if len(data) != 0 {
+		return errInvalidPayload
+	}
+	return nil
+}
+
+// MarshalBinary encodes the request as
+// BlockHash(32) || Count(2) || Count * Index(2), with increasing indexes.
+func (m *MsgGetBlockTx) MarshalBinary() ([]byte, error) {
+	if len(m.Indexes) > MaxCompactTxs {
+		return nil, fmt.Errorf("%d indexes exceed limit of %d", len(m.Indexes), MaxCompactTxs)
+	}
+	buf := make([]byte, 0, types.HashSize+2+len(m.Indexes)*2)
+	buf = append(buf, m.BlockHash[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Indexes)))
+	for i, index := range m.Indexes {
+		if i > 0 && index <= m.Indexes[i-1] {
+			return nil, fmt.Errorf("%w: indexes not increasing", errInvalidPayload)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, index)
+	}
+	return buf, nil
+}
+
+func (m *MsgGetBlockTx) UnmarshalBinary(data []byte) error {
+	if len(data) < types.HashSize+2 {
+		return errInvalidPayload
+	}
+	copy(m.BlockHash[:], data[:types.HashSize])
+	count := int(binary.BigEndian.Uint16(data[types.HashSize:]))
+	data = data[types.HashSize+2:]
+	if len(data) != count*2 {
+		return errInvalidPayload
+	}
+	m.Indexes = make([]uint16, count)
+	for i := range m.Indexes {
+		m.Indexes[i] = binary.BigEndian.Uint16(data[2*i:])
+		if i > 0 && m.Indexes[i] <= m.Indexes[i-1] {
+			return errInvalidPayload
+		}
+	}
+	return nil
+}
+
+// MarshalBinary encodes the transactions as
+// BlockHash(32) || Count(2) || Count * (TxLen(4) || Transaction(TxLen)).
+func (m *MsgBlockTx) MarshalBinary() ([]byte, error) {
+	if len(m.Txs) > MaxCompactTxs {
+		return nil, fmt.Errorf("%d transactions exceed limit of %d", len(m.Txs), MaxCompactTxs)
+	}
+	buf := make([]byte, 0, types.HashSize+2)
+	buf = append(buf, m.BlockHash[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Txs)))
+	for _, tx := range m.Txs {
+		txBytes, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(txBytes)))
+		buf = append(buf, txBytes...)
+	}
+	return buf, nil
+}
+
+func (m *MsgBlockTx) UnmarshalBinary(data []byte) error {
+	if len(data) < types.HashSize+2 {
+		return errInvalidPayload
+	}
+	copy(m.BlockHash[:], data[:types.HashSize])
+	count := int(binary.BigEndian.Uint16(data[types.HashSize:]))
+	data = data[types.HashSize+2:]
+	if count*4 > len(data) {
+		return errInvalidPayload
+	}
+	m.Txs = make([]*types.Transaction, count)
+	for i := range m.Txs {
+		if len(data) < 4 {
+			return errInvalidPayload
+		}
+		txLen := binary.BigEndian.Uint32(data[0:4])
+		data = data[4:]
+		if uint64(txLen) > uint64(len(data)) {
+			return errInvalidPayload
+		}
+		tx := &types.Transaction{}
+		if err := tx.UnmarshalBinary(data[:txLen]); err != nil {
+			return err
+		}
+		m.Txs[i] = tx
+		data = data[txLen:]
+	}
+	if len(data) != 0 {
+		return errInvalidPayload
+	}
+	return nil
 }
@@ -0,0 +1,191 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+var testMagic = [4]byte{'T', 'E', 'S', 'T'}
+
+func testMessages() []Message {
+	ts := time.Unix(1_700_000_000, 0)
+	tx := &types.Transaction{
+		Type:      types.TxTypeTransfer,
+		Timestamp: ts,
+		From:      types.Hash{0x01},
+		To:        types.Hash{0x02},
+		Amount:    5,
+		Fee:       1,
+		Signature: bytes.Repeat([]byte{0xCD}, 64),
+	}
+	tx.ID = tx.ComputeID()
+	block := &types.Block{
+		Header:       types.BlockHeader{Version: 1, Height: 4, Timestamp: ts, Bits: 0x2100ffff},
+		Transactions: []*types.Transaction{tx},
+	}
+	block.Header.MerkleRoot = types.ComputeMerkleRoot(block.Transactions)
+	block.Hash = block.ComputeHash()
+
+	return []Message{
+		&MsgVersion{
+			Version:        ProtocolVersion,
+			Network:        "test",
+			GenesisHash:    types.Hash{0x0A},
+			BestHash:       block.Hash,
+			BestHeight:     10,
+			CumulativeWork: big.NewInt(123456),
+			Services:       ServiceFullNode,
+			Nonce:          77,
+			From:           "127.0.0.1:9000",
+			NodeKey:        [32]byte{0x01},
+			SessionKey:     [32]byte{0x02},
+			Signature:      [64]byte{0x03},
+		},
+		&MsgVerAck{},
+		&MsgPing{Nonce: 1},
+		&MsgPong{Nonce: 2},
+		&MsgGetAddr{},
+		&MsgAddr{Addresses: []NetAddress{
+			{Addr: "10.0.0.1:3000", LastSeen: ts},
+			{Addr: "[2001:db8::1]:3000", LastSeen: ts.Add(-time.Hour)},
+		}},
+		&MsgInv{Inventory: []InvVect{{Type: InvTypeBlock, Hash: block.Hash}, {Type: InvTypeTx, Hash: tx.ID}}},
+		&MsgGetData{Inventory: []InvVect{{Type: InvTypeTx, Hash: tx.ID}}},
+		&MsgNotFound{Inventory: []InvVect{}},
+		&MsgBlock{Block: block},
+		&MsgTx{Tx: tx},
+		&MsgGetHeaders{Locator: []types.Hash{block.Hash, {0x0A}}, HashStop: types.Hash{0x42}},
+		&MsgGetHeaders{Locator: []types.Hash{}},
+		&MsgHeaders{Headers: []types.BlockHeader{block.Header, block.Header}},
+		&MsgGetBlock{Hash: types.Hash{0x42}},
+		&MsgCmpctBlock{
+			Header:    block.Header,
+			PowHash:   types.Hash{0x07},
+			Nonce:     9,
+			ShortIDs:  []ShortID{{1, 2, 3, 4, 5, 6}, {6, 5, 4, 3, 2, 1}},
+			Prefilled: []PrefilledTx{{Index: 0, Tx: tx}, {Index: 2, Tx: tx}},
+		},
+		&MsgGetBlockTx{BlockHash: block.Hash, Indexes: []uint16{1, 5, 300}},
+		&MsgBlockTx{BlockHash: block.Hash, Txs: []*types.Transaction{tx, tx}},
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, msg := range testMessages() {
+		var buf bytes.Buffer
+		if err := EncodeMessage(&buf, testMagic, msg); err != nil {
+			t.Fatalf("EncodeMessage(%T) failed: %v", msg, err)
+		}
+		// A trailing frame must be left untouched.
+		buf.Write([]byte("next"))
+
+		got, err := DecodeMessage(&buf, testMagic)
+		if err != nil {
+			t.Fatalf("DecodeMessage(%T) failed: %v", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T round trip mismatch:\n got %+v\nwant %+v", msg, got, msg)
+		}
+		if buf.String() != "next" {
+			t.Errorf("%T: decoder consumed %q of the next frame", msg, "next"[:4-buf.Len()])
+		}
+	}
+}
+
+func TestDecodeMessageRejects(t *testing.T) {
+	var valid bytes.Buffer
+	if err := EncodeMessage(&valid, testMagic, &MsgGetBlock{Hash: types.Hash{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	frame := valid.Bytes()
+
+	mutate := func(f func(b []byte)) []byte {
+		b := append([]byte(nil), frame...)
+		f(b)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"wrong magic", mutate(func(b []byte) { b[0] = 'X' }), ErrBadMagic},
+		{"unknown type", mutate(func(b []byte) { b[4] = 0xEE }), ErrUnknownMessage},
+		{"oversized", mutate(func(b []byte) { binary.BigEndian.PutUint32(b[5:9], 1<<30) }), ErrMessageTooLarge},
+		{"above type limit", mutate(func(b []byte) { binary.BigEndian.PutUint32(b[5:9], 33) }), ErrMessageTooLarge},
+		{"bad checksum", mutate(func(b []byte) { b[len(b)-1] ^= 0xFF }), ErrBadChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeMessage(bytes.NewReader(tt.data), testMagic)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("DecodeMessage error = %v, want %v", err, tt.want)
+			}
+			if decodeErrorScore(err) == 0 {
+				t.Errorf("decode error %v carries no misbehaviour score", err)
+			}
+		})
+	}
+
+	// A well-formed frame around a payload of the wrong shape.
+	var bad bytes.Buffer
+	payload := []byte{1, 2, 3}
+	bad.Write(testMagic[:])
+	bad.WriteByte(byte(MsgTypeGetBlock))
+	bad.Write(binary.BigEndian.AppendUint32(nil, uint32(len(payload))))
+	bad.Write(checksum(payload))
+	bad.Write(payload)
+	if _, err := DecodeMessage(&bad, testMagic); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("DecodeMessage error = %v, want ErrMalformedMessage", err)
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, msg := range testMessages() {
+		var buf bytes.Buffer
+		if err := EncodeMessage(&buf, testMagic, msg); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add(append(testMagic[:], byte(MsgTypeHeaders), 0xFF, 0xFF, 0xFF, 0xFF))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		msg, err := DecodeMessage(r, testMagic)
+		if err != nil {
+			return
+		}
+
+		// Whatever decodes must re-encode to exactly the bytes consumed.
+		consumed := data[:len(data)-r.Len()]
+		var buf bytes.Buffer
+		if err := EncodeMessage(&buf, testMagic, msg); err != nil {
+			t.Fatalf("re-encoding decoded %T failed: %v", msg, err)
+		}
+		if !bytes.Equal(buf.Bytes(), consumed) {
+			t.Fatalf("%T re-encodes to different bytes", msg)
+		}
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	for typ := MsgTypeVersion; typ <= MsgTypeBlockTx; typ++ {
+		_, max, err := newMessage(typ)
+		if err != nil {
+			continue
+		}
+		if max > MaxMessageSize {
+			t.Errorf("message type 0x%x accepts %d bytes, above MaxMessageSize", byte(typ), max)
+		}
+	}
+}
@@ -1,11 +1,57 @@
 package p2p
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+	"github.com/chronodrachma/chrd/pkg/core/types"
 )
 
+const (
+	// BanThreshold is the misbehaviour score at which a peer is disconnected and banned.
+	BanThreshold = 100
+
+	// DefaultBanDuration is how long a banned host is refused unless
+	// ServerConfig.BanDuration says otherwise.
+	DefaultBanDuration = 24 * time.Hour
+
+	// HandshakeTimeout is how long a peer has to complete the version handshake.
+	HandshakeTimeout = 30 * time.Second
+
+	// ControlQueueSize and BulkQueueSize bound the outbound queues of a peer.
+	ControlQueueSize = 32
+	BulkQueueSize    = 128
+
+	// WriteTimeout is the deadline for writing a single message.
+	WriteTimeout = time.Minute
+
+	// MaxQueueStall is how long a peer's outbound queue may stay full before
+	// the peer is disconnected.
+	MaxQueueStall = 30 * time.Second
+
+	// PingInterval is how often a peer is pinged once the handshake is done.
+	PingInterval = 2 * time.Minute
+
+	// PingTimeout is how long a ping may go unanswered before the peer is evicted.
+	PingTimeout = time.Minute
+
+	// IdleTimeout is the read deadline: a peer that sends nothing at all
+	// (not even pongs) for this long is disconnected.
+	IdleTimeout = 5 * time.Minute
+)
+
+// ErrSendQueueFull is returned by Send when the peer's outbound queue is full.
+var ErrSendQueueFull = errors.New("peer send queue full")
+
 // Peer represents a connected remote node.
 type Peer struct {
 	Conn     net.Conn
@@ -13,6 +59,50 @@ type Peer struct {
 	Outbound bool // True if we initiated the connection
 	wg       sync.WaitGroup
 	quit     chan struct{}
+	stopOnce sync.Once
+
+	// Outbound queues, drained by writeLoop. Control messages go first.
+	controlQueue chan Message
+	bulkQueue    chan Message
+
+	mu          sync.Mutex
+	banScore    int
+	fullSince   time.Time // When Send first found a queue full; zero if not full.
+	connectedAt time.Time
+	lastBlock   time.Time // When the peer last relayed a block we accepted.
+
+	// Keepalive state, guarded by mu.
+	pingNonce uint64    // Nonce of the outstanding ping; 0 if none.
+	pingSent  time.Time // When the outstanding ping was sent.
+	latency   time.Duration
+
+	// Handshake state, guarded by mu.
+	remoteVersion *MsgVersion // Set once the peer's MsgVersion is accepted.
+	verAckRcvd    bool
+
+	// knownInv holds the blocks and transactions the peer is known to have,
+	// so they are not announced to it again.
+	knownInv *knownInventory
+
+	// Address exchange state, guarded by mu.
+	listenAddr string // Address the peer accepts connections on, if known.
+	addrSent   bool   // Whether we answered its MsgGetAddr.
+	addrAsked  bool   // Whether we sent MsgGetAddr and await the MsgAddr.
+
+	// Transport state. sessionKey is our X25519 key for this connection,
+	// nil if we don't offer encryption. recvCipher is only used by readLoop;
+	// sendCipher is guarded by mu. Both are nil on plaintext connections.
+	sessionKey *ecdh.PrivateKey
+	recvCipher *frameCipher
+	sendCipher *frameCipher
+
+	// bestWork is the most cumulative work the peer is known to have,
+	// from its version message and the headers it sent. Guarded by mu.
+	bestWork *big.Int
+
+	// compact is the compact block waiting for the MsgBlockTx we asked
+	// the peer for; nil if none. Only used by readLoop.
+	compact *partialBlock
 }
 
 // NewPeer creates a new peer instance.
@@ -22,20 +112,139 @@ func NewPeer(conn net.Conn, server *Server, outbound bool) *Peer {
 		Server:   server,
 		Outbound: outbound,
 		quit:     make(chan struct{}),
+
+		controlQueue: make(chan Message, ControlQueueSize),
+		bulkQueue:    make(chan Message, BulkQueueSize),
+		connectedAt:  time.Now(),
+		knownInv:     newKnownInventory(MaxKnownInventory),
 	}
 }
 
-// Start begins the peer's read/write loops.
+// Start begins the peer's read/write loops. The peer is disconnected if the
+// handshake does not complete within HandshakeTimeout.
 func (p *Peer) Start() {
-	p.wg.Add(1)
+	p.wg.Add(3)
 	go p.readLoop()
+	go p.writeLoop()
+	go p.pingLoop()
+
+	time.AfterFunc(HandshakeTimeout, func() {
+		if !p.HandshakeComplete() {
+			log.Printf("Handshake with %s timed out", p.Conn.RemoteAddr())
+			p.Stop()
+		}
+	})
+}
+
+// HandshakeComplete reports whether the peer's version was accepted and it
+// acknowledged ours. Until then only handshake messages are processed.
+func (p *Peer) HandshakeComplete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remoteVersion != nil && p.verAckRcvd
 }
 
-// Stop closes the peer connection.
+// RemoteVersion returns the version message the peer sent, or nil before it
+// has been accepted.
+func (p *Peer) RemoteVersion() *MsgVersion {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remoteVersion
+}
+
+// Stop closes the peer connection. It is safe to call more than once and
+// from the peer's own read loop.
 func (p *Peer) Stop() {
-	close(p.quit)
-	p.Conn.Close()
-	p.wg.Wait()
+	p.stopOnce.Do(func() {
+		close(p.quit)
+		p.Conn.Close()
+	})
+}
+
+// stopped reports whether Stop has been called.
+func (p *Peer) stopped() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Misbehaving adds score to the peer's ban score. Once it reaches
+// BanThreshold the peer is banned and disconnected.
+func (p *Peer) Misbehaving(score int, reason string) {
+	p.mu.Lock()
+	p.banScore += score
+	total := p.banScore
+	p.mu.Unlock()
+
+	log.Printf("Peer %s misbehaving (+%d = %d): %s", p.Conn.RemoteAddr(), score, total, reason)
+	if total >= BanThreshold {
+		log.Printf("Banning peer %s", p.Conn.RemoteAddr())
+		p.Server.Ban(p.Conn.RemoteAddr())
+		p.Stop()
+	}
+}
+
+// decodeErrorScore returns the misbehaviour score for an error reading a
+// message: from DecodeMessage, or from opening an encrypted frame. I/O
+// errors (including a clean close) carry no penalty.
+func decodeErrorScore(err error) int {
+	switch {
+	case errors.Is(err, ErrMessageTooLarge), errors.Is(err, ErrMalformedMessage):
+		return BanThreshold
+	case errors.Is(err, ErrBadChecksum), errors.Is(err, ErrDecrypt):
+		return 50
+	case errors.Is(err, ErrUnknownMessage), errors.Is(err, ErrBadMagic):
+		return 20
+	default:
+		return 0
+	}
+}
+
+// blockErrorScore returns the misbehaviour score for a block the peer sent
+// that ProcessBlock rejected with err. Blocks that can never be valid get the
+// full BanThreshold; errors that depend on our own state or clock get none.
+func blockErrorScore(err error) int {
+	var txErr *blockchain.TxError
+	switch {
+	case errors.As(err, &txErr),
+		errors.Is(err, blockchain.ErrInvalidPoW),
+		errors.Is(err, blockchain.ErrPowHashMismatch),
+		errors.Is(err, blockchain.ErrInvalidBits),
+		errors.Is(err, blockchain.ErrInvalidBlockHash),
+		errors.Is(err, blockchain.ErrInvalidMerkleRoot),
+		errors.Is(err, blockchain.ErrInvalidHeight),
+		errors.Is(err, blockchain.ErrInvalidPrevHash),
+		errors.Is(err, blockchain.ErrInvalidTimestamp),
+		errors.Is(err, blockchain.ErrTimestampTooOld),
+		errors.Is(err, blockchain.ErrNoCoinbaseTx),
+		errors.Is(err, blockchain.ErrInvalidCoinbasePos),
+		errors.Is(err, blockchain.ErrInvalidCoinbaseAmt),
+		errors.Is(err, blockchain.ErrAmountOverflow),
+		errors.Is(err, blockchain.ErrKnownInvalid):
+		return BanThreshold
+	case errors.Is(err, blockchain.ErrFinalizedFork):
+		// Possibly an honest node stuck on a stale fork, but one we can
+		// never follow.
+		return 20
+	default:
+		// ErrTimestampTooFar may be our clock; storage errors are ours.
+		return 0
+	}
+}
+
+// txErrorScore returns the misbehaviour score for a transaction the peer
+// relayed that the mempool rejected with err. Nonce and balance failures
+// depend on our view of the chain and carry no penalty.
+func txErrorScore(err error) int {
+	switch {
+	case errors.Is(err, mempool.ErrInvalidSignature):
+		return BanThreshold
+	default:
+		return 0
+	}
 }
 
 // readLoop continuously reads messages from the connection.
@@ -48,9 +257,15 @@ func (p *Peer) readLoop() {
 		case <-p.quit:
 			return
 		default:
-			msg, err := DecodeMessage(p.Conn)
+			p.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+			msg, err := p.readMessage()
 			if err != nil {
 				log.Printf("Read error from %s: %v", p.Conn.RemoteAddr(), err)
+				// The stream cannot be resynchronised after a bad frame:
+				// penalise the peer and disconnect.
+				if score := decodeErrorScore(err); score > 0 {
+					p.Misbehaving(score, err.Error())
+				}
 				return
 			}
 			p.handleMessage(msg)
@@ -58,71 +273,270 @@ func (p *Peer) readLoop() {
 	}
 }
 
+// writeLoop is the only writer of the connection. It drains the control queue
+// before the bulk queue and disconnects the peer on write errors or timeouts.
+func (p *Peer) writeLoop() {
+	defer p.wg.Done()
+
+	for {
+		var msg Message
+		select {
+		case msg = <-p.controlQueue:
+		default:
+			select {
+			case msg = <-p.controlQueue:
+			case msg = <-p.bulkQueue:
+			case <-p.quit:
+				return
+			}
+		}
+
+		p.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		if err := p.writeMessage(msg); err != nil {
+			log.Printf("Write error to %s: %v", p.Conn.RemoteAddr(), err)
+			p.Stop()
+			return
+		}
+	}
+}
+
+// readMessage reads the next message, decrypting it once the session is
+// encrypted.
+func (p *Peer) readMessage() (Message, error) {
+	magic := p.Server.Config.Network.Magic
+	if p.recvCipher == nil {
+		return DecodeMessage(p.Conn, magic)
+	}
+	frame, err := p.recvCipher.readFrame(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(frame)
+	msg, err := DecodeMessage(r, magic)
+	if err == nil && r.Len() != 0 {
+		err = fmt.Errorf("%w: trailing data in encrypted frame", ErrMalformedMessage)
+	}
+	return msg, err
+}
+
+// writeMessage writes msg, encrypting it once the session is encrypted.
+// MsgVersion is always sent in the clear: it carries the session keys.
+func (p *Peer) writeMessage(msg Message) error {
+	magic := p.Server.Config.Network.Magic
+	p.mu.Lock()
+	c := p.sendCipher
+	p.mu.Unlock()
+	if c == nil || msg.Type() == MsgTypeVersion {
+		return EncodeMessage(p.Conn, magic, msg)
+	}
+	var frame bytes.Buffer
+	if err := EncodeMessage(&frame, magic, msg); err != nil {
+		return err
+	}
+	return c.writeFrame(p.Conn, frame.Bytes())
+}
+
+// startSession switches the connection to encrypted frames if both sides
+// offered a session key in their versions. It runs on readLoop, so the
+// peer's next frame is already read encrypted; the peer, likewise, reads
+// our frames after our version encrypted.
+func (p *Peer) startSession(m *MsgVersion) error {
+	if p.sessionKey == nil || m.SessionKey == ([32]byte{}) {
+		if p.Server.Config.Encryption == EncryptionRequired {
+			return errEncryptionRequired
+		}
+		return nil
+	}
+	send, recv, err := sessionCiphers(p.sessionKey, m.SessionKey)
+	if err != nil {
+		return err
+	}
+	p.recvCipher = recv
+	p.mu.Lock()
+	p.sendCipher = send
+	p.mu.Unlock()
+	return nil
+}
+
+// Encrypted reports whether the connection is encrypted.
+func (p *Peer) Encrypted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sendCipher != nil
+}
+
+// pingLoop pings the peer every PingInterval.
+func (p *Peer) pingLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.pingTick(time.Now())
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// pingTick evicts the peer if its last ping went unanswered for PingTimeout,
+// and otherwise sends a new ping.
+func (p *Peer) pingTick(now time.Time) {
+	p.mu.Lock()
+	outstanding := p.pingNonce != 0
+	waited := now.Sub(p.pingSent)
+	p.mu.Unlock()
+
+	if outstanding && waited > PingTimeout {
+		log.Printf("Peer %s did not answer ping for %v, disconnecting", p.Conn.RemoteAddr(), waited.Round(time.Second))
+		p.Stop()
+		return
+	}
+	if !outstanding && p.HandshakeComplete() {
+		p.sendPing(now)
+	}
+}
+
+// sendPing sends a ping with a fresh nonce and remembers it.
+func (p *Peer) sendPing(now time.Time) {
+	nonce := randomNonce()
+	for nonce == 0 {
+		nonce = randomNonce()
+	}
+
+	p.mu.Lock()
+	p.pingNonce = nonce
+	p.pingSent = now
+	p.mu.Unlock()
+
+	p.Send(&MsgPing{Nonce: nonce})
+}
+
+// handlePong records the round-trip time of the outstanding ping.
+func (p *Peer) handlePong(m *MsgPong) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce == 0 || m.Nonce != p.pingNonce {
+		// Late or unsolicited pong; harmless.
+		return
+	}
+	p.latency = time.Since(p.pingSent)
+	p.pingNonce = 0
+}
+
+// Latency returns the round-trip time of the last answered ping, or 0.
+func (p *Peer) Latency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latency
+}
+
 func (p *Peer) handleMessage(msg Message) {
+	if !p.HandshakeComplete() {
+		switch m := msg.(type) {
+		case *MsgVersion:
+			p.handleVersion(m)
+		case *MsgVerAck:
+			p.handleVerAck()
+		default:
+			p.Misbehaving(10, fmt.Sprintf("message type 0x%x before handshake", byte(msg.Type())))
+		}
+		return
+	}
+
 	switch m := msg.(type) {
-	case *MsgVersion:
-		log.Printf("Received Version from %s: v%d, height=%d", p.Conn.RemoteAddr(), m.Version, m.BlockHeight)
-		// Check if we are behind
-		localHeight := p.Server.Chain.Height()
-		if m.BlockHeight > localHeight {
-			log.Printf("We are behind peer %s (local=%d, peer=%d). Requesting sync.", p.Conn.RemoteAddr(), localHeight, m.BlockHeight)
-			p.Send(&MsgGetBlocks{FromHeight: localHeight + 1})
-		}
-
-	case *MsgGetBlocks:
-		// Peer wants blocks
-		log.Printf("Received GetBlocks from %s starting at %d", p.Conn.RemoteAddr(), m.FromHeight)
-		blocks, err := p.Server.Chain.GetBlocksRange(m.FromHeight, 50)
-		if err != nil {
-			log.Printf("Failed to get blocks for peer: %v", err)
+	case *MsgVersion, *MsgVerAck:
+		p.Misbehaving(1, "duplicate handshake message")
+
+	case *MsgPing:
+		p.Send(&MsgPong{Nonce: m.Nonce})
+
+	case *MsgPong:
+		p.handlePong(m)
+
+	case *MsgGetAddr:
+		p.mu.Lock()
+		repeated := p.addrSent
+		p.addrSent = true
+		p.mu.Unlock()
+		if repeated {
+			// Answer once per connection so peers can't scrape us repeatedly.
 			return
 		}
-		if len(blocks) > 0 {
-			log.Printf("Sending %d blocks to %s", len(blocks), p.Conn.RemoteAddr())
-			p.Send(&MsgBlocks{Blocks: blocks})
-		}
-
-	case *MsgBlocks:
-		// Peer sent us blocks
-		log.Printf("Received %d blocks from %s", len(m.Blocks), p.Conn.RemoteAddr())
-		count := 0
-		for _, block := range m.Blocks {
-			if err := p.Server.Chain.AddBlock(block); err != nil {
-				log.Printf("Sync: Failed to add block %d (%x): %v", block.Header.Height, block.Hash[:8], err)
-				// Stop processing batch on error? Or continue?
-				// Usually stop if parent missing.
-				break
+		p.Send(&MsgAddr{Addresses: p.Server.addrs.Addresses(MaxAddrPerMsg)})
+
+	case *MsgAddr:
+		p.mu.Lock()
+		asked := p.addrAsked
+		p.addrAsked = false
+		p.mu.Unlock()
+		if !asked {
+			// Only answers are taken, so a peer can't flood the book.
+			p.Misbehaving(10, "unsolicited addr message")
+			return
+		}
+		p.Server.addrs.AddGossiped(m.Addresses, p.Conn.RemoteAddr().String())
+
+	case *MsgInv:
+		p.handleInv(m)
+
+	case *MsgGetData:
+		p.handleGetData(m)
+
+	case *MsgNotFound:
+		now := time.Now()
+		for _, iv := range m.Inventory {
+			if iv.Type == InvTypeCompactBlock {
+				iv.Type = InvTypeBlock // Requests are tracked by block.
+			}
+			if next := p.Server.requests.notFound(p, iv, now); next != nil {
+				next.Send(&MsgGetData{Inventory: []InvVect{iv}})
 			}
-			count++
 		}
-		log.Printf("Sync: Added %d/%d blocks.", count, len(m.Blocks))
 
-		// If we processed all successfully, and we are not yet at tip, request more?
-		// We can check if the last block added is still behind known peer height?
-		// But peer height from Version might be stale.
-		// Simple logic: if we received a full batch (50), likely more available.
-		if count == len(m.Blocks) && count == 50 {
-			lastHeight := m.Blocks[len(m.Blocks)-1].Header.Height
-			log.Printf("Sync: Requesting more blocks from %d...", lastHeight+1)
-			p.Send(&MsgGetBlocks{FromHeight: lastHeight + 1})
+	case *MsgGetHeaders:
+		headers := p.Server.Chain.LocateHeaders(m.Locator, m.HashStop, MaxHeadersPerMsg)
+		p.Send(&MsgHeaders{Headers: headers})
+
+	case *MsgHeaders:
+		p.Server.sync.handleHeaders(p, m)
+
+	case *MsgGetBlock:
+		block, err := p.Server.Chain.GetBlockByHash(m.Hash)
+		if err != nil {
+			log.Printf("Peer %s requested unknown block %x", p.Conn.RemoteAddr(), m.Hash[:8])
+			return
 		}
+		p.Send(&MsgBlock{Block: block})
 
 	case *MsgBlock:
-		log.Printf("Received Block from %s: %x", p.Conn.RemoteAddr(), m.Block.Hash)
-		if err := p.Server.Chain.AddBlock(m.Block); err != nil {
-			log.Printf("Failed to add block: %v", err)
-		} else {
-			log.Printf("Added block %x from peer, broadcasting...", m.Block.Hash)
-			p.Server.Broadcast(m) // Gossip
-		}
+		p.handleBlock(m.Block)
+
+	case *MsgCmpctBlock:
+		p.handleCmpctBlock(m)
+
+	case *MsgGetBlockTx:
+		p.handleGetBlockTx(m)
+
+	case *MsgBlockTx:
+		p.handleBlockTx(m)
 
 	case *MsgTx:
 		log.Printf("Received Tx from %s: %x", p.Conn.RemoteAddr(), m.Tx.ID)
+		iv := InvVect{Type: InvTypeTx, Hash: m.Tx.ID}
+		p.knownInv.Add(iv)
+		p.Server.requests.received(iv)
 		if err := p.Server.Mempool.AddTransaction(m.Tx); err != nil {
 			// If already exists, don't gossip back
-			if err.Error() != "transaction already in mempool" {
+			if !errors.Is(err, mempool.ErrTxAlreadyInMempool) {
 				log.Printf("Failed to add transaction: %v", err)
 			}
+			if score := txErrorScore(err); score > 0 {
+				p.Misbehaving(score, fmt.Sprintf("invalid transaction %x: %v", m.Tx.ID[:8], err))
+			}
 		} else {
 			log.Printf("Added tx %x to mempool, broadcasting...", m.Tx.ID)
 			p.Server.Broadcast(m)
@@ -130,7 +544,293 @@ func (p *Peer) handleMessage(msg Message) {
 	}
 }
 
-// Send sends a message to the peer.
+// handleBlock processes a block the peer sent, in full or compactly, and
+// relays it if it extends our chain.
+func (p *Peer) handleBlock(block *types.Block) {
+	log.Printf("Received Block from %s: %x", p.Conn.RemoteAddr(), block.Hash)
+	iv := InvVect{Type: InvTypeBlock, Hash: block.Hash}
+	p.knownInv.Add(iv)
+	p.Server.requests.received(iv)
+	if err := p.Server.Chain.ProcessBlock(block, p.Addr()); err != nil {
+		if errors.Is(err, blockchain.ErrOrphanBlock) {
+			p.Server.sync.blockOrphaned(p, block)
+			p.Server.sync.blockReceived(p, block)
+			return
+		}
+		log.Printf("Failed to add block: %v", err)
+		if score := blockErrorScore(err); score > 0 {
+			p.Misbehaving(score, fmt.Sprintf("invalid block %x: %v", block.Hash[:8], err))
+		} else {
+			p.Server.sync.blockDeferred(block.Hash)
+		}
+	} else {
+		p.mu.Lock()
+		p.lastBlock = time.Now()
+		p.mu.Unlock()
+		log.Printf("Added block %x from peer, broadcasting...", block.Hash)
+		p.Server.Broadcast(&MsgBlock{Block: block}) // Gossip
+	}
+	p.Server.sync.blockReceived(p, block)
+}
+
+// handleInv requests the announced items we don't have and that no other
+// peer is already sending us. New blocks are requested compactly from peers
+// that support it, unless we are syncing and unlikely to have their
+// transactions.
+func (p *Peer) handleInv(m *MsgInv) {
+	now := time.Now()
+	compact := p.supportsCompactBlocks() && len(p.Server.Chain.MissingBlocks(1)) == 0
+	var want []InvVect
+	for _, iv := range m.Inventory {
+		p.knownInv.Add(iv)
+
+		switch iv.Type {
+		case InvTypeBlock:
+			if work, err := p.Server.Chain.HeaderWork(iv.Hash); err == nil {
+				p.updateBestWork(work)
+			}
+			if p.Server.Chain.HaveBlock(iv.Hash) {
+				continue
+			}
+		case InvTypeTx:
+			if _, ok := p.Server.Mempool.Get(iv.Hash); ok {
+				continue
+			}
+		default:
+			p.Misbehaving(20, fmt.Sprintf("unknown inventory type 0x%x", byte(iv.Type)))
+			return
+		}
+
+		if p.Server.requests.announced(p, iv, now) {
+			if iv.Type == InvTypeBlock && compact {
+				// Tracked as InvTypeBlock, so a retry fetches the full block.
+				iv.Type = InvTypeCompactBlock
+			}
+			want = append(want, iv)
+		}
+	}
+	if len(want) > 0 {
+		p.Send(&MsgGetData{Inventory: want})
+	}
+}
+
+// handleGetData sends the requested blocks and transactions, and lists the
+// ones we don't have in a MsgNotFound.
+func (p *Peer) handleGetData(m *MsgGetData) {
+	var missing []InvVect
+	for _, iv := range m.Inventory {
+		var msg Message
+		switch iv.Type {
+		case InvTypeBlock:
+			if block, err := p.Server.Chain.GetBlockByHash(iv.Hash); err == nil {
+				msg = &MsgBlock{Block: block}
+			}
+		case InvTypeCompactBlock:
+			if block, err := p.Server.Chain.GetBlockByHash(iv.Hash); err == nil {
+				if cmpct := newCompactBlock(block); cmpct != nil {
+					msg = cmpct
+				} else {
+					msg = &MsgBlock{Block: block}
+				}
+				iv.Type = InvTypeBlock
+			}
+		case InvTypeTx:
+			if tx, ok := p.Server.Mempool.Get(iv.Hash); ok {
+				msg = &MsgTx{Tx: tx}
+			}
+		}
+		if msg == nil {
+			missing = append(missing, iv)
+			continue
+		}
+		p.knownInv.Add(iv)
+		if err := p.Send(msg); err != nil {
+			log.Printf("Failed to queue %x for %s: %v", iv.Hash[:8], p.Conn.RemoteAddr(), err)
+		}
+	}
+	if len(missing) > 0 {
+		p.Send(&MsgNotFound{Inventory: missing})
+	}
+}
+
+// handleVersion checks the peer's version and acknowledges it. Peers on
+// another network or chain, with an unsupported protocol version, or that
+// turn out to be ourselves are disconnected.
+func (p *Peer) handleVersion(m *MsgVersion) {
+	log.Printf("Received Version from %s: v%d, network=%s, height=%d", p.Conn.RemoteAddr(), m.Version, m.Network, m.BestHeight)
+
+	p.mu.Lock()
+	duplicate := p.remoteVersion != nil
+	p.mu.Unlock()
+	if duplicate {
+		p.Misbehaving(1, "duplicate version")
+		return
+	}
+
+	if err := p.Server.checkVersion(m); err != nil {
+		log.Printf("Disconnecting %s: %v", p.Conn.RemoteAddr(), err)
+		if p.Outbound && errors.Is(err, errSelfConnection) {
+			p.Server.addrs.Remove(p.ListenAddr())
+		}
+		p.Stop()
+		return
+	}
+	if p.Server.connectedTo(m.Nonce, p) {
+		log.Printf("Disconnecting %s: already connected to this node", p.Conn.RemoteAddr())
+		p.Stop()
+		return
+	}
+	if err := p.startSession(m); err != nil {
+		log.Printf("Disconnecting %s: %v", p.Conn.RemoteAddr(), err)
+		p.Stop()
+		return
+	}
+
+	p.mu.Lock()
+	p.remoteVersion = m
+	p.bestWork = m.CumulativeWork
+	if !p.Outbound {
+		p.listenAddr = advertisedAddr(p.Conn.RemoteAddr(), m.From)
+	}
+	p.mu.Unlock()
+
+	p.Send(&MsgVerAck{})
+	p.maybeFinishHandshake()
+}
+
+// handleVerAck records the peer's acknowledgement of our version.
+func (p *Peer) handleVerAck() {
+	p.mu.Lock()
+	p.verAckRcvd = true
+	p.mu.Unlock()
+	p.maybeFinishHandshake()
+}
+
+// maybeFinishHandshake starts syncing once both sides have accepted each other.
+func (p *Peer) maybeFinishHandshake() {
+	if !p.HandshakeComplete() {
+		return
+	}
+	v := p.RemoteVersion()
+	log.Printf("Handshake with %s complete (v%d, services=%x)", p.Conn.RemoteAddr(), v.Version, v.Services)
+
+	// Outbound peers are asked for more addresses; inbound peers tell us
+	// where they listen.
+	if addr := p.ListenAddr(); addr != "" {
+		if p.Outbound {
+			p.Server.addrs.Good(addr)
+			p.mu.Lock()
+			p.addrAsked = true
+			p.mu.Unlock()
+			p.Send(&MsgGetAddr{})
+		} else {
+			p.Server.addrs.Add(addr, time.Now())
+		}
+	}
+
+	p.Server.sync.peerReady()
+}
+
+// BestWork returns the most cumulative work the peer is known to have.
+func (p *Peer) BestWork() *big.Int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bestWork == nil {
+		return new(big.Int)
+	}
+	return p.bestWork
+}
+
+// updateBestWork raises the peer's known work to work if that is more.
+func (p *Peer) updateBestWork(work *big.Int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bestWork == nil || work.Cmp(p.bestWork) > 0 {
+		p.bestWork = work
+	}
+}
+
+// setBestWork replaces the peer's known work, once its headers have shown
+// where its chain ends.
+func (p *Peer) setBestWork(work *big.Int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bestWork = work
+}
+
+// ListenAddr returns the address the peer accepts connections on: the dialled
+// address for outbound peers, the advertised one for inbound peers. It is
+// empty for inbound peers before the handshake.
+func (p *Peer) ListenAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listenAddr
+}
+
+// advertisedAddr combines the host a peer connected from with the port it
+// advertised in its version message. It returns "" if from has no port.
+func advertisedAddr(remote net.Addr, from string) string {
+	_, port, err := net.SplitHostPort(from)
+	if err != nil {
+		return ""
+	}
+	addr := net.JoinHostPort(hostOf(remote), port)
+	if !validAddr(addr) {
+		return ""
+	}
+	return addr
+}
+
+// Addr returns the peer's remote address, used as its identifier.
+func (p *Peer) Addr() string {
+	return p.Conn.RemoteAddr().String()
+}
+
+// isBulk reports whether msg carries block or transaction data, which is
+// queued behind control messages.
+func isBulk(msg Message) bool {
+	switch msg.(type) {
+	case *MsgBlock, *MsgTx, *MsgCmpctBlock, *MsgBlockTx:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send queues a message for the peer without blocking. If the queue is full
+// the message is dropped and ErrSendQueueFull returned; a peer whose queue
+// stays full for MaxQueueStall is disconnected.
 func (p *Peer) Send(msg Message) error {
-	return EncodeMessage(p.Conn, msg)
+	queue := p.controlQueue
+	if isBulk(msg) {
+		queue = p.bulkQueue
+	}
+
+	select {
+	case <-p.quit:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case queue <- msg:
+		p.mu.Lock()
+		p.fullSince = time.Time{}
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+
+	p.mu.Lock()
+	if p.fullSince.IsZero() {
+		p.fullSince = time.Now()
+	}
+	stalled := time.Since(p.fullSince)
+	p.mu.Unlock()
+
+	if stalled > MaxQueueStall {
+		log.Printf("Send queue to %s full for %v, disconnecting", p.Conn.RemoteAddr(), stalled.Round(time.Second))
+		p.Stop()
+	}
+	return ErrSendQueueFull
 }
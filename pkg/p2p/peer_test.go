@@ -0,0 +1,206 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/config"
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// newPipePeer returns a peer on one end of an in-memory connection and the
+// other end. Its loops are not started.
+func newPipePeer(t *testing.T) (*Peer, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	server := &Server{Config: ServerConfig{Network: config.NetworkConfig{Name: "test", Magic: testMagic}}}
+	p := NewPeer(local, server, false)
+	t.Cleanup(func() {
+		p.Stop()
+		remote.Close()
+	})
+	return p, remote
+}
+
+func TestPeerSendsControlBeforeBulk(t *testing.T) {
+	p, remote := newPipePeer(t)
+
+	if err := p.Send(&MsgBlock{Block: &types.Block{}}); err != nil {
+		t.Fatalf("Send(block) failed: %v", err)
+	}
+	if err := p.Send(&MsgGetBlock{Hash: types.Hash{0x01}}); err != nil {
+		t.Fatalf("Send(getblock) failed: %v", err)
+	}
+
+	p.wg.Add(1)
+	go p.writeLoop()
+
+	for _, want := range []MessageType{MsgTypeGetBlock, MsgTypeBlock} {
+		msg, err := DecodeMessage(remote, testMagic)
+		if err != nil {
+			t.Fatalf("DecodeMessage failed: %v", err)
+		}
+		if msg.Type() != want {
+			t.Errorf("got message type 0x%x, want 0x%x", byte(msg.Type()), byte(want))
+		}
+	}
+}
+
+func TestPeerDisconnectsWhenQueueStaysFull(t *testing.T) {
+	p, _ := newPipePeer(t)
+
+	// Nothing drains the queue.
+	for i := 0; i < BulkQueueSize; i++ {
+		if err := p.Send(&MsgTx{Tx: &types.Transaction{}}); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := p.Send(&MsgTx{Tx: &types.Transaction{}}); !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("Send on full queue = %v, want ErrSendQueueFull", err)
+	}
+	// Control messages have their own queue.
+	if err := p.Send(&MsgGetHeaders{}); err != nil {
+		t.Fatalf("Send(control) with full bulk queue failed: %v", err)
+	}
+
+	// Still full after MaxQueueStall: the peer is dropped.
+	p.mu.Lock()
+	p.fullSince = time.Now().Add(-MaxQueueStall - time.Second)
+	p.mu.Unlock()
+	p.Send(&MsgTx{Tx: &types.Transaction{}})
+
+	select {
+	case <-p.quit:
+	default:
+		t.Fatal("peer with a stalled queue should be stopped")
+	}
+}
+
+func TestPeerPingRecordsLatency(t *testing.T) {
+	p, remote := newPipePeer(t)
+	p.wg.Add(1)
+	go p.writeLoop()
+
+	sent := time.Now().Add(-50 * time.Millisecond)
+	p.sendPing(sent)
+	msg, err := DecodeMessage(remote, testMagic)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %v", err)
+	}
+	ping, ok := msg.(*MsgPing)
+	if !ok {
+		t.Fatalf("got %T, want *MsgPing", msg)
+	}
+
+	// A pong with the wrong nonce is ignored.
+	p.handlePong(&MsgPong{Nonce: ping.Nonce + 1})
+	if p.Latency() != 0 {
+		t.Fatal("latency recorded for a pong with the wrong nonce")
+	}
+
+	p.handlePong(&MsgPong{Nonce: ping.Nonce})
+	if p.Latency() < 50*time.Millisecond {
+		t.Errorf("latency = %v, want at least 50ms", p.Latency())
+	}
+	p.mu.Lock()
+	outstanding := p.pingNonce
+	p.mu.Unlock()
+	if outstanding != 0 {
+		t.Error("answered ping is still outstanding")
+	}
+}
+
+func TestPeerEvictedWhenPingUnanswered(t *testing.T) {
+	p, _ := newPipePeer(t)
+
+	now := time.Now()
+	p.mu.Lock()
+	p.pingNonce = 1
+	p.pingSent = now.Add(-PingTimeout / 2)
+	p.mu.Unlock()
+
+	p.pingTick(now)
+	select {
+	case <-p.quit:
+		t.Fatal("peer stopped before PingTimeout")
+	default:
+	}
+
+	p.pingTick(now.Add(PingTimeout))
+	select {
+	case <-p.quit:
+	default:
+		t.Fatal("peer that ignores pings should be stopped")
+	}
+}
+
+func TestValidationErrorScores(t *testing.T) {
+	blockTests := []struct {
+		err  error
+		want int
+	}{
+		{blockchain.ErrInvalidPoW, BanThreshold},
+		{fmt.Errorf("%w: expected 1, got 5", blockchain.ErrInvalidHeight), BanThreshold},
+		{&blockchain.TxError{Err: blockchain.ErrInvalidTxSignature}, BanThreshold},
+		{blockchain.ErrFinalizedFork, 20},
+		{blockchain.ErrTimestampTooFar, 0},
+		{blockchain.ErrOrphanBlock, 0},
+		{errors.New("disk full"), 0},
+	}
+	for _, tt := range blockTests {
+		if got := blockErrorScore(tt.err); got != tt.want {
+			t.Errorf("blockErrorScore(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+
+	txTests := []struct {
+		err  error
+		want int
+	}{
+		{mempool.ErrInvalidSignature, BanThreshold},
+		{mempool.ErrInvalidNonce, 0},
+		{mempool.ErrInsufficientFunds, 0},
+		{mempool.ErrTxAlreadyInMempool, 0},
+	}
+	for _, tt := range txTests {
+		if got := txErrorScore(tt.err); got != tt.want {
+			t.Errorf("txErrorScore(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPeerTakesOnlySolicitedAddr(t *testing.T) {
+	p, _ := newPipePeer(t)
+	p.Server.addrs, _ = NewAddrManager(nil)
+	p.remoteVersion = &MsgVersion{}
+	p.verAckRcvd = true
+	msg := &MsgAddr{Addresses: []NetAddress{{Addr: "10.0.0.1:3000", LastSeen: time.Now()}}}
+
+	p.handleMessage(msg)
+	if p.Server.addrs.Len() != 0 {
+		t.Fatal("unsolicited addresses were added to the book")
+	}
+	p.mu.Lock()
+	score := p.banScore
+	p.addrAsked = true
+	p.mu.Unlock()
+	if score == 0 {
+		t.Error("unsolicited addr message was not penalised")
+	}
+
+	p.handleMessage(msg)
+	if p.Server.addrs.Len() != 1 {
+		t.Fatalf("book has %d addresses after the answer, want 1", p.Server.addrs.Len())
+	}
+
+	// Only one answer is taken per request.
+	p.handleMessage(&MsgAddr{Addresses: []NetAddress{{Addr: "10.0.0.2:3000", LastSeen: time.Now()}}})
+	if p.Server.addrs.Len() != 1 {
+		t.Errorf("book has %d addresses after a second answer, want 1", p.Server.addrs.Len())
+	}
+}
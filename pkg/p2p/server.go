@@ -1,12 +1,68 @@
 package p2p
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/chronodrachma/chrd/pkg/config"
 	"github.com/chronodrachma/chrd/pkg/core/blockchain"
 	"github.com/chronodrachma/chrd/pkg/core/mempool"
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	// ProtocolVersion is the P2P protocol version this node speaks.
+	ProtocolVersion uint32 = 5
+
+	// MinProtocolVersion is the oldest protocol version accepted from peers.
+	// Version 3 replaced height-based MsgGetBlocks sync with headers-first
+	// sync; version 4 added node keys and encryption to MsgVersion.
+	MinProtocolVersion uint32 = 4
+
+	// CompactBlocksVersion is the first protocol version that serves
+	// MsgCmpctBlock.
+	CompactBlocksVersion uint32 = 5
+)
+
+const (
+	// DefaultTargetOutbound is the number of outbound peers the connection
+	// manager maintains unless ServerConfig.TargetOutbound says otherwise.
+	DefaultTargetOutbound = 8
+
+	// ConnectInterval is how often the connection manager tops up outbound peers.
+	ConnectInterval = 10 * time.Second
+
+	// DialTimeout bounds a single outbound connection attempt.
+	DialTimeout = 10 * time.Second
+
+	// DefaultMaxInbound, DefaultMaxOutbound and DefaultMaxPerIP are the
+	// connection limits used unless ServerConfig says otherwise.
+	DefaultMaxInbound  = 64
+	DefaultMaxOutbound = 16
+	DefaultMaxPerIP    = 8 // Several nodes may share an address behind NAT.
+)
+
+var (
+	// errSelfConnection is returned by checkVersion when we dialled ourselves.
+	errSelfConnection = errors.New("connected to self")
+
+	// errInboundFull and errTooManyFromHost are returned by admitInbound.
+	errInboundFull     = errors.New("inbound slots full")
+	errTooManyFromHost = errors.New("too many connections from host")
+)
+
+// Service bits advertised in MsgVersion.
+const (
+	ServiceFullNode uint64 = 1 << 0 // Stores and serves the full chain.
 )
 
 // Server manages the P2P network.
@@ -18,50 +74,315 @@ type Server struct {
 	peerMu   sync.RWMutex
 	listener net.Listener
 	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup // Server goroutines, but not peers.
+
+	// nonce identifies this server in version messages, to detect
+	// connections to ourselves.
+	nonce uint64
+
+	// nodeKey is the node's identity key, used to sign handshakes.
+	nodeKey ed25519.PrivateKey
+
+	// bans and addrs are the ban list and address book, loaded in Start.
+	bans  *BanList
+	addrs *AddrManager
+
+	// requests tracks the blocks and transactions requested with MsgGetData.
+	requests *requestTracker
+
+	// sync drives headers-first synchronisation.
+	sync *syncManager
+
+	// pending holds the addresses being dialled by the connection manager.
+	// Guarded by peerMu.
+	pending map[string]bool
 }
 
 type ServerConfig struct {
 	ListenAddr string
 	SeedNodes  []string
+	Network    config.NetworkConfig // Defaults to config.TestnetConfig.
+
+	// DB persists the address book and ban list. If nil, they are kept in memory.
+	DB *badger.DB
+
+	// BanDuration is how long a misbehaving host is banned.
+	// Defaults to DefaultBanDuration.
+	BanDuration time.Duration
+
+	// TargetOutbound is the number of outbound peers to maintain.
+	// Defaults to DefaultTargetOutbound, and is capped at MaxOutbound.
+	TargetOutbound int
+
+	// MaxInbound and MaxOutbound bound the inbound and outbound peers, and
+	// MaxPerIP the inbound peers from a single host. They default to
+	// DefaultMaxInbound, DefaultMaxOutbound and DefaultMaxPerIP.
+	MaxInbound  int
+	MaxOutbound int
+	MaxPerIP    int
+
+	// NodeKey is the node's identity key; see LoadOrCreateNodeKey. If nil,
+	// a new one is generated and the node ID changes on every start.
+	NodeKey ed25519.PrivateKey
+
+	// Encryption says whether connections are encrypted.
+	// Defaults to EncryptionPreferred.
+	Encryption EncryptionMode
+
+	// Transport listens for and dials peer connections. Defaults to TCP.
+	Transport Transport
+}
+
+func NewServer(cfg ServerConfig, chain *blockchain.Chain, mp *mempool.Mempool) *Server {
+	if cfg.Network.Name == "" {
+		cfg.Network = config.TestnetConfig
+	}
+	if cfg.TargetOutbound == 0 {
+		cfg.TargetOutbound = DefaultTargetOutbound
+	}
+	if cfg.BanDuration == 0 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+	if cfg.MaxInbound == 0 {
+		cfg.MaxInbound = DefaultMaxInbound
+	}
+	if cfg.MaxOutbound == 0 {
+		cfg.MaxOutbound = DefaultMaxOutbound
+	}
+	if cfg.MaxPerIP == 0 {
+		cfg.MaxPerIP = DefaultMaxPerIP
+	}
+	cfg.TargetOutbound = min(cfg.TargetOutbound, cfg.MaxOutbound)
+	if cfg.Transport == nil {
+		cfg.Transport = tcpTransport{}
+	}
+	if cfg.NodeKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		cfg.NodeKey = key
+	}
+	s := &Server{
+		Config:   cfg,
+		Chain:    chain,
+		Mempool:  mp,
+		peers:    make(map[string]*Peer),
+		quit:     make(chan struct{}),
+		nonce:    randomNonce(),
+		nodeKey:  cfg.NodeKey,
+		pending:  make(map[string]bool),
+		requests: newRequestTracker(),
+	}
+	s.sync = newSyncManager(s)
+	return s
 }
 
-func NewServer(config ServerConfig, chain *blockchain.Chain, mp *mempool.Mempool) *Server {
-	return &Server{
-		Config:  config,
-		Chain:   chain,
-		Mempool: mp,
-		peers:   make(map[string]*Peer),
-		quit:    make(chan struct{}),
+func randomNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
 	}
+	return binary.BigEndian.Uint64(b[:])
 }
 
 func (s *Server) Start() error {
-	l, err := net.Listen("tcp", s.Config.ListenAddr)
+	bans, err := NewBanList(s.Config.DB)
 	if err != nil {
 		return err
 	}
-	s.listener = l
-	log.Printf("P2P server listening on %s", s.Config.ListenAddr)
+	s.bans = bans
+
+	addrs, err := NewAddrManager(s.Config.DB)
+	if err != nil {
+		return err
+	}
+	s.addrs = addrs
+	log.Printf("Address book has %d known peers", addrs.Len())
 
-	// Connect to seeds
+	// Seeds go into the address book so the connection manager retries
+	// them like any other address.
 	for _, seed := range s.Config.SeedNodes {
-		go s.Connect(seed)
+		s.addrs.Add(seed, time.Now())
 	}
 
+	l, err := s.Config.Transport.Listen(s.Config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	log.Printf("P2P server listening on %s", s.Config.ListenAddr)
+
+	s.wg.Add(3)
 	go s.acceptLoop()
+	go s.connectionLoop()
+	go s.requestLoop()
 	return nil
 }
 
+// Stop closes the listener and disconnects every peer, then waits for the
+// server's and peers' goroutines to exit or for ctx to be done, whichever
+// comes first. A stopped server cannot be restarted.
+func (s *Server) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+
+	// addPeer refuses new peers once quit is closed, so this is all of them.
+	s.peerMu.RLock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.peerMu.RUnlock()
+	for _, p := range peers {
+		p.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		for _, p := range peers {
+			p.wg.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("P2P server stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopping reports whether Stop has been called.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestLoop moves timed out getdata requests to other peers and keeps
+// the header sync going.
+func (s *Server) requestLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(requestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			sendGetData(s.requests.expire(now))
+			s.sync.tick(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// sendGetData requests items from the peers they are assigned to.
+func sendGetData(requests map[*Peer][]InvVect) {
+	for p, inv := range requests {
+		p.Send(&MsgGetData{Inventory: inv})
+	}
+}
+
+// Connect dials addr and adds it as an outbound peer, unless MaxOutbound
+// outbound peers are already connected. The dial is abandoned if the server
+// stops.
 func (s *Server) Connect(addr string) {
-	conn, err := net.Dial("tcp", addr)
+	if n := s.outboundCount(); n >= s.Config.MaxOutbound {
+		log.Printf("Not connecting to %s: %d outbound peers already", addr, n)
+		return
+	}
+	s.addrs.Attempt(addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err := s.Config.Transport.Dial(ctx, addr)
 	if err != nil {
-		log.Printf("Failed to connect to seed %s: %v", addr, err)
+		log.Printf("Failed to connect to %s: %v", addr, err)
 		return
 	}
-	s.addPeer(conn, true)
+	s.addPeer(conn, true, addr)
+}
+
+// connectionLoop keeps TargetOutbound outbound peers connected, picking
+// addresses from the address book.
+func (s *Server) connectionLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(ConnectInterval)
+	defer ticker.Stop()
+
+	for {
+		s.fillOutbound()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// fillOutbound dials enough addresses to reach TargetOutbound outbound peers.
+func (s *Server) fillOutbound() {
+	s.peerMu.Lock()
+	outbound := len(s.pending)
+	skip := make(map[string]bool, len(s.peers)+len(s.pending))
+	for addr := range s.pending {
+		skip[addr] = true
+	}
+	for _, p := range s.peers {
+		if p.Outbound {
+			outbound++
+		}
+		if addr := p.ListenAddr(); addr != "" {
+			skip[addr] = true
+		}
+	}
+	s.peerMu.Unlock()
+
+	for ; outbound < s.Config.TargetOutbound; outbound++ {
+		addr, ok := s.addrs.Select(func(addr string) bool {
+			return skip[addr] || s.bans.IsBanned(hostOfAddr(addr))
+		})
+		if !ok {
+			return
+		}
+		skip[addr] = true
+
+		s.peerMu.Lock()
+		s.pending[addr] = true
+		s.peerMu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.Connect(addr)
+			s.peerMu.Lock()
+			delete(s.pending, addr)
+			s.peerMu.Unlock()
+		}()
+	}
 }
 
 func (s *Server) acceptLoop() {
+	defer s.wg.Done()
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -73,53 +394,323 @@ func (s *Server) acceptLoop() {
 				continue
 			}
 		}
-		s.addPeer(conn, false)
+		// Checked ahead of admitInbound, so that a banned host cannot
+		// have an inbound peer evicted to make room for it.
+		if s.IsBanned(conn.RemoteAddr()) {
+			log.Printf("Rejecting banned peer %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if err := s.admitInbound(conn.RemoteAddr()); err != nil {
+			log.Printf("Rejecting inbound peer %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		s.addPeer(conn, false, "")
 	}
 }
 
-func (s *Server) addPeer(conn net.Conn, outbound bool) {
-	s.peerMu.Lock()
-	defer s.peerMu.Unlock()
+// admitInbound enforces the inbound limits for a connection from remote:
+// at most MaxPerIP from its host, and at most MaxInbound in all. When the
+// inbound slots are full, an inbound peer is evicted to make room if
+// selectEviction finds one that isn't protected.
+func (s *Server) admitInbound(remote net.Addr) error {
+	host := hostOf(remote)
+
+	s.peerMu.RLock()
+	var candidates []evictionCandidate
+	fromHost := 0
+	for _, p := range s.peers {
+		if p.Outbound || p.stopped() {
+			continue
+		}
+		c := p.evictionCandidate()
+		if c.host == host {
+			fromHost++
+		}
+		candidates = append(candidates, c)
+	}
+	s.peerMu.RUnlock()
+
+	if fromHost >= s.Config.MaxPerIP {
+		return errTooManyFromHost
+	}
+	if len(candidates) < s.Config.MaxInbound {
+		return nil
+	}
+	victim := selectEviction(candidates)
+	if victim == nil {
+		return errInboundFull
+	}
+	log.Printf("Evicting inbound peer %s to make room for %s", victim.Conn.RemoteAddr(), remote)
+	victim.Stop()
+	return nil
+}
+
+// outboundCount returns the number of connected outbound peers.
+func (s *Server) outboundCount() int {
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
 
+	n := 0
+	for _, p := range s.peers {
+		if p.Outbound && !p.stopped() {
+			n++
+		}
+	}
+	return n
+}
+
+// addPeer starts a peer on conn and sends it our version. For outbound
+// peers, dialAddr is the address that was dialled.
+func (s *Server) addPeer(conn net.Conn, outbound bool, dialAddr string) {
 	addr := conn.RemoteAddr().String()
-	if _, ok := s.peers[addr]; ok {
+	version, err := s.versionMessage()
+	if err != nil {
+		log.Printf("Failed to build version for %s: %v", addr, err)
 		conn.Close()
 		return
 	}
+	var session *ecdh.PrivateKey
+	if s.Config.Encryption != EncryptionDisabled {
+		if session, err = newSessionKey(); err != nil {
+			log.Printf("Failed to create session key for %s: %v", addr, err)
+			conn.Close()
+			return
+		}
+	}
+	signVersion(version, s.nodeKey, session)
 
+	s.peerMu.Lock()
+	if s.stopping() {
+		s.peerMu.Unlock()
+		conn.Close()
+		return
+	}
+	if _, ok := s.peers[addr]; ok {
+		s.peerMu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.IsBanned(conn.RemoteAddr()) {
+		s.peerMu.Unlock()
+		log.Printf("Rejecting banned peer %s", addr)
+		conn.Close()
+		return
+	}
 	p := NewPeer(conn, s, outbound)
+	p.listenAddr = dialAddr // Before Start, so no lock needed.
+	p.sessionKey = session
+	// Queued before Start so it is the first frame, ahead of our verack.
+	p.Send(version)
 	s.peers[addr] = p
+	// Started under peerMu so that Stop, which snapshots the peers, waits
+	// for its goroutines.
 	p.Start()
-
-	// Send handshake
-	p.Send(&MsgVersion{
-		Version:     1,
-		BlockHeight: s.Chain.Height(),
-		From:        s.Config.ListenAddr,
-	})
+	s.peerMu.Unlock()
 
 	log.Printf("Peer connected: %s (outbound=%v)", addr, outbound)
 }
 
+// versionMessage builds the MsgVersion describing this node.
+func (s *Server) versionMessage() (*MsgVersion, error) {
+	genesis, err := s.Chain.GetBlockByHeight(0)
+	if err != nil {
+		return nil, fmt.Errorf("no genesis block: %w", err)
+	}
+	tip := s.Chain.Tip()
+	work, err := s.Chain.CumulativeWork(tip.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgVersion{
+		Version:        ProtocolVersion,
+		Network:        s.Config.Network.Name,
+		GenesisHash:    genesis.Hash,
+		BestHash:       tip.Hash,
+		BestHeight:     tip.Header.Height,
+		CumulativeWork: work,
+		Services:       ServiceFullNode,
+		Nonce:          s.nonce,
+		From:           s.listener.Addr().String(),
+	}, nil
+}
+
+// checkVersion returns why a peer's version is unacceptable, or nil.
+func (s *Server) checkVersion(m *MsgVersion) error {
+	if m.Nonce == s.nonce {
+		return errSelfConnection
+	}
+	if m.Version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d below minimum %d", m.Version, MinProtocolVersion)
+	}
+	if m.Network != s.Config.Network.Name {
+		return fmt.Errorf("peer is on network %q, we are on %q", m.Network, s.Config.Network.Name)
+	}
+	genesis, err := s.Chain.GetBlockByHeight(0)
+	if err != nil {
+		return fmt.Errorf("no genesis block: %w", err)
+	}
+	if m.GenesisHash != genesis.Hash {
+		return fmt.Errorf("peer genesis %x differs from ours %x", m.GenesisHash[:8], genesis.Hash[:8])
+	}
+	return verifyVersion(m)
+}
+
 func (s *Server) RemovePeer(p *Peer) {
 	s.peerMu.Lock()
-	defer s.peerMu.Unlock()
-
 	addr := p.Conn.RemoteAddr().String()
 	delete(s.peers, addr)
 	p.Stop()
+	s.peerMu.Unlock()
 	log.Printf("Peer disconnected: %s", addr)
+
+	if s.stopping() {
+		return
+	}
+	sendGetData(s.requests.peerGone(p, time.Now()))
+	s.sync.peerGone(p)
 }
 
+// Broadcast sends msg to every peer that completed the handshake. Blocks and
+// transactions are announced with MsgInv, and only to peers not already
+// known to have them; peers fetch them with MsgGetData.
 func (s *Server) Broadcast(msg Message) {
 	s.peerMu.RLock()
 	defer s.peerMu.RUnlock()
 
+	iv, isInv := invFor(msg)
+	for _, p := range s.peers {
+		if !p.HandshakeComplete() {
+			continue
+		}
+		out := msg
+		if isInv {
+			if p.knownInv.Has(iv) {
+				continue
+			}
+			p.knownInv.Add(iv)
+			out = &MsgInv{Inventory: []InvVect{iv}}
+		}
+		if err := p.Send(out); err != nil {
+			log.Printf("Failed to queue message for %s: %v", p.Addr(), err)
+		}
+	}
+}
+
+// connectedTo reports whether a peer other than except has already
+// introduced itself with nonce, i.e. whether except duplicates a connection.
+func (s *Server) connectedTo(nonce uint64, except *Peer) bool {
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+
 	for _, p := range s.peers {
-		go p.Send(msg)
+		if p == except {
+			continue
+		}
+		if v := p.RemoteVersion(); v != nil && v.Nonce == nonce {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban bans the host of addr for the configured BanDuration.
+func (s *Server) Ban(addr net.Addr) {
+	s.BanHost(hostOf(addr), s.Config.BanDuration)
+}
+
+// BanHost refuses connections from host for d and disconnects any peers
+// already connected from it.
+func (s *Server) BanHost(host string, d time.Duration) {
+	s.bans.Ban(host, time.Now().Add(d))
+
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+	for _, p := range s.peers {
+		if hostOf(p.Conn.RemoteAddr()) == host {
+			p.Stop()
+		}
 	}
 }
 
+// Unban lifts the ban on host. It reports whether host was banned.
+func (s *Server) Unban(host string) bool {
+	return s.bans.Unban(host)
+}
+
+// Bans returns the currently banned hosts.
+func (s *Server) Bans() []BanEntry {
+	return s.bans.List()
+}
+
+// IsBanned reports whether the host of addr is currently banned.
+func (s *Server) IsBanned(addr net.Addr) bool {
+	return s.bans.IsBanned(hostOf(addr))
+}
+
+// hostOf strips the port from addr: bans apply to a host, not a connection.
+func hostOf(addr net.Addr) string {
+	return hostOfAddr(addr.String())
+}
+
+func hostOfAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr        string
+	NodeID      string // Empty before the handshake.
+	Encrypted   bool
+	Outbound    bool
+	Handshaked  bool
+	Version     uint32
+	Services    uint64
+	BestHeight  uint64 // As announced in the handshake.
+	Latency     time.Duration
+	BanScore    int
+	ConnectedAt time.Time
+}
+
+// PeerInfo returns a snapshot of every connected peer.
+func (s *Server) PeerInfo() []PeerInfo {
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+
+	infos := make([]PeerInfo, 0, len(s.peers))
+	for _, p := range s.peers {
+		info := PeerInfo{
+			Addr:       p.Addr(),
+			Outbound:   p.Outbound,
+			Handshaked: p.HandshakeComplete(),
+			Latency:    p.Latency(),
+			Encrypted:  p.Encrypted(),
+		}
+		if v := p.RemoteVersion(); v != nil {
+			info.Version = v.Version
+			info.Services = v.Services
+			info.BestHeight = v.BestHeight
+			info.NodeID = NodeID(v.NodeKey[:])
+		}
+		p.mu.Lock()
+		info.BanScore = p.banScore
+		info.ConnectedAt = p.connectedAt
+		p.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// NodeID returns this node's identity; see NodeID.
+func (s *Server) NodeID() string {
+	return NodeID(s.nodeKey.Public().(ed25519.PublicKey))
+}
+
 // PeerCount returns the number of connected peers.
 func (s *Server) PeerCount() int {
 	s.peerMu.RLock()
@@ -0,0 +1,502 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/config"
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/consensus"
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+var testGenesisTime = time.Unix(1_700_000_000, 0)
+
+// newTestServer starts a server on a loopback port with its own in-memory chain.
+func newTestServer(t *testing.T, network string, genesisTime time.Time, seeds ...string) *Server {
+	t.Helper()
+	return startTestServer(t, ServerConfig{SeedNodes: seeds}, network, genesisTime)
+}
+
+// startTestServer is newTestServer with the given config. The listen
+// address and network are filled in.
+func startTestServer(t *testing.T, cfg ServerConfig, network string, genesisTime time.Time) *Server {
+	t.Helper()
+	hasher := consensus.NewSHA256Hasher()
+	store, err := blockchain.NewBadgerStore("")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	chain, err := blockchain.NewChain(store, hasher)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if _, err := chain.InitGenesis(types.Hash{}, 1, genesisTime); err != nil {
+		t.Fatalf("InitGenesis failed: %v", err)
+	}
+
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.Network = config.NetworkConfig{Name: network, Magic: testMagic}
+	s := NewServer(cfg, chain, mempool.NewMempool(chain))
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Stop(ctx); err != nil {
+			t.Errorf("Stop failed: %v", err)
+		}
+		store.Close()
+		hasher.Close()
+	})
+	return s
+}
+
+func (s *Server) testAddr() string {
+	return s.listener.Addr().String()
+}
+
+// handshakedPeers returns the peers that completed the handshake.
+func handshakedPeers(s *Server) []*Peer {
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+	var peers []*Peer
+	for _, p := range s.peers {
+		if p.HandshakeComplete() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+	b := newTestServer(t, "test", testGenesisTime)
+
+	b.Connect(a.testAddr())
+	waitFor(t, "handshake on both sides", func() bool {
+		return len(handshakedPeers(a)) == 1 && len(handshakedPeers(b)) == 1
+	})
+
+	v := handshakedPeers(b)[0].RemoteVersion()
+	genesis, _ := a.Chain.GetBlockByHeight(0)
+	if v.Network != "test" || v.GenesisHash != genesis.Hash || v.Nonce != a.nonce {
+		t.Errorf("unexpected remote version: %+v", v)
+	}
+	if v.Services&ServiceFullNode == 0 {
+		t.Error("peer should advertise ServiceFullNode")
+	}
+}
+
+func TestHandshakeRejectsMismatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		network     string
+		genesisTime time.Time
+	}{
+		{"other genesis", "test", testGenesisTime.Add(time.Hour)},
+		{"other network", "other", testGenesisTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestServer(t, "test", testGenesisTime)
+			b := newTestServer(t, tt.network, tt.genesisTime)
+
+			b.Connect(a.testAddr())
+			waitFor(t, "disconnect", func() bool {
+				return a.PeerCount() == 0 && b.PeerCount() == 0
+			})
+			if len(handshakedPeers(a))+len(handshakedPeers(b)) != 0 {
+				t.Error("mismatched peers must not complete the handshake")
+			}
+		})
+	}
+}
+
+func TestHandshakeDetectsSelfConnection(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+
+	a.Connect(a.testAddr())
+	waitFor(t, "self connection to drop", func() bool {
+		return a.PeerCount() == 0
+	})
+}
+
+func TestAddrExchange(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+	c := newTestServer(t, "test", testGenesisTime)
+
+	// a learns c's listen address from its inbound connection.
+	c.Connect(a.testAddr())
+	waitFor(t, "a to learn c's address", func() bool {
+		_, ok := a.addrs.Get(c.testAddr())
+		return ok
+	})
+
+	// b connects to a through its seed and learns about c.
+	b := newTestServer(t, "test", testGenesisTime, a.testAddr())
+	waitFor(t, "b to learn c's address", func() bool {
+		_, ok := b.addrs.Get(c.testAddr())
+		return ok
+	})
+	ka, _ := b.addrs.Get(a.testAddr())
+	if ka.LastSuccess.IsZero() || ka.Attempts != 0 {
+		t.Errorf("seed not recorded as good: %+v", ka)
+	}
+
+	// The connection manager dials c on its next pass.
+	b.fillOutbound()
+	waitFor(t, "b to connect to c", func() bool {
+		return len(handshakedPeers(b)) == 2
+	})
+}
+
+// dialHandshaked connects to s as a bare peer and completes the handshake.
+func dialHandshaked(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	version, err := s.versionMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialHandshakedAs(t, s, version)
+}
+
+// dialHandshakedAs is dialHandshaked introducing itself with version.
+func dialHandshakedAs(t *testing.T, s *Server, version *MsgVersion) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.testAddr())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	version.Nonce = randomNonce()
+	version.From = "127.0.0.1:1"
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signVersion(version, key, nil) // A bare peer speaks plaintext.
+	if err := EncodeMessage(conn, testMagic, version); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeMessage(conn, testMagic, &MsgVerAck{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := DecodeMessage(conn, testMagic)
+		if err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if msg.Type() == MsgTypeVerAck {
+			return conn
+		}
+	}
+}
+
+func TestInvalidBlockBansPeer(t *testing.T) {
+	s := newTestServer(t, "test", testGenesisTime)
+	conn := dialHandshaked(t, s)
+
+	genesis, _ := s.Chain.GetBlockByHeight(0)
+	bad := &types.Block{Header: types.BlockHeader{
+		Version:       1,
+		Height:        5, // Not parent height + 1.
+		PrevBlockHash: genesis.Hash,
+		Timestamp:     testGenesisTime.Add(time.Minute),
+	}}
+	bad.Hash = bad.ComputeHash()
+	if err := EncodeMessage(conn, testMagic, &MsgBlock{Block: bad}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "peer to be banned", func() bool {
+		return s.IsBanned(conn.LocalAddr())
+	})
+	waitFor(t, "banned peer to be dropped", func() bool {
+		return s.PeerCount() == 0
+	})
+	if bans := s.Bans(); len(bans) != 1 || bans[0].Host != "127.0.0.1" {
+		t.Errorf("Bans() = %+v, want 127.0.0.1", bans)
+	}
+
+	// Reconnecting is refused until the ban is lifted.
+	again, err := net.Dial("tcp", s.testAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	again.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := DecodeMessage(again, testMagic); err == nil {
+		t.Error("banned host got a version message")
+	}
+
+	if !s.Unban("127.0.0.1") {
+		t.Fatal("Unban returned false")
+	}
+	dialHandshaked(t, s)
+}
+
+// expectMessage reads the next message from conn and checks its type.
+func expectMessage[M Message](t *testing.T, conn net.Conn) M {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := DecodeMessage(conn, testMagic)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %v", err)
+	}
+	m, ok := msg.(M)
+	if !ok {
+		t.Fatalf("got %T, want %T", msg, *new(M))
+	}
+	return m
+}
+
+func TestInventoryExchange(t *testing.T) {
+	s := newTestServer(t, "test", testGenesisTime)
+	first := dialHandshaked(t, s)
+	second := dialHandshaked(t, s)
+	waitFor(t, "both peers", func() bool { return len(handshakedPeers(s)) == 2 })
+
+	// An unknown block is requested from the first announcer only, as a
+	// compact block since we aren't syncing.
+	unknown := InvVect{Type: InvTypeBlock, Hash: types.Hash{0xAA}}
+	EncodeMessage(first, testMagic, &MsgInv{Inventory: []InvVect{unknown}})
+	getData := expectMessage[*MsgGetData](t, first)
+	if want := (InvVect{Type: InvTypeCompactBlock, Hash: unknown.Hash}); len(getData.Inventory) != 1 || getData.Inventory[0] != want {
+		t.Fatalf("getdata = %+v, want %+v", getData.Inventory, want)
+	}
+	EncodeMessage(second, testMagic, &MsgInv{Inventory: []InvVect{unknown}})
+
+	// When the first doesn't have it after all, the second is asked.
+	EncodeMessage(first, testMagic, &MsgNotFound{Inventory: []InvVect{unknown}})
+	expectMessage[*MsgGetData](t, second)
+
+	// We serve what we have and report what we don't.
+	genesis, _ := s.Chain.GetBlockByHeight(0)
+	have := InvVect{Type: InvTypeBlock, Hash: genesis.Hash}
+	EncodeMessage(first, testMagic, &MsgGetData{Inventory: []InvVect{have, unknown}})
+	// The block and the notfound travel on different queues, in either order.
+	for i := 0; i < 2; i++ {
+		switch m := expectMessage[Message](t, first).(type) {
+		case *MsgNotFound:
+			if len(m.Inventory) != 1 || m.Inventory[0] != unknown {
+				t.Errorf("notfound = %+v, want %+v", m.Inventory, unknown)
+			}
+		case *MsgBlock:
+			if m.Block.Hash != genesis.Hash {
+				t.Errorf("got block %x, want genesis", m.Block.Hash[:8])
+			}
+		default:
+			t.Fatalf("unexpected %T", m)
+		}
+	}
+
+	// Broadcasts are announced only to peers that don't have the item:
+	// first just received genesis, second gets an inv.
+	s.Broadcast(&MsgBlock{Block: genesis})
+	inv := expectMessage[*MsgInv](t, second)
+	if len(inv.Inventory) != 1 || inv.Inventory[0] != have {
+		t.Errorf("inv = %+v, want %+v", inv.Inventory, have)
+	}
+	s.Broadcast(&MsgBlock{Block: genesis})
+	for _, conn := range []net.Conn{first, second} {
+		EncodeMessage(conn, testMagic, &MsgPing{Nonce: 7})
+		expectMessage[*MsgPong](t, conn)
+	}
+}
+
+// mineTestBlocks extends the chain by n blocks paying miner, which makes
+// the blocks differ from other test chains.
+func mineTestBlocks(t *testing.T, chain *blockchain.Chain, miner types.Hash, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		block := newTestBlock(t, chain, miner)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock at height %d failed: %v", block.Header.Height, err)
+		}
+	}
+}
+
+// newTestBlock mines a block on the chain's tip holding txs, paying the
+// reward and fees to miner. The block is not added to the chain.
+func newTestBlock(t *testing.T, chain *blockchain.Chain, miner types.Hash, txs ...*types.Transaction) *types.Block {
+	t.Helper()
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+
+	parent := chain.Tip()
+	bits, err := consensus.CalcNextRequiredBits(&parent.Header, func(height uint64) (*types.BlockHeader, error) {
+		b, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		return &b.Header, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fees, err := blockchain.TotalFees(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := &types.Transaction{
+		Type:      types.TxTypeCoinbase,
+		Timestamp: parent.Header.Timestamp,
+		To:        miner,
+		Amount:    types.BlockReward + fees,
+		Nonce:     parent.Header.Height + 1,
+	}
+	coinbase.ID = coinbase.ComputeID()
+	txs = append([]*types.Transaction{coinbase}, txs...)
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			Height:        parent.Header.Height + 1,
+			Timestamp:     parent.Header.Timestamp.Add(consensus.TargetBlockTime * time.Second),
+			PrevBlockHash: parent.Hash,
+			MerkleRoot:    types.ComputeMerkleRoot(txs),
+			Bits:          bits,
+		},
+		Transactions: txs,
+	}
+	for {
+		block.Hash = block.ComputeHash()
+		powHash, err := hasher.Hash(block.Header.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if consensus.MeetsTarget(powHash, block.Header.Bits) {
+			block.PowHash = powHash
+			return block
+		}
+		block.Header.Nonce++
+	}
+}
+
+func TestHeadersFirstSyncAcrossFork(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+	b := newTestServer(t, "test", testGenesisTime)
+
+	// b's own short chain differs from a's at every height, which height
+	// based sync could not get past.
+	mineTestBlocks(t, a.Chain, types.Hash{0x0A}, 12)
+	mineTestBlocks(t, b.Chain, types.Hash{0x0B}, 3)
+
+	b.Connect(a.testAddr())
+	waitFor(t, "b to reach a's tip", func() bool {
+		return b.Chain.Tip().Hash == a.Chain.Tip().Hash
+	})
+
+	hash, height, _, err := b.Chain.BestHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != a.Chain.Tip().Hash || height != 12 {
+		t.Errorf("best header = %x at %d, want a's tip at 12", hash[:8], height)
+	}
+	if n := b.requests.Len(); n != 0 {
+		t.Errorf("%d block requests left outstanding", n)
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+	b := newTestServer(t, "test", testGenesisTime)
+	b.Connect(a.testAddr())
+	conn := dialHandshaked(t, a)
+	waitFor(t, "peers", func() bool { return a.PeerCount() == 2 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if n := a.PeerCount(); n != 0 {
+		t.Errorf("%d peers left after Stop", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := DecodeMessage(conn, testMagic); err != nil {
+			break // Closed by a.
+		}
+	}
+	if c, err := net.Dial("tcp", a.testAddr()); err == nil {
+		c.Close()
+		t.Error("listener still accepting after Stop")
+	}
+	waitFor(t, "b to notice", func() bool { return b.PeerCount() == 0 })
+
+	// Stopping twice is harmless.
+	if err := a.Stop(ctx); err != nil {
+		t.Errorf("second Stop failed: %v", err)
+	}
+}
+
+func TestInboundLimits(t *testing.T) {
+	// A connection over the per-IP limit is refused outright.
+	s := startTestServer(t, ServerConfig{MaxPerIP: 1}, "test", testGenesisTime)
+	dialHandshaked(t, s)
+	extra, err := net.Dial("tcp", s.testAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := DecodeMessage(extra, testMagic); err == nil {
+		t.Error("connection over the per-IP limit got a version message")
+	}
+
+	// A full server evicts the newest unprotected peer instead: the first
+	// is protected as the longest connected.
+	s = startTestServer(t, ServerConfig{MaxInbound: 2}, "test", testGenesisTime)
+	first := dialHandshaked(t, s)
+	second := dialHandshaked(t, s)
+	dialHandshaked(t, s)
+	waitFor(t, "eviction", func() bool { return s.PeerCount() == 2 })
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := DecodeMessage(second, testMagic); err != nil {
+			break
+		}
+	}
+	EncodeMessage(first, testMagic, &MsgPing{Nonce: 1})
+	expectMessage[*MsgPong](t, first)
+
+	// A banned host is turned away before any peer is evicted for it.
+	s = startTestServer(t, ServerConfig{MaxInbound: 2}, "test", testGenesisTime)
+	dialHandshaked(t, s)
+	second = dialHandshaked(t, s)
+	s.bans.Ban("127.0.0.1", time.Now().Add(time.Hour))
+	banned, err := net.Dial("tcp", s.testAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer banned.Close()
+	banned.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := DecodeMessage(banned, testMagic); err == nil {
+		t.Error("banned host got a version message")
+	}
+	EncodeMessage(second, testMagic, &MsgPing{Nonce: 2})
+	expectMessage[*MsgPong](t, second)
+	if n := s.PeerCount(); n != 2 {
+		t.Errorf("peer count = %d, want 2", n)
+	}
+}
@@ -0,0 +1,406 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+const (
+	// BlockDownloadWindow is how far past our tip blocks are downloaded.
+	// Blocks arriving ahead of their parents wait in the orphan pool, so
+	// this stays below blockchain.MaxOrphanBlocks.
+	BlockDownloadWindow = 128
+
+	// MaxBlocksPerPeer bounds the blocks requested from one peer at a time.
+	MaxBlocksPerPeer = 16
+
+	// BlockStallTimeout is how long the peer asked for the lowest missing
+	// block may hold up the download window before it is disconnected and
+	// its requests move to other peers.
+	BlockStallTimeout = 15 * time.Second
+
+	// BlockRetryDelay is how long a block that failed validation through
+	// no fault of its sender, such as a timestamp ahead of our clock, waits
+	// before it is requested again.
+	BlockRetryDelay = time.Minute
+)
+
+// SyncProgress describes how far the node is from the best known chain.
+type SyncProgress struct {
+	HeadersHeight  uint64        // Height of the best validated header.
+	BlocksHeight   uint64        // Height of our tip.
+	Syncing        bool          // Whether blocks are missing below the best header.
+	BlocksInFlight int           // Blocks and transactions requested from peers.
+	ETA            time.Duration // Estimated time to catch up; 0 if unknown.
+}
+
+// syncManager drives headers-first sync. Headers are fetched from the peer
+// claiming the most work and validated as a chain; the blocks along the
+// best header chain are then downloaded in parallel from every peer that
+// has them, lowest first, and connected in order as their parents arrive.
+type syncManager struct {
+	server *Server
+
+	mu          sync.Mutex
+	peer        *Peer     // Peer with an outstanding MsgGetHeaders; nil if none.
+	headersSent time.Time // When that request was sent.
+
+	// Download rate, for the ETA. Guarded by mu.
+	downloadStart  time.Time // When the current download began; zero if none.
+	downloadHeight uint64    // Our tip height at that time.
+
+	// deferred holds the blocks not to request before the given time.
+	// Guarded by mu.
+	deferred map[types.Hash]time.Time
+}
+
+func newSyncManager(s *Server) *syncManager {
+	return &syncManager{server: s, deferred: make(map[types.Hash]time.Time)}
+}
+
+// start fetches headers from the handshaked peer with the most work, if it
+// has more than our best header. It does nothing while a headers request is
+// outstanding.
+func (m *syncManager) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.peer != nil {
+		return
+	}
+	_, _, ourWork, err := m.server.Chain.BestHeader()
+	if err != nil {
+		log.Printf("Sync: failed to get best header: %v", err)
+		return
+	}
+	p := m.server.bestPeer(ourWork)
+	if p == nil {
+		return
+	}
+	log.Printf("Sync: fetching headers from %s", p.Conn.RemoteAddr())
+	m.requestHeaders(p)
+}
+
+// requestHeaders asks p for the headers following our best header and makes
+// p the sync peer. m.mu must be held.
+func (m *syncManager) requestHeaders(p *Peer) {
+	hash, _, _, err := m.server.Chain.BestHeader()
+	if err != nil {
+		log.Printf("Sync: failed to get best header: %v", err)
+		return
+	}
+	m.requestHeadersAfter(p, hash)
+}
+
+// requestHeadersAfter asks p for the headers following hash and makes p the
+// sync peer. m.mu must be held.
+func (m *syncManager) requestHeadersAfter(p *Peer, hash types.Hash) {
+	locator, err := m.server.Chain.BlockLocator(hash)
+	if err != nil {
+		log.Printf("Sync: failed to build block locator: %v", err)
+		return
+	}
+	if len(locator) > MaxLocatorHashes {
+		// Keep the densest part and genesis.
+		locator = append(locator[:MaxLocatorHashes-1], locator[len(locator)-1])
+	}
+	if err := p.Send(&MsgGetHeaders{Locator: locator}); err != nil {
+		log.Printf("Sync: failed to request headers from %s: %v", p.Conn.RemoteAddr(), err)
+		return
+	}
+	m.peer = p
+	m.headersSent = time.Now()
+}
+
+// handleHeaders validates the headers p sent and continues the sync: more
+// headers if the batch was full, and the blocks we are missing.
+func (m *syncManager) handleHeaders(p *Peer, msg *MsgHeaders) {
+	chain := m.server.Chain
+	added, err := chain.ProcessHeaders(msg.Headers)
+
+	m.mu.Lock()
+	wasSyncPeer := m.peer == p
+	if wasSyncPeer {
+		m.peer = nil
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Sync: invalid headers from %s: %v", p.Conn.RemoteAddr(), err)
+		switch {
+		case errors.Is(err, blockchain.ErrParentNotFound), errors.Is(err, blockchain.ErrHeadersNotContiguous):
+			p.Misbehaving(20, fmt.Sprintf("headers: %v", err))
+		default:
+			if score := blockErrorScore(err); score > 0 {
+				p.Misbehaving(score, fmt.Sprintf("invalid header: %v", err))
+			}
+		}
+		m.start()
+		return
+	}
+
+	if len(msg.Headers) == 0 {
+		// The peer has nothing past our best header, whatever its version
+		// message claimed.
+		if _, _, work, err := chain.BestHeader(); err == nil {
+			p.setBestWork(work)
+		}
+		m.start()
+		return
+	}
+
+	last := msg.Headers[len(msg.Headers)-1].ComputeHash()
+	if work, err := chain.HeaderWork(last); err == nil {
+		if len(msg.Headers) < MaxHeadersPerMsg {
+			p.setBestWork(work)
+		} else {
+			p.updateBestWork(work)
+		}
+	}
+	log.Printf("Sync: %d new headers from %s up to height %d", added, p.Conn.RemoteAddr(), msg.Headers[len(msg.Headers)-1].Height)
+
+	if len(msg.Headers) == MaxHeadersPerMsg {
+		m.mu.Lock()
+		if m.peer == nil {
+			m.requestHeadersAfter(p, last)
+		}
+		m.mu.Unlock()
+	} else {
+		m.start()
+	}
+	m.fetchBlocks()
+}
+
+// fetchBlocks requests the lowest BlockDownloadWindow missing blocks of
+// the best header chain that aren't already requested. Each goes to the
+// least busy peer known to have it, up to MaxBlocksPerPeer per peer; the
+// other peers that have it are kept as fallbacks should that peer stall.
+func (m *syncManager) fetchBlocks() {
+	chain := m.server.Chain
+	missing := chain.MissingBlocks(BlockDownloadWindow)
+	if len(missing) == 0 {
+		m.mu.Lock()
+		m.downloadStart = time.Time{}
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	if m.downloadStart.IsZero() {
+		m.downloadStart = now
+		m.downloadHeight = chain.Tip().Header.Height
+	}
+	for hash, until := range m.deferred {
+		if !now.Before(until) {
+			delete(m.deferred, hash)
+		}
+	}
+	deferred := make(map[types.Hash]bool, len(m.deferred))
+	for hash := range m.deferred {
+		deferred[hash] = true
+	}
+	m.mu.Unlock()
+
+	peers := m.server.handshakedPeers()
+	load := make(map[*Peer]int, len(peers))
+	for _, p := range peers {
+		load[p] = m.server.requests.inflightFrom(p)
+	}
+
+	requests := make(map[*Peer][]InvVect)
+	for _, hash := range missing {
+		if deferred[hash] {
+			continue
+		}
+		work, err := chain.HeaderWork(hash)
+		if err != nil {
+			continue // Connected meanwhile.
+		}
+		var have []*Peer
+		var best *Peer
+		for _, p := range peers {
+			if p.BestWork().Cmp(work) < 0 {
+				continue
+			}
+			have = append(have, p)
+			if load[p] < MaxBlocksPerPeer && (best == nil || load[p] < load[best]) {
+				best = p
+			}
+		}
+		if best == nil {
+			continue
+		}
+		iv := InvVect{Type: InvTypeBlock, Hash: hash}
+		if m.server.requests.announced(best, iv, now) {
+			requests[best] = append(requests[best], iv)
+			load[best]++
+		}
+		for _, p := range have {
+			if p != best {
+				m.server.requests.announced(p, iv, now)
+			}
+		}
+	}
+	sendGetData(requests)
+}
+
+// blockReceived notes that p has block and, once half of p's requests have
+// been answered, tops up the download.
+func (m *syncManager) blockReceived(p *Peer, block *types.Block) {
+	if work, err := m.server.Chain.HeaderWork(block.Hash); err == nil {
+		p.updateBestWork(work)
+	}
+	if m.server.requests.inflightFrom(p) <= MaxBlocksPerPeer/2 {
+		m.fetchBlocks()
+	}
+}
+
+// blockDeferred handles a block on a header chain we know that failed
+// validation for a reason that may pass, such as a timestamp ahead of our
+// clock: it is not requested again for BlockRetryDelay. Blocks that can
+// never be valid drop out of the best header chain instead, and their
+// senders are penalised.
+func (m *syncManager) blockDeferred(hash types.Hash) {
+	if !m.server.Chain.HaveHeader(hash) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred[hash] = time.Now().Add(BlockRetryDelay)
+}
+
+// blockOrphaned handles a block from p whose parent we don't have. If the
+// parent's header is known the parent is on its way; otherwise p is on a
+// chain we haven't seen, so its headers are fetched.
+func (m *syncManager) blockOrphaned(p *Peer, block *types.Block) {
+	if m.server.Chain.HaveHeader(block.Header.PrevBlockHash) {
+		return
+	}
+	log.Printf("Sync: block %x from %s doesn't connect, fetching headers", block.Hash[:8], p.Conn.RemoteAddr())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peer == nil {
+		m.requestHeaders(p)
+	}
+}
+
+// peerReady is called when a peer completes the handshake: it may have more
+// work than us, and can take a share of the block download.
+func (m *syncManager) peerReady() {
+	m.start()
+	m.fetchBlocks()
+}
+
+// peerGone picks a new sync peer if p was the current one, and requests
+// the blocks p was to send that no other peer had announced.
+func (m *syncManager) peerGone(p *Peer) {
+	m.mu.Lock()
+	wasSyncPeer := m.peer == p
+	if wasSyncPeer {
+		m.peer = nil
+	}
+	m.mu.Unlock()
+
+	if wasSyncPeer {
+		m.start()
+	}
+	m.fetchBlocks()
+}
+
+// tick disconnects a sync peer that hasn't answered within RequestTimeout,
+// and a peer holding up the block download for BlockStallTimeout if others
+// can take over. It then tops up the header sync and the block download.
+func (m *syncManager) tick(now time.Time) {
+	m.mu.Lock()
+	stalled := m.peer
+	if stalled != nil && now.Sub(m.headersSent) < RequestTimeout {
+		stalled = nil
+	}
+	m.mu.Unlock()
+
+	if stalled != nil {
+		log.Printf("Sync: %s did not answer getheaders, disconnecting", stalled.Conn.RemoteAddr())
+		// Stopping the peer ends its readLoop, which removes it and picks
+		// a new sync peer.
+		stalled.Stop()
+		return
+	}
+
+	if lowest := m.server.Chain.MissingBlocks(1); len(lowest) == 1 {
+		iv := InvVect{Type: InvTypeBlock, Hash: lowest[0]}
+		p, sent, ok := m.server.requests.holder(iv)
+		if ok && now.Sub(sent) >= BlockStallTimeout && len(m.server.handshakedPeers()) > 1 {
+			log.Printf("Sync: %s stalled the download of block %x, disconnecting", p.Conn.RemoteAddr(), iv.Hash[:8])
+			// RemovePeer moves its requests to other peers.
+			p.Stop()
+		}
+	}
+
+	m.start()
+	m.fetchBlocks()
+}
+
+// progress reports the sync state.
+func (m *syncManager) progress() SyncProgress {
+	chain := m.server.Chain
+	tip := chain.Tip()
+	_, headersHeight, _, err := chain.BestHeader()
+	if err != nil || headersHeight < tip.Header.Height {
+		headersHeight = tip.Header.Height
+	}
+	p := SyncProgress{
+		HeadersHeight:  headersHeight,
+		BlocksHeight:   tip.Header.Height,
+		Syncing:        len(chain.MissingBlocks(1)) > 0,
+		BlocksInFlight: m.server.requests.Len(),
+	}
+
+	m.mu.Lock()
+	start, startHeight := m.downloadStart, m.downloadHeight
+	m.mu.Unlock()
+	if p.Syncing && !start.IsZero() && p.BlocksHeight > startHeight {
+		done := p.BlocksHeight - startHeight
+		remaining := p.HeadersHeight - p.BlocksHeight
+		p.ETA = time.Duration(float64(time.Since(start)) * float64(remaining) / float64(done))
+	}
+	return p
+}
+
+// bestPeer returns the handshaked peer with the most work, if any has more
+// than work.
+func (s *Server) bestPeer(work *big.Int) *Peer {
+	var best *Peer
+	for _, p := range s.handshakedPeers() {
+		if w := p.BestWork(); w.Cmp(work) > 0 {
+			best, work = p, w
+		}
+	}
+	return best
+}
+
+// handshakedPeers returns the connected peers that completed the handshake.
+func (s *Server) handshakedPeers() []*Peer {
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		if p.HandshakeComplete() && !p.stopped() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// SyncProgress reports how far the node is from the best known chain.
+func (s *Server) SyncProgress() SyncProgress {
+	return s.sync.progress()
+}
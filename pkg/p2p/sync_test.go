@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/consensus"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// servePeer answers getheaders and getdata on conn from src's chain until
+// the connection closes. If serveBlocks is false, block requests are
+// recorded but never answered. It returns the number of blocks requested.
+func servePeer(t *testing.T, conn net.Conn, src *Server, serveBlocks bool) func() int {
+	var mu sync.Mutex
+	requested := 0
+	go func() {
+		for {
+			msg, err := DecodeMessage(conn, testMagic)
+			if err != nil {
+				return
+			}
+			switch m := msg.(type) {
+			case *MsgGetHeaders:
+				headers := src.Chain.LocateHeaders(m.Locator, m.HashStop, MaxHeadersPerMsg)
+				EncodeMessage(conn, testMagic, &MsgHeaders{Headers: headers})
+			case *MsgGetData:
+				mu.Lock()
+				requested += len(m.Inventory)
+				mu.Unlock()
+				if !serveBlocks {
+					continue
+				}
+				for _, iv := range m.Inventory {
+					block, err := src.Chain.GetBlockByHash(iv.Hash)
+					if err != nil {
+						t.Errorf("block %x requested from the wrong chain", iv.Hash[:8])
+						continue
+					}
+					EncodeMessage(conn, testMagic, &MsgBlock{Block: block})
+				}
+			}
+		}
+	}()
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requested
+	}
+}
+
+func TestParallelBlockDownload(t *testing.T) {
+	src := newTestServer(t, "test", testGenesisTime)
+	mineTestBlocks(t, src.Chain, types.Hash{0x0A}, 40)
+	s := newTestServer(t, "test", testGenesisTime)
+
+	version, err := src.versionMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := servePeer(t, dialHandshakedAs(t, s, version), src, false)
+	waitFor(t, "the slow peer's handshake", func() bool { return len(handshakedPeers(s)) == 1 })
+	version, _ = src.versionMessage()
+	fast := servePeer(t, dialHandshakedAs(t, s, version), src, true)
+
+	// Both peers are asked for blocks; the slow one never delivers, which
+	// holds the tip back once the fast one has sent all it was asked for.
+	waitFor(t, "blocks requested from both peers", func() bool {
+		return slow() > 0 && fast() > 0
+	})
+	if n := slow(); n > MaxBlocksPerPeer {
+		t.Errorf("slow peer was asked for %d blocks, limit is %d", n, MaxBlocksPerPeer)
+	}
+	waitFor(t, "the fast peer's blocks", func() bool {
+		return s.SyncProgress().HeadersHeight == 40 &&
+			len(s.Chain.MissingBlocks(BlockDownloadWindow)) == slow()
+	})
+	if p := s.SyncProgress(); !p.Syncing || p.BlocksHeight == 40 {
+		t.Fatalf("progress = %+v, want syncing below 40", p)
+	}
+
+	// The stalling peer is dropped and its blocks fetched from the other.
+	s.sync.tick(time.Now().Add(BlockStallTimeout))
+	waitFor(t, "sync to complete", func() bool {
+		return s.Chain.Tip().Hash == src.Chain.Tip().Hash
+	})
+	if n := len(handshakedPeers(s)); n != 1 {
+		t.Errorf("%d peers left, want only the fast one", n)
+	}
+	p := s.SyncProgress()
+	if p.Syncing || p.HeadersHeight != 40 || p.BlocksHeight != 40 || p.ETA != 0 {
+		t.Errorf("progress after sync = %+v", p)
+	}
+}
+
+func TestInvalidBodyAfterHeader(t *testing.T) {
+	src := newTestServer(t, "test", testGenesisTime)
+	mineTestBlocks(t, src.Chain, types.Hash{0x0A}, 3)
+	s := newTestServer(t, "test", testGenesisTime)
+
+	// Block 4 pays its miner too much; its header is valid and commits to
+	// the overpaying coinbase.
+	bad := newTestBlock(t, src.Chain, types.Hash{0x0A})
+	bad.Transactions[0].Amount++
+	bad.Transactions[0].ID = bad.Transactions[0].ComputeID()
+	bad.Header.MerkleRoot = types.ComputeMerkleRoot(bad.Transactions)
+	hasher := consensus.NewSHA256Hasher()
+	defer hasher.Close()
+	for {
+		bad.Hash = bad.ComputeHash()
+		powHash, err := hasher.Hash(bad.Header.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if consensus.MeetsTarget(powHash, bad.Header.Bits) {
+			bad.PowHash = powHash
+			break
+		}
+		bad.Header.Nonce++
+	}
+
+	version, err := src.versionMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialHandshakedAs(t, s, version)
+	go func() {
+		for {
+			msg, err := DecodeMessage(conn, testMagic)
+			if err != nil {
+				return
+			}
+			switch m := msg.(type) {
+			case *MsgGetHeaders:
+				headers := src.Chain.LocateHeaders(m.Locator, m.HashStop, MaxHeadersPerMsg)
+				EncodeMessage(conn, testMagic, &MsgHeaders{Headers: append(headers, bad.Header)})
+			case *MsgGetData:
+				for _, iv := range m.Inventory {
+					block := bad
+					if iv.Hash != bad.Hash {
+						if block, err = src.Chain.GetBlockByHash(iv.Hash); err != nil {
+							continue
+						}
+					}
+					EncodeMessage(conn, testMagic, &MsgBlock{Block: block})
+				}
+			}
+		}
+	}()
+
+	// The sender is banned and the download finishes below the bad block
+	// instead of waiting for it forever.
+	waitFor(t, "the sender to be banned", func() bool {
+		return s.IsBanned(conn.LocalAddr())
+	})
+	waitFor(t, "the valid blocks", func() bool {
+		return s.Chain.Tip().Hash == src.Chain.Tip().Hash
+	})
+	if missing := s.Chain.MissingBlocks(BlockDownloadWindow); len(missing) != 0 {
+		t.Errorf("%d blocks still missing", len(missing))
+	}
+	if p := s.SyncProgress(); p.Syncing || p.HeadersHeight != 3 || p.ETA != 0 {
+		t.Errorf("progress = %+v, want synced at 3", p)
+	}
+}
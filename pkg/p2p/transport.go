@@ -0,0 +1,240 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Transport carries the connections between peers. The server runs its
+// protocol, encryption included, over whatever connections it provides, so
+// tests can replace TCP with an in-memory network.
+type Transport interface {
+	// Listen returns a listener for inbound connections on addr.
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to addr, giving up when ctx is done.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// tcpTransport is the default Transport.
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// EncryptionMode says whether connections are encrypted. Encryption is
+// negotiated in the version handshake: each side offers an X25519 session
+// key, and if both do, every frame after the MsgVersion is sealed with
+// AES-GCM under keys derived from the shared secret.
+type EncryptionMode int
+
+const (
+	// EncryptionPreferred encrypts when the peer offers a key too.
+	EncryptionPreferred EncryptionMode = iota
+	// EncryptionRequired disconnects peers that don't offer a key.
+	EncryptionRequired
+	// EncryptionDisabled never offers a key.
+	EncryptionDisabled
+)
+
+// NodeKeyFile is the name of the node identity key in the data directory.
+const NodeKeyFile = "nodekey"
+
+var (
+	// ErrDecrypt is returned when an encrypted frame fails authentication.
+	ErrDecrypt = errors.New("encrypted frame failed authentication")
+
+	// errEncryptionRequired is returned by the handshake when the peer
+	// doesn't offer encryption and we require it.
+	errEncryptionRequired = errors.New("peer does not support encryption")
+
+	// errBadHandshakeSignature is returned when a version message isn't
+	// signed by the node key it carries.
+	errBadHandshakeSignature = errors.New("invalid handshake signature")
+)
+
+// LoadOrCreateNodeKey loads the node identity key from path, creating and
+// saving a new one if the file doesn't exist. The key is stored hex encoded,
+// like wallet keys.
+func LoadOrCreateNodeKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid node key in %s", path)
+		}
+		return ed25519.PrivateKey(key), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, fmt.Errorf("save node key: %w", err)
+	}
+	return key, nil
+}
+
+// NodeID returns the printable identity of a node key: its public key in hex.
+func NodeID(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// handshakeSigDomain separates handshake signatures from any other use of
+// the node key.
+const handshakeSigDomain = "chrd-handshake-v1"
+
+// handshakeSigData returns the bytes a version message's signature covers:
+// the session key and nonce, so the key exchange is bound to the node key.
+func handshakeSigData(m *MsgVersion) []byte {
+	buf := make([]byte, 0, len(handshakeSigDomain)+len(m.SessionKey)+8)
+	buf = append(buf, handshakeSigDomain...)
+	buf = append(buf, m.SessionKey[:]...)
+	return binary.BigEndian.AppendUint64(buf, m.Nonce)
+}
+
+// signVersion fills in the identity and session key fields of m.
+func signVersion(m *MsgVersion, nodeKey ed25519.PrivateKey, session *ecdh.PrivateKey) {
+	copy(m.NodeKey[:], nodeKey.Public().(ed25519.PublicKey))
+	m.SessionKey = [32]byte{}
+	if session != nil {
+		copy(m.SessionKey[:], session.PublicKey().Bytes())
+	}
+	copy(m.Signature[:], ed25519.Sign(nodeKey, handshakeSigData(m)))
+}
+
+// verifyVersion checks that m is signed by the node key it carries.
+func verifyVersion(m *MsgVersion) error {
+	if !ed25519.Verify(m.NodeKey[:], handshakeSigData(m), m.Signature[:]) {
+		return errBadHandshakeSignature
+	}
+	return nil
+}
+
+// newSessionKey returns a fresh X25519 key for one connection.
+func newSessionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// sessionCiphers derives the sending and receiving ciphers of a connection
+// from our session key and the peer's public session key. Each direction
+// has its own key, named after the sender's public key so both sides agree
+// without knowing who dialled.
+func sessionCiphers(ours *ecdh.PrivateKey, theirs [32]byte) (send, recv *frameCipher, err error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(theirs[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := ours.ECDH(peerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ourPub := ours.PublicKey().Bytes()
+	if bytes.Equal(ourPub, theirs[:]) {
+		return nil, nil, errors.New("peer echoed our session key")
+	}
+
+	derive := func(sender, receiver []byte) (*frameCipher, error) {
+		mac := hmac.New(sha256.New, shared)
+		mac.Write([]byte(handshakeSigDomain))
+		mac.Write(sender)
+		mac.Write(receiver)
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &frameCipher{aead: aead}, nil
+	}
+	if send, err = derive(ourPub, theirs[:]); err != nil {
+		return nil, nil, err
+	}
+	if recv, err = derive(theirs[:], ourPub); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
+
+// frameCipher seals or opens the frames of one direction of a connection.
+// Nonces are a frame counter, so frames can't be dropped, replayed or
+// reordered without failing authentication. It is not safe for concurrent
+// use; each direction has a single reader or writer.
+type frameCipher struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+// maxSealedFrame bounds the length of an encrypted frame: the frame of the
+// largest payload any message type accepts, plus the GCM tag.
+const maxSealedFrame = frameHeaderSize + MaxMessageSize + 16
+
+func (c *frameCipher) nonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.counter)
+	c.counter++
+	return nonce
+}
+
+// writeFrame writes frame as Length(4) || AES-GCM(frame), with the length
+// authenticated as additional data.
+func (c *frameCipher) writeFrame(w io.Writer, frame []byte) error {
+	sealedLen := len(frame) + c.aead.Overhead()
+	buf := make([]byte, 4, 4+sealedLen)
+	binary.BigEndian.PutUint32(buf, uint32(sealedLen))
+	buf = c.aead.Seal(buf, c.nonce(), frame, buf[:4])
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads and opens one frame written by writeFrame.
+func (c *frameCipher) readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxSealedFrame {
+		return nil, fmt.Errorf("%w: encrypted frame of %d bytes", ErrMessageTooLarge, n)
+	}
+	// The buffer grows as the data arrives, so a peer must send what it
+	// announced before we hold that much for it.
+	var sealed bytes.Buffer
+	if _, err := io.CopyN(&sealed, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	frame, err := c.aead.Open(sealed.Bytes()[:0], c.nonce(), sealed.Bytes(), lenBuf[:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return frame, nil
+}
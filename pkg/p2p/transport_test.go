@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateNodeKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), NodeKeyFile)
+	key, err := LoadOrCreateNodeKey(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	again, err := LoadOrCreateNodeKey(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !key.Equal(again) {
+		t.Error("node key changed across loads")
+	}
+}
+
+func TestFrameCipher(t *testing.T) {
+	a, _ := newSessionKey()
+	b, _ := newSessionKey()
+	var aPub, bPub [32]byte
+	copy(aPub[:], a.PublicKey().Bytes())
+	copy(bPub[:], b.PublicKey().Bytes())
+	aSend, aRecv, err := sessionCiphers(a, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSend, bRecv, err := sessionCiphers(b, aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wire bytes.Buffer
+	aSend.writeFrame(&wire, []byte("first"))
+	aSend.writeFrame(&wire, []byte("second"))
+	sealed := append([]byte(nil), wire.Bytes()...)
+	for _, want := range []string{"first", "second"} {
+		got, err := bRecv.readFrame(&wire)
+		if err != nil || string(got) != want {
+			t.Fatalf("readFrame = %q, %v; want %q", got, err, want)
+		}
+	}
+	if bytes.Contains(sealed, []byte("first")) {
+		t.Error("plaintext visible on the wire")
+	}
+
+	// Replayed frames fail: the counter has moved on.
+	if _, err := bRecv.readFrame(bytes.NewReader(sealed)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("replayed frame: err = %v, want ErrDecrypt", err)
+	}
+	// The other direction has its own key and counter.
+	wire.Reset()
+	bSend.writeFrame(&wire, []byte("reply"))
+	if got, err := aRecv.readFrame(&wire); err != nil || string(got) != "reply" {
+		t.Fatalf("reply = %q, %v", got, err)
+	}
+
+	// Tampering is detected.
+	bSend.writeFrame(&wire, []byte("reply"))
+	tampered := wire.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	if _, err := aRecv.readFrame(&wire); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered frame: err = %v, want ErrDecrypt", err)
+	}
+	if decodeErrorScore(ErrDecrypt) == 0 {
+		t.Error("a frame failing authentication carries no misbehaviour score")
+	}
+
+	// Lengths beyond the largest message are refused before reading on,
+	// and a frame cut short is an I/O error.
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], maxSealedFrame+1)
+	if _, err := aRecv.readFrame(bytes.NewReader(length[:])); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("oversized frame: err = %v, want ErrMessageTooLarge", err)
+	}
+	binary.BigEndian.PutUint32(length[:], maxSealedFrame)
+	if _, err := aRecv.readFrame(bytes.NewReader(append(length[:], 1, 2, 3))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated frame: err = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	a := newTestServer(t, "test", testGenesisTime)
+	b := newTestServer(t, "test", testGenesisTime)
+	b.Connect(a.testAddr())
+	waitFor(t, "handshake", func() bool {
+		return len(handshakedPeers(a)) == 1 && len(handshakedPeers(b)) == 1
+	})
+
+	infos := b.PeerInfo()
+	if len(infos) != 1 || !infos[0].Encrypted || infos[0].NodeID != a.NodeID() {
+		t.Fatalf("b's peer info = %+v, want encrypted connection to %s", infos, a.NodeID())
+	}
+	if !handshakedPeers(a)[0].Encrypted() {
+		t.Error("a's side of the connection is not encrypted")
+	}
+
+	// Messages flow over the encrypted session.
+	p := handshakedPeers(b)[0]
+	p.sendPing(time.Now())
+	waitFor(t, "pong", func() bool { return p.Latency() > 0 })
+}
+
+func TestEncryptionRequired(t *testing.T) {
+	s := startTestServer(t, ServerConfig{Encryption: EncryptionRequired}, "test", testGenesisTime)
+	plain := startTestServer(t, ServerConfig{Encryption: EncryptionDisabled}, "test", testGenesisTime)
+
+	plain.Connect(s.testAddr())
+	waitFor(t, "handshake to fail", func() bool {
+		return s.PeerCount() == 0 && plain.PeerCount() == 0
+	})
+
+	// Peers that prefer encryption get it.
+	other := newTestServer(t, "test", testGenesisTime)
+	other.Connect(s.testAddr())
+	waitFor(t, "handshake", func() bool { return len(handshakedPeers(s)) == 1 })
+	if !handshakedPeers(s)[0].Encrypted() {
+		t.Error("connection is not encrypted")
+	}
+}
@@ -0,0 +1,331 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+)
+
+// JSON-RPC 2.0 error codes. The first five are defined by the
+// specification; the others are this node's, in the range it reserves for
+// implementations.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	CodeBlockNotFound     = -32001
+	CodeTxRejected        = -32010 // Rejected for a reason without its own code.
+	CodeTxAlreadyKnown    = -32011
+	CodeInvalidSignature  = -32012
+	CodeInsufficientFunds = -32013
+	CodeInvalidNonce      = -32014
+)
+
+const (
+	// MaxRequestSize bounds the body of a JSON-RPC request.
+	MaxRequestSize = 1 << 20
+
+	// MaxBatchSize bounds the calls in a batch request.
+	MaxBatchSize = 100
+)
+
+// errorCodes maps the sentinel errors methods return to error codes.
+var errorCodes = []struct {
+	err  error
+	code int
+}{
+	{blockchain.ErrBlockNotFound, CodeBlockNotFound},
+	{blockchain.ErrBlockNotFoundInStore, CodeBlockNotFound},
+	{mempool.ErrTxAlreadyInMempool, CodeTxAlreadyKnown},
+	{mempool.ErrInvalidSignature, CodeInvalidSignature},
+	{mempool.ErrInsufficientFunds, CodeInsufficientFunds},
+	{mempool.ErrInvalidNonce, CodeInvalidNonce},
+	{mempool.ErrTxTooOld, CodeTxRejected},
+	{blockchain.ErrInvalidTxID, CodeTxRejected},
+}
+
+// Error is a JSON-RPC error object. Methods may return one to choose the
+// code; other errors are mapped from their sentinel, or reported as
+// CodeInternalError.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// invalidParams returns a CodeInvalidParams error.
+func invalidParams(format string, args ...any) *Error {
+	return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// toError converts an error returned by a method to an error object.
+func toError(err error) *Error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return &Error{Code: e.code, Message: err.Error()}
+		}
+	}
+	return &Error{Code: CodeInternalError, Message: err.Error()}
+}
+
+// request is a JSON-RPC request. ID is nil for notifications, which get no
+// response, and "null" for a request with a null id.
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// response is a JSON-RPC response: Result on success, Error otherwise.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
+
+func errorResponse(id json.RawMessage, err *Error) *response {
+	if id == nil {
+		id = nullID
+	}
+	return &response{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// Handler implements a JSON-RPC method. params is the raw "params" member,
+// nil if absent. The result is encoded as JSON.
+type Handler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Method adapts fn to a Handler, decoding the params into P, a struct (see
+// decodeParams). Decoding errors are reported as CodeInvalidParams.
+func Method[P any](fn func(ctx context.Context, params P) (any, error)) Handler {
+	return func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var p P
+		if err := decodeParams(raw, &p); err != nil {
+			return nil, invalidParams("%v", err)
+		}
+		return fn(ctx, p)
+	}
+}
+
+// NoParams adapts fn, a method taking no parameters, to a Handler.
+func NoParams(fn func(ctx context.Context) (any, error)) Handler {
+	return Method(func(ctx context.Context, _ struct{}) (any, error) {
+		return fn(ctx)
+	})
+}
+
+// decodeParams decodes params into v, a pointer to a struct. Params may be
+// given by name, as an object keyed by the fields' JSON names, or by
+// position, as an array in field order. Params left out keep their zero
+// value.
+func decodeParams(params json.RawMessage, v any) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, nullID) {
+		return nil
+	}
+	switch params[0] {
+	case '{':
+		dec := json.NewDecoder(bytes.NewReader(params))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	case '[':
+		var list []json.RawMessage
+		if err := json.Unmarshal(params, &list); err != nil {
+			return err
+		}
+		rv := reflect.ValueOf(v).Elem()
+		var fields []reflect.Value
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).IsExported() {
+				fields = append(fields, rv.Field(i))
+			}
+		}
+		if len(list) > len(fields) {
+			return fmt.Errorf("got %d params, want at most %d", len(list), len(fields))
+		}
+		for i, raw := range list {
+			if err := json.Unmarshal(raw, fields[i].Addr().Interface()); err != nil {
+				return fmt.Errorf("param %d: %w", i, err)
+			}
+		}
+		return nil
+	default:
+		return errors.New("params must be an array or an object")
+	}
+}
+
+// Registry holds the JSON-RPC methods and serves them over HTTP. Methods
+// may be registered at any time, so subsystems started after the RPC
+// server can add their own.
+type Registry struct {
+	mu      sync.RWMutex
+	methods map[string]Handler
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{methods: make(map[string]Handler)}
+}
+
+// Register adds a method. It panics if the name is already registered.
+func (r *Registry) Register(name string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.methods[name]; ok {
+		panic(fmt.Sprintf("rpc: method %q registered twice", name))
+	}
+	r.methods[name] = h
+}
+
+// Methods returns the registered method names, sorted.
+func (r *Registry) Methods() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.methods))
+	for name := range r.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP handles a POSTed JSON-RPC request or batch.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := r.serve(req.Context(), body)
+	if resp == nil {
+		// Only notifications: nothing to answer.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serve runs a request or batch and returns the response to encode, or nil
+// if there is nothing to answer.
+func (r *Registry) serve(ctx context.Context, body []byte) any {
+	body = bytes.TrimSpace(body)
+	switch {
+	case !json.Valid(body):
+		return errorResponse(nil, &Error{Code: CodeParseError, Message: "parse error"})
+	case body[0] == '[':
+		return r.handleBatch(ctx, body)
+	default:
+		if resp := r.handle(ctx, body); resp != nil {
+			return resp
+		}
+		return nil
+	}
+}
+
+// handleBatch runs the calls of a batch in order. It returns nil if they
+// were all notifications.
+func (r *Registry) handleBatch(ctx context.Context, body []byte) any {
+	var calls []json.RawMessage
+	if err := json.Unmarshal(body, &calls); err != nil || len(calls) == 0 {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "invalid batch"})
+	}
+	if len(calls) > MaxBatchSize {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf("batch of %d calls exceeds limit of %d", len(calls), MaxBatchSize)})
+	}
+	var responses []*response
+	for _, call := range calls {
+		if resp := r.handle(ctx, call); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// handle runs one call. It returns nil for a notification.
+func (r *Registry) handle(ctx context.Context, raw json.RawMessage) *response {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" || !validID(req.ID) {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+
+	r.mu.RLock()
+	h, ok := r.methods[req.Method]
+	r.mu.RUnlock()
+
+	var result any
+	var err error
+	if ok {
+		result, err = call(ctx, h, req.Params)
+	} else {
+		err = &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+	}
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, toError(err))
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, toError(err))
+	}
+	return &response{JSONRPC: "2.0", Result: data, ID: req.ID}
+}
+
+// call runs h, turning a panic into an internal error.
+func call(ctx context.Context, h Handler, params json.RawMessage) (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("RPC: method panicked: %v", p)
+			err = &Error{Code: CodeInternalError, Message: "internal error"}
+		}
+	}()
+	return h(ctx, params)
+}
+
+// validID reports whether id is absent, null, a string or a number.
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case 'n', '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	default:
+		return false
+	}
+}
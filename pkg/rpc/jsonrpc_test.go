@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+)
+
+// post sends body to url and decodes the response into v, unless the
+// server answered 204 No Content.
+func post(t *testing.T, url, body string, v any) int {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func newTestRegistry(t *testing.T) *httptest.Server {
+	type addParams struct {
+		A int `json:"a"`
+		B int `json:"b"`
+	}
+	r := NewRegistry()
+	r.Register("add", Method(func(ctx context.Context, p addParams) (any, error) {
+		return p.A + p.B, nil
+	}))
+	r.Register("fail", NoParams(func(ctx context.Context) (any, error) {
+		return nil, fmt.Errorf("rejected: %w", mempool.ErrInvalidNonce)
+	}))
+	r.Register("panic", NoParams(func(ctx context.Context) (any, error) {
+		panic("boom")
+	}))
+	r.Register("internal", NoParams(func(ctx context.Context) (any, error) {
+		return nil, errors.New("disk on fire")
+	}))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestJSONRPCCall(t *testing.T) {
+	srv := newTestRegistry(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		result string
+		code   int
+		id     string
+	}{
+		{"named params", `{"jsonrpc":"2.0","method":"add","params":{"a":2,"b":3},"id":1}`, "5", 0, "1"},
+		{"positional params", `{"jsonrpc":"2.0","method":"add","params":[4,5],"id":"x"}`, "9", 0, `"x"`},
+		{"missing params", `{"jsonrpc":"2.0","method":"add","id":null}`, "0", 0, "null"},
+		{"too many params", `{"jsonrpc":"2.0","method":"add","params":[1,2,3],"id":2}`, "", CodeInvalidParams, "2"},
+		{"unknown param", `{"jsonrpc":"2.0","method":"add","params":{"c":1},"id":3}`, "", CodeInvalidParams, "3"},
+		{"unknown method", `{"jsonrpc":"2.0","method":"nope","id":4}`, "", CodeMethodNotFound, "4"},
+		{"sentinel error", `{"jsonrpc":"2.0","method":"fail","id":5}`, "", CodeInvalidNonce, "5"},
+		{"other error", `{"jsonrpc":"2.0","method":"internal","id":6}`, "", CodeInternalError, "6"},
+		{"panic", `{"jsonrpc":"2.0","method":"panic","id":7}`, "", CodeInternalError, "7"},
+		{"wrong version", `{"jsonrpc":"1.0","method":"add","id":8}`, "", CodeInvalidRequest, "null"},
+		{"bad id", `{"jsonrpc":"2.0","method":"add","id":{}}`, "", CodeInvalidRequest, "null"},
+		{"parse error", `{"jsonrpc":"2.0",`, "", CodeParseError, "null"},
+		{"empty batch", `[]`, "", CodeInvalidRequest, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp response
+			if status := post(t, srv.URL, tt.body, &resp); status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			if string(resp.ID) != tt.id {
+				t.Errorf("id %s, want %s", resp.ID, tt.id)
+			}
+			if tt.code != 0 {
+				if resp.Error == nil || resp.Error.Code != tt.code {
+					t.Fatalf("error %+v, want code %d", resp.Error, tt.code)
+				}
+				return
+			}
+			if resp.Error != nil || string(resp.Result) != tt.result {
+				t.Fatalf("result %s, error %+v; want %s", resp.Result, resp.Error, tt.result)
+			}
+		})
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	srv := newTestRegistry(t)
+
+	var resps []response
+	body := `[
+		{"jsonrpc":"2.0","method":"add","params":[1,1],"id":1},
+		{"jsonrpc":"2.0","method":"add","params":[1,2]},
+		{"jsonrpc":"2.0","method":"nope","id":2},
+		42
+	]`
+	if status := post(t, srv.URL, body, &resps); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	// The notification gets no response; the others are answered in order.
+	if len(resps) != 3 {
+		t.Fatalf("got %d responses, want 3", len(resps))
+	}
+	if string(resps[0].ID) != "1" || string(resps[0].Result) != "2" {
+		t.Errorf("first response %+v", resps[0])
+	}
+	if resps[1].Error == nil || resps[1].Error.Code != CodeMethodNotFound {
+		t.Errorf("second response %+v, want method not found", resps[1])
+	}
+	if resps[2].Error == nil || resps[2].Error.Code != CodeInvalidRequest {
+		t.Errorf("third response %+v, want invalid request", resps[2])
+	}
+
+	// A batch of notifications gets no body at all.
+	body = `[{"jsonrpc":"2.0","method":"add"},{"jsonrpc":"2.0","method":"fail"}]`
+	if status := post(t, srv.URL, body, nil); status != http.StatusNoContent {
+		t.Errorf("notification batch: status %d, want 204", status)
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	r := NewRegistry()
+	h := NoParams(func(ctx context.Context) (any, error) { return nil, nil })
+	r.Register("m", h)
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a method twice did not panic")
+		}
+	}()
+	r.Register("m", h)
+}
@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/chronodrachma/chrd/pkg/p2p"
+)
+
+// registerMethods registers the node's built-in JSON-RPC methods.
+func (s *Server) registerMethods() {
+	s.Register("getblockcount", NoParams(s.getBlockCount))
+	s.Register("getbestblockhash", NoParams(s.getBestBlockHash))
+	s.Register("getblockhash", Method(s.getBlockHash))
+	s.Register("getblock", Method(s.getBlock))
+	s.Register("getbalance", Method(s.getBalance))
+	s.Register("sendrawtransaction", Method(s.sendRawTransaction))
+	s.Register("getmempoolinfo", NoParams(s.getMempoolInfo))
+	s.Register("getrawmempool", NoParams(s.getRawMempool))
+	s.Register("getpeerinfo", NoParams(s.getPeerInfo))
+	s.Register("getsyncinfo", NoParams(s.getSyncInfo))
+	s.Register("getstatus", NoParams(s.getStatus))
+	s.Register("subscribe", Method(s.subscribe))
+	s.Register("unsubscribe", Method(s.unsubscribe))
+}
+
+// parseHash decodes a hex hash param, reporting errors as invalid params.
+func parseHash(name, h string) (types.Hash, error) {
+	if h == "" {
+		return types.Hash{}, invalidParams("missing %s", name)
+	}
+	hash, err := types.HashFromHex(h)
+	if err != nil {
+		return types.Hash{}, invalidParams("invalid %s: %v", name, err)
+	}
+	return hash, nil
+}
+
+// getblockcount returns the height of the chain tip.
+func (s *Server) getBlockCount(ctx context.Context) (any, error) {
+	return s.chain.Height(), nil
+}
+
+// getbestblockhash returns the hash of the chain tip.
+func (s *Server) getBestBlockHash(ctx context.Context) (any, error) {
+	tip := s.chain.Tip()
+	if tip == nil {
+		return nil, blockchain.ErrBlockNotFound
+	}
+	return tip.Hash, nil
+}
+
+type heightParams struct {
+	Height uint64 `json:"height"`
+}
+
+// getblockhash [height] returns the hash of the canonical block at height.
+func (s *Server) getBlockHash(ctx context.Context, p heightParams) (any, error) {
+	block, err := s.chain.GetBlockByHeight(p.Height)
+	if err != nil {
+		return nil, err
+	}
+	return block.Hash, nil
+}
+
+type hashParams struct {
+	Hash string `json:"hash"`
+}
+
+// getblock [hash] returns the block with the given hash.
+func (s *Server) getBlock(ctx context.Context, p hashParams) (any, error) {
+	hash, err := parseHash("hash", p.Hash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := s.chain.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return s.blockView(block), nil
+}
+
+type addressParams struct {
+	Address string `json:"address"`
+}
+
+// getbalance [address] returns an account's balance and next nonce.
+func (s *Server) getBalance(ctx context.Context, p addressParams) (any, error) {
+	addr, err := parseHash("address", p.Address)
+	if err != nil {
+		return nil, err
+	}
+	return s.balance(addr)
+}
+
+type rawTxParams struct {
+	Tx string `json:"tx"` // Hex of the binary encoding.
+}
+
+// sendrawtransaction [tx] adds a signed transaction to the mempool, relays
+// it and returns its ID.
+func (s *Server) sendRawTransaction(ctx context.Context, p rawTxParams) (any, error) {
+	if p.Tx == "" {
+		return nil, invalidParams("missing tx")
+	}
+	data, err := hex.DecodeString(p.Tx)
+	if err != nil {
+		return nil, invalidParams("invalid tx hex: %v", err)
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(data); err != nil {
+		return nil, invalidParams("invalid tx: %v", err)
+	}
+	if tx.ID != tx.ComputeID() {
+		return nil, blockchain.ErrInvalidTxID
+	}
+
+	if err := s.mempool.AddTransaction(tx); err != nil {
+		return nil, fmt.Errorf("rejected: %w", err)
+	}
+	s.p2pServer.Broadcast(&p2p.MsgTx{Tx: tx})
+	return tx.ID, nil
+}
+
+// mempoolInfo is the result of getmempoolinfo.
+type mempoolInfo struct {
+	Size int `json:"size"`
+}
+
+// getmempoolinfo returns a summary of the mempool.
+func (s *Server) getMempoolInfo(ctx context.Context) (any, error) {
+	return mempoolInfo{Size: s.mempool.Size()}, nil
+}
+
+// getrawmempool returns the IDs of the pending transactions.
+func (s *Server) getRawMempool(ctx context.Context) (any, error) {
+	txs := s.mempool.Transactions()
+	ids := make([]types.Hash, 0, len(txs))
+	for _, tx := range txs {
+		ids = append(ids, tx.ID)
+	}
+	return ids, nil
+}
+
+// getpeerinfo returns the connected peers.
+func (s *Server) getPeerInfo(ctx context.Context) (any, error) {
+	return s.peerInfo(), nil
+}
+
+// getsyncinfo returns the sync progress.
+func (s *Server) getSyncInfo(ctx context.Context) (any, error) {
+	return newSyncStatus(s.p2pServer.SyncProgress()), nil
+}
+
+// getstatus returns the same summary as /status.
+func (s *Server) getStatus(ctx context.Context) (any, error) {
+	return s.status(), nil
+}
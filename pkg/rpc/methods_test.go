@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/chronodrachma/chrd/pkg/simnet"
+)
+
+// rpcCall calls method on the server at url and decodes its result into v.
+func rpcCall(t *testing.T, url, method string, params any, v any) *Error {
+	t.Helper()
+	p, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp response
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":%s,"id":1}`, method, p)
+	if status := post(t, url, body, &resp); status != http.StatusOK {
+		t.Fatalf("%s: status %d", method, status)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if v != nil {
+		if err := json.Unmarshal(resp.Result, v); err != nil {
+			t.Fatalf("%s: decode result: %v", method, err)
+		}
+	}
+	return nil
+}
+
+func TestMethods(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := simnet.New(t, 1).Nodes[0]
+	copy(node.Miner[:], pub)
+	blocks := node.Mine(int(blockchain.CoinbaseMaturity) + 1)
+	s := NewServer(node.Chain, node.Mempool, node.Server)
+	defer s.Close()
+	srv := httptest.NewServer(s.methods)
+	defer srv.Close()
+
+	var height uint64
+	if err := rpcCall(t, srv.URL, "getblockcount", nil, &height); err != nil || height != uint64(len(blocks)) {
+		t.Fatalf("getblockcount = %d, %v; want %d", height, err, len(blocks))
+	}
+	var hash types.Hash
+	if err := rpcCall(t, srv.URL, "getblockhash", []uint64{3}, &hash); err != nil || hash != blocks[2].Hash {
+		t.Fatalf("getblockhash [3] = %s, %v", hash, err)
+	}
+	if err := rpcCall(t, srv.URL, "getblockhash", []uint64{1000}, nil); err == nil || err.Code != CodeBlockNotFound {
+		t.Errorf("getblockhash past the tip: %v, want code %d", err, CodeBlockNotFound)
+	}
+	var block Block
+	if err := rpcCall(t, srv.URL, "getblock", map[string]types.Hash{"hash": hash}, &block); err != nil || block.Hash != blocks[2].Hash {
+		t.Fatalf("getblock = %x, %v", block.Hash[:8], err)
+	}
+	if want := uint64(len(blocks)) - 2; block.Confirmations != want || block.Transactions[0].Confirmations != want {
+		t.Errorf("block has %d confirmations, want %d", block.Confirmations, want)
+	}
+	if block.PowHash != blocks[2].PowHash || block.Size == 0 || block.Transactions[0].Type != "coinbase" {
+		t.Errorf("getblock = %+v", block)
+	}
+	if err := rpcCall(t, srv.URL, "getblock", []string{types.Hash{1}.Hex()}, nil); err == nil || err.Code != CodeBlockNotFound {
+		t.Errorf("getblock unknown: %v, want code %d", err, CodeBlockNotFound)
+	}
+	if err := rpcCall(t, srv.URL, "getblock", []string{"xyz"}, nil); err == nil || err.Code != CodeInvalidParams {
+		t.Errorf("getblock bad hash: %v, want code %d", err, CodeInvalidParams)
+	}
+
+	// A signed transfer is accepted once; bad ones get specific codes.
+	tx := &types.Transaction{
+		Type:      types.TxTypeTransfer,
+		Timestamp: time.Now(),
+		To:        types.Hash{0x0D},
+		Amount:    10,
+		Fee:       1,
+	}
+	copy(tx.From[:], pub)
+	tx.Signature = ed25519.Sign(key, tx.Serialize())
+	tx.ID = tx.ComputeID()
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txid types.Hash
+	if err := rpcCall(t, srv.URL, "sendrawtransaction", []string{hex.EncodeToString(raw)}, &txid); err != nil || txid != tx.ID {
+		t.Fatalf("sendrawtransaction = %s, %v", txid, err)
+	}
+	if err := rpcCall(t, srv.URL, "sendrawtransaction", []string{hex.EncodeToString(raw)}, nil); err == nil || err.Code != CodeTxAlreadyKnown {
+		t.Errorf("resending: %v, want code %d", err, CodeTxAlreadyKnown)
+	}
+	tx.Nonce = 5
+	tx.ID = tx.ComputeID()
+	raw, _ = tx.MarshalBinary()
+	if err := rpcCall(t, srv.URL, "sendrawtransaction", []string{hex.EncodeToString(raw)}, nil); err == nil || err.Code != CodeInvalidSignature {
+		t.Errorf("stale signature: %v, want code %d", err, CodeInvalidSignature)
+	}
+
+	var ids []types.Hash
+	if err := rpcCall(t, srv.URL, "getrawmempool", nil, &ids); err != nil || len(ids) != 1 || ids[0] != txid {
+		t.Errorf("getrawmempool = %v, %v", ids, err)
+	}
+	var bal balanceInfo
+	if err := rpcCall(t, srv.URL, "getbalance", []string{node.Miner.Hex()}, &bal); err != nil || bal.Address != node.Miner || bal.Balance == 0 {
+		t.Errorf("getbalance = %+v, %v", bal, err)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/chronodrachma/chrd/pkg/core/blockchain"
@@ -19,17 +23,54 @@ type Server struct {
 	chain     *blockchain.Chain
 	mempool   *mempool.Mempool
 	p2pServer *p2p.Server
+	methods   *Registry
+
+	// WebSocket subscriptions, fed by the chain and mempool until Close.
+	hub       *hub
+	closeOnce sync.Once
+	unsub     []func()
 }
 
 func NewServer(chain *blockchain.Chain, mp *mempool.Mempool, p2p *p2p.Server) *Server {
-	return &Server{
+	s := &Server{
 		chain:     chain,
 		mempool:   mp,
 		p2pServer: p2p,
+		methods:   NewRegistry(),
+		hub:       newHub(),
 	}
+	s.registerMethods()
+
+	updates, cancelUpdates := chain.SubscribeUpdates()
+	txs, cancelTxs := mp.SubscribeTransactions()
+	s.unsub = []func(){cancelUpdates, cancelTxs}
+	go s.runEvents(updates, txs)
+	return s
+}
+
+// Close stops delivering events and disconnects the WebSocket clients.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		for _, cancel := range s.unsub {
+			cancel()
+		}
+		s.hub.closeAll()
+	})
+}
+
+// Register adds a JSON-RPC method, served at /rpc. It panics if the name is
+// already registered.
+func (s *Server) Register(name string, h Handler) {
+	s.methods.Register(name, h)
 }
 
+// Start serves the API on port until it fails.
 func (s *Server) Start(port string) error {
+	return http.ListenAndServe(port, s.Handler())
+}
+
+// Handler returns the handler serving every endpoint.
+func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/balance", s.handleBalance)
 	mux.HandleFunc("/tx", s.handleTx)
@@ -37,12 +78,33 @@ func (s *Server) Start(port string) error {
 	mux.HandleFunc("/block/hash", s.handleBlockByHash)
 	mux.HandleFunc("/mempool", s.handleMempool)
 	mux.HandleFunc("/status", s.handleStatus)
-
-	return http.ListenAndServe(port, mux)
+	mux.HandleFunc("/peers", s.handlePeers)
+	mux.HandleFunc("/bans", adminOnly(s.handleBans))
+	mux.HandleFunc("/bans/add", adminOnly(s.handleBanAdd))
+	mux.HandleFunc("/bans/remove", adminOnly(s.handleBanRemove))
+	mux.Handle("/rpc", s.methods)
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	return mux
 }
 
 // GET /status
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// nodeStatus is the node summary reported by /status and getstatus.
+type nodeStatus struct {
+	Height          uint64     `json:"height"`
+	TipHash         types.Hash `json:"tip_hash"`
+	FinalizedHeight uint64     `json:"finalized_height"`
+	TotalSupply     Amount     `json:"total_supply"`
+	MempoolSize     int        `json:"mempool_size"`
+	PeerCount       int        `json:"peer_count"`
+	Sync            syncStatus `json:"sync"`
+}
+
+func (s *Server) status() nodeStatus {
 	tip := s.chain.Tip()
 	height := uint64(0)
 	tipHash := types.Hash{}
@@ -51,24 +113,185 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		tipHash = tip.Hash
 	}
 
-	resp := struct {
-		Height      uint64       `json:"height"`
-		TipHash     types.Hash   `json:"tip_hash"`
-		TotalSupply types.Amount `json:"total_supply"`
-		MempoolSize int          `json:"mempool_size"`
-		PeerCount   int          `json:"peer_count"`
-	}{
-		Height:      height,
-		TipHash:     tipHash,
-		TotalSupply: s.chain.TotalSupply(),
-		MempoolSize: s.mempool.Size(),
-		PeerCount:   s.p2pServer.PeerCount(),
+	return nodeStatus{
+		Height:          height,
+		TipHash:         tipHash,
+		FinalizedHeight: s.chain.FinalizedHeight(),
+		TotalSupply:     Amount(s.chain.TotalSupply()),
+		MempoolSize:     s.mempool.Size(),
+		PeerCount:       s.p2pServer.PeerCount(),
+		Sync:            newSyncStatus(s.p2pServer.SyncProgress()),
+	}
+}
+
+// syncStatus is the sync progress reported by /status and getsyncinfo.
+type syncStatus struct {
+	HeadersHeight  uint64  `json:"headers_height"`
+	BlocksHeight   uint64  `json:"blocks_height"`
+	Syncing        bool    `json:"syncing"`
+	BlocksInFlight int     `json:"blocks_in_flight"`
+	ETASeconds     float64 `json:"eta_seconds"` // 0 if unknown or in sync.
+}
+
+func newSyncStatus(p p2p.SyncProgress) syncStatus {
+	return syncStatus{
+		HeadersHeight:  p.HeadersHeight,
+		BlocksHeight:   p.BlocksHeight,
+		Syncing:        p.Syncing,
+		BlocksInFlight: p.BlocksInFlight,
+		ETASeconds:     p.ETA.Seconds(),
+	}
+}
+
+// GET /peers
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.peerInfo())
+}
+
+// peerInfo describes a connected peer for /peers and getpeerinfo.
+type peerInfo struct {
+	Addr        string  `json:"addr"`
+	NodeID      string  `json:"node_id"`
+	Encrypted   bool    `json:"encrypted"`
+	Outbound    bool    `json:"outbound"`
+	Handshaked  bool    `json:"handshaked"`
+	Version     uint32  `json:"version"`
+	Services    uint64  `json:"services"`
+	BestHeight  uint64  `json:"best_height"`
+	LatencyMs   float64 `json:"latency_ms"` // 0 until the first pong.
+	BanScore    int     `json:"ban_score"`
+	ConnectedAt int64   `json:"connected_at"` // Unix timestamp
+}
+
+func (s *Server) peerInfo() []peerInfo {
+	infos := s.p2pServer.PeerInfo()
+	resp := make([]peerInfo, 0, len(infos))
+	for _, p := range infos {
+		resp = append(resp, peerInfo{
+			Addr:        p.Addr,
+			NodeID:      p.NodeID,
+			Encrypted:   p.Encrypted,
+			Outbound:    p.Outbound,
+			Handshaked:  p.Handshaked,
+			Version:     p.Version,
+			Services:    p.Services,
+			BestHeight:  p.BestHeight,
+			LatencyMs:   float64(p.Latency) / float64(time.Millisecond),
+			BanScore:    p.BanScore,
+			ConnectedAt: p.ConnectedAt.Unix(),
+		})
+	}
+	return resp
+}
+
+// adminOnly restricts a handler to clients connecting from loopback. A
+// browser on the node's host connects from loopback too, so requests that
+// web pages from other hosts make through it are refused (see sameOrigin).
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "admin endpoints are only available from localhost", http.StatusForbidden)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin requests not allowed", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// GET /bans
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	type ban struct {
+		Host  string `json:"host"`
+		Until int64  `json:"until"` // Unix timestamp
+	}
+
+	bans := s.p2pServer.Bans()
+	resp := make([]ban, 0, len(bans))
+	for _, b := range bans {
+		resp = append(resp, ban{Host: b.Host, Until: b.Until.Unix()})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// BanRequest is the body of /bans/add and /bans/remove.
+type BanRequest struct {
+	Host     string `json:"host"`     // IP address
+	Duration int64  `json:"duration"` // Seconds; 0 uses the node's ban period. Ignored by remove.
+}
+
+// MaxBanDuration is the longest ban /bans/add accepts, in seconds: the
+// longest time.Duration.
+const MaxBanDuration = math.MaxInt64 / int64(time.Second)
+
+// readBanRequest decodes and checks a BanRequest, writing the error response
+// itself if the request is invalid. The body must be sent as JSON, which
+// web pages cannot do across origins without the browser asking first.
+func readBanRequest(w http.ResponseWriter, r *http.Request) (*BanRequest, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	var req BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return nil, false
+	}
+	ip := net.ParseIP(req.Host)
+	if ip == nil {
+		http.Error(w, "host must be an IP address", http.StatusBadRequest)
+		return nil, false
+	}
+	if req.Duration < 0 || req.Duration > MaxBanDuration {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return nil, false
+	}
+	req.Host = ip.String()
+	return &req, true
+}
+
+// POST /bans/add
+func (s *Server) handleBanAdd(w http.ResponseWriter, r *http.Request) {
+	req, ok := readBanRequest(w, r)
+	if !ok {
+		return
+	}
+
+	d := s.p2pServer.Config.BanDuration
+	if req.Duration > 0 {
+		d = time.Duration(req.Duration) * time.Second
+	}
+	s.p2pServer.BanHost(req.Host, d)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"status\": \"ok\"}")
+}
+
+// POST /bans/remove
+func (s *Server) handleBanRemove(w http.ResponseWriter, r *http.Request) {
+	req, ok := readBanRequest(w, r)
+	if !ok {
+		return
+	}
+	if !s.p2pServer.Unban(req.Host) {
+		http.Error(w, "host is not banned", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"status\": \"ok\"}")
+}
+
 // GET /block/height?h=<uint64>
 func (s *Server) handleBlockByHeight(w http.ResponseWriter, r *http.Request) {
 	hStr := r.URL.Query().Get("h")
@@ -90,7 +313,7 @@ func (s *Server) handleBlockByHeight(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(block)
+	json.NewEncoder(w).Encode(s.blockView(block))
 }
 
 // GET /block/hash?id=<hex>
@@ -114,7 +337,7 @@ func (s *Server) handleBlockByHash(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(block)
+	json.NewEncoder(w).Encode(s.blockView(block))
 }
 
 // GET /mempool
@@ -123,7 +346,7 @@ func (s *Server) handleMempool(w http.ResponseWriter, r *http.Request) {
 	txs := s.mempool.GetPendingTransactions(1000)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(txs)
+	json.NewEncoder(w).Encode(newTransactions(txs))
 }
 
 // GET /balance?addr=<hex>
@@ -140,27 +363,31 @@ func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance, nonce, err := s.chain.GetAccountState(addr)
+	resp, err := s.balance(addr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to get state: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Return JSON
-	resp := struct {
-		Address string       `json:"address"`
-		Balance types.Amount `json:"balance"`
-		Nonce   uint64       `json:"nonce"`
-	}{
-		Address: addrHex,
-		Balance: balance,
-		Nonce:   nonce,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// balanceInfo is an account's state as reported by /balance and getbalance.
+type balanceInfo struct {
+	Address types.Hash `json:"address"`
+	Balance Amount     `json:"balance"`
+	Nonce   uint64     `json:"nonce"`
+}
+
+func (s *Server) balance(addr types.Hash) (*balanceInfo, error) {
+	balance, nonce, err := s.chain.GetAccountState(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &balanceInfo{Address: addr, Balance: Amount(balance), Nonce: nonce}, nil
+}
+
 // POST /tx
 // Body: JSON object of transaction fields + signature
 type TxRequest struct {
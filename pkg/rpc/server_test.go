@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chronodrachma/chrd/pkg/simnet"
+)
+
+func TestBanEndpoints(t *testing.T) {
+	node := simnet.New(t, 1).Nodes[0]
+	s := NewServer(node.Chain, node.Mempool, node.Server)
+	defer s.Close()
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	send := func(path, contentType, origin, body string) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	ban := `{"host":"10.0.0.1","duration":60}`
+
+	// Requests a web page could make from another origin are refused.
+	if code := send("/bans/add", "text/plain", "", ban); code != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain body: status %d, want %d", code, http.StatusUnsupportedMediaType)
+	}
+	if code := send("/bans/add", "application/json", "http://evil.example", ban); code != http.StatusForbidden {
+		t.Errorf("cross-origin request: status %d, want %d", code, http.StatusForbidden)
+	}
+	if bans := node.Server.Bans(); len(bans) != 0 {
+		t.Fatalf("refused requests banned %v", bans)
+	}
+
+	// A duration too long for time.Duration is rejected, not wrapped.
+	tooLong := fmt.Sprintf(`{"host":"10.0.0.1","duration":%d}`, MaxBanDuration+1)
+	if code := send("/bans/add", "application/json", "", tooLong); code != http.StatusBadRequest {
+		t.Errorf("overlong duration: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if code := send("/bans/add", "application/json; charset=utf-8", "", ban); code != http.StatusOK {
+		t.Fatalf("ban: status %d", code)
+	}
+	if bans := node.Server.Bans(); len(bans) != 1 || bans[0].Host != "10.0.0.1" {
+		t.Fatalf("bans = %v, want 10.0.0.1", bans)
+	}
+	if code := send("/bans/remove", "application/json", "", ban); code != http.StatusOK {
+		t.Errorf("unban: status %d", code)
+	}
+}
@@ -0,0 +1,420 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// Clients connect to /ws and speak JSON-RPC over WebSocket: every method is
+// available, plus subscribe and unsubscribe. Events arrive as notifications:
+//
+//	{"jsonrpc":"2.0","method":"subscription",
+//	 "params":{"subscription":"1","topic":"newHeads","result":{...}}}
+
+// Subscription topics.
+const (
+	TopicNewHeads        = "newHeads"            // Each block joining the main chain.
+	TopicReorgs          = "reorgs"              // Main chain switches, with the blocks on each side.
+	TopicPendingTxs      = "pendingTransactions" // Each transaction accepted into the mempool.
+	TopicAddressActivity = "addressActivity"     // Transactions to or from an address.
+)
+
+const (
+	// WriteTimeout bounds each write to a WebSocket client.
+	WriteTimeout = 10 * time.Second
+
+	// IdleTimeout is how long a WebSocket client may stay silent before it
+	// is disconnected. Clients are pinged every PingInterval, so a live
+	// client always has a pong to send in time; a half-open connection
+	// is noticed.
+	IdleTimeout  = 60 * time.Second
+	PingInterval = IdleTimeout / 2
+
+	// ClientQueueSize is how many messages may wait for a WebSocket client.
+	// A client that falls further behind is disconnected, so that a slow
+	// reader never holds up the node.
+	ClientQueueSize = 256
+
+	// MaxSubscriptions bounds the subscriptions of one WebSocket client.
+	MaxSubscriptions = 32
+)
+
+// Address activity statuses.
+const (
+	activityPending   = "pending"   // Accepted into the mempool.
+	activityConfirmed = "confirmed" // Included in a block joining the main chain.
+	activityReverted  = "reverted"  // Included in a block leaving the main chain.
+)
+
+// reorgEvent is the result of a reorgs notification.
+type reorgEvent struct {
+	CommonAncestor types.Hash `json:"common_ancestor"`
+	Disconnected   []*Block   `json:"disconnected"` // Highest first.
+	Connected      []*Block   `json:"connected"`    // Lowest first.
+}
+
+// addressActivity is the result of an addressActivity notification.
+type addressActivity struct {
+	Status string      `json:"status"`
+	Tx     Transaction `json:"tx"`
+}
+
+// subscription is one topic a client subscribed to.
+type subscription struct {
+	id      string
+	topic   string
+	address types.Hash // For TopicAddressActivity.
+}
+
+// wsClient is a WebSocket connection and its subscriptions.
+type wsClient struct {
+	conn *wsConn
+	send chan []byte
+
+	// pingInterval is how often the write loop pings the client.
+	pingInterval time.Duration
+
+	dropOnce   sync.Once
+	done       chan struct{}
+	dropCode   int
+	dropReason string
+
+	mu     sync.Mutex
+	subs   map[string]*subscription
+	nextID uint64
+}
+
+func newWSClient(conn *wsConn) *wsClient {
+	return &wsClient{
+		conn:         conn,
+		send:         make(chan []byte, ClientQueueSize),
+		pingInterval: PingInterval,
+		done:         make(chan struct{}),
+		subs:         make(map[string]*subscription),
+	}
+}
+
+// queue schedules msg to be sent, dropping the client if its queue is
+// full. It never blocks.
+func (c *wsClient) queue(msg []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.drop(closeTryAgainLater, "client too slow")
+		return false
+	}
+}
+
+// drop has the write loop close the connection with the given code.
+func (c *wsClient) drop(code int, reason string) {
+	c.dropOnce.Do(func() {
+		c.dropCode, c.dropReason = code, reason
+		close(c.done)
+	})
+}
+
+// writeLoop sends queued messages, and pings while there are none, until
+// the client is dropped.
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(c.pingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case msg := <-c.send:
+			err = c.conn.WriteText(msg)
+		case <-ping.C:
+			err = c.conn.writeFrame(opPing, nil)
+		case <-c.done:
+			c.conn.Close(c.dropCode, c.dropReason)
+			return
+		}
+		if err != nil {
+			c.drop(closeNormal, "")
+			c.conn.conn.Close()
+			return
+		}
+	}
+}
+
+// hub delivers events to the subscribed WebSocket clients.
+type hub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*wsClient]struct{})}
+}
+
+func (h *hub) add(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+}
+
+func (h *hub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// closeAll drops every client.
+func (h *hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		c.drop(closeGoingAway, "server shutting down")
+	}
+}
+
+// publish notifies every subscription to topic accepted by match, which may
+// be nil. result is only called if there is such a subscription.
+func (h *hub) publish(topic string, match func(*subscription) bool, result func() any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var raw json.RawMessage
+	for c := range h.clients {
+		c.mu.Lock()
+		var msgs [][]byte
+		for _, sub := range c.subs {
+			if sub.topic != topic || (match != nil && !match(sub)) {
+				continue
+			}
+			if raw == nil {
+				var err error
+				if raw, err = json.Marshal(result()); err != nil {
+					c.mu.Unlock()
+					log.Printf("RPC: encode %s notification: %v", topic, err)
+					return
+				}
+			}
+			msgs = append(msgs, notification(sub, raw))
+		}
+		c.mu.Unlock()
+
+		for _, msg := range msgs {
+			if !c.queue(msg) {
+				break
+			}
+		}
+	}
+}
+
+// notification encodes a subscription notification.
+func notification(sub *subscription, result json.RawMessage) []byte {
+	msg, _ := json.Marshal(struct {
+		JSONRPC string `json:"jsonrpc"`
+		Method  string `json:"method"`
+		Params  any    `json:"params"`
+	}{
+		JSONRPC: "2.0",
+		Method:  "subscription",
+		Params: struct {
+			Subscription string          `json:"subscription"`
+			Topic        string          `json:"topic"`
+			Result       json.RawMessage `json:"result"`
+		}{sub.id, sub.topic, result},
+	})
+	return msg
+}
+
+// runEvents publishes chain and mempool events until both channels close.
+func (s *Server) runEvents(updates <-chan *blockchain.ChainUpdate, txs <-chan *types.Transaction) {
+	for updates != nil || txs != nil {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			s.publishUpdate(u)
+		case tx, ok := <-txs:
+			if !ok {
+				txs = nil
+				continue
+			}
+			s.publishPending(tx)
+		}
+	}
+}
+
+// headView returns the view of b without its transactions.
+func headView(b *types.Block, confirmations uint64) *Block {
+	view := newBlock(b, confirmations)
+	view.Transactions = nil
+	return view
+}
+
+func (s *Server) publishUpdate(u *blockchain.ChainUpdate) {
+	if len(u.Disconnect) > 0 {
+		s.hub.publish(TopicReorgs, nil, func() any {
+			ev := reorgEvent{CommonAncestor: u.Disconnect[len(u.Disconnect)-1].Header.PrevBlockHash}
+			for _, b := range u.Disconnect {
+				ev.Disconnected = append(ev.Disconnected, headView(b, 0))
+			}
+			for i, b := range u.Connect {
+				ev.Connected = append(ev.Connected, headView(b, uint64(len(u.Connect)-i)))
+			}
+			return ev
+		})
+	}
+	for i, b := range u.Connect {
+		s.hub.publish(TopicNewHeads, nil, func() any {
+			return headView(b, uint64(len(u.Connect)-i))
+		})
+	}
+
+	for _, b := range u.Disconnect {
+		s.publishActivity(b, activityReverted, 0)
+	}
+	for i, b := range u.Connect {
+		s.publishActivity(b, activityConfirmed, uint64(len(u.Connect)-i))
+	}
+}
+
+// publishActivity notifies the address subscribers of the transactions in b.
+func (s *Server) publishActivity(b *types.Block, status string, confirmations uint64) {
+	for _, tx := range b.Transactions {
+		s.hub.publish(TopicAddressActivity, involves(tx), func() any {
+			view := newTransaction(tx)
+			if status != activityReverted {
+				view.BlockHash = &b.Hash
+				view.BlockHeight = &b.Header.Height
+				view.Confirmations = confirmations
+			}
+			return addressActivity{Status: status, Tx: view}
+		})
+	}
+}
+
+func (s *Server) publishPending(tx *types.Transaction) {
+	s.hub.publish(TopicPendingTxs, nil, func() any {
+		return newTransaction(tx)
+	})
+	s.hub.publish(TopicAddressActivity, involves(tx), func() any {
+		return addressActivity{Status: activityPending, Tx: newTransaction(tx)}
+	})
+}
+
+// involves matches the address subscriptions that tx sends from or to.
+func involves(tx *types.Transaction) func(*subscription) bool {
+	return func(sub *subscription) bool {
+		return sub.address == tx.To || (tx.Type != types.TxTypeCoinbase && sub.address == tx.From)
+	}
+}
+
+// GET /ws
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, MaxRequestSize)
+	if err != nil {
+		return
+	}
+	c := newWSClient(conn)
+	s.hub.add(c)
+	defer s.hub.remove(c)
+	go c.writeLoop()
+
+	ctx := context.WithValue(r.Context(), clientKey{}, c)
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			c.drop(closeNormal, "")
+			return
+		}
+		resp := s.methods.serve(ctx, msg)
+		if resp == nil {
+			continue
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("RPC: encode response: %v", err)
+			continue
+		}
+		if !c.queue(data) {
+			return
+		}
+	}
+}
+
+// clientKey is the context key of the WebSocket client making a call.
+type clientKey struct{}
+
+// wsClientFrom returns the WebSocket client making a call.
+func wsClientFrom(ctx context.Context) (*wsClient, error) {
+	c, ok := ctx.Value(clientKey{}).(*wsClient)
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "subscriptions are only available over WebSocket"}
+	}
+	return c, nil
+}
+
+type subscribeParams struct {
+	Topic   string `json:"topic"`
+	Address string `json:"address"` // For addressActivity.
+}
+
+// subscribe [topic, address] subscribes the calling WebSocket client to a
+// topic and returns the subscription ID.
+func (s *Server) subscribe(ctx context.Context, p subscribeParams) (any, error) {
+	c, err := wsClientFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{topic: p.Topic}
+	switch p.Topic {
+	case TopicNewHeads, TopicReorgs, TopicPendingTxs:
+		if p.Address != "" {
+			return nil, invalidParams("%s takes no address", p.Topic)
+		}
+	case TopicAddressActivity:
+		if sub.address, err = parseHash("address", p.Address); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, invalidParams("unknown topic %q", p.Topic)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.subs) >= MaxSubscriptions {
+		return nil, invalidParams("at most %d subscriptions per connection", MaxSubscriptions)
+	}
+	c.nextID++
+	sub.id = strconv.FormatUint(c.nextID, 10)
+	c.subs[sub.id] = sub
+	return sub.id, nil
+}
+
+type unsubscribeParams struct {
+	Subscription string `json:"subscription"`
+}
+
+// unsubscribe [subscription] cancels a subscription of the calling
+// WebSocket client. It returns false if there was no such subscription.
+func (s *Server) unsubscribe(ctx context.Context, p unsubscribeParams) (any, error) {
+	c, err := wsClientFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.subs[p.Subscription]
+	delete(c.subs, p.Subscription)
+	return ok, nil
+}
@@ -0,0 +1,366 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/chronodrachma/chrd/pkg/simnet"
+)
+
+// testWSClient is the client side of a WebSocket connection.
+type testWSClient struct {
+	t      *testing.T
+	conn   net.Conn
+	br     *bufio.Reader
+	nextID int
+}
+
+func dialWS(t *testing.T, url string) *testWSClient {
+	t.Helper()
+	ws, resp := handshakeWS(t, url, "")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return ws
+}
+
+// handshakeWS sends an opening handshake to host "node", with an Origin
+// header unless origin is empty, and returns the response.
+func handshakeWS(t *testing.T, url, origin string) (*testWSClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if origin != "" {
+		origin = "Origin: " + origin + "\r\n"
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: node\r\n%sUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", origin, key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testWSClient{t: t, conn: conn, br: br}, resp
+}
+
+// writeFrame writes a masked frame.
+func (c *testWSClient) writeFrame(op byte, fin bool, payload []byte) {
+	hdr := []byte{op, 0x80}
+	if fin {
+		hdr[0] |= 0x80
+	}
+	if n := len(payload); n <= 125 {
+		hdr[1] |= byte(n)
+	} else {
+		hdr[1] |= 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	hdr = append(hdr, mask[:]...)
+	for i, b := range payload {
+		hdr = append(hdr, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(hdr); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readFrame reads an unmasked frame.
+func (c *testWSClient) readFrame() (byte, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(simnet.WaitTimeout))
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		c.t.Fatalf("read frame: %v", err)
+	}
+	n := int(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatalf("read frame: %v", err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+// call sends a request and returns its result, failing on an error.
+func (c *testWSClient) call(method string, params ...any) json.RawMessage {
+	c.t.Helper()
+	c.nextID++
+	req, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": method, "params": params, "id": c.nextID})
+	c.writeFrame(opText, true, req)
+	var resp response
+	if err := json.Unmarshal(c.next(), &resp); err != nil || resp.Error != nil {
+		c.t.Fatalf("%s: %s, %v", method, resp.Error, err)
+	}
+	return resp.Result
+}
+
+// next returns the next message.
+func (c *testWSClient) next() []byte {
+	c.t.Helper()
+	op, payload := c.readFrame()
+	if op != opText {
+		c.t.Fatalf("got opcode %#x, want text", op)
+	}
+	return payload
+}
+
+// testNotification is a decoded subscription notification.
+type testNotification struct {
+	Subscription string          `json:"subscription"`
+	Topic        string          `json:"topic"`
+	Result       json.RawMessage `json:"result"`
+}
+
+func (c *testWSClient) notification() testNotification {
+	c.t.Helper()
+	var msg struct {
+		Method string           `json:"method"`
+		Params testNotification `json:"params"`
+	}
+	if err := json.Unmarshal(c.next(), &msg); err != nil || msg.Method != "subscription" {
+		c.t.Fatalf("notification %+v: %v", msg, err)
+	}
+	return msg.Params
+}
+
+func TestSubscriptions(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw := simnet.New(t, 2)
+	a, b := nw.Nodes[0], nw.Nodes[1]
+	copy(a.Miner[:], pub)
+	a.Mine(int(blockchain.CoinbaseMaturity) + 1)
+
+	s := NewServer(a.Chain, a.Mempool, a.Server)
+	defer s.Close()
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	ws := dialWS(t, srv.URL)
+
+	var heads, reorgs, pending, activity string
+	json.Unmarshal(ws.call("subscribe", TopicNewHeads), &heads)
+	json.Unmarshal(ws.call("subscribe", TopicReorgs), &reorgs)
+	json.Unmarshal(ws.call("subscribe", TopicPendingTxs), &pending)
+	json.Unmarshal(ws.call("subscribe", TopicAddressActivity, types.Hash{0x0D}.Hex()), &activity)
+
+	// Ordinary methods work over the socket too.
+	var height uint64
+	if json.Unmarshal(ws.call("getblockcount"), &height); height != blockchain.CoinbaseMaturity+1 {
+		t.Fatalf("getblockcount = %d", height)
+	}
+
+	// A transfer to the watched address is reported pending, then confirmed.
+	tx := &types.Transaction{Type: types.TxTypeTransfer, Timestamp: time.Now(), To: types.Hash{0x0D}, Amount: 10, Fee: 1}
+	copy(tx.From[:], pub)
+	tx.Signature = ed25519.Sign(key, tx.Serialize())
+	tx.ID = tx.ComputeID()
+	if err := a.Mempool.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	n := ws.notification()
+	var view Transaction
+	if json.Unmarshal(n.Result, &view); n.Subscription != pending || view.ID != tx.ID {
+		t.Fatalf("pending notification %+v", n)
+	}
+	var act addressActivity
+	if n = ws.notification(); json.Unmarshal(n.Result, &act) != nil || n.Subscription != activity || act.Status != activityPending {
+		t.Fatalf("activity notification %s", n.Result)
+	}
+
+	mined := a.Mine(1)[0]
+	var head Block
+	if n = ws.notification(); json.Unmarshal(n.Result, &head) != nil || n.Subscription != heads || head.Hash != mined.Hash || head.Transactions != nil {
+		t.Fatalf("head notification %s", n.Result)
+	}
+	if n = ws.notification(); json.Unmarshal(n.Result, &act) != nil || act.Status != activityConfirmed || *act.Tx.BlockHash != mined.Hash {
+		t.Fatalf("activity notification %s", n.Result)
+	}
+
+	// Node b mines a heavier chain from the common ancestor; once
+	// connected, a reorganizes onto it.
+	ws.call("unsubscribe", activity)
+	nw.Connect(a, b)
+	nw.WaitConverged()
+	nw.Partition([]*simnet.Node{a}, []*simnet.Node{b})
+	orphaned := a.Mine(1)[0]
+	ws.notification()
+	heavier := b.Mine(2)
+	nw.Heal()
+	nw.WaitConverged()
+
+	var reorg reorgEvent
+	if n = ws.notification(); json.Unmarshal(n.Result, &reorg) != nil || n.Subscription != reorgs {
+		t.Fatalf("reorg notification %s", n.Result)
+	}
+	if len(reorg.Disconnected) != 1 || reorg.Disconnected[0].Hash != orphaned.Hash ||
+		len(reorg.Connected) != 2 || reorg.Connected[1].Hash != heavier[1].Hash || reorg.CommonAncestor != mined.Hash {
+		t.Fatalf("reorg %+v", reorg)
+	}
+	for _, want := range heavier {
+		if n = ws.notification(); json.Unmarshal(n.Result, &head) != nil || head.Hash != want.Hash {
+			t.Fatalf("head notification %s, want %x", n.Result, want.Hash[:8])
+		}
+	}
+
+	// Closing the server disconnects the client with "going away".
+	s.Close()
+	if op, payload := ws.readFrame(); op != opClose || binary.BigEndian.Uint16(payload) != closeGoingAway {
+		t.Errorf("got opcode %#x %q, want close", op, payload)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	s := &Server{methods: NewRegistry(), hub: newHub()}
+	s.Register("echo", Method(func(ctx context.Context, p struct{ S string }) (any, error) {
+		return p.S, nil
+	}))
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	ws := dialWS(t, srv.URL)
+
+	// Pings are answered in between the fragments of a message.
+	req := []byte(`{"jsonrpc":"2.0","method":"echo","params":["hi"],"id":1}`)
+	ws.writeFrame(opText, false, req[:10])
+	ws.writeFrame(opPing, true, []byte("are you there"))
+	ws.writeFrame(opContinuation, true, req[10:])
+	if op, payload := ws.readFrame(); op != opPong || string(payload) != "are you there" {
+		t.Fatalf("got opcode %#x %q, want pong", op, payload)
+	}
+	if got := string(ws.next()); got != `{"jsonrpc":"2.0","result":"hi","id":1}` {
+		t.Fatalf("response %s", got)
+	}
+
+	// Unmasked frames break the protocol.
+	ws.conn.Write([]byte{0x80 | opText, 2, '{', '}'})
+	if op, payload := ws.readFrame(); op != opClose || binary.BigEndian.Uint16(payload) != closeProtocolError {
+		t.Errorf("got opcode %#x %q, want close", op, payload)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := &Server{methods: NewRegistry(), hub: newHub()}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://node", http.StatusSwitchingProtocols},
+		{"https://NODE", http.StatusSwitchingProtocols},
+		{"http://evil.example", http.StatusForbidden},
+		{"http://node.evil.example", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	} {
+		if _, resp := handshakeWS(t, srv.URL, tt.origin); resp.StatusCode != tt.want {
+			t.Errorf("origin %q: %s, want %d", tt.origin, resp.Status, tt.want)
+		}
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &wsConn{conn: server, br: bufio.NewReader(server), maxMessage: MaxRequestSize, idleTimeout: 200 * time.Millisecond}
+	c := newWSClient(conn)
+	c.pingInterval = 50 * time.Millisecond
+	go c.writeLoop()
+	defer c.drop(closeNormal, "")
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		read <- err
+	}()
+
+	// The client answers pings, which keeps it connected past the idle
+	// timeout.
+	ws := &testWSClient{t: t, conn: client, br: bufio.NewReader(client)}
+	deadline := time.Now().Add(2 * conn.idleTimeout)
+	for time.Now().Before(deadline) {
+		if op, _ := ws.readFrame(); op != opPing {
+			t.Fatalf("got opcode %#x, want ping", op)
+		}
+		ws.writeFrame(opPong, true, nil)
+	}
+	select {
+	case err := <-read:
+		t.Fatalf("read ended while the client answered pings: %v", err)
+	default:
+	}
+
+	// Once it falls silent, the read times out.
+	go io.Copy(io.Discard, client)
+	select {
+	case err := <-read:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("read error %v, want timeout", err)
+		}
+	case <-time.After(simnet.WaitTimeout):
+		t.Fatal("silent client was not timed out")
+	}
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	c := newWSClient(nil)
+	c.subs["1"] = &subscription{id: "1", topic: TopicPendingTxs}
+	h := newHub()
+	h.add(c)
+
+	// Nothing drains the queue, so the client is dropped once it is full;
+	// publishing never blocks.
+	for i := 0; i <= ClientQueueSize; i++ {
+		h.publish(TopicPendingTxs, nil, func() any { return i })
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("slow client was not dropped")
+	}
+	if c.dropCode != closeTryAgainLater {
+		t.Errorf("dropped with code %d, want %d", c.dropCode, closeTryAgainLater)
+	}
+}
+
+func TestSubscribeOverHTTP(t *testing.T) {
+	s := &Server{methods: NewRegistry()}
+	s.registerMethods()
+	srv := httptest.NewServer(s.methods)
+	defer srv.Close()
+
+	var resp response
+	post(t, srv.URL, `{"jsonrpc":"2.0","method":"subscribe","params":["newHeads"],"id":1}`, &resp)
+	if resp.Error == nil || resp.Error.Code != CodeMethodNotFound {
+		t.Errorf("subscribe over HTTP: %+v, want method not found", resp.Error)
+	}
+}
@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+// The types in this file are the JSON shapes of blocks and transactions
+// returned by every endpoint, REST and JSON-RPC alike. Hashes are hex,
+// amounts decimal CHRD, and times both RFC 3339 and Unix seconds.
+
+// Amount is a CHRD amount, encoded as a decimal string with eight places,
+// such as "1.50000000", so that clients never round it through a float.
+type Amount types.Amount
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(types.Amount(a).String())
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := types.ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = Amount(v)
+	return nil
+}
+
+// Block is the view of a block.
+type Block struct {
+	Hash          types.Hash    `json:"hash"`
+	Height        uint64        `json:"height"`
+	Confirmations uint64        `json:"confirmations"` // 0 if not on the main chain.
+	Version       uint32        `json:"version"`
+	PrevBlockHash types.Hash    `json:"prev_block_hash"`
+	MerkleRoot    types.Hash    `json:"merkle_root"`
+	PowHash       types.Hash    `json:"pow_hash"`
+	Bits          uint32        `json:"bits"`
+	Nonce         uint64        `json:"nonce"`
+	Time          string        `json:"time"`      // RFC 3339
+	Timestamp     int64         `json:"timestamp"` // Unix timestamp
+	Size          int           `json:"size"`      // Bytes in the binary encoding.
+	Fees          Amount        `json:"fees"`
+	TxCount       int           `json:"tx_count"`
+	Transactions  []Transaction `json:"transactions,omitempty"` // Left out of notifications.
+}
+
+// Transaction is the view of a transaction. The block fields are unset for
+// pending transactions.
+type Transaction struct {
+	ID            types.Hash  `json:"id"`
+	Type          string      `json:"type"` // "coinbase" or "transfer"
+	From          types.Hash  `json:"from"` // Zero for coinbase.
+	To            types.Hash  `json:"to"`
+	Amount        Amount      `json:"amount"`
+	Fee           Amount      `json:"fee"`
+	Nonce         uint64      `json:"nonce"`
+	Signature     string      `json:"signature,omitempty"` // Hex
+	Time          string      `json:"time"`                // RFC 3339
+	Timestamp     int64       `json:"timestamp"`           // Unix timestamp
+	Size          int         `json:"size"`                // Bytes in the binary encoding.
+	BlockHash     *types.Hash `json:"block_hash,omitempty"`
+	BlockHeight   *uint64     `json:"block_height,omitempty"`
+	Confirmations uint64      `json:"confirmations"`
+}
+
+// txTypeNames names transaction types in views.
+var txTypeNames = map[types.TxType]string{
+	types.TxTypeCoinbase: "coinbase",
+	types.TxTypeTransfer: "transfer",
+}
+
+// newTransaction returns the view of a pending transaction.
+func newTransaction(tx *types.Transaction) Transaction {
+	size := 0
+	if data, err := tx.MarshalBinary(); err == nil {
+		size = len(data)
+	}
+	name, ok := txTypeNames[tx.Type]
+	if !ok {
+		name = "unknown"
+	}
+	return Transaction{
+		ID:        tx.ID,
+		Type:      name,
+		From:      tx.From,
+		To:        tx.To,
+		Amount:    Amount(tx.Amount),
+		Fee:       Amount(tx.Fee),
+		Nonce:     tx.Nonce,
+		Signature: hex.EncodeToString(tx.Signature),
+		Time:      tx.Timestamp.UTC().Format(time.RFC3339),
+		Timestamp: tx.Timestamp.Unix(),
+		Size:      size,
+	}
+}
+
+// newTransactions returns the views of pending transactions.
+func newTransactions(txs []*types.Transaction) []Transaction {
+	views := make([]Transaction, 0, len(txs))
+	for _, tx := range txs {
+		views = append(views, newTransaction(tx))
+	}
+	return views
+}
+
+// newBlock returns the view of b, which has the given number of
+// confirmations.
+func newBlock(b *types.Block, confirmations uint64) *Block {
+	size := 0
+	if data, err := b.MarshalBinary(); err == nil {
+		size = len(data)
+	}
+	view := &Block{
+		Hash:          b.Hash,
+		Height:        b.Header.Height,
+		Confirmations: confirmations,
+		Version:       b.Header.Version,
+		PrevBlockHash: b.Header.PrevBlockHash,
+		MerkleRoot:    b.Header.MerkleRoot,
+		PowHash:       b.PowHash,
+		Bits:          b.Header.Bits,
+		Nonce:         b.Header.Nonce,
+		Time:          b.Header.Timestamp.UTC().Format(time.RFC3339),
+		Timestamp:     b.Header.Timestamp.Unix(),
+		Size:          size,
+		TxCount:       len(b.Transactions),
+		Transactions:  make([]Transaction, 0, len(b.Transactions)),
+	}
+	for _, tx := range b.Transactions {
+		if tx.Type != types.TxTypeCoinbase {
+			view.Fees += Amount(tx.Fee)
+		}
+		txView := newTransaction(tx)
+		txView.BlockHash = &view.Hash
+		txView.BlockHeight = &view.Height
+		txView.Confirmations = confirmations
+		view.Transactions = append(view.Transactions, txView)
+	}
+	return view
+}
+
+// blockView returns the view of b, counting its confirmations against the
+// current main chain.
+func (s *Server) blockView(b *types.Block) *Block {
+	var confirmations uint64
+	if tip := s.chain.Tip(); tip != nil && b.Header.Height <= tip.Header.Height {
+		if main, err := s.chain.GetBlockByHeight(b.Header.Height); err == nil && main.Hash == b.Hash {
+			confirmations = tip.Header.Height - b.Header.Height + 1
+		}
+	}
+	return newBlock(b, confirmations)
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/core/types"
+)
+
+func TestBlockViewJSON(t *testing.T) {
+	ts := time.Unix(1_700_000_000, 0)
+	coinbase := &types.Transaction{Type: types.TxTypeCoinbase, Timestamp: ts, To: types.Hash{0x01}, Amount: types.BlockReward + 3}
+	coinbase.ID = coinbase.ComputeID()
+	transfer := &types.Transaction{Type: types.TxTypeTransfer, Timestamp: ts, From: types.Hash{0x02}, To: types.Hash{0x03}, Amount: 150_000_000, Fee: 3, Signature: []byte{0xAB, 0xCD}}
+	transfer.ID = transfer.ComputeID()
+	b := &types.Block{
+		Header:       types.BlockHeader{Version: 1, Height: 7, Timestamp: ts},
+		Transactions: []*types.Transaction{coinbase, transfer},
+		PowHash:      types.Hash{0xFF},
+	}
+	b.Hash = b.Header.ComputeHash()
+
+	data, err := json.Marshal(newBlock(b, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"hash":          b.Hash.Hex(),
+		"pow_hash":      types.Hash{0xFF}.Hex(),
+		"confirmations": 2.0,
+		"fees":          "0.00000003",
+		"time":          "2023-11-14T22:13:20Z",
+		"timestamp":     1_700_000_000.0,
+		"tx_count":      2.0,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+
+	tx := got["transactions"].([]any)[1].(map[string]any)
+	for key, want := range map[string]any{
+		"id":           transfer.ID.Hex(),
+		"type":         "transfer",
+		"amount":       "1.50000000",
+		"signature":    "abcd",
+		"block_hash":   b.Hash.Hex(),
+		"block_height": 7.0,
+	} {
+		if tx[key] != want {
+			t.Errorf("transaction %s = %v, want %v", key, tx[key], want)
+		}
+	}
+
+	// Views decode back to the same values.
+	var view Block
+	if err := json.Unmarshal(data, &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Hash != b.Hash || view.Transactions[1].Amount != 150_000_000 {
+		t.Errorf("decoded %+v", view)
+	}
+}
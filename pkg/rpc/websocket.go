@@ -0,0 +1,301 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the server side of the WebSocket protocol (RFC 6455),
+// as much of it as the subscription endpoint needs: no extensions and no
+// subprotocols.
+
+// websocketGUID is appended to the client's key to compute the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// WebSocket close codes.
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+	closeTryAgainLater = 1013
+)
+
+var (
+	errNotWebSocket = errors.New("not a websocket handshake")
+	errWSClosed     = errors.New("websocket closed by peer")
+)
+
+// wsError is a protocol violation by the client, closed with code.
+type wsError struct {
+	code int
+	msg  string
+}
+
+func (e *wsError) Error() string { return e.msg }
+
+// wsConn is a server-side WebSocket connection. Reads happen on one
+// goroutine; writes may come from several.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// maxMessage bounds the size of a (reassembled) message.
+	maxMessage int
+
+	// idleTimeout is how long a read may wait for the next frame.
+	idleTimeout time.Duration
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// headerContains reports whether the comma-separated header field contains
+// token, ignoring case.
+func headerContains(h http.Header, field, token string) bool {
+	for _, v := range h.Values(field) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptKey computes Sec-WebSocket-Accept for a client key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// sameOrigin reports whether a handshake comes from a page served by this
+// host, or from a client that is not a browser and sends no Origin. Browsers
+// let any page open a WebSocket to any host, so without this check a web
+// page could drive the node through its visitor's browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. Cross-origin handshakes are refused. On failure it has
+// already written the HTTP error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+		return nil, errNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errNotWebSocket
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin websocket not allowed", http.StatusForbidden)
+		return nil, errNotWebSocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errNotWebSocket
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack: %w", err)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return &wsConn{conn: conn, br: brw.Reader, maxMessage: maxMessage, idleTimeout: IdleTimeout}, nil
+}
+
+// readFrame reads one frame, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0F
+	if hdr[0]&0x70 != 0 {
+		return fin, op, nil, &wsError{closeProtocolError, "reserved bits set"}
+	}
+	if hdr[1]&0x80 == 0 {
+		return fin, op, nil, &wsError{closeProtocolError, "client frame not masked"}
+	}
+
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (n > 125 || !fin) {
+		return fin, op, nil, &wsError{closeProtocolError, "invalid control frame"}
+	}
+	if n > uint64(c.maxMessage) {
+		return fin, op, nil, &wsError{closeTooBig, "frame too large"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings
+// and reassembling fragments. It returns errWSClosed once the client
+// closes the connection, and a timeout error if the client sends nothing,
+// not even a pong, for idleTimeout.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		if c.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var wsErr *wsError
+			if errors.As(err, &wsErr) {
+				c.Close(wsErr.code, wsErr.msg)
+			}
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.Close(closeNormal, "")
+			return nil, errWSClosed
+		case opText, opBinary:
+			if started {
+				c.Close(closeProtocolError, "expected continuation frame")
+				return nil, &wsError{closeProtocolError, "expected continuation frame"}
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				c.Close(closeProtocolError, "unexpected continuation frame")
+				return nil, &wsError{closeProtocolError, "unexpected continuation frame"}
+			}
+		default:
+			c.Close(closeProtocolError, "unknown opcode")
+			return nil, &wsError{closeProtocolError, fmt.Sprintf("unknown opcode %#x", op)}
+		}
+
+		if len(msg)+len(payload) > c.maxMessage {
+			c.Close(closeTooBig, "message too large")
+			return nil, &wsError{closeTooBig, "message too large"}
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// writeFrame writes a single unmasked, final frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	hdr := make([]byte, 0, 10)
+	hdr = append(hdr, 0x80|op)
+	switch n := len(payload); {
+	case n <= 125:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText writes a text message.
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Close sends a close frame with the given code and closes the connection.
+// Only the first call has an effect.
+func (c *wsConn) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		c.writeFrame(opClose, append(payload, reason...))
+		c.conn.Close()
+	})
+}
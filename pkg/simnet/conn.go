@@ -0,0 +1,203 @@
+package simnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// addr is the address of a node or connection end on the simulated network.
+type addr string
+
+func (a addr) Network() string { return "simnet" }
+func (a addr) String() string  { return string(a) }
+
+// segment is a write in flight, readable from at.
+type segment struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe is one direction of a connection. Writes never block: they are
+// queued and become readable once their latency has passed, in order.
+type pipe struct {
+	mu     sync.Mutex
+	queue  []segment
+	closed bool          // No more data will be written.
+	wake   chan struct{} // Closed and replaced whenever the pipe changes.
+}
+
+func newPipe() *pipe {
+	return &pipe{wake: make(chan struct{})}
+}
+
+// signal wakes blocked readers. p.mu must be held.
+func (p *pipe) signal() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *pipe) write(b []byte, latency time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+	at := time.Now().Add(latency)
+	if n := len(p.queue); n > 0 && at.Before(p.queue[n-1].at) {
+		at = p.queue[n-1].at // Latency changes must not reorder the stream.
+	}
+	p.queue = append(p.queue, segment{data: append([]byte(nil), b...), at: at})
+	p.signal()
+	return nil
+}
+
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.signal()
+	}
+}
+
+// conn is one end of a simulated connection.
+type conn struct {
+	local, remote addr
+	r, w          *pipe
+
+	// latency returns the current one-way delay of the link.
+	latency func() time.Duration
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newConnPair returns the two ends of a connection between a and b.
+func newConnPair(a, b addr, latency func() time.Duration) (*conn, *conn) {
+	ab, ba := newPipe(), newPipe()
+	ca := &conn{local: a, remote: b, r: ba, w: ab, latency: latency, done: make(chan struct{})}
+	cb := &conn{local: b, remote: a, r: ab, w: ba, latency: latency, done: make(chan struct{})}
+	return ca, cb
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		p := c.r
+		p.mu.Lock()
+		var wait time.Duration = -1
+		if len(p.queue) > 0 {
+			seg := &p.queue[0]
+			if wait = time.Until(seg.at); wait <= 0 {
+				n := copy(b, seg.data)
+				if seg.data = seg.data[n:]; len(seg.data) == 0 {
+					p.queue = p.queue[1:]
+				}
+				p.mu.Unlock()
+				return n, nil
+			}
+		} else if p.closed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() {
+			until := time.Until(deadline)
+			if until <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			if wait < 0 || until < wait {
+				wait = until
+			}
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-wake:
+		case <-timeout:
+		case <-c.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := c.w.write(b, c.latency()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes both directions: the other end reads what was already sent
+// and then io.EOF, and its writes fail.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.r.close()
+		c.w.close()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	// Wake a blocked Read so it sees the new deadline.
+	c.r.mu.Lock()
+	c.r.signal()
+	c.r.mu.Unlock()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,49 @@
+package simnet
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnLatencyAndClose(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	a, b := newConnPair("10.0.0.1:50000", "10.0.0.2:7000", func() time.Duration { return latency })
+
+	start := time.Now()
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if n, err := io.ReadFull(b, buf); err != nil || string(buf[:n]) != "hel" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("data arrived after %v, latency is %v", elapsed, latency)
+	}
+
+	// Deadlines interrupt a read waiting for data.
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Read(buf); err != nil {
+		t.Fatalf("buffered read failed: %v", err)
+	}
+	if _, err := b.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v, want ErrDeadlineExceeded", err)
+	}
+	b.SetReadDeadline(time.Time{})
+
+	// Data sent before Close is still delivered, then io.EOF.
+	a.Write([]byte("bye"))
+	a.Close()
+	if n, err := io.ReadFull(b, buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("read %q, %v after close", buf[:n], err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Errorf("read after close: %v, want io.EOF", err)
+	}
+	if _, err := b.Write(buf); err == nil {
+		t.Error("write to a closed connection succeeded")
+	}
+}
@@ -0,0 +1,518 @@
+// Package simnet runs several nodes in one process, connected by an
+// in-memory network, for testing sync, gossip and fork choice without
+// starting chrd processes. Each node has an in-memory BadgerStore, the
+// SHA256Hasher and a real p2p.Server; tests cut and heal links, add latency,
+// mine blocks deterministically and wait for the nodes to agree on a tip.
+//
+//	net := simnet.New(t, 3)
+//	net.ConnectAll()
+//	net.Nodes[0].Mine(5)
+//	net.WaitConverged()
+package simnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronodrachma/chrd/pkg/config"
+	"github.com/chronodrachma/chrd/pkg/core/blockchain"
+	"github.com/chronodrachma/chrd/pkg/core/consensus"
+	"github.com/chronodrachma/chrd/pkg/core/mempool"
+	"github.com/chronodrachma/chrd/pkg/core/types"
+	"github.com/chronodrachma/chrd/pkg/p2p"
+)
+
+const (
+	// Port is the port every node listens on.
+	Port = 7000
+
+	// WaitTimeout bounds WaitConverged and the wait for connections.
+	WaitTimeout = 10 * time.Second
+)
+
+var (
+	// GenesisTime is the timestamp of the shared genesis block. Blocks are
+	// mined consensus.TargetBlockTime apart from it, so it is far enough in
+	// the past for long chains not to run into the present.
+	GenesisTime = time.Unix(1_700_000_000, 0)
+
+	// NetworkConfig identifies the simulated network in handshakes.
+	NetworkConfig = config.NetworkConfig{Name: "simnet", Magic: [4]byte{'S', 'I', 'M', 'N'}}
+)
+
+var (
+	errRefused = errors.New("connection refused")
+	errNoRoute = errors.New("no route to host")
+)
+
+// Network is a set of nodes and the links between them. Nodes can only
+// connect to each other over a link, made by Connect, so tests control the
+// topology even though the nodes exchange addresses.
+type Network struct {
+	Nodes []*Node
+
+	t testing.TB
+
+	mu        sync.Mutex
+	listeners map[addr]*listener
+	links     map[linkKey]*link
+	nextPort  int // For the local end of dialled connections.
+}
+
+// Node is one simulated node.
+type Node struct {
+	Index   int
+	Addr    string     // Listen address, host:Port.
+	Miner   types.Hash // Coinbase address of the blocks it mines.
+	Chain   *blockchain.Chain
+	Mempool *mempool.Mempool
+	Server  *p2p.Server
+
+	net    *Network
+	store  *blockchain.BadgerStore
+	hasher *consensus.SHA256Hasher
+}
+
+// linkKey names the link between two hosts, in sorted order.
+type linkKey struct{ a, b string }
+
+func newLinkKey(a, b string) linkKey {
+	if a > b {
+		a, b = b, a
+	}
+	return linkKey{a, b}
+}
+
+// link is a network path between two nodes. Connections can be made over
+// it once Connect has linked the nodes, unless Partition has cut it.
+type link struct {
+	from, to *Node // Who dialled whom, to reconnect on Heal.
+	latency  time.Duration
+	linked   bool
+	cut      bool
+	conns    []*conn
+}
+
+// New starts n nodes sharing a genesis block, with no links between them.
+// They are stopped when the test ends.
+func New(t testing.TB, n int) *Network {
+	t.Helper()
+	nw := &Network{
+		t:         t,
+		listeners: make(map[addr]*listener),
+		links:     make(map[linkKey]*link),
+		nextPort:  50000,
+	}
+	t.Cleanup(nw.stop)
+	for i := 0; i < n; i++ {
+		nw.Nodes = append(nw.Nodes, nw.newNode(i))
+	}
+	return nw
+}
+
+func (nw *Network) newNode(i int) *Node {
+	t := nw.t
+	t.Helper()
+	hasher := consensus.NewSHA256Hasher()
+	store, err := blockchain.NewBadgerStore("")
+	if err != nil {
+		t.Fatalf("node %d: create store: %v", i, err)
+	}
+	chain, err := blockchain.NewChain(store, hasher)
+	if err != nil {
+		t.Fatalf("node %d: create chain: %v", i, err)
+	}
+	if _, err := chain.InitGenesis(config.GenesisMinerAddress, 1, GenesisTime); err != nil {
+		t.Fatalf("node %d: init genesis: %v", i, err)
+	}
+	mp := mempool.NewMempool(chain)
+	chain.SetMempool(mp)
+
+	node := &Node{
+		Index:   i,
+		Addr:    net.JoinHostPort(fmt.Sprintf("10.0.%d.%d", (i+1)/256, (i+1)%256), strconv.Itoa(Port)),
+		Miner:   types.Hash{0x5E, byte(i >> 8), byte(i)},
+		Chain:   chain,
+		Mempool: mp,
+		net:     nw,
+		store:   store,
+		hasher:  hasher,
+	}
+	node.Server = p2p.NewServer(p2p.ServerConfig{
+		ListenAddr: node.Addr,
+		Network:    NetworkConfig,
+		Transport:  &transport{net: nw, node: node},
+	}, chain, mp)
+	if err := node.Server.Start(); err != nil {
+		t.Fatalf("node %d: start server: %v", i, err)
+	}
+	return node
+}
+
+func (nw *Network) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	for _, node := range nw.Nodes {
+		if err := node.Server.Stop(ctx); err != nil {
+			nw.t.Errorf("node %d: stop: %v", node.Index, err)
+		}
+	}
+	for _, node := range nw.Nodes {
+		node.store.Close()
+		node.hasher.Close()
+	}
+}
+
+// Connect links a to b and has a dial b, waiting for the handshake.
+func (nw *Network) Connect(a, b *Node) {
+	nw.t.Helper()
+	nw.mu.Lock()
+	key := newLinkKey(a.Addr, b.Addr)
+	l, ok := nw.links[key]
+	if !ok {
+		l = &link{from: a, to: b}
+		nw.links[key] = l
+	}
+	l.linked = true
+	nw.mu.Unlock()
+
+	nw.dial(a, b)
+}
+
+// ConnectAll links every pair of nodes.
+func (nw *Network) ConnectAll() {
+	nw.t.Helper()
+	for i, a := range nw.Nodes {
+		for _, b := range nw.Nodes[i+1:] {
+			nw.Connect(a, b)
+		}
+	}
+}
+
+// dial has a connect to b unless they are connected already, and waits for
+// the handshake.
+func (nw *Network) dial(a, b *Node) {
+	nw.t.Helper()
+	if !a.ConnectedTo(b) {
+		a.Server.Connect(b.Addr)
+	}
+	nw.waitFor(fmt.Sprintf("node %d to connect to node %d", a.Index, b.Index), func() bool {
+		return a.ConnectedTo(b) && b.ConnectedTo(a)
+	})
+}
+
+// Partition cuts every link between nodes of different groups, closing its
+// connections, and waits for the nodes to notice. Nodes in no group form
+// one more group.
+func (nw *Network) Partition(groups ...[]*Node) {
+	nw.t.Helper()
+	group := make(map[string]int)
+	for i, g := range groups {
+		for _, node := range g {
+			group[node.Addr] = i + 1
+		}
+	}
+
+	nw.mu.Lock()
+	var cut []*link
+	var conns []*conn
+	for _, l := range nw.links {
+		if !l.linked || l.cut || group[l.from.Addr] == group[l.to.Addr] {
+			continue
+		}
+		l.cut = true
+		cut = append(cut, l)
+		conns = append(conns, l.conns...)
+		l.conns = nil
+	}
+	nw.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, l := range cut {
+		nw.waitFor(fmt.Sprintf("node %d to disconnect from node %d", l.from.Index, l.to.Index), func() bool {
+			return !l.from.ConnectedTo(l.to) && !l.to.ConnectedTo(l.from)
+		})
+	}
+}
+
+// Heal restores the links cut by Partition and reconnects their nodes.
+func (nw *Network) Heal() {
+	nw.t.Helper()
+	nw.mu.Lock()
+	var healed []*link
+	for _, l := range nw.links {
+		if l.cut {
+			l.cut = false
+			healed = append(healed, l)
+		}
+	}
+	nw.mu.Unlock()
+
+	for _, l := range healed {
+		nw.dial(l.from, l.to)
+	}
+}
+
+// SetLatency delays everything sent between a and b, in either direction,
+// by d. They need not be linked yet.
+func (nw *Network) SetLatency(a, b *Node, d time.Duration) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	key := newLinkKey(a.Addr, b.Addr)
+	l, ok := nw.links[key]
+	if !ok {
+		l = &link{from: a, to: b}
+		nw.links[key] = l
+	}
+	l.latency = d
+}
+
+// Converged reports whether the nodes (all of them if none are given) have
+// the same tip.
+func (nw *Network) Converged(nodes ...*Node) bool {
+	if len(nodes) == 0 {
+		nodes = nw.Nodes
+	}
+	for _, node := range nodes[1:] {
+		if node.Chain.Tip().Hash != nodes[0].Chain.Tip().Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitConverged waits up to WaitTimeout for the nodes (all of them if none
+// are given) to have the same tip, and returns it. The test fails if they
+// don't.
+func (nw *Network) WaitConverged(nodes ...*Node) *types.Block {
+	nw.t.Helper()
+	if len(nodes) == 0 {
+		nodes = nw.Nodes
+	}
+	deadline := time.Now().Add(WaitTimeout)
+	for !nw.Converged(nodes...) {
+		if time.Now().After(deadline) {
+			var tips []string
+			for _, node := range nodes {
+				tip := node.Chain.Tip()
+				tips = append(tips, fmt.Sprintf("node %d at %d (%x)", node.Index, tip.Header.Height, tip.Hash[:8]))
+			}
+			nw.t.Fatalf("nodes did not converge: %s", strings.Join(tips, ", "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nodes[0].Chain.Tip()
+}
+
+func (nw *Network) waitFor(what string, cond func() bool) {
+	nw.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			nw.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ConnectedTo reports whether the node has completed a handshake with peer.
+func (n *Node) ConnectedTo(peer *Node) bool {
+	host := hostOf(peer.Addr)
+	for _, info := range n.Server.PeerInfo() {
+		if info.Handshaked && hostOf(info.Addr) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Mine extends the node's chain by count blocks and announces them to its
+// peers. Blocks are deterministic: they pay n.Miner, are timestamped
+// consensus.TargetBlockTime after their parent, hold the mempool
+// transactions that are valid next in nonce order, and take the lowest
+// nonce meeting the target.
+func (n *Node) Mine(count int) []*types.Block {
+	t := n.net.t
+	t.Helper()
+	blocks := make([]*types.Block, 0, count)
+	for i := 0; i < count; i++ {
+		block, err := n.newBlock()
+		if err != nil {
+			t.Fatalf("node %d: build block: %v", n.Index, err)
+		}
+		if err := n.Chain.AddBlock(block); err != nil {
+			t.Fatalf("node %d: add block at height %d: %v", n.Index, block.Header.Height, err)
+		}
+		n.Mempool.RemoveTransactions(block.Transactions[1:])
+		n.Server.Broadcast(&p2p.MsgBlock{Block: block})
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// newBlock builds and solves the next block on the node's tip.
+func (n *Node) newBlock() (*types.Block, error) {
+	parent := n.Chain.Tip()
+	height := parent.Header.Height + 1
+	bits, err := consensus.CalcNextRequiredBits(&parent.Header, func(h uint64) (*types.BlockHeader, error) {
+		b, err := n.Chain.GetBlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		return &b.Header, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := n.Mempool.Transactions()
+	pending, fees, err := n.Chain.SelectTransactions(parent, candidates, len(candidates))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := parent.Header.Timestamp.Add(consensus.TargetBlockTime * time.Second)
+	coinbase := &types.Transaction{
+		Type:      types.TxTypeCoinbase,
+		Timestamp: timestamp,
+		To:        n.Miner,
+		Amount:    blockchain.BlockReward(height) + fees,
+		Nonce:     height, // Keeps coinbase IDs unique.
+	}
+	coinbase.ID = coinbase.ComputeID()
+	txs := append([]*types.Transaction{coinbase}, pending...)
+
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			Height:        height,
+			Timestamp:     timestamp,
+			PrevBlockHash: parent.Hash,
+			MerkleRoot:    types.ComputeMerkleRoot(txs),
+			Bits:          bits,
+		},
+		Transactions: txs,
+	}
+	for {
+		powHash, err := n.hasher.Hash(block.Header.Serialize())
+		if err != nil {
+			return nil, err
+		}
+		if consensus.MeetsTarget(powHash, block.Header.Bits) {
+			block.Hash = block.ComputeHash()
+			block.PowHash = powHash
+			return block, nil
+		}
+		block.Header.Nonce++
+	}
+}
+
+func hostOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// transport is a node's p2p.Transport on the simulated network.
+type transport struct {
+	net  *Network
+	node *Node
+}
+
+func (tr *transport) Listen(address string) (net.Listener, error) {
+	nw := tr.net
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	a := addr(address)
+	if _, ok := nw.listeners[a]; ok {
+		return nil, fmt.Errorf("simnet: listen %s: address in use", address)
+	}
+	l := &listener{net: nw, addr: a, conns: make(chan net.Conn, 16), done: make(chan struct{})}
+	nw.listeners[a] = l
+	return l, nil
+}
+
+// Dial connects to address if a link to it is up.
+func (tr *transport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	nw := tr.net
+	nw.mu.Lock()
+	target := nw.listeners[addr(address)]
+	l := nw.links[newLinkKey(tr.node.Addr, address)]
+	if l == nil || !l.linked || l.cut {
+		nw.mu.Unlock()
+		return nil, fmt.Errorf("simnet: dial %s: %w", address, errNoRoute)
+	}
+	if target == nil {
+		nw.mu.Unlock()
+		return nil, fmt.Errorf("simnet: dial %s: %w", address, errRefused)
+	}
+	nw.nextPort++
+	local := addr(net.JoinHostPort(hostOf(tr.node.Addr), strconv.Itoa(nw.nextPort)))
+	latency := func() time.Duration {
+		nw.mu.Lock()
+		defer nw.mu.Unlock()
+		return l.latency
+	}
+	ours, theirs := newConnPair(local, addr(address), latency)
+	live := l.conns[:0]
+	for _, c := range l.conns {
+		select {
+		case <-c.done:
+		default:
+			live = append(live, c)
+		}
+	}
+	l.conns = append(live, ours, theirs)
+	nw.mu.Unlock()
+
+	select {
+	case target.conns <- theirs:
+		return ours, nil
+	case <-target.done:
+	case <-ctx.Done():
+	}
+	ours.Close()
+	theirs.Close()
+	return nil, fmt.Errorf("simnet: dial %s: %w", address, errRefused)
+}
+
+// listener accepts the connections dialled to its address.
+type listener struct {
+	net       *Network
+	addr      addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		delete(l.net.listeners, l.addr)
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return l.addr }
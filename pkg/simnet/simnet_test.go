@@ -0,0 +1,63 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGossipAlongLine(t *testing.T) {
+	nw := New(t, 4)
+	for i := 0; i+1 < len(nw.Nodes); i++ {
+		nw.Connect(nw.Nodes[i], nw.Nodes[i+1])
+	}
+
+	// Blocks mined at either end reach the other through relays.
+	blocks := nw.Nodes[0].Mine(3)
+	if tip := nw.WaitConverged(); tip.Hash != blocks[2].Hash {
+		t.Fatalf("converged on %x, want node 0's block %x", tip.Hash[:8], blocks[2].Hash[:8])
+	}
+	blocks = nw.Nodes[3].Mine(2)
+	if tip := nw.WaitConverged(); tip.Hash != blocks[1].Hash || tip.Header.Height != 5 {
+		t.Fatalf("converged on %x at %d, want node 3's block at 5", tip.Hash[:8], tip.Header.Height)
+	}
+}
+
+func TestPartitionAndHeal(t *testing.T) {
+	nw := New(t, 4)
+	nw.ConnectAll()
+	nw.Nodes[0].Mine(2)
+	nw.WaitConverged()
+
+	// Each side of the partition builds its own chain.
+	left, right := nw.Nodes[:2], nw.Nodes[2:]
+	nw.Partition(left, right)
+	nw.Nodes[0].Mine(2)
+	heavier := nw.Nodes[3].Mine(4)
+	leftTip := nw.WaitConverged(left...)
+	rightTip := nw.WaitConverged(right...)
+	if leftTip.Hash == rightTip.Hash || rightTip.Hash != heavier[3].Hash {
+		t.Fatalf("sides at %x and %x, want separate chains", leftTip.Hash[:8], rightTip.Hash[:8])
+	}
+
+	// Once healed, everyone follows the chain with more work.
+	nw.Heal()
+	if tip := nw.WaitConverged(); tip.Hash != heavier[3].Hash {
+		t.Fatalf("converged on %x at %d, want the right side's tip", tip.Hash[:8], tip.Header.Height)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	nw := New(t, 2)
+	a, b := nw.Nodes[0], nw.Nodes[1]
+	nw.SetLatency(a, b, latency)
+	nw.Connect(a, b)
+
+	// A block takes an inv, a getdata and the block itself to arrive.
+	start := time.Now()
+	a.Mine(1)
+	nw.WaitConverged()
+	if elapsed := time.Since(start); elapsed < 3*latency {
+		t.Errorf("block arrived after %v with %v latency", elapsed, latency)
+	}
+}